@@ -34,6 +34,16 @@ type ChannelComputer interface {
 	UseGlobalSequence() bool
 }
 
+// Optionally implemented by a ChannelComputer, to be notified when principals are saved or
+// deleted, or sessions created, through an Authenticator.  Saves that only invalidate a
+// principal's computed channels or roles aren't reported.
+type PrincipalObserver interface {
+	PrincipalEventsEnabled() bool // If false, the other methods aren't called
+	PrincipalSaved(princ Principal, created bool)
+	PrincipalDeleted(princ Principal)
+	SessionCreated(session *LoginSession)
+}
+
 type userByEmailInfo struct {
 	Username string
 }
@@ -209,6 +219,23 @@ func (auth *Authenticator) GetUserByEmail(email string) (User, error) {
 
 // Saves the information for a user/role.
 func (auth *Authenticator) Save(p Principal) error {
+	observer := auth.principalObserver()
+	created := false
+	if observer != nil {
+		_, _, err := auth.bucket.GetRaw(p.DocID())
+		created = base.IsDocNotFoundError(err)
+	}
+	if err := auth.save(p); err != nil {
+		return err
+	}
+	if observer != nil {
+		observer.PrincipalSaved(p, created)
+	}
+	return nil
+}
+
+// Saves a Principal without notifying the PrincipalObserver.
+func (auth *Authenticator) save(p Principal) error {
 	if err := p.validate(); err != nil {
 		return err
 	}
@@ -242,7 +269,7 @@ func (auth *Authenticator) InvalidateChannels(p Principal) error {
 			p.SetPreviousChannels(p.Channels())
 		}
 		p.setChannels(nil)
-		if err := auth.Save(p); err != nil {
+		if err := auth.save(p); err != nil {
 			return err
 		}
 	}
@@ -254,7 +281,7 @@ func (auth *Authenticator) InvalidateRoles(user User) error {
 	if user != nil && user.Channels() != nil {
 		base.LogTo("Access", "Invalidate roles of %q", user.Name())
 		user.setRolesSince(nil)
-		if err := auth.Save(user); err != nil {
+		if err := auth.save(user); err != nil {
 			return err
 		}
 	}
@@ -268,7 +295,21 @@ func (auth *Authenticator) Delete(p Principal) error {
 			auth.bucket.Delete(docIDForUserEmail(user.Email()))
 		}
 	}
-	return auth.bucket.Delete(p.DocID())
+	if err := auth.bucket.Delete(p.DocID()); err != nil {
+		return err
+	}
+	if observer := auth.principalObserver(); observer != nil {
+		observer.PrincipalDeleted(p)
+	}
+	return nil
+}
+
+// Returns the ChannelComputer as a PrincipalObserver, if it is one and wants notifications.
+func (auth *Authenticator) principalObserver() PrincipalObserver {
+	if observer, ok := auth.channelComputer.(PrincipalObserver); ok && observer.PrincipalEventsEnabled() {
+		return observer
+	}
+	return nil
 }
 
 // Authenticates a user given the username and password.
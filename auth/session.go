@@ -88,6 +88,9 @@ func (auth *Authenticator) CreateSession(username string, ttl time.Duration) (*L
 	if err := auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(ttl), session); err != nil {
 		return nil, err
 	}
+	if observer := auth.principalObserver(); observer != nil {
+		observer.SessionCreated(session)
+	}
 	return session, nil
 }
 
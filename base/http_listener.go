@@ -12,6 +12,21 @@ import (
 var httpListenerExpvars *expvar.Map
 var maxWaitExpvar, maxActiveExpvar IntMax
 
+// The listeners and servers started by ListenAndServeHTTP, so they can be stopped on shutdown
+var httpServing struct {
+	listeners []net.Listener
+	servers   []*http.Server
+	stopping  bool
+	lock      sync.Mutex
+}
+
+// The open connections of the servers started by ListenAndServeHTTP, by remote address, so that
+// a handler can close its request's connection.  Hijacked connections are left out.
+var httpConns = struct {
+	conns map[string]net.Conn
+	lock  sync.Mutex
+}{conns: map[string]net.Conn{}}
+
 func init() {
 	httpListenerExpvars = expvar.NewMap("syncGateway_httpListener")
 	httpListenerExpvars.Set("max_wait", &maxWaitExpvar)
@@ -46,7 +61,7 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		listener = tls.NewListener(listener, config)
 	}
 	defer listener.Close()
-	server := &http.Server{Addr: addr, Handler: handler}
+	server := &http.Server{Addr: addr, Handler: handler, ConnState: trackHTTPConnection}
 	if readTimeout != nil {
 		server.ReadTimeout = time.Duration(*readTimeout) * time.Second
 	}
@@ -54,7 +69,73 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		server.WriteTimeout = time.Duration(*writeTimeout) * time.Second
 	}
 
-	return server.Serve(listener)
+	httpServing.lock.Lock()
+	if httpServing.stopping {
+		httpServing.lock.Unlock()
+		return nil
+	}
+	httpServing.listeners = append(httpServing.listeners, listener)
+	httpServing.servers = append(httpServing.servers, server)
+	httpServing.lock.Unlock()
+
+	err = server.Serve(listener)
+	if IsHTTPStopping() {
+		return nil // Serve fails once its listener is closed; that's expected
+	}
+	return err
+}
+
+// Stops every server started by ListenAndServeHTTP from accepting new connections, and stops
+// keeping idle connections alive.  Requests already in progress carry on; ListenAndServeHTTP
+// returns nil once its listener is closed.
+func StopAcceptingHTTP() {
+	httpServing.lock.Lock()
+	defer httpServing.lock.Unlock()
+	if httpServing.stopping {
+		return
+	}
+	httpServing.stopping = true
+	for _, server := range httpServing.servers {
+		server.SetKeepAlivesEnabled(false)
+	}
+	for _, listener := range httpServing.listeners {
+		listener.Close()
+	}
+}
+
+// Returns true once StopAcceptingHTTP has been called.
+func IsHTTPStopping() bool {
+	httpServing.lock.Lock()
+	defer httpServing.lock.Unlock()
+	return httpServing.stopping
+}
+
+func trackHTTPConnection(conn net.Conn, state http.ConnState) {
+	remoteAddr := conn.RemoteAddr().String()
+	httpConns.lock.Lock()
+	defer httpConns.lock.Unlock()
+	switch state {
+	case http.StateNew:
+		httpConns.conns[remoteAddr] = conn
+	case http.StateHijacked, http.StateClosed:
+		if httpConns.conns[remoteAddr] == conn {
+			delete(httpConns.conns, remoteAddr)
+		}
+	}
+}
+
+// Closes the connection of a request, given its http.Request.RemoteAddr, which makes a write to
+// the response that's blocked on the client fail.  Returns false if there's no such connection,
+// e.g. because it's already closed or was hijacked.
+func CloseHTTPConnection(remoteAddr string) bool {
+	httpConns.lock.Lock()
+	conn := httpConns.conns[remoteAddr]
+	httpConns.lock.Unlock()
+	if conn == nil {
+		return false
+	}
+	conn.Close()
+	return true
 }
 
 type throttledListener struct {
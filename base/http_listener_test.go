@@ -0,0 +1,87 @@
+package base
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Undoes StopAcceptingHTTP, so later tests can start servers again.
+func resetHTTPServing() {
+	httpServing.lock.Lock()
+	defer httpServing.lock.Unlock()
+	httpServing.listeners = nil
+	httpServing.servers = nil
+	httpServing.stopping = false
+}
+
+func TestStopAcceptingHTTP(t *testing.T) {
+	defer resetHTTPServing()
+
+	// Find a free port to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err, "Couldn't find a free port")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if rq.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("done"))
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- ListenAndServeHTTP(addr, 10, nil, nil, handler, nil, nil, false)
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assertNoError(t, err, "Server didn't start")
+
+	// Start a request that's still in progress when the server stops accepting connections
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	responses := make(chan string, 1)
+	go func() {
+		response, err := client.Get("http://" + addr + "/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		responses <- string(body)
+	}()
+	<-started
+
+	StopAcceptingHTTP()
+	assert.True(t, IsHTTPStopping())
+	select {
+	case err := <-served:
+		assert.Equals(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServeHTTP didn't return")
+	}
+	_, err = net.Dial("tcp", addr)
+	assert.True(t, err != nil)
+
+	// The request in progress still completes
+	close(release)
+	assert.Equals(t, <-responses, "done")
+
+	// Servers started after stopping don't listen at all
+	assert.Equals(t, ListenAndServeHTTP(addr, 10, nil, nil, handler, nil, nil, false), nil)
+}
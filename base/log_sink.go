@@ -0,0 +1,518 @@
+package base
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats for log lines
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Severity of an individual log line.  Used to label JSON output and to route lines to sinks.
+type logSeverity int
+
+const (
+	severityInfo logSeverity = iota
+	severityWarn
+	severityError
+	severityPanic
+	severityFatal
+)
+
+var severityNames = []string{
+	severityInfo:  "info",
+	severityWarn:  "warn",
+	severityError: "error",
+	severityPanic: "panic",
+	severityFatal: "fatal",
+}
+
+func (s logSeverity) String() string {
+	return severityNames[s]
+}
+
+func parseLogSeverity(name string) (logSeverity, error) {
+	for severity, severityName := range severityNames {
+		if strings.EqualFold(name, severityName) {
+			return logSeverity(severity), nil
+		}
+	}
+	return severityInfo, fmt.Errorf("Unknown log level %q", name)
+}
+
+// Settings for the log file, including rotation and any additional per-level sinks.
+type LoggingConfig struct {
+	Format   string             `json:"format,omitempty"`   // "text" (default) or "json"
+	Rotation *LogRotationConfig `json:"rotation,omitempty"` // Rotation settings for the main log file (LogFilePath)
+	Sinks    []*LogSinkConfig   `json:"sinks,omitempty"`    // Additional log files, each receiving a range of levels
+}
+
+type LogRotationConfig struct {
+	MaxSize    int  `json:"max_size,omitempty"`    // Rotate once the file reaches this many megabytes
+	MaxAge     int  `json:"max_age,omitempty"`     // Rotate once the file has been written to for this many hours
+	MaxBackups int  `json:"max_backups,omitempty"` // Number of rotated files to keep (0 keeps all of them)
+	Compress   bool `json:"compress,omitempty"`    // Gzip rotated files
+}
+
+type LogSinkConfig struct {
+	Path     string             `json:"path"`                // Path of the log file
+	Format   string             `json:"format,omitempty"`    // "text" or "json"; defaults to the main log format
+	MinLevel string             `json:"min_level,omitempty"` // Lowest level written to this sink ("info", "warn", "error", "panic", "fatal")
+	MaxLevel string             `json:"max_level,omitempty"` // Highest level written to this sink
+	Rotation *LogRotationConfig `json:"rotation,omitempty"`  // Rotation settings for this sink
+}
+
+// Identifies what a log line relates to.  All fields are optional; empty ones are omitted from
+// JSON output.
+type LogContext struct {
+	Database  string
+	User      string
+	RequestID string
+}
+
+// One line of JSON log output.
+type logRecord struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Key       string `json:"key,omitempty"`
+	Database  string `json:"db,omitempty"`
+	User      string `json:"user,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Message   string `json:"message"`
+	Caller    string `json:"caller,omitempty"`
+}
+
+// An additional log destination for a range of levels.
+type logSink struct {
+	config   LogSinkConfig
+	minLevel logSeverity
+	maxLevel logSeverity
+	writer   *RotatingFile
+}
+
+var logFormat = LogFormatText
+
+var logSinks []*logSink
+
+var loggingConfig LoggingConfig
+
+// Applies a LoggingConfig: sets the output format, the rotation of the main log file and replaces
+// any previously configured sinks.  logFilePath is the main log file, or "" to log to stderr.
+// If any of the files can't be opened, returns an error and leaves the current logging in place.
+func ConfigureLogging(config LoggingConfig, logFilePath string) error {
+	format := LogFormatText
+	if config.Format != "" {
+		format = config.Format
+	}
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("Unknown log format %q", config.Format)
+	}
+
+	sinks := make([]*logSink, 0, len(config.Sinks))
+	for _, sinkConfig := range config.Sinks {
+		sink, err := newLogSink(*sinkConfig)
+		if err != nil {
+			closeLogSinks(sinks)
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+	var mainFile *RotatingFile
+	if logFilePath != "" {
+		var err error
+		if mainFile, err = NewRotatingFile(logFilePath, config.Rotation); err != nil {
+			closeLogSinks(sinks)
+			return fmt.Errorf("Unable to open log file %s: %v", logFilePath, err)
+		}
+	}
+
+	logLock.Lock()
+	oldSinks := logSinks
+	logSinks = sinks
+	logFormat = format
+	loggingConfig = config
+	logLock.Unlock()
+	closeLogSinks(oldSinks)
+
+	if mainFile != nil {
+		setLogFile(mainFile)
+	}
+	return nil
+}
+
+// Returns the LoggingConfig currently in effect.
+func GetLoggingConfig() LoggingConfig {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return loggingConfig
+}
+
+// Sets the output format ("text" or "json") of the main log and of sinks without an explicit format.
+func SetLogFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("Unknown log format %q", format)
+	}
+	logLock.Lock()
+	defer logLock.Unlock()
+	logFormat = format
+	loggingConfig.Format = format
+	return nil
+}
+
+func newLogSink(config LogSinkConfig) (*logSink, error) {
+	if config.Path == "" {
+		return nil, errors.New("Log sink requires a path")
+	}
+	if config.Format != "" && config.Format != LogFormatText && config.Format != LogFormatJSON {
+		return nil, fmt.Errorf("Unknown log format %q for sink %s", config.Format, config.Path)
+	}
+	sink := &logSink{config: config, minLevel: severityInfo, maxLevel: severityFatal}
+	var err error
+	if config.MinLevel != "" {
+		if sink.minLevel, err = parseLogSeverity(config.MinLevel); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxLevel != "" {
+		if sink.maxLevel, err = parseLogSeverity(config.MaxLevel); err != nil {
+			return nil, err
+		}
+	}
+	if sink.writer, err = NewRotatingFile(config.Path, config.Rotation); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func closeLogSinks(sinks []*logSink) {
+	for _, sink := range sinks {
+		sink.writer.Close()
+	}
+}
+
+// Writes a log line to the main logger and to any sinks accepting its severity.  key is the log
+// key passed to LogTo, if any; label is the prefix of lines logged with their caller's name
+// (e.g. "WARNING").  Assumes caller is holding logLock read lock.
+func output(severity logSeverity, key string, label string, context *LogContext, caller string, message string) {
+	// Text lines only carry the request ID, since the user and database are usually evident
+	// from the request line it refers back to.
+	textMessage := message
+	if context != nil && context.RequestID != "" {
+		textMessage = "[" + context.RequestID + "] " + message
+	}
+
+	if logFormat == LogFormatJSON {
+		logWriter.Write(formatJSONLogLine(severity, key, context, caller, message))
+	} else {
+		line := formatTextLogLine(severity, key, label, caller, textMessage, true)
+		if !logNoTime {
+			line = time.Now().Format(ISO8601Format) + " " + line
+		}
+		logger.Print(line)
+	}
+
+	for _, sink := range logSinks {
+		if severity < sink.minLevel || severity > sink.maxLevel {
+			continue
+		}
+		format := sink.config.Format
+		if format == "" {
+			format = logFormat
+		}
+		if format == LogFormatJSON {
+			sink.writer.Write(formatJSONLogLine(severity, key, context, caller, message))
+		} else {
+			sink.writer.Write([]byte(time.Now().Format(ISO8601Format) + " " +
+				formatTextLogLine(severity, key, label, caller, textMessage, false) + "\n"))
+		}
+	}
+}
+
+// Formats a line in the traditional text format, with ANSI colors if enabled and writing to the console.
+func formatTextLogLine(severity logSeverity, key string, label string, caller string, message string, console bool) string {
+	keyColor, labelColor, dimmed, plain := fgYellow, fgRed, dim, reset
+	if severity == severityInfo {
+		labelColor = fgYellow
+	}
+	if !console {
+		keyColor, labelColor, dimmed, plain = "", "", "", ""
+	}
+	switch {
+	case label != "":
+		return labelColor + label + ": " + message + plain + dimmed + " -- " + caller + plain
+	case key != "":
+		return keyColor + key + ": " + plain + message
+	default:
+		return message
+	}
+}
+
+func formatJSONLogLine(severity logSeverity, key string, context *LogContext, caller string, message string) []byte {
+	record := logRecord{
+		Timestamp: time.Now().Format(ISO8601Format),
+		Level:     severity.String(),
+		Key:       key,
+		Message:   message,
+		Caller:    caller,
+	}
+	if context != nil {
+		record.Database = context.Database
+		record.User = context.User
+		record.RequestID = context.RequestID
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(logRecord{Timestamp: record.Timestamp, Level: record.Level, Message: fmt.Sprintf("%q", message)})
+	}
+	return append(line, '\n')
+}
+
+//////// LOG FILE ROTATION:
+
+// Format of the timestamp inserted into the name of a rotated file
+const kRotatedFileTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is an io.Writer appending to a file, which is renamed aside and replaced by a fresh
+// file once it grows past a maximum size or age.  Besides log files, it's used by file event handlers.
+type RotatingFile struct {
+	path        string
+	rotation    LogRotationConfig
+	file        *os.File
+	closed      bool
+	size        int64
+	started     time.Time // When the current file was started, for MaxAge
+	lock        sync.Mutex
+	cleanUpLock sync.Mutex // Serializes compressing and removing rotated files
+}
+
+func NewRotatingFile(path string, rotation *LogRotationConfig) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path}
+	if rotation != nil {
+		rf.rotation = *rotation
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.started = rf.startTime(info)
+	return nil
+}
+
+// Returns when an existing file was started.  A file is started when the previous one is rotated,
+// so that's the time in the name of the newest rotated file.  Failing that, the best available
+// time is when the file was last written to.
+func (rf *RotatingFile) startTime(info os.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Now()
+	}
+	if backups := rf.rotatedFiles(); len(backups) > 0 {
+		if newest := backups[len(backups)-1].rotated; newest.Before(info.ModTime()) {
+			return newest
+		}
+	}
+	return info.ModTime()
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.closed {
+		return 0, errors.New("Log file is closed")
+	}
+	if rf.file == nil {
+		// A previous rotation couldn't reopen the file; try again
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf._needsRotation(int64(len(p))) {
+		if err := rf._rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	rf.closed = true
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// Forces a rotation regardless of the file's size or age.
+func (rf *RotatingFile) Rotate() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.closed {
+		return errors.New("Log file is closed")
+	}
+	return rf._rotate()
+}
+
+func (rf *RotatingFile) _needsRotation(writeLen int64) bool {
+	if rf.rotation.MaxSize > 0 && rf.size > 0 && rf.size+writeLen > int64(rf.rotation.MaxSize)*1024*1024 {
+		return true
+	}
+	if rf.rotation.MaxAge > 0 && time.Since(rf.started) > time.Duration(rf.rotation.MaxAge)*time.Hour {
+		return true
+	}
+	return false
+}
+
+func (rf *RotatingFile) _rotate() error {
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+	rotatedPath := rf.rotatedName(time.Now())
+	if err := os.Rename(rf.path, rotatedPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	go rf.cleanUp(rotatedPath)
+	return nil
+}
+
+// Returns the name a file is renamed to on rotation, e.g. "sg.log" -> "sg-2017-01-02T15-04-05.000.log"
+func (rf *RotatingFile) rotatedName(t time.Time) string {
+	ext := filepath.Ext(rf.path)
+	prefix := strings.TrimSuffix(rf.path, ext)
+	return fmt.Sprintf("%s-%s%s", prefix, t.UTC().Format(kRotatedFileTimeFormat), ext)
+}
+
+// A rotated file, and its compressed copy while it's being compressed.
+type rotatedFile struct {
+	rotated time.Time
+	paths   []string
+}
+
+type rotatedFilesByTime []*rotatedFile
+
+func (files rotatedFilesByTime) Len() int           { return len(files) }
+func (files rotatedFilesByTime) Less(i, j int) bool { return files[i].rotated.Before(files[j].rotated) }
+func (files rotatedFilesByTime) Swap(i, j int)      { files[i], files[j] = files[j], files[i] }
+
+// Returns the files rotated out of this one, oldest first.  Only names produced by rotatedName
+// (optionally gzipped) match, so the rotated files of another log whose name starts with the same
+// prefix, e.g. "sg-warnings.log" next to "sg.log", aren't included.
+func (rf *RotatingFile) rotatedFiles() []*rotatedFile {
+	dir, name := filepath.Split(rf.path)
+	if dir == "" {
+		dir = "."
+	}
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	byTimestamp := make(map[string]*rotatedFile)
+	for _, entry := range entries {
+		fileName := strings.TrimSuffix(entry.Name(), ".gz")
+		if len(fileName) != len(prefix)+len(kRotatedFileTimeFormat)+len(ext) ||
+			!strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, ext) {
+			continue
+		}
+		timestamp := fileName[len(prefix) : len(fileName)-len(ext)]
+		rotated, err := time.Parse(kRotatedFileTimeFormat, timestamp)
+		if err != nil {
+			continue
+		}
+		file := byTimestamp[timestamp]
+		if file == nil {
+			file = &rotatedFile{rotated: rotated}
+			byTimestamp[timestamp] = file
+		}
+		file.paths = append(file.paths, filepath.Join(dir, entry.Name()))
+	}
+	files := make(rotatedFilesByTime, 0, len(byTimestamp))
+	for _, file := range byTimestamp {
+		files = append(files, file)
+	}
+	sort.Sort(files)
+	return files
+}
+
+// Compresses a just-rotated file if configured, then removes rotated files beyond MaxBackups.
+func (rf *RotatingFile) cleanUp(rotatedPath string) {
+	rf.cleanUpLock.Lock()
+	defer rf.cleanUpLock.Unlock()
+	if rf.rotation.Compress {
+		if err := gzipFile(rotatedPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compress rotated log file %s: %v\n", rotatedPath, err)
+		}
+	}
+	if rf.rotation.MaxBackups <= 0 {
+		return
+	}
+	files := rf.rotatedFiles()
+	if len(files) <= rf.rotation.MaxBackups {
+		return
+	}
+	for _, file := range files[:len(files)-rf.rotation.MaxBackups] {
+		for _, path := range file.paths {
+			os.Remove(path)
+		}
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
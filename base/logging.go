@@ -11,12 +11,13 @@ package base
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
-	"time"
+
 	"github.com/couchbase/clog"
 )
 
@@ -33,13 +34,16 @@ var logLock sync.RWMutex
 
 var logger *log.Logger
 
-var logFile *os.File
+var logWriter io.Writer // Destination of logger, written to directly for JSON output
+
+var logFile *RotatingFile
 
 var logStar bool // enabling log key "*" enables all key-based logging
 
 //Attach logger to stderr during load, this may get re-attached once config is loaded
 func init() {
 	logger = log.New(os.Stderr, "", 0)
+	logWriter = os.Stderr
 	LogKeys = make(map[string]bool)
 	logNoTime = false
 }
@@ -156,12 +160,16 @@ func GetCallersName(depth int) string {
 
 // Logs a message to the console, but only if the corresponding key is true in LogKeys.
 func LogTo(key string, format string, args ...interface{}) {
+	logTo(nil, key, format, args...)
+}
+
+func logTo(context *LogContext, key string, format string, args ...interface{}) {
 	logLock.RLock()
 	defer logLock.RUnlock()
 	ok := logLevel <= 1 && (logStar || LogKeys[key])
 
 	if ok {
-		printf(fgYellow+key+": "+reset+format, args...)
+		output(severityInfo, key, "", context, "", fmt.Sprintf(format, args...))
 	}
 }
 
@@ -179,23 +187,21 @@ func LogEnabled(key string) bool {
 
 // Logs a message to the console.
 func Log(message string) {
-	logLock.RLock()
-	defer logLock.RUnlock()
-	ok := logLevel <= 1
-
-	if ok {
-		print(message)
-	}
+	logf(nil, "%s", message)
 }
 
 // Logs a formatted message to the console.
 func Logf(format string, args ...interface{}) {
+	logf(nil, format, args...)
+}
+
+func logf(context *LogContext, format string, args ...interface{}) {
 	logLock.RLock()
 	defer logLock.RUnlock()
 	ok := logLevel <= 1
 
 	if ok {
-		printf(format, args...)
+		output(severityInfo, "", "", context, "", fmt.Sprintf(format, args...))
 	}
 }
 
@@ -208,7 +214,7 @@ func LogError(err error) error {
 		logLock.RUnlock()
 
 		if ok {
-			logWithCaller(fgRed, "ERROR", "%v", err)
+			logWithCaller(nil, severityError, "ERROR", "%v", err)
 		}
 	}
 	return err
@@ -221,7 +227,7 @@ func Warn(format string, args ...interface{}) {
 	logLock.RUnlock()
 
 	if ok {
-		logWithCaller(fgRed, "WARNING", format, args...)
+		logWithCaller(nil, severityWarn, "WARNING", format, args...)
 	}
 }
 
@@ -229,49 +235,50 @@ func Warn(format string, args ...interface{}) {
 // temporary logging calls added during development and not to be checked in, hence its
 // distinctive name (which is visible and easy to search for before committing.)
 func TEMP(format string, args ...interface{}) {
-	logWithCaller(fgYellow, "TEMP", format, args...)
+	logWithCaller(nil, severityInfo, "TEMP", format, args...)
 }
 
 // Logs a warning to the console, then panics.
 func LogPanic(format string, args ...interface{}) {
-	logWithCaller(fgRed, "PANIC", format, args...)
+	logWithCaller(nil, severityPanic, "PANIC", format, args...)
 	panic(fmt.Sprintf(format, args...))
 }
 
 // Logs a warning to the console, then exits the process.
 func LogFatal(format string, args ...interface{}) {
-	logWithCaller(fgRed, "FATAL", format, args...)
+	logWithCaller(nil, severityFatal, "FATAL", format, args...)
 	os.Exit(1)
 }
 
-func logWithCaller(color string, prefix string, format string, args ...interface{}) {
+func logWithCaller(context *LogContext, severity logSeverity, prefix string, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
 	logLock.RLock()
 	defer logLock.RUnlock()
-	print(color, prefix, ": ", message, reset,
-		dim, " -- ", GetCallersName(2), reset)
+	if logLevel <= 1 {
+		output(severity, "", prefix, context, GetCallersName(2), message)
+	}
 }
 
-// Simple wrapper that converts Print to Printf.  Assumes caller is holding logLock read lock.
-func print(args ...interface{}) {
-	ok := logLevel <= 1
+//////// CONTEXT-AWARE LOGGING:
 
-	if ok {
-		printf("%s", fmt.Sprint(args...))
-	}
+// Logs a message if the corresponding key is enabled, tagged with the context's identifiers.
+func (lc *LogContext) LogTo(key string, format string, args ...interface{}) {
+	logTo(lc, key, format, args...)
 }
 
-// Logs a formatted message to the underlying logger.  Assumes caller is holding logLock read lock.
-func printf(format string, args ...interface{}) {
-	ok := logLevel <= 1
+// Logs a formatted message tagged with the context's identifiers.
+func (lc *LogContext) Logf(format string, args ...interface{}) {
+	logf(lc, format, args...)
+}
+
+// Logs a warning tagged with the context's identifiers.
+func (lc *LogContext) Warn(format string, args ...interface{}) {
+	logLock.RLock()
+	ok := logLevel <= 2
+	logLock.RUnlock()
 
 	if ok {
-		if !logNoTime {
-			timestampedFormat := strings.Join([]string{time.Now().Format(ISO8601Format), format}, " ")
-			logger.Printf(timestampedFormat, args...)
-		} else {
-			logger.Printf(format, args...)
-		}
+		logWithCaller(lc, severityWarn, "WARNING", format, args...)
 	}
 }
 
@@ -285,19 +292,35 @@ func lastComponent(path string) string {
 }
 
 func UpdateLogger(logFilePath string) {
+	if err := OpenLogFile(logFilePath); err != nil {
+		LogFatal("unable to open logfile for write: %s", logFilePath)
+	}
+}
+
+// Switches the main log to the given file, leaving the current log file in place if the new one
+// can't be opened.
+func OpenLogFile(logFilePath string) error {
+	logLock.RLock()
+	rotation := loggingConfig.Rotation
+	logLock.RUnlock()
+
 	//Attempt to open file for write at path provided
-	fo, err := os.OpenFile(logFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0664)
+	fo, err := NewRotatingFile(logFilePath, rotation)
 	if err != nil {
-		LogFatal("unable to open logfile for write: %s", logFilePath)
+		return err
 	}
+	setLogFile(fo)
+	return nil
+}
 
-	//defer write lock to here otherwise LogFatal above will deadlock
+func setLogFile(fo *RotatingFile) {
 	logLock.Lock()
 
 	//We keep a reference to the underlying log File as log.Logger and io.Writer
 	//have no close() methods and we want to close old files on log rotation
 	oldLogFile := logFile
 	logFile = fo
+	logWriter = fo
 	logger = log.New(fo, "", log.Lmicroseconds)
 	logLock.Unlock()
 
@@ -308,8 +331,7 @@ func UpdateLogger(logFilePath string) {
 
 	//If there is a previously opened log file, explicitly close it
 	if oldLogFile != nil {
-		err = oldLogFile.Close()
-		if err != nil {
+		if err := oldLogFile.Close(); err != nil {
 			Warn("unable to close old log File after updating logger")
 		}
 	}
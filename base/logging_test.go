@@ -10,8 +10,16 @@
 package base
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
 )
 
 func Benchmark_LoggingPerformance(b *testing.B) {
@@ -33,3 +41,101 @@ func Benchmark_LoggingPerformance(b *testing.B) {
 		TEMP("%s", "A TEMP message")
 	}
 }
+
+func TestJSONLogLine(t *testing.T) {
+	context := &LogContext{Database: "db", User: "alice", RequestID: "abc123"}
+	line := formatJSONLogLine(severityWarn, "CRUD", context, "", "a message")
+	assert.Equals(t, line[len(line)-1], byte('\n'))
+
+	var record map[string]string
+	assertNoError(t, json.Unmarshal(line, &record), "Couldn't unmarshal JSON log line")
+	assert.Equals(t, record["level"], "warn")
+	assert.Equals(t, record["key"], "CRUD")
+	assert.Equals(t, record["db"], "db")
+	assert.Equals(t, record["user"], "alice")
+	assert.Equals(t, record["request_id"], "abc123")
+	assert.Equals(t, record["message"], "a message")
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sg_log_rotation")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+
+	// Another log's file sharing the name prefix isn't one of the backups
+	otherPath := filepath.Join(dir, "sg-warnings.log")
+	assertNoError(t, ioutil.WriteFile(otherPath, []byte("warning"), 0664), "Couldn't write file")
+
+	path := filepath.Join(dir, "sg.log")
+	rf, err := NewRotatingFile(path, &LogRotationConfig{MaxSize: 1, MaxBackups: 2})
+	assertNoError(t, err, "Couldn't open rotating file")
+	defer rf.Close()
+
+	// Each write is 600KB, so every write after the first rotates the file
+	chunk := bytes.Repeat([]byte("x"), 600*1024)
+	for i := 0; i < 4; i++ {
+		_, err = rf.Write(chunk)
+		assertNoError(t, err, "Write failed")
+		// Backups are pruned asynchronously
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	info, err := os.Stat(path)
+	assertNoError(t, err, "Log file missing")
+	assert.Equals(t, info.Size(), int64(len(chunk)))
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "sg-*.log"))
+	assert.Equals(t, len(backups), 3)
+	_, err = os.Stat(otherPath)
+	assertNoError(t, err, "Other log file was removed")
+}
+
+func TestRotatingFileCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sg_log_rotation")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sg.log")
+	rf, err := NewRotatingFile(path, &LogRotationConfig{MaxBackups: 2, Compress: true})
+	assertNoError(t, err, "Couldn't open rotating file")
+	defer rf.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err = rf.Write([]byte("a line\n"))
+		assertNoError(t, err, "Write failed")
+		assertNoError(t, rf.Rotate(), "Rotate failed")
+		// Backups are compressed and pruned asynchronously
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	compressed, _ := filepath.Glob(filepath.Join(dir, "sg-*.log.gz"))
+	assert.Equals(t, len(compressed), 2)
+	uncompressed, _ := filepath.Glob(filepath.Join(dir, "sg-*.log"))
+	assert.Equals(t, len(uncompressed), 0)
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sg_log_rotation")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+
+	// An existing log file that was started two hours ago, when the previous one was rotated
+	path := filepath.Join(dir, "sg.log")
+	assertNoError(t, ioutil.WriteFile(path, []byte("a line\n"), 0664), "Couldn't write file")
+	rf := &RotatingFile{path: path}
+	backupPath := rf.rotatedName(time.Now().Add(-2 * time.Hour))
+	assertNoError(t, ioutil.WriteFile(backupPath, []byte("a line\n"), 0664), "Couldn't write file")
+
+	// Its age counts from then, not from when it's opened
+	rf, err = NewRotatingFile(path, &LogRotationConfig{MaxAge: 1})
+	assertNoError(t, err, "Couldn't open rotating file")
+	defer rf.Close()
+	_, err = rf.Write([]byte("another line\n"))
+	assertNoError(t, err, "Write failed")
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "sg-*.log"))
+	assert.Equals(t, len(backups), 2)
+	data, err := ioutil.ReadFile(path)
+	assertNoError(t, err, "Couldn't read log file")
+	assert.Equals(t, string(data), "another line\n")
+}
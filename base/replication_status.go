@@ -0,0 +1,154 @@
+package base
+
+import (
+	"sync"
+	"time"
+)
+
+// States of a replication, as reported in its ActiveTask and recorded for a stored replication
+const (
+	ReplicationStateRunning   = "running"
+	ReplicationStateRetrying  = "retrying"  // The last attempt failed; waiting to try again
+	ReplicationStateError     = "error"     // Stopped after failing too many times in a row
+	ReplicationStateCompleted = "completed" // A one-shot replication finished
+)
+
+// Default upper limit of the wait between attempts of a failing replication
+const DefaultReplicationMaxBackoff = 5 * time.Minute
+
+// How a replication retries after a failed attempt.  The wait before a retry starts at
+// InitialBackoff and doubles after each consecutive failure, up to MaxBackoff.  After MaxAttempts
+// consecutive failures the replication stops in the error state.  A MaxAttempts of zero means a
+// continuous replication retries forever, and a one-shot replication isn't retried.
+type ReplicationRetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxAttempts    int
+}
+
+func DefaultReplicationRetryPolicy() ReplicationRetryPolicy {
+	return ReplicationRetryPolicy{
+		InitialBackoff: time.Millisecond * time.Duration(DefaultContinuousRetryTimeMs),
+		MaxBackoff:     DefaultReplicationMaxBackoff,
+	}
+}
+
+// Tracks the health of a replication across its attempts.
+type replicationStatus struct {
+	policy              ReplicationRetryPolicy
+	continuous          bool
+	state               string
+	lastError           string
+	lastErrorTime       time.Time
+	consecutiveFailures int
+	checkpointSeq       interface{}   // End sequence of the last successful attempt
+	stopped             chan struct{} // Closed when the replication is cancelled or fails
+	stopOnce            sync.Once
+	lock                sync.Mutex
+}
+
+func newReplicationStatus(policy ReplicationRetryPolicy, continuous bool) *replicationStatus {
+	return &replicationStatus{
+		policy:     policy,
+		continuous: continuous,
+		state:      ReplicationStateRunning,
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Records a successful attempt, which ended at the given sequence.
+func (s *replicationStatus) attemptSucceeded(checkpointSeq interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = ReplicationStateRunning
+	s.consecutiveFailures = 0
+	if checkpointSeq != nil {
+		s.checkpointSeq = checkpointSeq
+	}
+}
+
+// Records a failed attempt.  Returns true if the replication has now failed too many times in a
+// row, and has entered the error state.
+func (s *replicationStatus) attemptFailed(err error) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.consecutiveFailures++
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+
+	maxAttempts := s.policy.MaxAttempts
+	if maxAttempts <= 0 && !s.continuous {
+		maxAttempts = 1
+	}
+	if maxAttempts > 0 && s.consecutiveFailures >= maxAttempts {
+		s.state = ReplicationStateError
+		return true
+	}
+	s.state = ReplicationStateRetrying
+	return false
+}
+
+func (s *replicationStatus) getState() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Returns how long to wait before the next attempt.
+func (s *replicationStatus) backoff() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.consecutiveFailures == 0 {
+		return 0
+	}
+	backoff := s.policy.InitialBackoff
+	for i := 1; i < s.consecutiveFailures && backoff < s.policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if s.policy.MaxBackoff > 0 && backoff > s.policy.MaxBackoff {
+		backoff = s.policy.MaxBackoff
+	}
+	return backoff
+}
+
+// Waits before the next attempt, less the time already waited.  Returns false if the replication
+// was stopped in the meantime.
+func (s *replicationStatus) waitToRetry(alreadyWaited time.Duration) bool {
+	wait := s.backoff() - alreadyWaited
+	if wait <= 0 {
+		return !s.isStopped()
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-s.stopped:
+		return false
+	}
+}
+
+func (s *replicationStatus) stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
+
+func (s *replicationStatus) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Adds the status to an ActiveTask.
+func (s *replicationStatus) fillTask(task *ActiveTask) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	task.State = s.state
+	task.LastError = s.lastError
+	if !s.lastErrorTime.IsZero() {
+		lastErrorTime := s.lastErrorTime
+		task.LastErrorTime = &lastErrorTime
+	}
+	task.ConsecutiveFailures = s.consecutiveFailures
+	task.CheckpointSeq = s.checkpointSeq
+}
@@ -0,0 +1,70 @@
+package base
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestReplicationStatusBackoff(t *testing.T) {
+	policy := ReplicationRetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		MaxAttempts:    6,
+	}
+	status := newReplicationStatus(policy, true)
+	assert.Equals(t, status.backoff(), time.Duration(0))
+
+	expected := []time.Duration{100, 200, 400, 800, 1000}
+	for _, backoff := range expected {
+		assert.False(t, status.attemptFailed(errors.New("unreachable")))
+		assert.Equals(t, status.getState(), ReplicationStateRetrying)
+		assert.Equals(t, status.backoff(), backoff*time.Millisecond)
+	}
+
+	var task ActiveTask
+	status.fillTask(&task)
+	assert.Equals(t, task.ConsecutiveFailures, 5)
+	assert.Equals(t, task.LastError, "unreachable")
+	assert.True(t, task.LastErrorTime != nil)
+
+	// A success resets the failures, but the last error is still reported
+	status.attemptSucceeded(float64(12))
+	assert.Equals(t, status.getState(), ReplicationStateRunning)
+	assert.Equals(t, status.backoff(), time.Duration(0))
+	task = ActiveTask{}
+	status.fillTask(&task)
+	assert.Equals(t, task.ConsecutiveFailures, 0)
+	assert.Equals(t, task.LastError, "unreachable")
+	assert.Equals(t, task.CheckpointSeq, float64(12))
+
+	for i := 1; i < policy.MaxAttempts; i++ {
+		assert.False(t, status.attemptFailed(errors.New("unreachable")))
+	}
+	assert.True(t, status.attemptFailed(errors.New("unreachable")))
+	assert.Equals(t, status.getState(), ReplicationStateError)
+}
+
+func TestReplicationStatusDefaultAttempts(t *testing.T) {
+	// By default a continuous replication retries forever, and a one-shot replication doesn't retry
+	continuous := newReplicationStatus(DefaultReplicationRetryPolicy(), true)
+	for i := 0; i < 100; i++ {
+		assert.False(t, continuous.attemptFailed(errors.New("unreachable")))
+	}
+	assert.Equals(t, continuous.backoff(), DefaultReplicationMaxBackoff)
+
+	oneShot := newReplicationStatus(DefaultReplicationRetryPolicy(), false)
+	assert.True(t, oneShot.attemptFailed(errors.New("unreachable")))
+	assert.Equals(t, oneShot.getState(), ReplicationStateError)
+}
+
+func TestReplicationStatusStop(t *testing.T) {
+	status := newReplicationStatus(ReplicationRetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour}, true)
+	status.attemptFailed(errors.New("unreachable"))
+	go status.stop()
+	assert.False(t, status.waitToRetry(0))
+	assert.True(t, status.isStopped())
+	status.stop()
+}
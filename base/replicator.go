@@ -2,6 +2,7 @@ package base
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -16,30 +17,67 @@ const (
 type Replicator struct {
 	replications      map[string]sgreplicate.SGReplication
 	replicationParams map[string]sgreplicate.ReplicationParameters
+	statuses          map[string]*replicationStatus
+	cancelled         map[string]bool // Replications being stopped by a cancel request
+	onFinished        ReplicationFinishedFunc
 	lock              sync.RWMutex
 }
 
+// Called when a replication stops on its own, rather than being cancelled: when a one-shot
+// replication finishes, or a continuous one fails too many times in a row or is terminated by
+// sg-replicate.  err is nil if the replication completed successfully.
+type ReplicationFinishedFunc func(task *ActiveTask, err error)
+
 type ActiveTask struct {
-	TaskType         string      `json:"type"`
-	ReplicationID    string      `json:"replication_id"`
-	Continuous       bool        `json:"continuous"`
-	Source           string      `json:"source"`
-	Target           string      `json:"target"`
-	DocsRead         uint32      `json:"docs_read"`
-	DocsWritten      uint32      `json:"docs_written"`
-	DocWriteFailures uint32      `json:"doc_write_failures"`
-	StartLastSeq     uint32      `json:"start_last_seq"`
-	EndLastSeq       interface{} `json:"end_last_seq"`
+	TaskType            string      `json:"type"`
+	ReplicationID       string      `json:"replication_id"`
+	Continuous          bool        `json:"continuous"`
+	Source              string      `json:"source"`
+	Target              string      `json:"target"`
+	DocsRead            uint32      `json:"docs_read"`
+	DocsWritten         uint32      `json:"docs_written"`
+	DocWriteFailures    uint32      `json:"doc_write_failures"`
+	StartLastSeq        uint32      `json:"start_last_seq"`
+	EndLastSeq          interface{} `json:"end_last_seq"`
+	State               string      `json:"state"`
+	LastError           string      `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time  `json:"last_error_time,omitempty"`
+	ConsecutiveFailures int         `json:"consecutive_failures"`
+	CheckpointSeq       interface{} `json:"checkpoint_seq,omitempty"` // End sequence of the last successful attempt
 }
 
 func NewReplicator() *Replicator {
 	return &Replicator{
 		replications:      make(map[string]sgreplicate.SGReplication),
 		replicationParams: make(map[string]sgreplicate.ReplicationParameters),
+		statuses:          make(map[string]*replicationStatus),
+		cancelled:         make(map[string]bool),
 	}
 }
 
+// Sets the function called when a replication finishes or fails.
+func (r *Replicator) SetFinishedCallback(callback ReplicationFinishedFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.onFinished = callback
+}
+
+// Returns the state of the active replication with the given ID, or nil if there isn't one.
+func (r *Replicator) ActiveTask(replicationId string) *ActiveTask {
+	replication := r.getReplication(replicationId)
+	if replication == nil {
+		return nil
+	}
+	return r.populateActiveTaskFromReplication(replication, r.getReplicationParams(replicationId), r.getStatus(replicationId))
+}
+
 func (r *Replicator) Replicate(params sgreplicate.ReplicationParameters, isCancel bool) (task *ActiveTask, err error) {
+	return r.ReplicateWithRetryPolicy(params, isCancel, DefaultReplicationRetryPolicy())
+}
+
+// Starts or cancels a replication, as Replicate does.  A replication that's started retries failed
+// attempts according to the given policy.
+func (r *Replicator) ReplicateWithRetryPolicy(params sgreplicate.ReplicationParameters, isCancel bool, policy ReplicationRetryPolicy) (task *ActiveTask, err error) {
 
 	replicationId, found := r.getReplicationForParams(params)
 
@@ -50,12 +88,20 @@ func (r *Replicator) Replicate(params sgreplicate.ReplicationParameters, isCance
 		return r.stopReplication(replicationId)
 	} else {
 		if found {
-			return nil, HTTPErrorf(http.StatusConflict, "Replication already active for specified parameters")
+			// A replication in the error state is kept until it's cancelled or started again
+			if status := r.getStatus(replicationId); status == nil || status.getState() != ReplicationStateError {
+				return nil, HTTPErrorf(http.StatusConflict, "Replication already active for specified parameters")
+			}
+			r.removeReplication(replicationId)
 		}
 
-		replication, err := r.startReplication(params)
+		status := newReplicationStatus(policy, params.Lifecycle == sgreplicate.CONTINUOUS)
+		replication, err := r.startReplication(params, status)
+		if replication == nil {
+			return nil, err
+		}
 
-		task = r.populateActiveTaskFromReplication(replication, params)
+		task = r.populateActiveTaskFromReplication(replication, params, status)
 
 		return task, err
 	}
@@ -68,18 +114,19 @@ func (r *Replicator) ActiveTasks() (tasks []ActiveTask) {
 	tasks = make([]ActiveTask, 0)
 	for replicationId, replication := range r.replications {
 		params := r.replicationParams[replicationId]
-		task := r.populateActiveTaskFromReplication(replication, params)
+		task := r.populateActiveTaskFromReplication(replication, params, r.statuses[replicationId])
 		tasks = append(tasks, *task)
 	}
 	return tasks
 
 }
 
-func (r *Replicator) addReplication(rep sgreplicate.SGReplication, parameters sgreplicate.ReplicationParameters) {
+func (r *Replicator) addReplication(rep sgreplicate.SGReplication, parameters sgreplicate.ReplicationParameters, status *replicationStatus) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	r.replications[parameters.ReplicationId] = rep
 	r.replicationParams[parameters.ReplicationId] = parameters
+	r.statuses[parameters.ReplicationId] = status
 }
 
 func (r *Replicator) getReplication(repId string) sgreplicate.SGReplication {
@@ -102,6 +149,12 @@ func (r *Replicator) getReplicationParams(repId string) sgreplicate.ReplicationP
 	}
 }
 
+func (r *Replicator) getStatus(repId string) *replicationStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.statuses[repId]
+}
+
 func (r *Replicator) getReplicationForParams(queryParams sgreplicate.ReplicationParameters) (replicationId string, found bool) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
@@ -129,10 +182,11 @@ func (r *Replicator) removeReplication(repId string) {
 	defer r.lock.Unlock()
 	delete(r.replications, repId)
 	delete(r.replicationParams, repId)
+	delete(r.statuses, repId)
 }
 
 // Starts a replication based on the provided replication config.
-func (r *Replicator) startReplication(parameters sgreplicate.ReplicationParameters) (sgreplicate.SGReplication, error) {
+func (r *Replicator) startReplication(parameters sgreplicate.ReplicationParameters, status *replicationStatus) (sgreplicate.SGReplication, error) {
 
 	LogTo("Replicate", "Starting replication with parameters %+v", parameters)
 
@@ -143,9 +197,9 @@ func (r *Replicator) startReplication(parameters sgreplicate.ReplicationParamete
 
 	switch parameters.Lifecycle {
 	case sgreplicate.ONE_SHOT:
-		return r.startOneShotReplication(parameters)
+		return r.startOneShotReplication(parameters, status)
 	case sgreplicate.CONTINUOUS:
-		return r.startContinuousReplication(parameters)
+		return r.startContinuousReplication(parameters, status)
 	default:
 		return nil, errors.New("Unknown replication lifecycle")
 	}
@@ -154,65 +208,115 @@ func (r *Replicator) startReplication(parameters sgreplicate.ReplicationParamete
 func (r *Replicator) stopReplication(repId string) (task *ActiveTask, err error) {
 	replication := r.getReplication(repId)
 	params := r.getReplicationParams(repId)
+	status := r.getStatus(repId)
 
 	if replication == nil {
 		return nil, HTTPErrorf(http.StatusNotFound, "No replication found matching specified replication ID")
 	}
-	err = replication.Stop()
-	if err != nil {
-		return nil, err
+	r.lock.Lock()
+	r.cancelled[repId] = true
+	r.lock.Unlock()
+
+	// A replication in the error state has already stopped, as has a one-shot replication waiting
+	// to retry
+	state := status.getState()
+	status.stop()
+	if state == ReplicationStateRunning || (state == ReplicationStateRetrying && params.Lifecycle == sgreplicate.CONTINUOUS) {
+		err = replication.Stop()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	taskState := r.populateActiveTaskFromReplication(replication, params)
+	taskState := r.populateActiveTaskFromReplication(replication, params, status)
 
 	r.removeReplication(repId)
 	return taskState, nil
 }
 
-func (r *Replicator) startOneShotReplication(parameters sgreplicate.ReplicationParameters) (sgreplicate.SGReplication, error) {
+func (r *Replicator) startOneShotReplication(parameters sgreplicate.ReplicationParameters, status *replicationStatus) (sgreplicate.SGReplication, error) {
 
 	replication := sgreplicate.StartOneShotReplication(parameters)
-	r.addReplication(replication, parameters)
+	r.addReplication(replication, parameters, status)
 
 	if parameters.Async {
-		go r.runOneShotReplication(replication, parameters)
+		go r.runOneShotReplication(replication, parameters, status)
 		return replication, nil
 	} else {
-		err := r.runOneShotReplication(replication, parameters)
+		err := r.runOneShotReplication(replication, parameters, status)
 		return replication, err
 
 	}
 }
 
-// Calls WaitUntilDone to work the notification channel for the one-shot replication.  Used for both synchronous and async one-shot replications.
-func (r *Replicator) runOneShotReplication(replication *sgreplicate.Replication, parameters sgreplicate.ReplicationParameters) error {
+// Calls WaitUntilDone to work the notification channel for the one-shot replication, restarting it
+// after a failure as allowed by its retry policy.  Used for both synchronous and async one-shot
+// replications.
+func (r *Replicator) runOneShotReplication(replication *sgreplicate.Replication, parameters sgreplicate.ReplicationParameters, status *replicationStatus) error {
 	defer r.removeReplication(parameters.ReplicationId)
-	_, err := replication.WaitUntilDone()
-	return err
+	for {
+		_, err := replication.WaitUntilDone()
+		if err == nil {
+			status.attemptSucceeded(replication.GetStats().GetEndLastSeq())
+			r.replicationFinished(replication, parameters, nil)
+			return nil
+		}
+		if status.attemptFailed(err) || !status.waitToRetry(0) {
+			r.replicationFinished(replication, parameters, err)
+			return err
+		}
+		LogTo("Replicate", "Retrying replication %s after error: %v", parameters.ReplicationId, err)
+		replication = sgreplicate.StartOneShotReplication(parameters)
+		r.addReplication(replication, parameters, status)
+	}
+}
+
+// Calls the finished callback, unless the replication was cancelled.
+func (r *Replicator) replicationFinished(replication sgreplicate.SGReplication, parameters sgreplicate.ReplicationParameters, err error) {
+	r.lock.Lock()
+	cancelled := r.cancelled[parameters.ReplicationId]
+	delete(r.cancelled, parameters.ReplicationId)
+	callback := r.onFinished
+	r.lock.Unlock()
+	if cancelled || callback == nil {
+		return
+	}
+	callback(r.populateActiveTaskFromReplication(replication, parameters, r.getStatus(parameters.ReplicationId)), err)
 }
 
-func (r *Replicator) startContinuousReplication(parameters sgreplicate.ReplicationParameters) (sgreplicate.SGReplication, error) {
+func (r *Replicator) startContinuousReplication(parameters sgreplicate.ReplicationParameters, status *replicationStatus) (sgreplicate.SGReplication, error) {
 
 	notificationChan := make(chan sgreplicate.ContinuousReplicationNotification)
 
+	// sg-replicate waits the initial backoff before each retry; the factory waits for the rest of
+	// the backoff, and watches each attempt's notifications to track failures.
+	retryTime := status.policy.InitialBackoff
 	factory := func(parameters sgreplicate.ReplicationParameters, notificationChan chan sgreplicate.ReplicationNotification) sgreplicate.Runnable {
 		parameters.Lifecycle = sgreplicate.ONE_SHOT
-		return sgreplicate.NewReplication(parameters, notificationChan)
+		status.waitToRetry(retryTime)
+		attemptChan := make(chan sgreplicate.ReplicationNotification)
+		attempt := sgreplicate.NewReplication(parameters, attemptChan)
+		go r.monitorAttempt(attempt, parameters, status, attemptChan, notificationChan)
+		return attempt
 	}
 
-	retryTime := time.Millisecond * time.Duration(DefaultContinuousRetryTimeMs)
 	replication := sgreplicate.NewContinuousReplication(parameters, factory, notificationChan, retryTime)
-	r.addReplication(replication, parameters)
+	r.addReplication(replication, parameters, status)
 	LogTo("Replicate", "Started continuous replication: %v", replication)
 
 	// Start goroutine to monitor notification channel, to remove the replication if it's terminated internally by sg-replicate
 	go func(rep sgreplicate.SGReplication, notificationChan chan sgreplicate.ContinuousReplicationNotification) {
-		defer r.removeReplication(parameters.ReplicationId)
 		for {
 			select {
 			case notification, ok := <-notificationChan:
 				if !ok {
+					// A replication that failed too many times is kept, so its error can be seen
+					if status.getState() == ReplicationStateError {
+						return
+					}
 					LogTo("Replicate", "Replication %s was terminated.", parameters.ReplicationId)
+					r.replicationFinished(rep, parameters, errors.New("Continuous replication was terminated"))
+					r.removeReplication(parameters.ReplicationId)
 					return
 				}
 				LogTo("Replicate+", "Got notification %v", notification)
@@ -223,7 +327,55 @@ func (r *Replicator) startContinuousReplication(parameters sgreplicate.Replicati
 	return replication, nil
 }
 
-func (r *Replicator) populateActiveTaskFromReplication(replication sgreplicate.SGReplication, params sgreplicate.ReplicationParameters) (task *ActiveTask) {
+// Forwards the notifications of one attempt of a continuous replication to sg-replicate, recording
+// whether the attempt succeeded.  Stops the replication if it has failed too many times in a row.
+// notificationChan belongs to sg-replicate, which reads it for the rest of the replication, so it's
+// never closed here.
+func (r *Replicator) monitorAttempt(attempt *sgreplicate.Replication, parameters sgreplicate.ReplicationParameters, status *replicationStatus,
+	attemptChan chan sgreplicate.ReplicationNotification, notificationChan chan sgreplicate.ReplicationNotification) {
+	for notification := range attemptChan {
+		notificationChan <- notification
+		switch notification.Status {
+		case sgreplicate.REPLICATION_STOPPED:
+			status.attemptSucceeded(attempt.GetStats().GetEndLastSeq())
+			return
+		case sgreplicate.REPLICATION_ABORTED:
+			r.attemptFailed(parameters, status, fmt.Errorf("Replication attempt failed: %v", notification.Error))
+			return
+		}
+	}
+	// The attempt ended without stopping or aborting; report it to sg-replicate as aborted, so the
+	// replication retries rather than waiting on it forever
+	notificationChan <- sgreplicate.ReplicationNotification{Status: sgreplicate.REPLICATION_ABORTED}
+	r.attemptFailed(parameters, status, errors.New("Replication attempt ended unexpectedly"))
+}
+
+// Records a failed attempt of a continuous replication, stopping the replication if it has failed
+// too many times in a row.
+func (r *Replicator) attemptFailed(parameters sgreplicate.ReplicationParameters, status *replicationStatus, err error) {
+	if status.attemptFailed(err) {
+		Warn("Replication %s failed %d times in a row; stopping it: %v", parameters.ReplicationId, status.policy.MaxAttempts, err)
+		go r.failReplication(parameters, status, err)
+	} else {
+		LogTo("Replicate", "Replication %s will retry after error: %v", parameters.ReplicationId, err)
+	}
+}
+
+// Stops a continuous replication that has entered the error state.  It stays in the list of
+// active replications, so its error can be seen, until it's cancelled or started again.
+func (r *Replicator) failReplication(parameters sgreplicate.ReplicationParameters, status *replicationStatus, err error) {
+	status.stop()
+	replication := r.getReplication(parameters.ReplicationId)
+	if replication == nil {
+		return
+	}
+	r.replicationFinished(replication, parameters, err)
+	if stopErr := replication.Stop(); stopErr != nil {
+		Warn("Error stopping replication %s: %v", parameters.ReplicationId, stopErr)
+	}
+}
+
+func (r *Replicator) populateActiveTaskFromReplication(replication sgreplicate.SGReplication, params sgreplicate.ReplicationParameters, status *replicationStatus) (task *ActiveTask) {
 
 	stats := replication.GetStats()
 
@@ -239,6 +391,9 @@ func (r *Replicator) populateActiveTaskFromReplication(replication sgreplicate.S
 		StartLastSeq:     stats.GetStartLastSeq(),
 		EndLastSeq:       stats.GetEndLastSeq(),
 	}
+	if status != nil {
+		status.fillTask(task)
+	}
 
 	return
 }
@@ -0,0 +1,111 @@
+package base
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of request processing tracked by RequestTimings.
+const (
+	PhaseAuth        = "auth"         // Authenticating the request
+	PhaseBucketRead  = "bucket_read"  // Reading documents and revisions from the bucket
+	PhaseBucketWrite = "bucket_write" // Writing documents and revisions to the bucket
+	PhaseCASRetry    = "cas_retry"    // Update attempts abandoned because of a CAS mismatch
+	PhaseSyncFn      = "sync_fn"      // Running the sync function
+	PhaseAttachments = "attachments"  // Reading and writing attachment bodies
+	PhaseResponse    = "response"     // Writing the response body to the client
+)
+
+// Accumulates the time a single request spends in each phase of processing, so slow requests
+// can be explained after the fact.  Each interval is recorded in a single phase: for example
+// cas_retry leaves out the sync function time of the abandoned attempts, which is in sync_fn.
+// All methods are safe to call on a nil receiver, in which case they do nothing.
+type RequestTimings struct {
+	lock      sync.Mutex
+	durations map[string]time.Duration
+	counts    map[string]int
+}
+
+func NewRequestTimings() *RequestTimings {
+	return &RequestTimings{
+		durations: map[string]time.Duration{},
+		counts:    map[string]int{},
+	}
+}
+
+// Adds time spent in a phase.
+func (rt *RequestTimings) Add(phase string, duration time.Duration) {
+	if rt == nil {
+		return
+	}
+	rt.lock.Lock()
+	rt.durations[phase] += duration
+	rt.counts[phase]++
+	rt.lock.Unlock()
+}
+
+// Adds the time elapsed since start to a phase.  Convenient with defer, e.g.
+// `defer timings.Track(base.PhaseAuth, time.Now())`.
+func (rt *RequestTimings) Track(phase string, start time.Time) {
+	if rt == nil {
+		return
+	}
+	rt.Add(phase, time.Since(start))
+}
+
+// Returns the total time recorded for a phase.
+func (rt *RequestTimings) Duration(phase string) time.Duration {
+	if rt == nil {
+		return 0
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.durations[phase]
+}
+
+// Returns the number of times a phase was recorded.
+func (rt *RequestTimings) Count(phase string) int {
+	if rt == nil {
+		return 0
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.counts[phase]
+}
+
+// Returns the total time recorded for all phases.
+func (rt *RequestTimings) Total() time.Duration {
+	if rt == nil {
+		return 0
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	var total time.Duration
+	for _, duration := range rt.durations {
+		total += duration
+	}
+	return total
+}
+
+// Formats the timings as "phase=1.2ms(count) ..." sorted by phase name.
+func (rt *RequestTimings) String() string {
+	if rt == nil {
+		return ""
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	phases := make([]string, 0, len(rt.durations))
+	for phase := range rt.durations {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	fields := make([]string, len(phases))
+	for i, phase := range phases {
+		fields[i] = fmt.Sprintf("%s=%.1fms(%d)", phase,
+			float64(rt.durations[phase])/float64(time.Millisecond), rt.counts[phase])
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,33 @@
+package base
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestRequestTimings(t *testing.T) {
+	timings := NewRequestTimings()
+	timings.Add(PhaseSyncFn, 2*time.Millisecond)
+	timings.Add(PhaseSyncFn, 3*time.Millisecond)
+	timings.Add(PhaseAuth, time.Millisecond)
+	assert.Equals(t, timings.Duration(PhaseSyncFn), 5*time.Millisecond)
+	assert.Equals(t, timings.Count(PhaseSyncFn), 2)
+	assert.Equals(t, timings.Count(PhaseCASRetry), 0)
+	assert.Equals(t, timings.Total(), 6*time.Millisecond)
+	assert.Equals(t, timings.String(), "auth=1.0ms(1) sync_fn=5.0ms(2)")
+
+	timings.Track(PhaseResponse, time.Now().Add(-time.Second))
+	assert.True(t, timings.Duration(PhaseResponse) >= time.Second)
+	assert.True(t, strings.Contains(timings.String(), "response="))
+
+	// A nil RequestTimings ignores everything
+	var disabled *RequestTimings
+	disabled.Add(PhaseAuth, time.Second)
+	disabled.Track(PhaseAuth, time.Now())
+	assert.Equals(t, disabled.Duration(PhaseAuth), time.Duration(0))
+	assert.Equals(t, disabled.Total(), time.Duration(0))
+	assert.Equals(t, disabled.String(), "")
+}
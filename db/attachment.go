@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/textproto"
 	"strings"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -163,25 +164,28 @@ func (db *Database) loadBodyAttachments(body Body, minRevpos int) (Body, error)
 
 // Retrieves an attachment, base64-encoded, given its key.
 func (db *Database) GetAttachment(key AttachmentKey) ([]byte, error) {
+	defer db.timings.Track(base.PhaseAttachments, time.Now())
 	v, _, err := db.Bucket.GetRaw(attachmentKeyToString(key))
 	return v, err
 }
 
 // Stores a base64-encoded attachment and returns the key to get it by.
 func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
+	defer db.timings.Track(base.PhaseAttachments, time.Now())
 	key := AttachmentKey(sha1DigestKey(attachment))
 	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
 	if err == nil {
-		base.LogTo("Attach", "\tAdded attachment %q", key)
+		db.logContext.LogTo("Attach", "\tAdded attachment %q", key)
 	}
 	return key, err
 }
 
 func (db *Database) setAttachments(attachments AttachmentData) error {
+	defer db.timings.Track(base.PhaseAttachments, time.Now())
 	for key, data := range attachments {
 		_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, data)
 		if err == nil {
-			base.LogTo("Attach", "\tAdded attachment %q", key)
+			db.logContext.LogTo("Attach", "\tAdded attachment %q", key)
 		} else {
 			return err
 		}
@@ -265,7 +269,7 @@ func (db *Database) WriteMultipartDocument(body Body, writer *multipart.Writer,
 			info.contentType, _ = meta["content_type"].(string)
 			info.data, err = decodeAttachment(meta["data"])
 			if info.data == nil {
-				base.Warn("Couldn't decode attachment %q of doc %q: %v", name, body["_id"], err)
+				db.logContext.Warn("Couldn't decode attachment %q of doc %q: %v", name, body["_id"], err)
 				meta["stub"] = true
 				delete(meta, "data")
 			} else if len(info.data) > kMaxInlineAttachmentSize {
@@ -34,20 +34,26 @@ func init() {
 
 // Manages a cache of the recent change history of all channels.
 type changeCache struct {
-	context         *DatabaseContext
-	logsDisabled    bool                     // If true, ignore incoming tap changes
-	nextSequence    uint64                   // Next consecutive sequence number to add
-	initialSequence uint64                   // DB's current sequence at startup time
-	receivedSeqs    map[uint64]struct{}      // Set of all sequences received
-	pendingLogs     LogPriorityQueue         // Out-of-sequence entries waiting to be cached
-	channelCaches   map[string]*channelCache // A cache of changes for each channel
-	onChange        func(base.Set)           // Client callback that notifies of channel changes
-	stopped         bool                     // Set by the Stop method
-	skippedSeqs     SkippedSequenceQueue     // Skipped sequences still pending on the TAP feed
-	skippedSeqLock  sync.RWMutex             // Coordinates access to skippedSeqs queue
-	lock            sync.RWMutex             // Coordinates access to struct fields
-	lateSeqLock     sync.RWMutex             // Coordinates access to late sequence caches
-	options         CacheOptions             // Cache config
+	context             *DatabaseContext
+	logsDisabled        bool                     // If true, ignore incoming tap changes
+	nextSequence        uint64                   // Next consecutive sequence number to add
+	initialSequence     uint64                   // Highest sequence assigned at startup time
+	initialReserved     uint64                   // Highest sequence reserved (_sync:seq) at startup time
+	startTime           time.Time                // When the cache was initialized
+	highestReceived     uint64                   // Highest sequence of a doc or principal received
+	receivedSeqs        map[uint64]struct{}      // Set of all sequences received
+	pendingLogs         LogPriorityQueue         // Out-of-sequence entries waiting to be cached
+	channelCaches       map[string]*channelCache // A cache of changes for each channel
+	onChange            func(base.Set)           // Client callback that notifies of channel changes
+	stopped             bool                     // Set by the Stop method
+	skippedSeqs         SkippedSequenceQueue     // Skipped sequences still pending on the TAP feed
+	skippedSeqLock      sync.RWMutex             // Coordinates access to skippedSeqs queue
+	lock                sync.RWMutex             // Coordinates access to struct fields
+	lateSeqLock         sync.RWMutex             // Coordinates access to late sequence caches
+	options             CacheOptions             // Cache config
+	cacheBudget         channelCacheBudget       // Database-wide limit on the size of the channel caches
+	newChannelValidFrom uint64                   // validFrom of newly created channel caches
+	warmingUp           int32                    // Non-zero while warming up on startup; accessed atomically
 }
 
 type LogEntry channels.LogEntry
@@ -67,20 +73,29 @@ type SkippedSequence struct {
 
 type CacheOptions struct {
 	ChannelCacheOptions
-	CachePendingSeqMaxWait time.Duration // Max wait for pending sequence before skipping
-	CachePendingSeqMaxNum  int           // Max number of pending sequences before skipping
-	CacheSkippedSeqMaxWait time.Duration // Max wait for skipped sequence before abandoning
+	CacheWarmupOptions
+	CachePendingSeqMaxWait      time.Duration // Max wait for pending sequence before skipping
+	CachePendingSeqMaxNum       int           // Max number of pending sequences before skipping
+	CacheSkippedSeqMaxWait      time.Duration // Max wait for skipped sequence before abandoning
+	ChannelCacheMaxTotalEntries int           // Max entries across all channel caches (0 for no limit)
+	ChannelCacheMaxTotalBytes   int64         // Max estimated bytes across all channel caches (0 for no limit)
 }
 
 //////// HOUSEKEEPING:
 
 // Initializes a new changeCache.
-// lastSequence is the last known database sequence assigned.
+// lastSequence is the value of the _sync:seq counter, the last sequence reserved.  With sequence
+// batching that can be ahead of the last one assigned, and sequences up to it can still be
+// assigned by other nodes after startup.  Those arrive as late sequences; the cache doesn't wait
+// for them, and the view serves them to requests older than the channel caches.
 // onChange is an optional function that will be called to notify of channel changes.
 func (c *changeCache) Init(context *DatabaseContext, lastSequence SequenceID, onChange func(base.Set), options *CacheOptions, indexOptions *ChangeIndexOptions) error {
 	c.context = context
-	c.initialSequence = lastSequence.Seq
+	c.initialReserved = lastSequence.Seq
+	c.startTime = time.Now()
+	c.initialSequence = context.highestWrittenSequence(lastSequence.Seq)
 	c.nextSequence = lastSequence.Seq + 1
+	c.newChannelValidFrom = lastSequence.Seq + 1
 	c.onChange = onChange
 	c.channelCaches = make(map[string]*channelCache, 10)
 	c.receivedSeqs = make(map[uint64]struct{})
@@ -105,7 +120,12 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence SequenceID, on
 			c.options.CacheSkippedSeqMaxWait = options.CacheSkippedSeqMaxWait
 		}
 		c.options.ChannelCacheOptions = options.ChannelCacheOptions
+		c.options.ChannelCacheMaxTotalEntries = options.ChannelCacheMaxTotalEntries
+		c.options.ChannelCacheMaxTotalBytes = options.ChannelCacheMaxTotalBytes
+		c.options.CacheWarmupOptions = options.CacheWarmupOptions
 	}
+	c.cacheBudget.maxEntries = int64(c.options.ChannelCacheMaxTotalEntries)
+	c.cacheBudget.maxBytes = c.options.ChannelCacheMaxTotalBytes
 
 	base.LogTo("Cache", "Initializing changes cache with options %+v", c.options)
 
@@ -127,6 +147,12 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence SequenceID, on
 		}
 	}()
 
+	// Start a background task to warm up the channel caches:
+	if len(c.options.WarmupChannels) > 0 || c.options.WarmupTopChannels > 0 {
+		c.warmingUp = 1
+		go c.runWarmup()
+	}
+
 	return nil
 }
 
@@ -146,8 +172,13 @@ func (c *changeCache) IsStopped() bool {
 
 // Forgets all cached changes for all channels.
 func (c *changeCache) Clear() {
+	lastReserved, _ := c.context.sequences.lastSequence()
 	c.lock.Lock()
-	c.initialSequence, _ = c.context.LastSequence()
+	c.newChannelValidFrom = lastReserved + 1
+	for _, cache := range c.channelCaches {
+		cache.detachFromBudget()
+	}
+	c.cacheBudget.reset()
 	c.channelCaches = make(map[string]*channelCache, 10)
 	c.pendingLogs = nil
 	heap.Init(&c.pendingLogs)
@@ -319,6 +350,9 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte, seq uint64, vbNo
 		} else if strings.HasPrefix(docID, auth.RoleKeyPrefix) {
 			c.processPrincipalDoc(docID, docJSON, false)
 			return
+		} else if strings.HasPrefix(docID, UnusedSequenceKeyPrefix) {
+			c.processUnusedSequences(docID)
+			return
 		}
 
 		// First unmarshal the doc (just its metadata, to save time/memory):
@@ -328,7 +362,7 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte, seq uint64, vbNo
 			return
 		}
 
-		if doc.Sequence <= c.initialSequence {
+		if doc.Sequence <= c.initialReserved && !c.reservedBeforeStartup(doc) {
 			return // Tap is sending us an old value from before I started up; ignore it
 		}
 
@@ -387,6 +421,35 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte, seq uint64, vbNo
 		}
 	}()
 }
+
+// True if a doc with a sequence from before startup was written since, using a sequence from a
+// batch another node reserved before startup.  Only possible with sequence batching; otherwise,
+// and for docs saved before the cache started, it's an old value the feed is redelivering.
+func (c *changeCache) reservedBeforeStartup(doc *syncData) bool {
+	return c.context.Options.MaxSequenceBatchSize > 1 && doc.TimeSaved.After(c.startTime)
+}
+
+// Adds empty entries for a range of sequences that a node reserved but released unused, so that
+// the cache doesn't wait for them (or, if they were already skipped, stops waiting for them).
+func (c *changeCache) processUnusedSequences(docID string) {
+	first, last, err := parseUnusedSequenceKey(docID)
+	if err != nil {
+		base.Warn("changeCache: %v", err)
+		return
+	}
+	base.LogTo("Cache", "Received unused sequences #%d-#%d", first, last)
+	for seq := first; seq <= last; seq++ {
+		if seq <= c.initialReserved {
+			continue // The cache didn't wait for sequences reserved before it started
+		}
+		change := &LogEntry{
+			Sequence:     seq,
+			TimeReceived: time.Now(),
+		}
+		c.processEntry(change)
+	}
+}
+
 func (c *changeCache) unmarshalPrincipal(docJSON []byte, isUser bool) (auth.Principal, error) {
 
 	c.context.BucketLock.RLock()
@@ -409,10 +472,10 @@ func (c *changeCache) processPrincipalDoc(docID string, docJSON []byte, isUser b
 	}
 	sequence := princ.Sequence()
 	c.lock.RLock()
-	initialSequence := c.initialSequence
+	initialReserved := c.initialReserved
 	c.lock.RUnlock()
-	if sequence <= initialSequence {
-		return // Tap is sending us an old value from before I started up; ignore it
+	if sequence <= initialReserved {
+		return // Old value from before I started up, or one the cache didn't wait for; ignore it
 	}
 
 	// Now add the (somewhat fictitious) entry:
@@ -450,6 +513,9 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 	}
 	c.receivedSeqs[sequence] = struct{}{}
 	// FIX: c.receivedSeqs grows monotonically. Need a way to remove old sequences.
+	if change.DocID != "" && sequence > c.highestReceived {
+		c.highestReceived = sequence
+	}
 
 	var changedChannels base.Set
 	if sequence == nextSequence || nextSequence == 0 {
@@ -468,7 +534,7 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 			// Too many pending; add the oldest one:
 			changedChannels = c._addPendingLogs()
 		}
-	} else if sequence > c.initialSequence {
+	} else if sequence > c.initialReserved {
 		// Out-of-order sequence received!
 		// Remove from skipped sequence queue
 		if !c.WasSkipped(sequence) {
@@ -483,6 +549,12 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 		// Add to cache before removing from skipped, to ensure lowSequence doesn't get incremented until results are available
 		// in cache
 		c.RemoveSkipped(sequence)
+	} else if change.DocID != "" {
+		// A doc written after startup, with a sequence from a batch reserved before it.  The channel
+		// caches start after it, so it only goes to the late sequence logs for feeds already past it.
+		base.LogTo("Cache", "  Received #%d reserved before startup (expecting %d) doc %q / %q", sequence, nextSequence, change.DocID, change.RevID)
+		change.Skipped = true
+		changedChannels = c._addToCache(change)
 	}
 	return changedChannels
 }
@@ -540,6 +612,7 @@ func (c *changeCache) _addToCache(change *LogEntry) base.Set {
 	lagMs = int(lag/(100*time.Millisecond)) * 100
 	changeCacheExpvars.Add(fmt.Sprintf("lag-queue-%04dms", lagMs), 1)
 
+	c._enforceCacheBudget()
 	return base.SetFromArray(addedTo)
 }
 
@@ -592,7 +665,8 @@ func (c *changeCache) GetStableClock(stale bool) (clock base.SequenceClock, err
 func (c *changeCache) _getChannelCache(channelName string) *channelCache {
 	cache := c.channelCaches[channelName]
 	if cache == nil {
-		cache = newChannelCacheWithOptions(c.context, channelName, c.initialSequence+1, c.options)
+		cache = newChannelCacheWithOptions(c.context, channelName, c.newChannelValidFrom, c.options)
+		cache.budget = &c.cacheBudget
 		c.channelCaches[channelName] = cache
 	}
 	return cache
@@ -618,6 +692,17 @@ func (c *changeCache) LastSequence() uint64 {
 	return c.nextSequence - 1
 }
 
+// Returns the highest sequence known to be assigned: the highest at startup, or the highest
+// received since.
+func (c *changeCache) highestSequence() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.highestReceived > c.initialSequence {
+		return c.highestReceived
+	}
+	return c.initialSequence
+}
+
 func (c *changeCache) _allChannels() base.Set {
 	array := make([]string, len(c.channelCaches))
 	i := 0
@@ -639,6 +724,13 @@ func (c *changeCache) getOldestSkippedSequence() uint64 {
 	}
 }
 
+// Returns the number of sequences currently waiting in the skipped sequence queue.
+func (c *changeCache) getSkippedSequenceCount() int {
+	c.skippedSeqLock.RLock()
+	defer c.skippedSeqLock.RUnlock()
+	return len(c.skippedSeqs)
+}
+
 //////// LOG PRIORITY QUEUE
 
 func (h LogPriorityQueue) Len() int           { return len(h) }
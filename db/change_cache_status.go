@@ -0,0 +1,215 @@
+package db
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Snapshot of the in-memory change cache's state, as reported by the admin API.
+type ChangeCacheStatus struct {
+	NextSequence     uint64                        `json:"next_sequence"`
+	InitialSequence  uint64                        `json:"initial_sequence"`
+	TotalEntries     int64                         `json:"total_entries"`
+	TotalBytes       int64                         `json:"total_bytes"`
+	MaxTotalEntries  int64                         `json:"max_total_entries,omitempty"`
+	MaxTotalBytes    int64                         `json:"max_total_bytes,omitempty"`
+	PendingLogs      PendingLogsStatus             `json:"pending_logs"`
+	SkippedCount     int                           `json:"skipped_count"`
+	SkippedSequences []SkippedSequenceStatus       `json:"skipped_sequences"`
+	ChannelCount     int                           `json:"channel_count"`
+	Channels         map[string]ChannelCacheStatus `json:"channels"`
+}
+
+// Default maximum number of channels and skipped sequences in a ChangeCacheStatus
+const DefaultChangeCacheStatusLimit = 100
+
+// Limits what a ChangeCacheStatus includes, since a database can cache many thousands of channels.
+type ChangeCacheStatusOptions struct {
+	Channels []string // If non-empty, only these channels are included
+	Limit    int      // Max channels (the largest) and skipped sequences (the oldest) included; 0 for all
+}
+
+type PendingLogsStatus struct {
+	Count          int     `json:"count"`
+	OldestSequence uint64  `json:"oldest_sequence,omitempty"`
+	OldestAgeSecs  float64 `json:"oldest_age_secs,omitempty"`
+}
+
+type SkippedSequenceStatus struct {
+	Sequence  uint64    `json:"seq"`
+	TimeAdded time.Time `json:"time_added"`
+	AgeSecs   float64   `json:"age_secs"`
+}
+
+type ChannelCacheStatus struct {
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	ValidFrom     uint64 `json:"valid_from"`
+	FirstSequence uint64 `json:"first_seq,omitempty"`
+	LastSequence  uint64 `json:"last_seq,omitempty"`
+	LateEntries   int    `json:"late_entries"`
+}
+
+var errNoChangeCache = base.HTTPErrorf(http.StatusNotFound, "Database doesn't use the in-memory change cache")
+
+// Returns the in-memory change cache, or an error if the database uses a channel index instead.
+func (context *DatabaseContext) inMemoryChangeCache() (*changeCache, error) {
+	if cache, ok := context.changeCache.(*changeCache); ok {
+		return cache, nil
+	}
+	return nil, errNoChangeCache
+}
+
+// Returns a snapshot of the change cache's sequence bookkeeping and channel caches.
+func (context *DatabaseContext) GetChangeCacheStatus(options ChangeCacheStatusOptions) (*ChangeCacheStatus, error) {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	return cache.status(options), nil
+}
+
+// Discards the cached entries of a channel.  Subsequent requests for older changes in the channel
+// will be served from the channel view.
+func (context *DatabaseContext) EvictChannelCache(channelName string) error {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return err
+	}
+	if !cache.evictChannelCache(channelName) {
+		return base.HTTPErrorf(http.StatusNotFound, "Channel is not cached")
+	}
+	return nil
+}
+
+// Removes a sequence from the skipped sequence queue without waiting for it to arrive.
+func (context *DatabaseContext) DropSkippedSequence(sequence uint64) error {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return err
+	}
+	if err := cache.RemoveSkipped(sequence); err != nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Sequence is not in the skipped sequence queue")
+	}
+	dbExpvars.Add("abandoned_seqs", 1)
+	base.Warn("Skipped sequence %d dropped from the skipped sequence queue by admin request.  If it's a valid sequence, it won't be replicated until Sync Gateway is restarted.", sequence)
+	return nil
+}
+
+func (c *changeCache) status(options ChangeCacheStatusOptions) *ChangeCacheStatus {
+	now := time.Now()
+	status := &ChangeCacheStatus{
+		Channels: map[string]ChannelCacheStatus{},
+	}
+
+	c.lock.RLock()
+	status.NextSequence = c.nextSequence
+	status.InitialSequence = c.initialSequence
+	status.TotalEntries = atomic.LoadInt64(&c.cacheBudget.entries)
+	status.TotalBytes = atomic.LoadInt64(&c.cacheBudget.bytes)
+	status.MaxTotalEntries = c.cacheBudget.maxEntries
+	status.MaxTotalBytes = c.cacheBudget.maxBytes
+	status.PendingLogs.Count = len(c.pendingLogs)
+	if len(c.pendingLogs) > 0 {
+		// The priority queue's root is its lowest sequence
+		oldest := c.pendingLogs[0]
+		status.PendingLogs.OldestSequence = oldest.Sequence
+		status.PendingLogs.OldestAgeSecs = now.Sub(oldest.TimeReceived).Seconds()
+	}
+	status.ChannelCount = len(c.channelCaches)
+	var caches []*channelCache
+	if len(options.Channels) > 0 {
+		for _, name := range options.Channels {
+			if cache, found := c.channelCaches[name]; found {
+				caches = append(caches, cache)
+			}
+		}
+	} else {
+		caches = make([]*channelCache, 0, len(c.channelCaches))
+		for _, cache := range c.channelCaches {
+			caches = append(caches, cache)
+		}
+	}
+	c.lock.RUnlock()
+
+	channelStatuses := make(channelStatusesBySize, len(caches))
+	for i, cache := range caches {
+		channelStatuses[i] = namedChannelCacheStatus{cache.channelName, cache.status()}
+	}
+	if options.Limit > 0 && len(options.Channels) == 0 && len(channelStatuses) > options.Limit {
+		sort.Sort(channelStatuses)
+		channelStatuses = channelStatuses[:options.Limit]
+	}
+	for _, channelStatus := range channelStatuses {
+		status.Channels[channelStatus.name] = channelStatus.status
+	}
+
+	c.skippedSeqLock.RLock()
+	status.SkippedCount = len(c.skippedSeqs)
+	skippedSeqs := c.skippedSeqs
+	if options.Limit > 0 && len(skippedSeqs) > options.Limit {
+		skippedSeqs = skippedSeqs[:options.Limit]
+	}
+	status.SkippedSequences = make([]SkippedSequenceStatus, len(skippedSeqs))
+	for i, skipped := range skippedSeqs {
+		status.SkippedSequences[i] = SkippedSequenceStatus{
+			Sequence:  skipped.seq,
+			TimeAdded: skipped.timeAdded,
+			AgeSecs:   now.Sub(skipped.timeAdded).Seconds(),
+		}
+	}
+	c.skippedSeqLock.RUnlock()
+
+	return status
+}
+
+type namedChannelCacheStatus struct {
+	name   string
+	status ChannelCacheStatus
+}
+
+// Sorts channel cache statuses largest first
+type channelStatusesBySize []namedChannelCacheStatus
+
+func (s channelStatusesBySize) Len() int           { return len(s) }
+func (s channelStatusesBySize) Less(i, j int) bool { return s[i].status.Bytes > s[j].status.Bytes }
+func (s channelStatusesBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Replaces a channel's cache with an empty one that's only valid from the next sequence, so
+// earlier changes will be reloaded from the view.  Returns false if the channel isn't cached.
+func (c *changeCache) evictChannelCache(channelName string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, found := c.channelCaches[channelName]; !found {
+		return false
+	}
+	c._removeChannelCache(channelName)
+	cache := newChannelCacheWithOptions(c.context, channelName, c.nextSequence, c.options)
+	cache.budget = &c.cacheBudget
+	c.channelCaches[channelName] = cache
+	base.LogTo("Cache", "Evicted cache for channel %q", channelName)
+	return true
+}
+
+func (c *channelCache) status() ChannelCacheStatus {
+	c.lock.RLock()
+	status := ChannelCacheStatus{
+		Entries:   len(c.logs),
+		Bytes:     c.entryBytes,
+		ValidFrom: c.validFrom,
+	}
+	if len(c.logs) > 0 {
+		status.FirstSequence = c.logs[0].Sequence
+		status.LastSequence = c.logs[len(c.logs)-1].Sequence
+	}
+	c.lock.RUnlock()
+
+	c.lateLogLock.RLock()
+	status.LateEntries = len(c.lateLogs)
+	c.lateLogLock.RUnlock()
+	return status
+}
@@ -10,6 +10,7 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -834,6 +835,61 @@ func TestStopChangeCache(t *testing.T) {
 	time.Sleep(2 * time.Second)
 }
 
+func TestChangeCacheStatus(t *testing.T) {
+	db := setupTestDBWithCacheOptions(t, CacheOptions{})
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC", "NBC"}, 2)
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing cache status without a change cache")
+	changeCache.waitForSequence(2)
+	changeCache.PushSkipped(10)
+
+	status, err := db.GetChangeCacheStatus(ChangeCacheStatusOptions{})
+	assertNoError(t, err, "Couldn't get cache status")
+	assert.Equals(t, status.NextSequence, uint64(3))
+	assert.Equals(t, status.PendingLogs.Count, 0)
+	assert.Equals(t, len(status.SkippedSequences), 1)
+	assert.Equals(t, status.SkippedSequences[0].Sequence, uint64(10))
+	assert.Equals(t, status.Channels["ABC"].Entries, 2)
+	assert.Equals(t, status.Channels["NBC"].Entries, 1)
+
+	// A limit keeps the largest channels, and the channel option picks specific ones
+	changeCache.PushSkipped(11)
+	status, _ = db.GetChangeCacheStatus(ChangeCacheStatusOptions{Limit: 1})
+	assert.Equals(t, len(status.Channels), 1)
+	assert.Equals(t, status.ChannelCount, 3) // ABC, NBC and *
+	for _, channelStatus := range status.Channels {
+		assert.Equals(t, channelStatus.Entries, 2)
+	}
+	assert.Equals(t, status.SkippedCount, 2)
+	assert.Equals(t, len(status.SkippedSequences), 1)
+	assert.Equals(t, status.SkippedSequences[0].Sequence, uint64(10))
+	status, _ = db.GetChangeCacheStatus(ChangeCacheStatusOptions{Channels: []string{"NBC", "CBS"}, Limit: 1})
+	assert.Equals(t, len(status.Channels), 1)
+	assert.Equals(t, status.Channels["NBC"].Entries, 1)
+	assertNoError(t, db.DropSkippedSequence(11), "Couldn't drop skipped sequence")
+
+	// Evicting a channel leaves an empty cache that's only valid from the next sequence
+	assertNoError(t, db.EvictChannelCache("ABC"), "Couldn't evict channel")
+	assertTrue(t, db.EvictChannelCache("CBS") != nil, "Expected error evicting uncached channel")
+	status, _ = db.GetChangeCacheStatus(ChangeCacheStatusOptions{})
+	assert.Equals(t, status.Channels["ABC"].Entries, 0)
+	assert.Equals(t, status.Channels["ABC"].ValidFrom, uint64(3))
+	assert.Equals(t, status.Channels["NBC"].Entries, 1)
+
+	// Evicted changes are still available from the view
+	entries, err := db.changeCache.GetChanges("ABC", ChangesOptions{Since: SequenceID{Seq: 0}})
+	assertNoError(t, err, "Get Changes returned error")
+	assert.Equals(t, len(entries), 2)
+
+	assertNoError(t, db.DropSkippedSequence(10), "Couldn't drop skipped sequence")
+	assertTrue(t, db.DropSkippedSequence(10) != nil, "Expected error dropping missing sequence")
+	assert.Equals(t, changeCache.getSkippedSequenceCount(), 0)
+}
+
 // Test size config
 func TestChannelCacheSize(t *testing.T) {
 
@@ -875,6 +931,102 @@ func TestChannelCacheSize(t *testing.T) {
 	assert.Equals(t, len(abcCache.logs), 600)
 }
 
+// Sequences reserved from _sync:seq before startup, e.g. in another node's batch, can be assigned
+// after it.  The cache doesn't wait for them, but doesn't drop them either.
+func TestSequencesReservedBeforeStartup(t *testing.T) {
+	bucket := testBucket()
+	for seq := uint64(1); seq <= 3; seq++ {
+		syncData := &syncData{
+			CurrentRev: "1-a",
+			Sequence:   seq,
+			Channels:   channels.ChannelMap{"ABC": nil},
+			TimeSaved:  time.Now(),
+		}
+		key := fmt.Sprintf("doc-%d", seq)
+		bucket.Add(key, 0, Body{"_sync": syncData, "key": key})
+	}
+	_, err := bucket.Incr(SyncSeqKey, 10, 10, 0)
+	assertNoError(t, err, "Couldn't reserve sequences")
+
+	context, err := NewDatabaseContext("db", bucket, false, DatabaseContextOptions{
+		CacheOptions:         &CacheOptions{},
+		MaxSequenceBatchSize: 10,
+	})
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing reserved sequences without a change cache")
+
+	// The last sequence is the highest one written, not the counter
+	lastSeq, _ := db.LastSequence()
+	assert.Equals(t, lastSeq, uint64(3))
+	assert.Equals(t, changeCache.LastSequence(), uint64(10))
+
+	// Another node assigns one of the sequences it reserved before startup
+	WriteDirect(db, []string{"ABC"}, 5)
+	for i := 0; i < 100 && changeCache.highestSequence() < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lastSeq, _ = db.LastSequence()
+	assert.Equals(t, lastSeq, uint64(5))
+
+	// It isn't cached, since the channel's cache starts after it, but is sent to feeds that are
+	// already past it, and is served from the view
+	abcCache := changeCache.getChannelCache("ABC")
+	assert.Equals(t, len(abcCache.logs), 0)
+	assert.Equals(t, abcCache.lastLateSequence, uint64(5))
+	WriteDirect(db, []string{"ABC"}, 11)
+	changeCache.waitForSequence(11)
+	changes, err := db.GetChanges(base.SetOf("ABC"), ChangesOptions{Since: SequenceID{Seq: 0}})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assertTrue(t, verifyChangesSequences(changes, []uint64{1, 2, 3, 5, 11}), "Unexpected changes")
+}
+
+// A doc from before startup that the feed delivers again, e.g. after reconnecting, is ignored,
+// with or without sequence batching.
+func TestRedeliveredDocFromBeforeStartup(t *testing.T) {
+	for _, batchSize := range []int{0, 10} {
+		bucket := testBucket()
+		syncData := &syncData{
+			CurrentRev: "1-a",
+			Sequence:   1,
+			Channels:   channels.ChannelMap{"ABC": nil},
+			TimeSaved:  time.Now().Add(-time.Minute),
+		}
+		doc := Body{"_sync": syncData, "key": "doc-1"}
+		bucket.Add("doc-1", 0, doc)
+		_, err := bucket.Incr(SyncSeqKey, 1, 1, 0)
+		assertNoError(t, err, "Couldn't reserve sequence")
+
+		context, err := NewDatabaseContext("db", bucket, false, DatabaseContextOptions{
+			CacheOptions:         &CacheOptions{},
+			MaxSequenceBatchSize: batchSize,
+		})
+		assertNoError(t, err, "Couldn't create context for database 'db'")
+		db, err := CreateDatabase(context)
+		assertNoError(t, err, "Couldn't create database 'db'")
+		db.ChannelMapper = channels.NewDefaultChannelMapper()
+		changeCache, ok := db.changeCache.(*changeCache)
+		assertTrue(t, ok, "Testing redelivered docs without a change cache")
+
+		docJSON, _ := json.Marshal(doc)
+		changeCache.DocChanged("doc-1", docJSON, 1, 0)
+		time.Sleep(50 * time.Millisecond) // DocChanged is processed asynchronously
+
+		changeCache.lock.RLock()
+		received := len(changeCache.receivedSeqs)
+		changeCache.lock.RUnlock()
+		assert.Equals(t, received, 0)
+		assert.Equals(t, changeCache.getChannelCache("ABC").lastLateSequence, uint64(0))
+		lastSeq, _ := db.LastSequence()
+		assert.Equals(t, lastSeq, uint64(1))
+		tearDownTestDB(t, db)
+	}
+}
+
 func shortWaitCache() CacheOptions {
 
 	return CacheOptions{
@@ -1004,3 +1156,120 @@ func appendFromFeed(changes *[]*ChangeEntry, feed <-chan (*ChangeEntry), numEntr
 	return nil
 
 }
+
+func TestChannelCacheBudget(t *testing.T) {
+	db := setupTestDBWithCacheOptions(t, CacheOptions{ChannelCacheMaxTotalEntries: 10})
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing cache budget without a change cache")
+
+	writeToChannel := func(channelName string, firstSeq uint64) {
+		for seq := firstSeq; seq < firstSeq+3; seq++ {
+			WriteDirect(db, []string{channelName}, seq)
+		}
+		changeCache.waitForSequence(firstSeq + 2)
+	}
+	writeToChannel("A", 1)
+	writeToChannel("B", 4)
+	writeToChannel("C", 7)
+
+	// Query A, so that B is the least recently used channel
+	_, err := db.changeCache.GetChanges("A", ChangesOptions{})
+	assertNoError(t, err, "Get Changes returned error")
+	writeToChannel("D", 10)
+
+	status, err := db.GetChangeCacheStatus(ChangeCacheStatusOptions{})
+	assertNoError(t, err, "Couldn't get cache status")
+	assert.Equals(t, status.TotalEntries, int64(9))
+	assertTrue(t, status.TotalBytes > 0, "Expected non-zero cache size")
+	_, found := status.Channels["B"]
+	assertTrue(t, !found, "Expected channel B to be evicted")
+	assert.Equals(t, status.Channels["A"].Entries, 3)
+	assert.Equals(t, status.Channels["C"].Entries, 3)
+	assert.Equals(t, status.Channels["D"].Entries, 3)
+
+	// The evicted channel's changes are reloaded from the view
+	entries, err := db.changeCache.GetChanges("B", ChangesOptions{})
+	assertNoError(t, err, "Get Changes returned error")
+	assert.Equals(t, len(entries), 3)
+}
+
+func TestChannelCacheWarmup(t *testing.T) {
+	db := setupTestDBWithCacheOptions(t, CacheOptions{})
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing cache warm-up without a change cache")
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		WriteDirect(db, []string{"A"}, seq)
+	}
+	WriteDirect(db, []string{"B"}, 6)
+	changeCache.waitForSequence(6)
+
+	// Replace A's cache with an empty one, as though the gateway had just restarted
+	assertTrue(t, changeCache.evictChannelCache("A"), "Expected channel A to be cached")
+	WriteDirect(db, []string{"A"}, 7)
+	changeCache.waitForSequence(7)
+
+	cache := changeCache.getChannelCache("A")
+	assertTrue(t, verifyCacheSequences(cache, []uint64{7}), "Unexpected sequences before warm-up")
+	entries, err := cache.warmUp()
+	assertNoError(t, err, "Warm-up returned error")
+	assert.Equals(t, entries, 5)
+	assertTrue(t, verifyCacheSequences(cache, []uint64{1, 2, 3, 4, 5, 7}), "Unexpected sequences after warm-up")
+	assert.Equals(t, cache.validFrom, uint64(1))
+
+	// The most recently queried channels are saved for the next warm-up, merged with the ones
+	// saved by other nodes.  Channels that were cached but never queried, like A, aren't saved.
+	changeCache.options.WarmupChannels = []string{"C"}
+	changeCache.options.WarmupTopChannels = 2
+	otherNodeDoc := cacheWarmupDoc{Channels: map[string]int64{"D": time.Now().UnixNano(), "E": 1}}
+	assertNoError(t, db.Bucket.Set(kCacheWarmupDocKey, 0, otherNodeDoc), "Couldn't save warm-up doc")
+	_, err = db.changeCache.GetChanges("B", ChangesOptions{})
+	assertNoError(t, err, "Get Changes returned error")
+	changeCache.saveWarmupChannels()
+	assert.DeepEquals(t, changeCache.warmupChannelNames(), []string{"C", "B", "D"})
+}
+
+func TestUnusedSequenceRelease(t *testing.T) {
+	defer func(wait time.Duration) { DefaultSequenceReleaseWait = wait }(DefaultSequenceReleaseWait)
+	DefaultSequenceReleaseWait = 50 * time.Millisecond
+
+	db := setupTestDBWithCacheOptions(t, CacheOptions{})
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing unused sequences without a change cache")
+	db.sequences.setMaxBatchSize(4)
+
+	// Sequences are reserved in batches of 1, 2, then 4
+	for i := uint64(1); i <= 4; i++ {
+		seq, err := db.sequences.nextSequence()
+		assertNoError(t, err, "nextSequence returned error")
+		assert.Equals(t, seq, i)
+		WriteDirect(db, []string{"A"}, seq)
+	}
+	lastSeq, _ := db.LastSequence()
+	assert.Equals(t, lastSeq, uint64(7))
+
+	// Once idle, the rest of the batch is released, and the cache doesn't wait for it
+	changeCache.waitForSequence(7)
+	assert.Equals(t, changeCache.getSkippedSequenceCount(), 0)
+	seq, err := db.sequences.nextSequence()
+	assertNoError(t, err, "nextSequence returned error")
+	assert.Equals(t, seq, uint64(8))
+}
+
+func TestParseUnusedSequenceKey(t *testing.T) {
+	first, last, err := parseUnusedSequenceKey(UnusedSequenceKeyPrefix + "5:7")
+	assertNoError(t, err, "Couldn't parse unused sequence key")
+	assert.Equals(t, first, uint64(5))
+	assert.Equals(t, last, uint64(7))
+
+	_, _, err = parseUnusedSequenceKey(UnusedSequenceKeyPrefix + "7:5")
+	assertTrue(t, err != nil, "Expected error for reversed range")
+	_, _, err = parseUnusedSequenceKey(UnusedSequenceKeyPrefix + "7")
+	assertTrue(t, err != nil, "Expected error for missing range end")
+}
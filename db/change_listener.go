@@ -3,6 +3,7 @@ package db
 import (
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"math"
 
@@ -24,6 +25,7 @@ type changeListener struct {
 	keyCounts             map[string]uint64      // Latest count at which each doc key was updated
 	DocChannel            chan sgbucket.TapEvent // Passthru channel for doc mutations
 	OnDocChanged          DocChangedFunc         // Called when change arrives on feed
+	feedActive            int32                  // Non-zero while the feed's event loop is running
 }
 
 type DocChangedFunc func(docID string, jsonData []byte, seq uint64, vbNo uint16)
@@ -50,8 +52,10 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool, notify
 	}
 
 	// Start a goroutine to broadcast to the tapNotifier whenever a channel or user/role changes:
+	atomic.StoreInt32(&listener.feedActive, 1)
 	go func() {
 		defer func() {
+			atomic.StoreInt32(&listener.feedActive, 0)
 			listener.notifyStopping()
 			if listener.DocChannel != nil {
 				close(listener.DocChannel)
@@ -66,6 +70,10 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool, notify
 						listener.OnDocChanged(key, event.Value, event.Sequence, event.VbNo)
 					}
 					listener.Notify(base.SetOf(key))
+				} else if strings.HasPrefix(key, UnusedSequenceKeyPrefix) {
+					if listener.OnDocChanged != nil && event.Opcode == sgbucket.TapMutation {
+						listener.OnDocChanged(key, event.Value, event.Sequence, event.VbNo)
+					}
 				} else if !strings.HasPrefix(key, KSyncKeyPrefix) && !strings.HasPrefix(key, base.KIndexPrefix) {
 					if listener.OnDocChanged != nil {
 						listener.OnDocChanged(key, event.Value, event.Sequence, event.VbNo)
@@ -93,6 +101,11 @@ func (listener changeListener) TapFeed() base.TapFeed {
 	return listener.tapFeed
 }
 
+// Returns true while the TAP/DCP feed is delivering events, false once it has closed or failed.
+func (listener *changeListener) IsFeedActive() bool {
+	return atomic.LoadInt32(&listener.feedActive) != 0
+}
+
 //////// NOTIFICATIONS:
 
 // Changes the counter, notifying waiting clients.
@@ -33,6 +33,19 @@ type ChangesOptions struct {
 	ActiveOnly  bool       // If true, only return information on non-deleted, non-removed revisions
 }
 
+// Slow consumer policies: what to do with a continuous feed client that has more than
+// SlowConsumerOptions.BufferSize entries waiting to be written to it
+const (
+	SlowConsumerDisconnect = "disconnect" // Close the connection, dropping what's waiting
+	SlowConsumerCatchUp    = "catchup"    // Stop reading changes until the client catches up, then resume
+)
+
+// Limits on the changes waiting to be written to each continuous or websocket feed client.
+type SlowConsumerOptions struct {
+	BufferSize int    // Max change entries waiting to be written to a client
+	Policy     string // SlowConsumerDisconnect or SlowConsumerCatchUp
+}
+
 // A changes entry; Database.GetChanges returns an array of these.
 // Marshals into the standard CouchDB _changes format.
 type ChangeEntry struct {
@@ -71,7 +84,7 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 	}
 	doc, err := db.GetDoc(entry.ID)
 	if err != nil {
-		base.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
+		db.logContext.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
 		return
 	}
 
@@ -99,7 +112,7 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 		var err error
 		entry.Doc, err = db.getRevFromDoc(doc, revID, false)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
+			db.logContext.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
 		}
 	}
 }
@@ -109,7 +122,7 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan *ChangeEntry, error) {
 	dbExpvars.Add("channelChangesFeeds", 1)
 	log, err := db.changeCache.GetChanges(channel, options)
-	base.LogTo("DIndex+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
+	db.logContext.LogTo("DIndex+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
 	if err != nil {
 		return nil, err
 	}
@@ -144,10 +157,10 @@ func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan
 
 			change := makeChangeEntry(logEntry, seqID, channel)
 
-			base.LogTo("Changes+", "Sending seq:%v from channel %s", seqID, channel)
+			db.logContext.LogTo("Changes+", "Sending seq:%v from channel %s", seqID, channel)
 			select {
 			case <-options.Terminator:
-				base.LogTo("Changes+", "Aborting changesFeed")
+				db.logContext.LogTo("Changes+", "Aborting changesFeed")
 				return
 			case feed <- &change:
 			}
@@ -189,13 +202,17 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 	}
 
 	if (options.Continuous || options.Wait) && options.Terminator == nil {
-		base.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
+		db.logContext.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
 	}
 	if db.SequenceType == IntSequenceType {
-		base.LogTo("Changes+", "Int sequence multi changes feed...")
+		if db.Options.ShareChangesFeeds && options.Wait && options.Limit == 0 && options.Terminator != nil {
+			db.logContext.LogTo("Changes+", "Shared multi changes feed...")
+			return db.sharedMultiChangesFeed(chans, options)
+		}
+		db.logContext.LogTo("Changes+", "Int sequence multi changes feed...")
 		return db.SimpleMultiChangesFeed(chans, options)
 	} else {
-		base.LogTo("Changes+", "Vector multi changes feed...")
+		db.logContext.LogTo("Changes+", "Vector multi changes feed...")
 		return db.VectorMultiChangesFeed(chans, options)
 	}
 }
@@ -233,19 +250,19 @@ func (db *Database) checkForUserUpdates(userChangeCount uint64, changeWaiter *ch
 	if newCount := changeWaiter.CurrentUserCount(); newCount > userChangeCount {
 		var previousChannels channels.TimedSet
 		var newChannels base.Set
-		base.LogTo("Changes+", "MultiChangesFeed reloading user %+v", db.user)
+		db.logContext.LogTo("Changes+", "MultiChangesFeed reloading user %+v", db.user)
 		userChangeCount = newCount
 
 		if db.user != nil {
 			previousChannels = db.user.InheritedChannels()
 			if err := db.ReloadUser(); err != nil {
-				base.Warn("Error reloading user %q: %v", db.user.Name(), err)
+				db.logContext.Warn("Error reloading user %q: %v", db.user.Name(), err)
 				return false, 0, nil, err
 			}
 			// check whether channels have changed
 			newChannels = db.user.GetAddedChannels(previousChannels)
 			if len(newChannels) > 0 {
-				base.LogTo("Changes+", "New channels found after user reload: %v", newChannels)
+				db.logContext.LogTo("Changes+", "New channels found after user reload: %v", newChannels)
 			}
 		}
 		return true, newCount, newChannels, nil
@@ -261,12 +278,12 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 		to = fmt.Sprintf("  (to %s)", db.user.Name())
 	}
 
-	base.LogTo("Changes", "MultiChangesFeed(%s, %+v) ... %s", chans, options, to)
+	db.logContext.LogTo("Changes", "MultiChangesFeed(%s, %+v) ... %s", chans, options, to)
 	output := make(chan *ChangeEntry, 50)
 
 	go func() {
 		defer func() {
-			base.LogTo("Changes", "MultiChangesFeed done %s", to)
+			db.logContext.LogTo("Changes", "MultiChangesFeed done %s", to)
 			close(output)
 		}()
 
@@ -324,7 +341,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			if changeWaiter != nil {
 				changeWaiter.UpdateChannels(channelsSince)
 			}
-			base.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince, to)
+			db.logContext.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince, to)
 
 			// lowSequence is used to send composite keys to clients, so that they can obtain any currently
 			// skipped sequences in a future iteration or request.
@@ -374,7 +391,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				}
 				feed, err := db.changesFeed(name, chanOpts)
 				if err != nil {
-					base.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
+					db.logContext.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
 					return
 				}
 				feeds = append(feeds, feed)
@@ -388,7 +405,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					if lateSequenceFeedHandler != nil {
 						latefeed, err := db.getLateFeed(lateSequenceFeedHandler)
 						if err != nil {
-							base.Warn("MultiChangesFeed got error reading late sequence feed %q: %v", name, err)
+							db.logContext.Warn("MultiChangesFeed got error reading late sequence feed %q: %v", name, err)
 						} else {
 							// Mark feed as actively used in this iteration.  Used to remove lateSequenceFeeds
 							// when the user loses channel access
@@ -483,7 +500,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				minEntry.Seq.LowSeq = lowSequence
 
 				// Send the entry, and repeat the loop:
-				base.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
+				db.logContext.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
 				select {
 				case <-options.Terminator:
 					return
@@ -506,7 +523,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 
 			// If nothing found, and in wait mode: wait for the db to change, then run again.
 			// First notify the reader that we're waiting by sending a nil.
-			base.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
+			db.logContext.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
 			output <- nil
 		waitForChanges:
 			for {
@@ -535,7 +552,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			userChanged, userCounter, addedChannels, err = db.checkForUserUpdates(userCounter, changeWaiter)
 			if err != nil {
 				change := makeErrorEntry("User not found during reload - terminating changes feed")
-				base.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
+				db.logContext.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
 				output <- &change
 				return
 			}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Description of an active changes feed, as reported by the admin API.
+type ChangesFeedInfo struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Channels    []string  `json:"channels"`
+	Since       string    `json:"since"`
+	FeedType    string    `json:"feed"`
+	StartTime   time.Time `json:"start_time"`
+	EntriesSent uint64    `json:"entries_sent"`
+	RemoteAddr  string    `json:"remote_addr"`
+	RequestID   string    `json:"request_id,omitempty"`
+}
+
+// An entry in a ChangesFeedRegistry.  Tracks the number of entries sent, and allows the feed to
+// be terminated (exactly once) by either its own handler or an administrator.
+type ChangesFeedRegistration struct {
+	info          ChangesFeedInfo // Immutable after registration, except for EntriesSent
+	entriesSent   uint64          // Updated atomically
+	terminator    chan bool
+	terminateOnce sync.Once
+}
+
+// Adds to the number of change entries sent to the client.  Safe to call on a nil receiver.
+func (reg *ChangesFeedRegistration) AddEntriesSent(count int) {
+	if reg != nil {
+		atomic.AddUint64(&reg.entriesSent, uint64(count))
+	}
+}
+
+// Closes the feed's terminator channel, if it hasn't been closed already.
+func (reg *ChangesFeedRegistration) Terminate() {
+	reg.terminateOnce.Do(func() {
+		close(reg.terminator)
+	})
+}
+
+func (reg *ChangesFeedRegistration) Info() ChangesFeedInfo {
+	info := reg.info
+	info.EntriesSent = atomic.LoadUint64(&reg.entriesSent)
+	return info
+}
+
+// Tracks the active longpoll, continuous and websocket changes feeds of a database.
+// The zero value is ready to use.
+type ChangesFeedRegistry struct {
+	lock   sync.RWMutex
+	feeds  map[string]*ChangesFeedRegistration
+	lastID uint64
+}
+
+// Registers a feed, assigning it an ID.  terminator must be the feed's ChangesOptions.Terminator;
+// once registered, it must be closed via the registration's Terminate method rather than directly.
+func (registry *ChangesFeedRegistry) Register(info ChangesFeedInfo, terminator chan bool) *ChangesFeedRegistration {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.feeds == nil {
+		registry.feeds = map[string]*ChangesFeedRegistration{}
+	}
+	registry.lastID++
+	info.ID = strconv.FormatUint(registry.lastID, 10)
+	reg := &ChangesFeedRegistration{info: info, terminator: terminator}
+	registry.feeds[info.ID] = reg
+	return reg
+}
+
+// Removes a feed from the registry.  Does not terminate it.
+func (registry *ChangesFeedRegistry) Unregister(reg *ChangesFeedRegistration) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	delete(registry.feeds, reg.info.ID)
+}
+
+// Returns descriptions of all registered feeds, oldest first.
+func (registry *ChangesFeedRegistry) List() []ChangesFeedInfo {
+	registry.lock.RLock()
+	feeds := make([]ChangesFeedInfo, 0, len(registry.feeds))
+	for _, reg := range registry.feeds {
+		feeds = append(feeds, reg.Info())
+	}
+	registry.lock.RUnlock()
+	sort.Sort(changesFeedInfoByStartTime(feeds))
+	return feeds
+}
+
+// Returns the number of registered feeds.
+func (registry *ChangesFeedRegistry) Count() int {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return len(registry.feeds)
+}
+
+// Terminates the feed with the given ID.  Returns false if there is no such feed.
+func (registry *ChangesFeedRegistry) Terminate(id string) bool {
+	registry.lock.RLock()
+	reg := registry.feeds[id]
+	registry.lock.RUnlock()
+	if reg == nil {
+		return false
+	}
+	reg.Terminate()
+	return true
+}
+
+// Terminates every registered feed.  Returns the number of feeds terminated.
+func (registry *ChangesFeedRegistry) TerminateAll() int {
+	registry.lock.RLock()
+	feeds := make([]*ChangesFeedRegistration, 0, len(registry.feeds))
+	for _, reg := range registry.feeds {
+		feeds = append(feeds, reg)
+	}
+	registry.lock.RUnlock()
+	for _, reg := range feeds {
+		reg.Terminate()
+	}
+	return len(feeds)
+}
+
+type changesFeedInfoByStartTime []ChangesFeedInfo
+
+func (feeds changesFeedInfoByStartTime) Len() int      { return len(feeds) }
+func (feeds changesFeedInfoByStartTime) Swap(i, j int) { feeds[i], feeds[j] = feeds[j], feeds[i] }
+func (feeds changesFeedInfoByStartTime) Less(i, j int) bool {
+	if feeds[i].StartTime.Equal(feeds[j].StartTime) {
+		return feeds[i].ID < feeds[j].ID
+	}
+	return feeds[i].StartTime.Before(feeds[j].StartTime)
+}
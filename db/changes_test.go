@@ -119,3 +119,85 @@ func _testChangesAfterChannelAdded(t *testing.T, db *Database) {
 	assertNoError(t, err, "Couldn't GetChanges")
 	printChanges(changes)
 }
+
+func TestSharedChangesFeed(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	db.Options.ShareChangesFeeds = true
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	db.changeCache.waitForSequence(2)
+
+	// Two feeds on the same channel, starting from different sequences, share one upstream feed
+	startFeed := func(since uint64) (<-chan *ChangeEntry, chan bool) {
+		feedDb := &Database{DatabaseContext: db.DatabaseContext}
+		options := ChangesOptions{Since: SequenceID{Seq: since}, Terminator: make(chan bool), Continuous: true, Wait: true}
+		feed, err := feedDb.MultiChangesFeed(base.SetOf("ABC"), options)
+		assertNoError(t, err, "MultiChangesFeed returned error")
+		return feed, options.Terminator
+	}
+	feed1, terminator1 := startFeed(0)
+	feed2, terminator2 := startFeed(1)
+	assert.Equals(t, db.sharedFeeds.count(), 1)
+
+	var changes1, changes2 []*ChangeEntry
+	assertNoError(t, appendFromFeed(&changes1, feed1, 2), "Missing catch-up changes")
+	assertNoError(t, appendFromFeed(&changes2, feed2, 1), "Missing catch-up changes")
+
+	WriteDirect(db, []string{"ABC"}, 3)
+	WriteDirect(db, []string{"NBC"}, 4)
+	WriteDirect(db, []string{"ABC"}, 5)
+	db.changeCache.waitForSequence(5)
+
+	assertNoError(t, appendFromFeed(&changes1, feed1, 2), "Missing shared changes")
+	assertNoError(t, appendFromFeed(&changes2, feed2, 2), "Missing shared changes")
+	assert.True(t, verifyChangesSequences(changes1, []uint64{1, 2, 3, 5}))
+	assert.True(t, verifyChangesSequences(changes2, []uint64{2, 3, 5}))
+
+	// The upstream feed stops when its last subscriber goes away
+	close(terminator1)
+	close(terminator2)
+	for i := 0; i < 20 && db.sharedFeeds.count() > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equals(t, db.sharedFeeds.count(), 0)
+}
+
+func TestSharedChangesFeedCompoundSince(t *testing.T) {
+	db := setupTestDBWithCacheOptions(t, shortWaitCache())
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	db.Options.ShareChangesFeeds = true
+
+	// Seq 3 is delayed, so a client that's seen 5 resumes from 2::5
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	WriteDirect(db, []string{"ABC"}, 4)
+	WriteDirect(db, []string{"ABC"}, 5)
+	db.changeCache.waitForSequenceID(SequenceID{Seq: 5})
+
+	options := ChangesOptions{Since: SequenceID{LowSeq: 2, Seq: 5}, Terminator: make(chan bool), Continuous: true, Wait: true}
+	defer close(options.Terminator)
+	feed, err := db.MultiChangesFeed(base.SetOf("ABC"), options)
+	assertNoError(t, err, "MultiChangesFeed returned error")
+	assert.Equals(t, db.sharedFeeds.count(), 1)
+
+	// The skipped sequence is sent when it arrives after the feed has subscribed
+	var changes []*ChangeEntry
+	appendFromFeed(&changes, feed, 10)
+	WriteDirect(db, []string{"ABC"}, 3)
+	db.changeCache.waitForSequenceWithMissing(3)
+	appendFromFeed(&changes, feed, 10)
+
+	sent := map[uint64]int{}
+	for _, change := range changes {
+		sent[change.Seq.Seq]++
+	}
+	assert.Equals(t, sent[3], 1)
+	assert.Equals(t, sent[1]+sent[2], 0)
+	for seq, count := range sent {
+		assert.True(t, count == 1 && seq > 2)
+	}
+}
@@ -46,19 +46,7 @@ func (dbc *DatabaseContext) getChangesInChannelFromView(
 		return nil, nil
 	}
 
-	// Convert the output to LogEntries:
-	entries := make(LogEntries, 0, len(vres.Rows))
-	for _, row := range vres.Rows {
-		entry := &LogEntry{
-			Sequence:     uint64(row.Key[1].(float64)),
-			DocID:        row.ID,
-			RevID:        row.Value.Rev,
-			Flags:        row.Value.Flags,
-			TimeReceived: time.Now(),
-		}
-		// base.LogTo("Cache", "  Got view sequence #%d (%q / %q)", entry.Sequence, entry.DocID, entry.RevID)
-		entries = append(entries, entry)
-	}
+	entries := vres.logEntries(false)
 
 	base.LogTo("Cache", "    Got %d rows from view for %q: #%d ... #%d",
 		len(entries), channelName, entries[0].Sequence, entries[len(entries)-1].Sequence)
@@ -70,6 +58,49 @@ func (dbc *DatabaseContext) getChangesInChannelFromView(
 	return entries, nil
 }
 
+// Queries the 'channels' view backwards from endSeq to get the most recent (up to limit) entries
+// of a single channel, in increasing-sequence order.
+func (dbc *DatabaseContext) getRecentChangesInChannelFromView(channelName string, endSeq uint64, limit int) (LogEntries, error) {
+	if dbc.Bucket == nil {
+		return nil, errors.New("No bucket available for channel view query")
+	}
+	optMap := Body{
+		"stale":      false,
+		"descending": true,
+		"startkey":   []interface{}{channelName, endSeq},
+		"endkey":     []interface{}{channelName, 0},
+		"limit":      limit,
+	}
+	base.LogTo("Cache", "  Querying 'channels' view for %q backwards from #%d (limit=%d)", channelName, endSeq, limit)
+	vres := channelsViewResult{}
+	if err := dbc.Bucket.ViewCustom(DesignDocSyncGateway, ViewChannels, optMap, &vres); err != nil {
+		base.Logf("Error from 'channels' view: %v", err)
+		return nil, err
+	}
+	changeCacheExpvars.Add("view_queries", 1)
+	return vres.logEntries(true), nil
+}
+
+// Converts the rows of a 'channels' view result to LogEntries, in increasing-sequence order.
+func (vres *channelsViewResult) logEntries(descending bool) LogEntries {
+	entries := make(LogEntries, len(vres.Rows))
+	for i, row := range vres.Rows {
+		entry := &LogEntry{
+			Sequence:     uint64(row.Key[1].(float64)),
+			DocID:        row.ID,
+			RevID:        row.Value.Rev,
+			Flags:        row.Value.Flags,
+			TimeReceived: time.Now(),
+		}
+		if descending {
+			entries[len(entries)-1-i] = entry
+		} else {
+			entries[i] = entry
+		}
+	}
+	return entries
+}
+
 func changesViewOptions(channelName string, endSeq uint64, options ChangesOptions) Body {
 	endKey := []interface{}{channelName, endSeq}
 	if endSeq == 0 {
@@ -29,10 +29,15 @@ type channelCache struct {
 	lateLogLock      sync.RWMutex         // Controls access to lateLogs
 	options          *ChannelCacheOptions // Cache size/expiry settings
 	cachedDocIDs     map[string]struct{}
+	budget           *channelCacheBudget // Database-wide limit this cache counts towards, if any
+	entryBytes       int64               // Estimated memory used by logs
+	lastQueried      int64               // Time of the last request for changes (UnixNano); accessed atomically
+	created          int64               // Time the cache was created (UnixNano)
 }
 
 func newChannelCache(context *DatabaseContext, channelName string, validFrom uint64) *channelCache {
 	cache := &channelCache{context: context, channelName: channelName, validFrom: validFrom}
+	cache.created = time.Now().UnixNano()
 	cache.initializeLateLogs()
 	cache.cachedDocIDs = make(map[string]struct{})
 	cache.options = &ChannelCacheOptions{
@@ -72,11 +77,16 @@ type ChannelCacheOptions struct {
 	ChannelCacheAge       time.Duration // Keep entries at least this long
 }
 
-// Low-level method to add a LogEntry to a single channel's cache.
+// Low-level method to add a LogEntry to a single channel's cache.  A late entry older than the
+// cache's validFrom is left out, since the view already has it.
 func (c *channelCache) addToCache(change *LogEntry, isRemoval bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if change.Sequence < c.validFrom {
+		base.LogTo("Cache+", "    #%d is older than channel %q's cache; not cached", change.Sequence, c.channelName)
+		return
+	}
 	if !isRemoval {
 		c._appendChange(change)
 	} else {
@@ -97,6 +107,7 @@ func (c *channelCache) _pruneCache() {
 		pruned = len(c.logs) - c.options.ChannelCacheMaxLength
 		for i := 0; i < pruned; i++ {
 			delete(c.cachedDocIDs, c.logs[i].DocID)
+			c._sizeChanged(-1, -estimatedEntrySize(c.logs[i]))
 		}
 		c.validFrom = c.logs[pruned-1].Sequence + 1
 		c.logs = c.logs[pruned:]
@@ -107,6 +118,7 @@ func (c *channelCache) _pruneCache() {
 	for len(c.logs) > c.options.ChannelCacheMinLength && time.Since(c.logs[0].TimeReceived) > c.options.ChannelCacheAge {
 		c.validFrom = c.logs[0].Sequence + 1
 		delete(c.cachedDocIDs, c.logs[0].DocID)
+		c._sizeChanged(-1, -estimatedEntrySize(c.logs[0]))
 		c.logs = c.logs[1:]
 		pruned++
 	}
@@ -124,6 +136,7 @@ func (c *channelCache) pruneCache() {
 // Returns all of the cached entries for sequences greater than 'since' in the given channel.
 // Entries are returned in increasing-sequence order.
 func (c *channelCache) getCachedChanges(options ChangesOptions) (validFrom uint64, result []*LogEntry) {
+	c.touch()
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c._getCachedChanges(options)
@@ -249,6 +262,7 @@ func (c *channelCache) _appendChange(change *LogEntry) {
 		if _, found := c.cachedDocIDs[change.DocID]; found {
 			for i := end; i >= 0; i-- {
 				if log[i].DocID == change.DocID {
+					c._sizeChanged(0, estimatedEntrySize(change)-estimatedEntrySize(log[i]))
 					copy(log[i:], log[i+1:])
 					log[end] = change
 					return
@@ -261,6 +275,7 @@ func (c *channelCache) _appendChange(change *LogEntry) {
 	}
 	c.logs = append(log, change)
 	c.cachedDocIDs[change.DocID] = struct{}{}
+	c._sizeChanged(1, estimatedEntrySize(change))
 }
 
 // Insert out-of-sequence entry into the cache.  If the docId is already present in a later
@@ -295,10 +310,12 @@ func (c *channelCache) insertChange(log *LogEntries, change *LogEntry) {
 					if i == insertAtIndex-1 {
 						// The sequence is adjacent to another with the same docId - replace it
 						// instead of inserting
+						c._sizeChanged(0, estimatedEntrySize(change)-estimatedEntrySize(currLog))
 						(*log)[i] = change
 						return
 					} else {
 						// Shift and insert to remove the old entry and add the new one
+						c._sizeChanged(0, estimatedEntrySize(change)-estimatedEntrySize(currLog))
 						copy((*log)[i:insertAtIndex-1], (*log)[i+1:insertAtIndex])
 						(*log)[insertAtIndex-1] = change
 						return
@@ -312,6 +329,7 @@ func (c *channelCache) insertChange(log *LogEntries, change *LogEntry) {
 	*log = append(*log, nil)
 	copy((*log)[insertAtIndex+1:], (*log)[insertAtIndex:])
 	(*log)[insertAtIndex] = change
+	c._sizeChanged(1, estimatedEntrySize(change))
 
 	return
 }
@@ -338,6 +356,9 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 			}
 			c.logs = make(LogEntries, len(changes))
 			copy(c.logs, changes)
+			for _, change := range changes {
+				c._sizeChanged(1, estimatedEntrySize(change))
+			}
 			base.LogTo("Cache", "  Initialized cache of %q with %d entries from view (#%d--#%d)",
 				c.channelName, len(changes), changes[0].Sequence, changes[len(changes)-1].Sequence)
 		}
@@ -367,6 +388,9 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 						newLog = append(newLog, changes[0:i]...)
 						newLog = append(newLog, log...)
 						c.logs = newLog
+						for _, change := range changes[0:i] {
+							c._sizeChanged(1, estimatedEntrySize(change))
+						}
 						base.LogTo("Cache", "  Added %d entries from view (#%d--#%d) to cache of %q",
 							i, changes[0].Sequence, changes[i-1].Sequence, c.channelName)
 					}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Rough per-entry memory overhead of a cached LogEntry: the struct itself, its slot in the
+// channel's log and its key in cachedDocIDs.  The variable-length doc and rev IDs are added on top.
+const kLogEntryOverheadBytes = 200
+
+// When the budget is exceeded, least-recently-queried channels are evicted until usage drops to
+// this fraction of the limit, so that eviction isn't triggered again by the very next change.
+const kChannelCacheBudgetLowWater = 0.9
+
+// A database-wide limit on the number of entries and/or estimated bytes held by all of a change
+// cache's channel caches.  Counters are updated atomically by the channel caches.
+type channelCacheBudget struct {
+	entries    int64 // Total entries currently cached
+	bytes      int64 // Total estimated bytes currently cached
+	maxEntries int64 // Max total entries; 0 for no limit
+	maxBytes   int64 // Max total bytes; 0 for no limit
+}
+
+// Estimated memory used by a cached LogEntry.
+func estimatedEntrySize(entry *LogEntry) int64 {
+	return kLogEntryOverheadBytes + 2*int64(len(entry.DocID)) + int64(len(entry.RevID))
+}
+
+func (b *channelCacheBudget) add(entries int, bytes int64) {
+	atomic.AddInt64(&b.entries, int64(entries))
+	atomic.AddInt64(&b.bytes, bytes)
+}
+
+func (b *channelCacheBudget) enabled() bool {
+	return b.maxEntries > 0 || b.maxBytes > 0
+}
+
+// Returns true if usage is over the given fraction of either limit.
+func (b *channelCacheBudget) over(fraction float64) bool {
+	return (b.maxEntries > 0 && float64(atomic.LoadInt64(&b.entries)) > fraction*float64(b.maxEntries)) ||
+		(b.maxBytes > 0 && float64(atomic.LoadInt64(&b.bytes)) > fraction*float64(b.maxBytes))
+}
+
+func (b *channelCacheBudget) reset() {
+	atomic.StoreInt64(&b.entries, 0)
+	atomic.StoreInt64(&b.bytes, 0)
+}
+
+type evictionCandidate struct {
+	name     string
+	lastUsed int64
+}
+
+// Sorts channels from least to most recently used
+type evictionCandidates []evictionCandidate
+
+func (c evictionCandidates) Len() int           { return len(c) }
+func (c evictionCandidates) Less(i, j int) bool { return c[i].lastUsed < c[j].lastUsed }
+func (c evictionCandidates) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Evicts least-recently-queried channel caches until the total is back under the budget's
+// low-water mark.  Evicted channels are reloaded from the view the next time they're queried.
+// Caller MUST be holding the write lock.
+func (c *changeCache) _enforceCacheBudget() {
+	if !c.cacheBudget.enabled() || !c.cacheBudget.over(1.0) {
+		return
+	}
+
+	candidates := make(evictionCandidates, 0, len(c.channelCaches))
+	for name, cache := range c.channelCaches {
+		candidates = append(candidates, evictionCandidate{name, cache.lastUsed()})
+	}
+	sort.Sort(candidates)
+
+	evicted, evictedEntries := 0, 0
+	for _, candidate := range candidates {
+		if !c.cacheBudget.over(kChannelCacheBudgetLowWater) {
+			break
+		}
+		evictedEntries += c._removeChannelCache(candidate.name)
+		evicted++
+	}
+	if evicted > 0 {
+		// Caches created from now on can't assume they've seen every change since startup
+		c.newChannelValidFrom = c.nextSequence
+		changeCacheExpvars.Add("channel_cache_evictions", int64(evicted))
+		changeCacheExpvars.Add("channel_cache_evicted_entries", int64(evictedEntries))
+		base.LogTo("Cache", "Evicted %d channel caches (%d entries) to stay within cache budget: %d entries, %d bytes now cached",
+			evicted, evictedEntries, atomic.LoadInt64(&c.cacheBudget.entries), atomic.LoadInt64(&c.cacheBudget.bytes))
+	}
+}
+
+// Removes a channel cache, releasing its entries from the budget.  Returns the number of entries
+// it held.  Caller MUST be holding the write lock.
+func (c *changeCache) _removeChannelCache(channelName string) int {
+	cache := c.channelCaches[channelName]
+	if cache == nil {
+		return 0
+	}
+	delete(c.channelCaches, channelName)
+	return cache.detachFromBudget()
+}
+
+// Stops a channel cache from counting towards its budget, returning the number of entries it held.
+func (c *channelCache) detachFromBudget() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := len(c.logs)
+	if c.budget != nil {
+		c.budget.add(-entries, -c.entryBytes)
+		c.budget = nil
+	}
+	return entries
+}
+
+// Records a change in the size of the cached logs.  Caller MUST be holding the lock.
+func (c *channelCache) _sizeChanged(entries int, bytes int64) {
+	c.entryBytes += bytes
+	if c.budget != nil {
+		c.budget.add(entries, bytes)
+	}
+}
+
+// Records that the channel's changes were just requested.
+func (c *channelCache) touch() {
+	atomic.StoreInt64(&c.lastQueried, time.Now().UnixNano())
+}
+
+// Returns when the channel's changes were last requested, or if they never were, when the cache
+// was created (UnixNano).
+func (c *channelCache) lastUsed() int64 {
+	if lastQueried := atomic.LoadInt64(&c.lastQueried); lastQueried > 0 {
+		return lastQueried
+	}
+	return c.created
+}
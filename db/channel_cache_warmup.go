@@ -0,0 +1,224 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Key of the doc listing the most recently queried channels on any node, used to warm up the cache
+// on startup
+const kCacheWarmupDocKey = KSyncKeyPrefix + "cacheWarmup"
+
+// How often the most recently queried channels are saved to the bucket
+var DefaultCacheWarmupSaveInterval = 5 * time.Minute
+
+// Channel cache warm-up settings.
+type CacheWarmupOptions struct {
+	WarmupChannels    []string // Channels to preload into the cache on startup
+	WarmupTopChannels int      // Also preload this many of the most recently queried channels, saved across restarts
+	WarmupWait        bool     // Whether the database is reported as not ready until warm-up completes
+}
+
+// Body of the doc saved at kCacheWarmupDocKey.  Each node merges its own recently queried
+// channels into it, so it isn't just the list of whichever node saved last.
+type cacheWarmupDoc struct {
+	Channels map[string]int64 `json:"channels"` // When each channel was last queried (UnixNano)
+}
+
+// Returns the channel names, most recently queried first.
+func (doc *cacheWarmupDoc) channelNames() []string {
+	candidates := make(evictionCandidates, 0, len(doc.Channels))
+	for name, lastQueried := range doc.Channels {
+		candidates = append(candidates, evictionCandidate{name, lastQueried})
+	}
+	sort.Sort(sort.Reverse(candidates))
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.name
+	}
+	return names
+}
+
+// Preloads the configured channels, plus the most recently queried channels saved by the last
+// run, into the cache.  Then periodically saves the most recently queried channels until the
+// cache is stopped.  Runs in its own goroutine.
+func (c *changeCache) runWarmup() {
+	channelNames := c.warmupChannelNames()
+	if len(channelNames) > 0 {
+		start := time.Now()
+		base.LogTo("Cache", "Warming up cache for %d channels", len(channelNames))
+		warmedEntries := 0
+		for _, channelName := range channelNames {
+			if c.IsStopped() {
+				break
+			}
+			if c.cacheBudget.enabled() && c.cacheBudget.over(kChannelCacheBudgetLowWater) {
+				base.LogTo("Cache", "Stopping cache warm-up: the cache budget is used up")
+				break
+			}
+			entries, err := c.getChannelCache(channelName).warmUp()
+			if err != nil {
+				base.Warn("Unable to warm up cache for channel %q: %v", channelName, err)
+				continue
+			}
+			// The warmed entries count towards the budget like any others
+			c.lock.Lock()
+			c._enforceCacheBudget()
+			c.lock.Unlock()
+			warmedEntries += entries
+			changeCacheExpvars.Add("warmup_channels", 1)
+			changeCacheExpvars.Add("warmup_entries", int64(entries))
+		}
+		base.Logf("Cache warm-up loaded %d entries for %d channels in %v", warmedEntries, len(channelNames), time.Since(start))
+	}
+	atomic.StoreInt32(&c.warmingUp, 0)
+
+	if c.options.WarmupTopChannels <= 0 {
+		return
+	}
+	for {
+		time.Sleep(DefaultCacheWarmupSaveInterval)
+		if c.IsStopped() {
+			return
+		}
+		c.saveWarmupChannels()
+	}
+}
+
+// Returns true while the cache is being warmed up on startup.
+func (c *changeCache) isWarmingUp() bool {
+	return atomic.LoadInt32(&c.warmingUp) != 0
+}
+
+// Returns the configured warm-up channels followed by the saved recently-queried ones, without
+// duplicates.
+func (c *changeCache) warmupChannelNames() []string {
+	channelNames := make([]string, 0, len(c.options.WarmupChannels)+c.options.WarmupTopChannels)
+	seen := make(map[string]bool)
+	add := func(names []string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				channelNames = append(channelNames, name)
+			}
+		}
+	}
+	add(c.options.WarmupChannels)
+
+	if c.options.WarmupTopChannels > 0 {
+		var doc cacheWarmupDoc
+		if _, err := c.context.Bucket.Get(kCacheWarmupDocKey, &doc); err != nil {
+			if !base.IsDocNotFoundError(err) {
+				base.Warn("Unable to read recently queried channels for cache warm-up: %v", err)
+			}
+		} else {
+			names := doc.channelNames()
+			if len(names) > c.options.WarmupTopChannels {
+				names = names[:c.options.WarmupTopChannels]
+			}
+			add(names)
+		}
+	}
+	return channelNames
+}
+
+// Merges this node's recently queried channels into the saved ones, keeping the most recent.
+func (c *changeCache) saveWarmupChannels() {
+	queried := make(map[string]int64)
+	c.lock.RLock()
+	for name, cache := range c.channelCaches {
+		if lastQueried := atomic.LoadInt64(&cache.lastQueried); lastQueried > 0 {
+			queried[name] = lastQueried
+		}
+	}
+	c.lock.RUnlock()
+	if len(queried) == 0 {
+		return
+	}
+
+	err := c.context.Bucket.Update(kCacheWarmupDocKey, 0, func(currentValue []byte) ([]byte, error) {
+		var doc cacheWarmupDoc
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &doc); err != nil {
+				base.Warn("Replacing invalid cache warm-up doc: %v", err)
+			}
+		}
+		if doc.Channels == nil {
+			doc.Channels = make(map[string]int64, len(queried))
+		}
+		for name, lastQueried := range queried {
+			if lastQueried > doc.Channels[name] {
+				doc.Channels[name] = lastQueried
+			}
+		}
+		if names := doc.channelNames(); len(names) > c.options.WarmupTopChannels {
+			for _, name := range names[c.options.WarmupTopChannels:] {
+				delete(doc.Channels, name)
+			}
+		}
+		return json.Marshal(doc)
+	})
+	if err != nil {
+		base.Warn("Unable to save recently queried channels for cache warm-up: %v", err)
+	}
+}
+
+// Fills an empty channel cache with the channel's most recent changes from the view, so the
+// first requests for the channel don't have to query it.  Returns the number of entries added.
+func (c *channelCache) warmUp() (int, error) {
+	c.viewLock.Lock()
+	defer c.viewLock.Unlock()
+
+	c.lock.RLock()
+	validFrom := c.validFrom
+	c.lock.RUnlock()
+	if validFrom <= 1 {
+		return 0, nil // Nothing older than the cache to load
+	}
+
+	// Query backwards from just before the cache's first valid sequence, so the results join up
+	// with whatever the cache has received from the feed in the meantime.
+	limit := c.options.ChannelCacheMaxLength
+	entries, err := c.context.getRecentChangesInChannelFromView(c.channelName, validFrom-1, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.validFrom != validFrom {
+		return 0, nil // Cache was pruned or backfilled while the view was queried
+	}
+	room := c.options.ChannelCacheMaxLength - len(c.logs)
+	if room <= 0 {
+		return 0, nil
+	}
+
+	// If the view returned fewer rows than requested, it holds the channel's entire history
+	changesValidFrom := uint64(1)
+	if len(entries) >= limit || len(entries) > room {
+		if len(entries) > room {
+			entries = entries[len(entries)-room:]
+		}
+		changesValidFrom = entries[0].Sequence
+	}
+
+	// Docs that have changed since are already cached with their newer sequence
+	warmed := make(LogEntries, 0, len(entries)+len(c.logs))
+	for _, entry := range entries {
+		if _, found := c.cachedDocIDs[entry.DocID]; !found {
+			warmed = append(warmed, entry)
+			c._sizeChanged(1, estimatedEntrySize(entry))
+		}
+	}
+	added := len(warmed)
+	c.addDocIDs(warmed)
+	c.logs = append(warmed, c.logs...)
+	c.validFrom = changesValidFrom
+	base.LogTo("Cache", "  Warmed up cache of %q with %d entries from view", c.channelName, added)
+	return added, nil
+}
@@ -14,6 +14,7 @@ import (
 	"math"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/go-couchbase"
@@ -56,6 +57,12 @@ func (db *DatabaseContext) GetDoc(docid string) (*document, error) {
 	return doc, nil
 }
 
+// Reads a document from the bucket, timing the read into the request's timings.
+func (db *Database) GetDoc(docid string) (*document, error) {
+	defer db.timings.Track(base.PhaseBucketRead, time.Now())
+	return db.DatabaseContext.GetDoc(docid)
+}
+
 // This is the RevisionCacheLoaderFunc callback for the context's RevisionCache.
 // Its job is to load a revision from the bucket when there's a cache miss.
 func (context *DatabaseContext) revCacheLoader(id IDAndRev) (body Body, history Body, channels base.Set, err error) {
@@ -107,7 +114,9 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 	if revIDGiven {
 		// Get a specific revision body and history from the revision cache
 		// (which will load them if necessary, by calling revCacheLoader, above)
+		revStart := time.Now()
 		body, revisions, inChannels, err = db.revisionCache.Get(docid, revid)
+		db.timings.Track(base.PhaseBucketRead, revStart)
 		if body == nil {
 			if err == nil {
 				err = base.HTTPErrorf(404, "missing")
@@ -380,7 +389,7 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	// Store the JSON as a separate doc in the bucket:
 	if err := db.setOldRevisionJSON(doc.ID, revid, json); err != nil {
 		// This isn't fatal since we haven't lost any information; just warn about it.
-		base.Warn("backupAncestorRevs failed: doc=%q rev=%q err=%v", doc.ID, revid, err)
+		db.logContext.Warn("backupAncestorRevs failed: doc=%q rev=%q err=%v", doc.ID, revid, err)
 		return err
 	}
 
@@ -390,7 +399,7 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	} else {
 		doc.History.setRevisionBody(revid, nil)
 	}
-	base.LogTo("CRUD+", "Backed up obsolete rev %q/%q", doc.ID, revid)
+	db.logContext.LogTo("CRUD+", "Backed up obsolete rev %q/%q", doc.ID, revid)
 	return nil
 }
 
@@ -489,7 +498,7 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 			}
 		}
 		if currentRevIndex == 0 {
-			base.LogTo("CRUD+", "PutExistingRev(%q): No new revisions to add", docid)
+			db.logContext.LogTo("CRUD+", "PutExistingRev(%q): No new revisions to add", docid)
 			return nil, nil, couchbase.UpdateCancel // No new revisions to add
 		}
 
@@ -521,6 +530,8 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 	if key == "" {
 		return "", base.HTTPErrorf(400, "Invalid doc ID")
 	}
+	atomic.AddInt64(&db.activeWrites, 1)
+	defer atomic.AddInt64(&db.activeWrites, -1)
 
 	var newRevID, parentRevID string
 	var doc *document
@@ -531,9 +542,27 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 	var unusedSequences []uint64
 	var oldBodyJSON string
 	var newAttachments AttachmentData
+	var rejection error // Set if the sync function rejected the new revision
+	attempts := 0
+	var firstAttemptStart, attemptStart, lastAttemptEnd time.Time
+	var recordedAtAttemptStart time.Duration
 
+	writeStart := time.Now()
 	err := db.Bucket.WriteUpdate(key, int(expiry), func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
 		// Be careful: this block can be invoked multiple times if there are races!
+		rejection = nil
+		now := time.Now()
+		if attempts++; attempts > 1 {
+			db.logContext.LogTo("CRUD+", "CAS mismatch updating doc %q; retrying (attempt %d)", docid, attempts)
+			// The abandoned attempt's time, including its failed write, less the time of the phases
+			// it contained, which were already recorded:
+			db.timings.Add(base.PhaseCASRetry, now.Sub(attemptStart)-(db.timings.Total()-recordedAtAttemptStart))
+		} else {
+			firstAttemptStart = now
+		}
+		attemptStart = now
+		recordedAtAttemptStart = db.timings.Total()
+		defer func() { lastAttemptEnd = time.Now() }()
 		if doc, err = unmarshalDocument(docid, currentValue); err != nil {
 			return
 		} else if !allowImport && currentValue != nil && !doc.HasValidSyncData(db.writeSequences()) {
@@ -600,6 +629,9 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 		//Assign old revision body to variable in method scope
 		oldBodyJSON = oldBody
 		if err != nil {
+			if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusForbidden {
+				rejection = err
+			}
 			return
 		}
 
@@ -620,7 +652,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 					// we previously allocated is unusable now. We have to allocate a new sequence
 					// instead, but we add the unused one(s) to the document so when the changeCache
 					// reads the doc it won't freak out over the break in the sequence numbering.
-					base.LogTo("Cache", "updateDoc %q: Unused sequence #%d", docid, docSequence)
+					db.logContext.LogTo("Cache", "updateDoc %q: Unused sequence #%d", docid, docSequence)
 					unusedSequences = append(unusedSequences, docSequence)
 				}
 				if docSequence, err = db.sequences.nextSequence(); err != nil {
@@ -675,7 +707,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 				// channels & access, for purposes of updating the doc:
 				var curBody Body
 				if curBody, err = db.getAvailableRev(doc, doc.CurrentRev); curBody != nil {
-					base.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
+					db.logContext.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
 						docid, newRevID, doc.CurrentRev)
 					channelSet, access, roles, oldBody, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
 
@@ -686,7 +718,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 					}
 				} else {
 					// Shouldn't be possible (CurrentRev is a leaf so won't have been compacted)
-					base.Warn("updateDoc(%q): Rev %q missing, can't call getChannelsAndAccess "+
+					db.logContext.Warn("updateDoc(%q): Rev %q missing, can't call getChannelsAndAccess "+
 						"on it (err=%v)", docid, doc.CurrentRev, err)
 					channelSet = nil
 					access = nil
@@ -703,7 +735,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
 				if cbb, ok := db.Bucket.(base.CouchbaseBucket); ok { //Backing store is Couchbase Server
 					if major, _, _, err := cbb.CBSVersion(); err == nil && major >= 3 {
-						base.LogTo("CRUD+", "Optimizing write for Couchbase Server >= 3.0")
+						db.logContext.LogTo("CRUD+", "Optimizing write for Couchbase Server >= 3.0")
 					} else {
 						// make sure the write blocks till
 						// the new value is indexable, otherwise when a User/Role updates (using a view) it
@@ -719,13 +751,13 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 			}
 
 		} else {
-			base.LogTo("CRUD+", "updateDoc(%q): Rev %q leaves %q still current",
+			db.logContext.LogTo("CRUD+", "updateDoc(%q): Rev %q leaves %q still current",
 				docid, newRevID, prevCurrentRev)
 		}
 
 		// Prune old revision history to limit the number of revisions:
 		if pruned := doc.History.pruneRevisions(db.RevsLimit, doc.CurrentRev); pruned > 0 {
-			base.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
+			db.logContext.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
 		}
 
 		doc.TimeSaved = time.Now()
@@ -736,17 +768,25 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 
 		// Return the new raw document value for the bucket to store.
 		raw, err = json.Marshal(doc)
-		base.LogTo("Cache", "SAVING #%d", doc.Sequence) //TEMP?
+		db.logContext.LogTo("Cache", "SAVING #%d", doc.Sequence) //TEMP?
 		return
 	})
+	// The bucket's own time is the read before the first attempt and the write after the last one.
+	// The time in between is accounted for by cas_retry and the phases the last attempt contains.
+	if attempts > 0 {
+		db.timings.Add(base.PhaseBucketWrite, time.Since(writeStart)-lastAttemptEnd.Sub(firstAttemptStart))
+	}
 
 	if err == couchbase.UpdateCancel {
 		return "", nil
 	} else if err == couchbase.ErrOverwritten {
 		// ErrOverwritten is ok; if a later revision got persisted, that's fine too
-		base.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
+		db.logContext.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
 			docid, newRevID)
 	} else if err != nil {
+		if rejection != nil {
+			db.documentRejected(docid, newRevID, body, rejection)
+		}
 		return "", err
 	}
 
@@ -765,27 +805,28 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 		// Raise event if this is not an echo from a shadow bucket
 		if newRevID != doc.UpstreamRev {
 			if db.EventMgr.HasHandlerForEvent(DocumentChange) {
-				db.EventMgr.RaiseDocumentChangeEvent(body, oldBodyJSON, revChannels)
+				db.EventMgr.RaiseDocumentChangeEvent(body, oldBodyJSON, revChannels, db.logContext)
 			}
 		}
 	} else {
 		//Revision has been pruned away so won't be added to cache
-		base.LogTo("CRUD", "doc %q / %q, has been pruned, it has not been inserted into the revision cache", docid, newRevID)
+		db.logContext.LogTo("CRUD", "doc %q / %q, has been pruned, it has not been inserted into the revision cache", docid, newRevID)
 	}
 
 	// Now that the document has successfully been stored, we can make other db changes:
-	base.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
+	db.logContext.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
 
 	// Mark affected users/roles as needing to recompute their channel access:
 	if len(changedPrincipals) > 0 {
-		base.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
+		db.logContext.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
 		for _, name := range changedPrincipals {
 			db.invalUserOrRoleChannels(name)
+			db.raiseAccessChangedEvent(name, "channels", docid, newRevID)
 			//If this is the current in memory db.user, reload to generate updated channels
 			if db.user != nil && db.user.Name() == name {
 				user, err := db.Authenticator().GetUser(db.user.Name())
 				if err != nil {
-					base.Warn("Error reloading db.user[%s], channels list is out of date --> %+v", db.user.Name(), err)
+					db.logContext.Warn("Error reloading db.user[%s], channels list is out of date --> %+v", db.user.Name(), err)
 				} else {
 					db.user = user
 				}
@@ -794,14 +835,15 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 	}
 
 	if len(changedRoleUsers) > 0 {
-		base.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
+		db.logContext.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
 		for _, name := range changedRoleUsers {
 			db.invalUserRoles(name)
+			db.raiseAccessChangedEvent(name, "roles", docid, newRevID)
 			//If this is the current in memory db.user, reload to generate updated roles
 			if db.user != nil && db.user.Name() == name {
 				user, err := db.Authenticator().GetUser(db.user.Name())
 				if err != nil {
-					base.Warn("Error reloading db.user[%s], roles list is out of date --> %+v", db.user.Name(), err)
+					db.logContext.Warn("Error reloading db.user[%s], roles list is out of date --> %+v", db.user.Name(), err)
 				} else {
 					db.user = user
 				}
@@ -812,6 +854,17 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 	return newRevID, nil
 }
 
+// Raises a PrincipalChangeEvent for a user or role (with a "role:" prefix) whose channel or role
+// grants were changed by a document revision.
+func (db *Database) raiseAccessChangedEvent(name string, grants string, docid string, revid string) {
+	isUser := !strings.HasPrefix(name, "role:")
+	if !isUser {
+		name = name[5:]
+	}
+	details := Body{"grants": grants, "doc_id": docid, "rev": revid}
+	db.EventMgr.RaisePrincipalChangeEvent(name, isUser, PrincipalAccessChanged, details, db.logContext)
+}
+
 // Creates a new document, assigning it a random doc ID.
 func (db *Database) Post(body Body) (string, string, error) {
 	if body["_rev"] != nil {
@@ -842,7 +895,7 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 // Calls the JS sync function to assign the doc to channels, grant users
 // access to channels, and reject invalid documents.
 func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string) (result base.Set, access channels.AccessMap, roles channels.AccessMap, oldJson string, err error) {
-	base.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
+	db.logContext.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
 
 	// Get the parent revision, to pass to the sync function:
 	var oldJsonBytes []byte
@@ -854,21 +907,23 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 	if db.ChannelMapper != nil {
 		// Call the ChannelMapper:
 		var output *channels.ChannelMapperOutput
+		syncStart := time.Now()
 		output, err = db.ChannelMapper.MapToChannelsAndAccess(body, oldJson,
 			makeUserCtx(db.user))
+		db.timings.Track(base.PhaseSyncFn, syncStart)
 		if err == nil {
 			result = output.Channels
 			access = output.Access
 			roles = output.Roles
 			err = output.Rejection
 			if err != nil {
-				base.Logf("Sync fn rejected: new=%+v  old=%s --> %s", body, oldJson, err)
+				db.logContext.Logf("Sync fn rejected: new=%+v  old=%s --> %s", body, oldJson, err)
 			} else if !validateAccessMap(access) || !validateRoleAccessMap(roles) {
 				err = base.HTTPErrorf(500, "Error in JS sync function")
 			}
 
 		} else {
-			base.Warn("Sync fn exception: %+v; doc = %s", err, body)
+			db.logContext.Warn("Sync fn exception: %+v; doc = %s", err, body)
 			err = base.HTTPErrorf(500, "Exception in JS sync function")
 		}
 
@@ -883,6 +938,17 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 	return
 }
 
+// Records a document update that failed because the sync function rejected it, and raises a
+// DocumentRejectedEvent.  Called once per failed update, however many times the sync function ran.
+func (db *Database) documentRejected(docid string, revid string, body Body, rejection error) {
+	rejectedDocsExpvars.Add(db.Name, 1)
+	userName := ""
+	if db.user != nil {
+		userName = db.user.Name()
+	}
+	db.EventMgr.RaiseDocumentRejectedEvent(docid, revid, userName, body, rejection, db.logContext)
+}
+
 // Creates a userCtx object to be passed to the sync function
 func makeUserCtx(user auth.User) map[string]interface{} {
 	if user == nil {
@@ -1022,7 +1088,7 @@ func (db *Database) RevDiff(docid string, revids []string) (missing, possible []
 	doc, err := db.GetDoc(docid)
 	if err != nil {
 		if !base.IsDocNotFoundError(err) {
-			base.Warn("RevDiff(%q) --> %T %v", docid, err, err)
+			db.logContext.Warn("RevDiff(%q) --> %T %v", docid, err, err)
 			// If something goes wrong getting the doc, treat it as though it's nonexistent.
 		}
 		missing = revids
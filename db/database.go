@@ -58,12 +58,15 @@ type DatabaseContext struct {
 	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function
 	StartTime          time.Time               // Timestamp when context was instantiated
 	ChangesClientStats Statistics              // Tracks stats of # of changes connections
+	ChangesFeeds       ChangesFeedRegistry     // Active longpoll, continuous & websocket changes feeds
+	sharedFeeds        sharedFeedRegistry      // Changes feeds shared by feeds with the same channels
 	RevsLimit          uint32                  // Max depth a document's revision tree can grow to
 	autoImport         bool                    // Add sync data to new untracked docs?
 	Shadower           *Shadower               // Tracks an external Couchbase bucket
 	revisionCache      *RevisionCache          // Cache of recently-accessed doc revisions
 	changeCache        ChangeIndex             //
 	EventMgr           *EventManager           // Manages notification events
+	DeadLetters        *DeadLetterStore        // Webhook events that couldn't be delivered
 	AllowEmptyPassword bool                    // Allow empty passwords?  Defaults to false
 	SequenceHasher     *sequenceHasher         // Used to generate and resolve hash values for vector clock sequences
 	SequenceType       SequenceType            // Type of sequences used for this DB (integer or vector clock)
@@ -72,6 +75,9 @@ type DatabaseContext struct {
 	State              uint32                  // The runtime state of the DB from a service perspective
 	ExitChanges        chan struct{}           // Active _changes feeds on the DB will close when this channel is closed
 	OIDCProviders      auth.OIDCProviderMap    // OIDC clients
+	activeWrites       int64                   // Number of updateDoc calls in progress; accessed atomically
+	durableEvents      []*DurableEventFeed     // Event handlers fed from the changes feed
+	durableEventsLock  sync.Mutex              // Guards durableEvents
 }
 
 type DatabaseContextOptions struct {
@@ -79,10 +85,17 @@ type DatabaseContextOptions struct {
 	IndexOptions          *ChangeIndexOptions
 	SequenceHashOptions   *SequenceHashOptions
 	RevisionCacheCapacity uint32
+	RevisionCacheShards   uint16
+	RevisionCacheMaxBytes int64
+	MaxSequenceBatchSize  uint64 // Max sequences a node reserves at once; 0 or 1 disables batching
+	ShareChangesFeeds     bool   // Whether continuous/longpoll feeds with the same channels share one upstream feed
 	AdminInterface        *string
+	NodeID                string // Identifies this node's own docs in the bucket, e.g. its durable event checkpoints
 	UnsupportedOptions    *UnsupportedOptions
 	TrackDocs             bool // Whether doc tracking channel should be created (used for autoImport, shadowing)
 	OIDCOptions           *auth.OIDCOptions
+	ReadinessOptions      *ReadinessOptions
+	SlowConsumerOptions   *SlowConsumerOptions // If non-nil, limits the changes waiting to be written to a continuous feed client
 }
 
 type OidcTestProviderOptions struct {
@@ -101,7 +114,9 @@ const DefaultRevsLimit = 1000
 // so this struct does not have to be thread-safe.
 type Database struct {
 	*DatabaseContext
-	user auth.User
+	user       auth.User
+	logContext *base.LogContext     // Identifies the request this Database is being used for, if any
+	timings    *base.RequestTimings // Accumulates per-phase timing of the request, if enabled
 }
 
 // All special/internal documents the gateway creates have this prefix in their keys.
@@ -109,6 +124,9 @@ const KSyncKeyPrefix = "_sync:"
 
 var dbExpvars = expvar.NewMap("syncGateway_db")
 
+// Number of document updates rejected by the sync function, by database name
+var rejectedDocsExpvars = expvar.NewMap("syncGateway_documentRejections")
+
 func ValidateDatabaseName(dbName string) error {
 	// http://wiki.apache.org/couchdb/HTTP_database_API#Naming_and_Addressing
 	if match, _ := regexp.MatchString(`^[a-z][-a-z0-9_$()+/]*$`, dbName); !match {
@@ -158,15 +176,22 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		autoImport: autoImport,
 		Options:    options,
 	}
-	context.revisionCache = NewRevisionCache(int(options.RevisionCacheCapacity), context.revCacheLoader)
+	context.revisionCache = NewShardedRevisionCache(RevisionCacheOptions{
+		Capacity:   int(options.RevisionCacheCapacity),
+		ShardCount: int(options.RevisionCacheShards),
+		MaxBytes:   options.RevisionCacheMaxBytes,
+	}, context.revCacheLoader)
+	revisionCacheExpvars.Set(dbName, context.revisionCache)
 
 	context.EventMgr = NewEventManager()
+	context.DeadLetters = &DeadLetterStore{context: context}
 
 	var err error
 	context.sequences, err = newSequenceAllocator(bucket)
 	if err != nil {
 		return nil, err
 	}
+	context.sequences.setMaxBatchSize(options.MaxSequenceBatchSize)
 	lastSeq, err := context.sequences.lastSequence()
 	if err != nil {
 		return nil, err
@@ -293,14 +318,41 @@ func (context *DatabaseContext) TapListener() changeListener {
 }
 
 func (context *DatabaseContext) Close() {
+	context.stopDurableEventHandlers()
+	context.EventMgr.CloseHandlers()
+
 	context.BucketLock.Lock()
 	defer context.BucketLock.Unlock()
 
+	context.sequences.stop()
 	context.tapListener.Stop()
 	context.changeCache.Stop()
 	context.Shadower.Stop()
 	context.Bucket.Close()
 	context.Bucket = nil
+
+	// Don't keep the closed database's cache alive through its stats, unless it's been reopened
+	if revisionCacheExpvars.Get(context.Name) == expvar.Var(context.revisionCache) {
+		revisionCacheExpvars.Set(context.Name, new(expvar.Map))
+	}
+}
+
+// Waits until no document updates are in progress, or until the timeout expires.  Returns false
+// on timeout.
+func (context *DatabaseContext) WaitForPendingWrites(timeout time.Duration) bool {
+	return waitForZero(&context.activeWrites, timeout)
+}
+
+// Polls an atomically-updated counter until it's zero.  Returns false if it isn't within the timeout.
+func waitForZero(counter *int64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(counter) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
 }
 
 func (context *DatabaseContext) IsClosed() bool {
@@ -362,11 +414,28 @@ func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
-	return &Database{context, user}, nil
+	return &Database{DatabaseContext: context, user: user}, nil
 }
 
 func CreateDatabase(context *DatabaseContext) (*Database, error) {
-	return &Database{context, nil}, nil
+	return &Database{DatabaseContext: context}, nil
+}
+
+// Sets the context used to tag log lines and events originating from operations on this Database,
+// so they can be correlated with the request that triggered them.
+func (db *Database) SetLogContext(logContext *base.LogContext) {
+	db.logContext = logContext
+}
+
+// Returns the log context set by SetLogContext, or nil.
+func (db *Database) LogContext() *base.LogContext {
+	return db.logContext
+}
+
+// Sets the accumulator that bucket I/O, CAS retries, sync function calls and attachment I/O
+// performed through this Database are timed into.  May be nil to disable timing.
+func (db *Database) SetRequestTimings(timings *base.RequestTimings) {
+	db.timings = timings
 }
 
 func (db *Database) SameAs(otherdb *Database) bool {
@@ -630,7 +699,7 @@ func (db *Database) ForEachDocID(callback ForEachDocIDFunc, resultsOpts ForEachD
 
 	err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres)
 	if err != nil {
-		base.Warn("all_docs got error: %v", err)
+		db.logContext.Warn("all_docs got error: %v", err)
 		return err
 	}
 
@@ -674,7 +743,7 @@ func (db *Database) queryAllDocs(reduce bool) (sgbucket.ViewResult, error) {
 	opts := Body{"stale": false, "reduce": reduce}
 	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewAllDocs, opts)
 	if err != nil {
-		base.Warn("all_docs got error: %v", err)
+		db.logContext.Warn("all_docs got error: %v", err)
 	}
 	return vres, err
 }
@@ -691,16 +760,16 @@ func (db *Database) DeleteAllDocs(docType string) error {
 	}
 	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewAllBits, opts)
 	if err != nil {
-		base.Warn("all_bits view returned %v", err)
+		db.logContext.Warn("all_bits view returned %v", err)
 		return err
 	}
 
 	//FIX: Is there a way to do this in one operation?
-	base.Logf("Deleting %d %q documents of %q ...", len(vres.Rows), docType, db.Name)
+	db.logContext.Logf("Deleting %d %q documents of %q ...", len(vres.Rows), docType, db.Name)
 	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
+		db.logContext.LogTo("CRUD", "\tDeleting %q", row.ID)
 		if err := db.Bucket.Delete(row.ID); err != nil {
-			base.Warn("Error deleting %q: %v", row.ID, err)
+			db.logContext.Warn("Error deleting %q: %v", row.ID, err)
 		}
 	}
 	return nil
@@ -732,17 +801,17 @@ func (db *Database) Compact() (int, error) {
 	opts := Body{"stale": false, "reduce": false}
 	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewOldRevs, opts)
 	if err != nil {
-		base.Warn("old_revs view returned %v", err)
+		db.logContext.Warn("old_revs view returned %v", err)
 		return 0, err
 	}
 
 	//FIX: Is there a way to do this in one operation?
-	base.Logf("Compacting away %d old revs of %q ...", len(vres.Rows), db.Name)
+	db.logContext.Logf("Compacting away %d old revs of %q ...", len(vres.Rows), db.Name)
 	count := 0
 	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
+		db.logContext.LogTo("CRUD", "\tDeleting %q", row.ID)
 		if err := db.Bucket.Delete(row.ID); err != nil {
-			base.Warn("Error deleting %q: %v", row.ID, err)
+			db.logContext.Warn("Error deleting %q: %v", row.ID, err)
 		} else {
 			count++
 		}
@@ -832,7 +901,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 	defer db.changeCache.EnableChannelIndexing(true)
 	db.changeCache.Clear()
 
-	base.Logf("Re-running sync function on all %d documents...", len(vres.Rows))
+	db.logContext.Logf("Re-running sync function on all %d documents...", len(vres.Rows))
 	changeCount := 0
 	for _, row := range vres.Rows {
 		rowKey := row.Key.([]interface{})
@@ -859,12 +928,12 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 				if err = db.initializeSyncData(doc); err != nil {
 					return nil, err
 				}
-				base.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
+				db.logContext.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
 			} else {
 				if !doCurrentDocs {
 					return nil, couchbase.UpdateCancel
 				}
-				base.LogTo("CRUD", "\tRe-syncing document %q", docid)
+				db.logContext.LogTo("CRUD", "\tRe-syncing document %q", docid)
 			}
 
 			// Run the sync fn over each current/leaf revision, in case there are conflicts:
@@ -874,7 +943,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 				channels, access, roles, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
 				if err != nil {
 					// Probably the validator rejected the doc
-					base.Warn("Error calling sync() on doc %q: %v", docid, err)
+					db.logContext.Warn("Error calling sync() on doc %q: %v", docid, err)
 					access = nil
 					channels = nil
 				}
@@ -888,7 +957,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 			})
 
 			if changed > 0 || imported {
-				base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+				db.logContext.LogTo("Access", "Saving updated channels and access grants of %q", docid)
 				return json.Marshal(doc)
 			} else {
 				return nil, couchbase.UpdateCancel
@@ -897,10 +966,10 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 		if err == nil {
 			changeCount++
 		} else if err != couchbase.UpdateCancel {
-			base.Warn("Error updating doc %q: %v", docid, err)
+			db.logContext.Warn("Error updating doc %q: %v", docid, err)
 		}
 	}
-	base.Logf("Finished re-running sync function; %d docs changed", changeCount)
+	db.logContext.Logf("Finished re-running sync function; %d docs changed", changeCount)
 
 	if changeCount > 0 {
 		// Now invalidate channel cache of all users/roles:
@@ -920,7 +989,7 @@ func (db *Database) invalUserRoles(username string) {
 	authr := db.Authenticator()
 	if user, _ := authr.GetUser(username); user != nil {
 		if err := authr.InvalidateRoles(user); err != nil {
-			base.Warn("Error invalidating roles for user %s: %v", username, err)
+			db.logContext.Warn("Error invalidating roles for user %s: %v", username, err)
 		}
 	}
 }
@@ -929,7 +998,7 @@ func (db *Database) invalUserChannels(username string) {
 	authr := db.Authenticator()
 	if user, _ := authr.GetUser(username); user != nil {
 		if err := authr.InvalidateChannels(user); err != nil {
-			base.Warn("Error invalidating channels for user %s: %v", username, err)
+			db.logContext.Warn("Error invalidating channels for user %s: %v", username, err)
 		}
 	}
 }
@@ -938,7 +1007,7 @@ func (db *Database) invalRoleChannels(rolename string) {
 	authr := db.Authenticator()
 	if role, _ := authr.GetRole(rolename); role != nil {
 		if err := authr.InvalidateChannels(role); err != nil {
-			base.Warn("Error invalidating channels for role %s: %v", rolename, err)
+			db.logContext.Warn("Error invalidating channels for role %s: %v", rolename, err)
 		}
 	}
 }
@@ -973,8 +1042,37 @@ func (context *DatabaseContext) SetUserViewsEnabled(value bool) {
 
 //////// SEQUENCE ALLOCATION:
 
+// Returns the last sequence assigned.  Without sequence batching that's the _sync:seq counter.
+// With it, the counter also counts the sequences nodes have reserved but not used yet, so this is
+// the highest sequence the change cache has received or this node has assigned.
 func (context *DatabaseContext) LastSequence() (uint64, error) {
-	return context.sequences.lastSequence()
+	cache, ok := context.changeCache.(*changeCache)
+	if !ok || context.Options.MaxSequenceBatchSize <= 1 {
+		return context.sequences.lastSequence()
+	}
+	last := cache.highestSequence()
+	if assigned := context.sequences.lastAssignedSequence(); assigned > last {
+		last = assigned
+	}
+	return last, nil
+}
+
+// Returns the highest sequence assigned to a doc, given the _sync:seq counter's value.  Without
+// sequence batching that's the counter.  With it, the counter can be ahead by the sequences other
+// nodes have reserved but not used, so the highest sequence in the channels view is used instead.
+func (context *DatabaseContext) highestWrittenSequence(lastReserved uint64) uint64 {
+	if context.Options.MaxSequenceBatchSize <= 1 || !EnableStarChannelLog || lastReserved == 0 {
+		return lastReserved
+	}
+	entries, err := context.getRecentChangesInChannelFromView(channels.UserStarChannel, lastReserved, 1)
+	if err != nil {
+		base.Warn("Unable to query the highest sequence written; using the sequence counter: %v", err)
+		return lastReserved
+	}
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[0].Sequence
 }
 
 func (context *DatabaseContext) ReserveSequences(numToReserve uint64) error {
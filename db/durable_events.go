@@ -0,0 +1,302 @@
+package db
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Key prefix of the docs holding the last sequence each durable event handler has processed on
+// each node, followed by "<node ID>:<handler ID>"
+const EventCheckpointKeyPrefix = KSyncKeyPrefix + "eventCheckpoint:"
+
+// Checkpoints are saved after this many events, and whenever the feed catches up
+const kDurableCheckpointInterval = 100
+
+// Wait before reopening the changes feed after it, or getting a changed revision, fails
+var durableFeedRetryInterval = 5 * time.Second
+
+// Per-handler stats of durable event feeds, keyed by "db:handler"
+var durableEventExpvars = expvar.NewMap("syncGateway_durableEvents")
+
+// Handlers that hold events back (e.g. batching webhooks) are flushed before a checkpoint is saved,
+// so the checkpoint never gets ahead of delivery.
+type eventFlusher interface {
+	Flush()
+}
+
+type eventCheckpoint struct {
+	Seq string `json:"seq"`
+}
+
+// Feeds document change events to a handler from the database's changes feed, instead of the
+// EventManager's in-memory queue.  The last sequence handled is saved in the bucket, so events
+// aren't lost when the queue is full or the gateway restarts; they may be delivered more than
+// once, though.  Every node runs the durable handlers in its config with checkpoints of its own,
+// so with N nodes each change is delivered N times, once by each node.  A handler whose receiver
+// can't deduplicate should be configured on one node only.
+type DurableEventFeed struct {
+	eventHandlerCounters
+	id         string
+	handler    EventHandler
+	context    *DatabaseContext
+	terminator chan bool
+	done       chan struct{}
+	expvars    *expvar.Map
+	lastSeq    uint64 // Sequence of the last event handled; accessed atomically
+}
+
+// Starts feeding document changes to the handler, beginning after its saved checkpoint.  The id
+// identifies the handler's checkpoint, and must stay the same across restarts.
+func (context *DatabaseContext) StartDurableEventHandler(id string, handler EventHandler) (*DurableEventFeed, error) {
+	if !EnableStarChannelLog {
+		return nil, errors.New("Durable event handlers require the star channel")
+	}
+	feed := &DurableEventFeed{
+		id:         id,
+		handler:    handler,
+		context:    context,
+		terminator: make(chan bool),
+		done:       make(chan struct{}),
+		expvars:    new(expvar.Map).Init(),
+	}
+	durableEventExpvars.Set(context.Name+":"+id, feed.expvars)
+	since, err := feed.loadCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	context.durableEventsLock.Lock()
+	context.durableEvents = append(context.durableEvents, feed)
+	context.durableEventsLock.Unlock()
+
+	base.LogTo("Events", "Starting durable event handler %q: %v, since %s", id, handler, since)
+	go feed.run(since)
+	return feed, nil
+}
+
+// Stops all durable event feeds, saving their checkpoints, and closes their handlers.
+func (context *DatabaseContext) stopDurableEventHandlers() {
+	context.durableEventsLock.Lock()
+	feeds := context.durableEvents
+	context.durableEvents = nil
+	context.durableEventsLock.Unlock()
+	for _, feed := range feeds {
+		feed.Stop()
+		if closer, ok := feed.handler.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Returns the webhook posting to the given URL, from either the event manager or a durable
+// event feed, or nil if there isn't one.
+func (context *DatabaseContext) webhookForUrl(url string) *Webhook {
+	if wh := context.EventMgr.webhookForUrl(url); wh != nil {
+		return wh
+	}
+	context.durableEventsLock.Lock()
+	defer context.durableEventsLock.Unlock()
+	for _, feed := range context.durableEvents {
+		if wh, ok := feed.handler.(*Webhook); ok && wh.url == url {
+			return wh
+		}
+	}
+	return nil
+}
+
+// Stops the feed after the event being handled, if any, and saves its checkpoint.
+func (feed *DurableEventFeed) Stop() {
+	close(feed.terminator)
+	// Wake the changes feed if it's waiting for changes, so it notices it's been terminated
+	feed.context.tapListener.NotifyCheckForTermination(base.SetOf("*"))
+	<-feed.done
+}
+
+// The sequence of the last event handled.
+func (feed *DurableEventFeed) LastSequence() uint64 {
+	return atomic.LoadUint64(&feed.lastSeq)
+}
+
+func (feed *DurableEventFeed) checkpointKey() string {
+	return EventCheckpointKeyPrefix + feed.context.Options.NodeID + ":" + feed.id
+}
+
+func (feed *DurableEventFeed) loadCheckpoint() (SequenceID, error) {
+	var checkpoint eventCheckpoint
+	if _, err := feed.context.Bucket.Get(feed.checkpointKey(), &checkpoint); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return SequenceID{}, nil
+		}
+		return SequenceID{}, err
+	}
+	since, err := feed.context.ParseSequenceID(checkpoint.Seq)
+	if err != nil {
+		base.Warn("Invalid checkpoint %q for durable event handler %q; starting from the beginning", checkpoint.Seq, feed.id)
+		return SequenceID{}, nil
+	}
+	atomic.StoreUint64(&feed.lastSeq, since.Seq)
+	feed.expvars.Set("checkpoint", expvarInt(int64(since.Seq)))
+	return since, nil
+}
+
+func (feed *DurableEventFeed) saveCheckpoint(since SequenceID) {
+	if flusher, ok := feed.handler.(eventFlusher); ok {
+		flusher.Flush()
+	}
+	if err := feed.context.Bucket.Set(feed.checkpointKey(), 0, eventCheckpoint{since.String()}); err != nil {
+		base.Warn("Unable to save checkpoint of durable event handler %q: %v", feed.id, err)
+		return
+	}
+	feed.expvars.Set("checkpoint", expvarInt(int64(since.Seq)))
+}
+
+// Number of sequences allocated past the last event handled.
+func (feed *DurableEventFeed) lag() int64 {
+	lag := int64(feed.context.changeCache.GetStableSequence("").Seq) - int64(feed.LastSequence())
+	if lag < 0 {
+		lag = 0
+	}
+	return lag
+}
+
+func (feed *DurableEventFeed) updateLag() {
+	feed.expvars.Set("lag", expvarInt(feed.lag()))
+}
+
+// Blocks while the feed is paused.  Returns false if it's stopped meanwhile.
+func (feed *DurableEventFeed) waitWhilePaused() bool {
+	for feed.isPaused() {
+		select {
+		case <-feed.terminator:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// Stats reported by the _event_handlers admin API
+func (feed *DurableEventFeed) Stats() EventHandlerStats {
+	stats := feed.stats(feed.id, DocumentChange, feed.handler)
+	stats.Durable = true
+	lag := feed.lag()
+	stats.Lag = &lag
+	return stats
+}
+
+func (feed *DurableEventFeed) run(since SequenceID) {
+	defer close(feed.done)
+	db := &Database{DatabaseContext: feed.context}
+	unsaved := 0 // Events handled since the checkpoint was saved
+	for {
+		// The changes feed ends when this feed is stopped, or when it's abandoned after an error
+		terminator := make(chan bool)
+		abandoned := make(chan struct{})
+		go func() {
+			select {
+			case <-feed.terminator:
+			case <-abandoned:
+				close(terminator)
+				feed.context.tapListener.NotifyCheckForTermination(base.SetOf("*"))
+				return
+			}
+			close(terminator)
+		}()
+		options := ChangesOptions{
+			Since:      since,
+			Wait:       true,
+			Continuous: true,
+			Terminator: terminator,
+		}
+		changes, err := db.MultiChangesFeed(base.SetOf("*"), options)
+		if err != nil {
+			base.Warn("Durable event handler %q couldn't read changes feed: %v", feed.id, err)
+		} else {
+			for entry := range changes {
+				if entry == nil {
+					// Caught up with the feed
+					if unsaved > 0 {
+						feed.saveCheckpoint(since)
+						unsaved = 0
+					}
+					feed.updateLag()
+					continue
+				}
+				if entry.Err != nil {
+					base.Warn("Durable event handler %q got error from changes feed: %v", feed.id, entry.Err)
+					break
+				}
+				// While paused, the feed isn't read, so the checkpoint holds and lag grows
+				if !feed.waitWhilePaused() {
+					break
+				}
+				// The checkpoint mustn't pass an event that wasn't handled, so on failure the feed is
+				// reopened from the last one that was
+				if err := feed.handleEntry(db, entry); err != nil {
+					base.Warn("Durable event handler %q couldn't handle change at %s; retrying: %v", feed.id, entry.Seq, err)
+					break
+				}
+				since = entry.Seq
+				atomic.StoreUint64(&feed.lastSeq, entry.Seq.Seq)
+				feed.expvars.Add("events", 1)
+				feed.updateLag()
+				if unsaved++; unsaved >= kDurableCheckpointInterval {
+					feed.saveCheckpoint(since)
+					unsaved = 0
+				}
+			}
+		}
+
+		close(abandoned)
+
+		select {
+		case <-feed.terminator:
+			if unsaved > 0 {
+				feed.saveCheckpoint(since)
+			}
+			base.LogTo("Events", "Stopped durable event handler %q at %s", feed.id, since)
+			return
+		case <-time.After(durableFeedRetryInterval):
+		}
+	}
+}
+
+// Sends the change as a DocumentChangeEvent to the handler.  The previous revision isn't known, so
+// the event's OldDoc is empty.  Returns an error if the revision couldn't be read, unless it no
+// longer exists, in which case the change is skipped.
+func (feed *DurableEventFeed) handleEntry(db *Database, entry *ChangeEntry) error {
+	revID := entry.Changes[0]["rev"]
+	body, _, channels, err := db.revisionCache.Get(entry.ID, revID)
+	if err != nil {
+		if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusNotFound {
+			return err
+		}
+	}
+	if body == nil {
+		base.Warn("Durable event handler %q skipping %q / %q, which no longer exists", feed.id, entry.ID, revID)
+		return nil
+	}
+	if entry.Deleted && body["_deleted"] == nil {
+		body = body.ShallowCopy()
+		body["_deleted"] = true
+	}
+	event := &DocumentChangeEvent{
+		AsyncEvent: AsyncEvent{logContext: db.logContext},
+		Doc:        body,
+		Channels:   channels,
+	}
+	base.LogTo("Events+", "Durable event handler %q sending event %s", feed.id, event.String())
+	feed.handle(feed.handler, event)
+	return nil
+}
+
+func expvarInt(value int64) *expvar.Int {
+	result := new(expvar.Int)
+	result.Set(value)
+	return result
+}
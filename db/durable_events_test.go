@@ -0,0 +1,141 @@
+package db
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Collects the IDs of the documents in the change events it handles
+type durableTestHandler struct {
+	docIDs chan string
+}
+
+func (h *durableTestHandler) HandleEvent(event Event) {
+	if dce, ok := event.(*DocumentChangeEvent); ok {
+		h.docIDs <- dce.Doc["_id"].(string)
+	}
+}
+
+func (h *durableTestHandler) String() string {
+	return "durableTestHandler"
+}
+
+func (h *durableTestHandler) expect(t *testing.T, docIDs ...string) {
+	for _, docID := range docIDs {
+		select {
+		case received := <-h.docIDs:
+			assert.Equals(t, received, docID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event for %q", docID)
+		}
+	}
+}
+
+func TestDurableEventHandler(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.Put("doc1", Body{"value": 1})
+	assertNoError(t, err, "Couldn't put doc1")
+	_, err = db.Put("doc2", Body{"value": 2})
+	assertNoError(t, err, "Couldn't put doc2")
+
+	// Events for docs written before the handler started are delivered from the changes feed
+	handler := &durableTestHandler{docIDs: make(chan string, 10)}
+	feed, err := db.StartDurableEventHandler("test", handler)
+	assertNoError(t, err, "Couldn't start durable event handler")
+	handler.expect(t, "doc1", "doc2")
+
+	_, err = db.Put("doc3", Body{"value": 3})
+	assertNoError(t, err, "Couldn't put doc3")
+	handler.expect(t, "doc3")
+	assert.Equals(t, feed.LastSequence(), uint64(3))
+
+	// Stopping saves the checkpoint; events raised while stopped are delivered on restart
+	db.stopDurableEventHandlers()
+	_, err = db.Put("doc4", Body{"value": 4})
+	assertNoError(t, err, "Couldn't put doc4")
+
+	var checkpoint eventCheckpoint
+	_, err = db.Bucket.Get(feed.checkpointKey(), &checkpoint)
+	assertNoError(t, err, "Couldn't get checkpoint")
+	assert.Equals(t, checkpoint.Seq, "3")
+
+	feed, err = db.StartDurableEventHandler("test", handler)
+	assertNoError(t, err, "Couldn't restart durable event handler")
+	handler.expect(t, "doc4")
+	assert.Equals(t, feed.LastSequence(), uint64(4))
+	select {
+	case docID := <-handler.docIDs:
+		t.Fatalf("Unexpected event for %q", docID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDurableEventCheckpointPerNode(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.Put("doc1", Body{"value": 1})
+	assertNoError(t, err, "Couldn't put doc1")
+
+	db.Options.NodeID = "node1"
+	handler := &durableTestHandler{docIDs: make(chan string, 10)}
+	_, err = db.StartDurableEventHandler("test", handler)
+	assertNoError(t, err, "Couldn't start durable event handler")
+	handler.expect(t, "doc1")
+	db.stopDurableEventHandlers()
+
+	// Another node keeps a checkpoint of its own, so it delivers the events too
+	db.Options.NodeID = "node2"
+	feed, err := db.StartDurableEventHandler("test", handler)
+	assertNoError(t, err, "Couldn't start durable event handler")
+	handler.expect(t, "doc1")
+	db.stopDurableEventHandlers()
+	assert.Equals(t, feed.checkpointKey(), EventCheckpointKeyPrefix+"node2:test")
+
+	var checkpoint eventCheckpoint
+	_, err = db.Bucket.Get(EventCheckpointKeyPrefix+"node1:test", &checkpoint)
+	assertNoError(t, err, "Couldn't get checkpoint of node1")
+	assert.Equals(t, checkpoint.Seq, "1")
+}
+
+func TestDurableEventHandlerRetriesFailedRevision(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	defer func(interval time.Duration) { durableFeedRetryInterval = interval }(durableFeedRetryInterval)
+	durableFeedRetryInterval = 50 * time.Millisecond
+
+	_, err := db.Put("doc1", Body{"value": 1})
+	assertNoError(t, err, "Couldn't put doc1")
+	_, err = db.Put("doc2", Body{"value": 2})
+	assertNoError(t, err, "Couldn't put doc2")
+
+	// Reading doc2's revision fails a couple of times, as if the bucket were briefly unavailable
+	var failures int32 = 2
+	loader := db.revisionCache.loaderFunc
+	db.revisionCache = NewRevisionCache(100, func(id IDAndRev) (Body, Body, base.Set, error) {
+		if id.DocID == "doc2" && atomic.AddInt32(&failures, -1) >= 0 {
+			return nil, nil, nil, errors.New("temporary failure")
+		}
+		return loader(id)
+	})
+
+	// doc2's event is delivered once the revision can be read, and the checkpoint never passes it
+	handler := &durableTestHandler{docIDs: make(chan string, 10)}
+	feed, err := db.StartDurableEventHandler("test", handler)
+	assertNoError(t, err, "Couldn't start durable event handler")
+	handler.expect(t, "doc1", "doc2")
+	assert.Equals(t, feed.LastSequence(), uint64(2))
+	assert.Equals(t, atomic.LoadInt32(&failures), int32(-1))
+	select {
+	case docID := <-handler.docIDs:
+		t.Fatalf("Unexpected event for %q", docID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -3,7 +3,9 @@ package db
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -17,6 +19,18 @@ const (
 	DocumentChange EventType = iota
 	DBStateChange
 	UserAdd
+	PrincipalChange
+	DocumentRejected
+	ReplicationFailed
+)
+
+// Actions reported by a PrincipalChangeEvent
+const (
+	PrincipalCreated        = "created"
+	PrincipalUpdated        = "updated"
+	PrincipalDeleted        = "deleted"
+	PrincipalAccessChanged  = "access_changed" // The sync function changed its channel or role grants
+	PrincipalSessionCreated = "session_created"
 )
 
 // An event that can be raised during SG processing.
@@ -24,18 +38,26 @@ type Event interface {
 	Synchronous() bool
 	EventType() EventType
 	String() string
+	LogContext() *base.LogContext
 }
 
-// Currently the AsyncEvent type only manages the Synchronous() check.  Future enhancements
-// around async processing would leverage this type.
+// Currently the AsyncEvent type only manages the Synchronous() check and the log context of
+// the request that raised the event.  Future enhancements around async processing would
+// leverage this type.
 type AsyncEvent struct {
 	//EventImpl
+	logContext *base.LogContext
 }
 
 func (ae AsyncEvent) Synchronous() bool {
 	return false
 }
 
+// Returns the log context of the request that raised the event, or nil.
+func (ae AsyncEvent) LogContext() *base.LogContext {
+	return ae.logContext
+}
+
 // DocumentChangeEvent is raised when a document has been successfully written to the backing
 // data store.  Event has the document body and channel set as properties.
 type DocumentChangeEvent struct {
@@ -69,6 +91,76 @@ func (dsce *DBStateChangeEvent) EventType() EventType {
 	return DBStateChange
 }
 
+// PrincipalChangeEvent is raised when a user or role is created, updated or deleted, when the
+// sync function changes the channels or roles granted to one, or when a user's session is created.
+// Doc has the principal's name, type ("user" or "role") and the action, plus details that depend
+// on the action.
+type PrincipalChangeEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (pce *PrincipalChangeEvent) String() string {
+	return fmt.Sprintf("Principal change event (%s) for %s %s", pce.Doc["action"], pce.Doc["type"], pce.Doc["name"])
+}
+
+func (pce *PrincipalChangeEvent) EventType() EventType {
+	return PrincipalChange
+}
+
+// DocumentRejectedEvent is raised when a document update is rejected by the sync function, either
+// by calling reject() or throw({forbidden:...}), or by throwing an exception.
+type DocumentRejectedEvent struct {
+	AsyncEvent
+	DocID   string
+	RevID   string
+	User    string // Name of the user making the update; "" for the admin or guest
+	Status  int
+	Message string
+	Doc     Body // The rejected document body
+	Time    time.Time
+}
+
+func (dre *DocumentRejectedEvent) String() string {
+	return fmt.Sprintf("Document rejected event for doc id: %s", dre.DocID)
+}
+
+func (dre *DocumentRejectedEvent) EventType() EventType {
+	return DocumentRejected
+}
+
+// Returns a description of the rejection, including the rejected body if includeBody is true.
+func (dre *DocumentRejectedEvent) Body(includeBody bool) Body {
+	body := Body{
+		"doc_id":    dre.DocID,
+		"rev":       dre.RevID,
+		"user":      dre.User,
+		"status":    dre.Status,
+		"message":   dre.Message,
+		"localtime": dre.Time.Format(base.ISO8601Format),
+	}
+	if includeBody {
+		body["doc"] = dre.Doc
+	}
+	return body
+}
+
+// ReplicationFailedEvent is raised when a replication stops because it failed, either after too
+// many failed attempts in a row or because sg-replicate terminated it.  Doc has the replication's
+// ID, source, target, error and number of consecutive failures.
+type ReplicationFailedEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (rfe *ReplicationFailedEvent) String() string {
+	return fmt.Sprintf("Replication failed event for replication id: %s", rfe.Doc["replication_id"])
+}
+
+func (rfe *ReplicationFailedEvent) EventType() EventType {
+	return ReplicationFailed
+}
+
 // Javascript function handling for events
 const kTaskCacheSize = 4
 
@@ -147,6 +239,12 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 		result, err = ef.Call(event.Doc, sgbucket.JSONString(event.OldDoc))
 	case *DBStateChangeEvent:
 		result, err = ef.Call(event.Doc)
+	case *PrincipalChangeEvent:
+		result, err = ef.Call(event.Doc)
+	case *DocumentRejectedEvent:
+		result, err = ef.Call(event.Body(true))
+	case *ReplicationFailedEvent:
+		result, err = ef.Call(event.Doc)
 	}
 
 	if err != nil {
@@ -157,6 +255,37 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 	return result, err
 }
 
+// Calls a jsEventFunction that builds a webhook payload.  It's passed the same parameters as
+// other event functions, plus the sorted channel names for a document change.
+func (ef *JSEventFunction) CallTransformFunction(event Event) (interface{}, error) {
+
+	var err error
+	var result interface{}
+
+	switch event := event.(type) {
+
+	case *DocumentChangeEvent:
+		channelNames := event.Channels.ToArray()
+		sort.Strings(channelNames)
+		result, err = ef.Call(event.Doc, sgbucket.JSONString(event.OldDoc), channelNames)
+	case *DBStateChangeEvent:
+		result, err = ef.Call(event.Doc)
+	case *PrincipalChangeEvent:
+		result, err = ef.Call(event.Doc)
+	case *DocumentRejectedEvent:
+		result, err = ef.Call(event.Body(true))
+	case *ReplicationFailedEvent:
+		result, err = ef.Call(event.Doc)
+	}
+
+	if err != nil {
+		base.Warn("Error calling transform function - event processing aborted: %v", err)
+		return nil, err
+	}
+
+	return result, err
+}
+
 // Calls a jsEventFunction returning bool.
 func (ef *JSEventFunction) CallValidateFunction(event Event) (bool, error) {
 
@@ -2,14 +2,23 @@ package db
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/couchbase/sync_gateway/base"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,20 +33,96 @@ type AsyncEventHandler struct{}
 // Webhook is an implementation of EventHandler that sends an asynchronous HTTP POST
 type Webhook struct {
 	AsyncEventHandler
-	url     string
-	filter  *JSEventFunction
-	timeout time.Duration
-	client  *http.Client
+	eventFunctions
+	deliveryFailures
+	url            string
+	timeout        time.Duration
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	deadLetters    *DeadLetterStore
+	secret         []byte
+	headers        map[string]string
+	batchSize      int
+	batchLinger    time.Duration
+	batches        map[string]*webhookBatch // Events waiting to be posted together, by path
+	batchLock      sync.Mutex               // Protects batches
+	batchPosts     sync.WaitGroup           // Batch posts in progress
+	retries        sync.WaitGroup           // Posts waiting to be retried, or being retried
+	pendingRetries int64                    // Number of posts in retries; accessed atomically
+}
+
+// Optional webhook settings
+type WebhookOptions struct {
+	Timeout        *uint64           // HTTP post timeout, in seconds
+	MaxAttempts    int               // Number of times to try posting each event; defaults to 1 (no retries)
+	InitialBackoff time.Duration     // Wait before the first retry; doubles on each retry, with jitter
+	MaxBackoff     time.Duration     // Upper limit of the wait between retries
+	DeadLetters    *DeadLetterStore  // Where events are saved when every attempt fails; may be nil
+	Secret         string            // If set, posts are signed with an HMAC-SHA256 using this key
+	Headers        map[string]string // Static headers added to every post, e.g. auth tokens
+	Transform      string            // Optional JS function that builds the payload of each post
+	BatchSize      int               // If greater than 1, events are posted together as a JSON array of up to this many
+	BatchLinger    time.Duration     // Longest time an event waits for a batch to fill up
+	IncludeBody    bool              // Whether document_rejected posts include the rejected body
+}
+
+// Filter and transform functions, used by all the event handler types to choose which events to
+// send and what to send for them
+type eventFunctions struct {
+	filter      *JSEventFunction
+	transform   *JSEventFunction
+	includeBody bool // Whether document_rejected payloads include the rejected body
+}
+
+// Optional settings of the file, exec and unix socket event handlers
+type EventSinkOptions struct {
+	Transform   string // Optional JS function that builds the payload written for each event
+	IncludeBody bool   // Whether document_rejected payloads include the rejected body
+}
+
+// A payload to be posted, and how to post it
+type webhookPost struct {
+	Payload     []byte
+	ContentType string
+	Path        string // Appended to the webhook's URL path
+	RequestID   string // ID of the request that raised the event, if any
 }
 
 // default HTTP post timeout
 const kDefaultWebhookTimeout = 60
 
+// default webhook retry backoff
+const (
+	kDefaultWebhookInitialBackoff = 1 * time.Second
+	kDefaultWebhookMaxBackoff     = 60 * time.Second
+)
+
+// Max posts a webhook may have waiting to be retried.  Beyond this, posts that fail are saved as
+// dead letters straight away, so an unreachable receiver can't pile up retries without limit.
+var maxWebhookPendingRetries int64 = 1000
+
+// default time an event waits for a webhook batch to fill up
+const kDefaultWebhookBatchLinger = 1 * time.Second
+
+// Headers of a signed webhook post.  The signature is the hex HMAC-SHA256 of the timestamp, a '.',
+// and the payload, so a receiver can reject replayed or tampered posts.
+const (
+	WebhookTimestampHeader = "X-Sync-Gateway-Timestamp"
+	WebhookSignatureHeader = "X-Sync-Gateway-Signature"
+)
+
 // used to match the HTTP basic auth component of a URL
 var kBasicAuthUrlRegexp = regexp.MustCompilePOSIX(`:\/\/[^:/]+:[^@/]+@`)
 
 // Creates a new webhook handler based on the url and filter function.
 func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, error) {
+	return NewWebhookWithOptions(url, filterFnString, WebhookOptions{Timeout: timeout})
+}
+
+// Creates a new webhook handler based on the url, filter function and options.
+func NewWebhookWithOptions(url string, filterFnString string, options WebhookOptions) (*Webhook, error) {
 
 	var err error
 
@@ -47,17 +132,37 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 	}
 
 	wh := &Webhook{
-		url: url,
+		url:            url,
+		maxAttempts:    options.MaxAttempts,
+		initialBackoff: options.InitialBackoff,
+		maxBackoff:     options.MaxBackoff,
+		deadLetters:    options.DeadLetters,
+		headers:        options.Headers,
+		batchSize:      options.BatchSize,
+		batchLinger:    options.BatchLinger,
+		eventFunctions: newEventFunctions(filterFnString, options.Transform, options.IncludeBody),
 	}
-	if filterFnString != "" {
-		wh.filter = NewJSEventFunction(filterFnString)
+	if options.Secret != "" {
+		wh.secret = []byte(options.Secret)
 	}
 
-	if timeout != nil {
-		wh.timeout = time.Duration(*timeout) * time.Second
+	if options.Timeout != nil {
+		wh.timeout = time.Duration(*options.Timeout) * time.Second
 	} else {
 		wh.timeout = time.Duration(kDefaultWebhookTimeout) * time.Second
 	}
+	if wh.maxAttempts < 1 {
+		wh.maxAttempts = 1
+	}
+	if wh.initialBackoff <= 0 {
+		wh.initialBackoff = kDefaultWebhookInitialBackoff
+	}
+	if wh.maxBackoff <= 0 {
+		wh.maxBackoff = kDefaultWebhookMaxBackoff
+	}
+	if wh.batchLinger <= 0 {
+		wh.batchLinger = kDefaultWebhookBatchLinger
+	}
 
 	// Initialize transport and client
 	transport := &http.Transport{DisableKeepAlives: false}
@@ -67,36 +172,151 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 }
 
 // Performs an HTTP POST to the url defined for the handler.  If a filter function is defined,
-// calls it to determine whether to POST.  The payload for the POST is depends
-// on the event type.
+// calls it to determine whether to POST.  The payload for the POST is built by the transform
+// function if there is one, and otherwise depends on the event type.
 func (wh *Webhook) HandleEvent(event Event) {
 
-	var payload *bytes.Buffer
-	var contentType string
-	if wh.filter != nil {
-		// If filter function is defined, use it to determine whether to post
-		success, err := wh.filter.CallValidateFunction(event)
+	logContext := event.LogContext()
+	post := wh.filterAndMakePost(event, "webhook")
+	if post == nil {
+		return
+	}
+
+	if wh.batchSize > 1 {
+		wh.addToBatch(post)
+		return
+	}
+	wh.deliver(post, eventTypeName(event.EventType()), event.String(), logContext)
+}
+
+// Returns the payload as a line of NDJSON, for the handlers that write events to a stream.
+func (post *webhookPost) ndjsonLine() []byte {
+	var line bytes.Buffer
+	if err := json.Compact(&line, post.jsonValue()); err != nil {
+		// Not valid JSON, despite its content type
+		line.Reset()
+		value, _ := json.Marshal(string(post.Payload))
+		line.Write(value)
+	}
+	line.WriteByte('\n')
+	return line.Bytes()
+}
+
+// Posts with retries, saving the post as a dead letter if it can't be delivered.  eventType and
+// description identify what's being posted, for the dead letter and logs.  If the first attempt
+// fails, the retries are made from a goroutine of their own, so that waiting between them doesn't
+// hold up the event queue; Flush waits for them.
+func (wh *Webhook) deliver(post *webhookPost, eventType string, description string, logContext *base.LogContext) {
+	err := wh.post(post)
+	if err != nil && wh.maxAttempts > 1 && isRetryableWebhookError(err) {
+		if atomic.AddInt64(&wh.pendingRetries, 1) <= maxWebhookPendingRetries {
+			wh.retries.Add(1)
+			go func() {
+				defer wh.retries.Done()
+				defer atomic.AddInt64(&wh.pendingRetries, -1)
+				attempts, err := wh.retry(post, err, logContext)
+				wh.delivered(post, attempts, err, eventType, description, logContext)
+			}()
+			return
+		}
+		atomic.AddInt64(&wh.pendingRetries, -1)
+		logContext.Warn("Too many posts to url %s waiting to be retried; not retrying %s", wh.SanitizedUrl(), description)
+	}
+	wh.delivered(post, 1, err, eventType, description, logContext)
+}
+
+// Records the outcome of posting, saving the post as a dead letter if it failed.
+func (wh *Webhook) delivered(post *webhookPost, attempts int, err error, eventType string, description string, logContext *base.LogContext) {
+	if err != nil {
+		logContext.Warn("Error attempting to post %s to url %s after %d attempt(s): %v", description, wh.SanitizedUrl(), attempts, err)
+		wh.addFailure()
+		if wh.deadLetters != nil {
+			letter := &DeadLetter{
+				Url:         wh.url,
+				Path:        post.Path,
+				EventType:   eventType,
+				ContentType: post.ContentType,
+				Payload:     string(post.Payload),
+				RequestID:   post.RequestID,
+				Error:       err.Error(),
+				Attempts:    attempts,
+				FailedAt:    time.Now(),
+			}
+			if err := wh.deadLetters.Add(letter); err != nil {
+				logContext.Warn("Unable to save undelivered %s as a dead letter: %v", description, err)
+			}
+		}
+		return
+	}
+
+	if base.LogEnabled("Events+") {
+		logContext.LogTo("Events+", "Webhook handler ran for %s.  Payload %s posted to URL %s",
+			description, post.Payload, wh.SanitizedUrl())
+	}
+}
+
+func newEventFunctions(filterFnString string, transformFnString string, includeBody bool) eventFunctions {
+	ef := eventFunctions{includeBody: includeBody}
+	if filterFnString != "" {
+		ef.filter = NewJSEventFunction(filterFnString)
+	}
+	if transformFnString != "" {
+		ef.transform = NewJSEventFunction(transformFnString)
+	}
+	return ef
+}
+
+// Runs the filter function, if any, then builds the payload for an event.  Returns nil if the
+// event is filtered out, or can't be sent.  handlerType is used in log messages.
+func (ef *eventFunctions) filterAndMakePost(event Event, handlerType string) *webhookPost {
+	logContext := event.LogContext()
+
+	if ef.filter != nil {
+		// If filter function is defined, use it to determine whether to send
+		success, err := ef.filter.CallValidateFunction(event)
 		if err != nil {
-			base.Warn("Error calling webhook filter function: %v", err)
+			logContext.Warn("Error calling %s filter function: %v", handlerType, err)
 		}
 
-		// If filter returns false, cancel webhook post
+		// If filter returns false, cancel the send
 		if !success {
-			return
+			return nil
 		}
 	}
 
+	post, err := ef.makePost(event)
+	if err != nil {
+		logContext.Warn("Error building %s payload for %s: %v", handlerType, event.String(), err)
+		return nil
+	} else if post == nil {
+		return nil // transform function returned null
+	}
+	if logContext != nil {
+		post.RequestID = logContext.RequestID
+	}
+	return post
+}
+
+// Builds the post for an event.  Returns nil if the transform function returns null, meaning
+// the event isn't posted.
+func (ef *eventFunctions) makePost(event Event) (*webhookPost, error) {
+	if ef.transform != nil {
+		result, err := ef.transform.CallTransformFunction(event)
+		if err != nil {
+			return nil, err
+		}
+		return makeTransformedPost(result)
+	}
+
 	// Different events post different content by default
 	switch event := event.(type) {
 	case *DocumentChangeEvent:
 		// for DocumentChangeEvent, post document body
 		jsonOut, err := json.Marshal(event.Doc)
 		if err != nil {
-			base.Warn("Error marshalling doc for webhook post")
-			return
+			return nil, err
 		}
-		contentType = "application/json"
-		payload = bytes.NewBuffer(jsonOut)
+		return &webhookPost{Payload: jsonOut, ContentType: "application/json"}, nil
 	case *DBStateChangeEvent:
 		// for DBStateChangeEvent, post JSON document with the following format
 		//{
@@ -108,36 +328,198 @@ func (wh *Webhook) HandleEvent(event Event) {
 		//}
 		jsonOut, err := json.Marshal(event.Doc)
 		if err != nil {
-			base.Warn("Error marshalling doc for webhook post")
-			return
+			return nil, err
 		}
-		contentType = "application/json"
-		payload = bytes.NewBuffer(jsonOut)
+		return &webhookPost{Payload: jsonOut, ContentType: "application/json"}, nil
+	case *PrincipalChangeEvent:
+		// for PrincipalChangeEvent, post the event's description of the principal and action
+		jsonOut, err := json.Marshal(event.Doc)
+		if err != nil {
+			return nil, err
+		}
+		return &webhookPost{Payload: jsonOut, ContentType: "application/json"}, nil
+	case *DocumentRejectedEvent:
+		// for DocumentRejectedEvent, post the doc ID, user, status and message, and optionally the body
+		jsonOut, err := json.Marshal(event.Body(ef.includeBody))
+		if err != nil {
+			return nil, err
+		}
+		return &webhookPost{Payload: jsonOut, ContentType: "application/json"}, nil
+	case *ReplicationFailedEvent:
+		// for ReplicationFailedEvent, post the event's description of the replication and its error
+		jsonOut, err := json.Marshal(event.Doc)
+		if err != nil {
+			return nil, err
+		}
+		return &webhookPost{Payload: jsonOut, ContentType: "application/json"}, nil
 	default:
-		base.Warn("Webhook invoked for unsupported event type.")
-		return
+		return nil, errors.New("Event handler invoked for unsupported event type.")
 	}
-	func() {
-		resp, err := wh.client.Post(wh.url, contentType, payload)
-		defer func() {
-			// Ensure we're closing the response, so it can be reused
-			if resp != nil && resp.Body != nil {
-				io.Copy(ioutil.Discard, resp.Body)
-				resp.Body.Close()
+}
+
+// Builds a post from the result of a transform function.  A string result is posted as text, and
+// anything else as JSON.  To choose the content type or URL path, the function returns an object
+// with the payload in its "_payload" property, plus optional "_content_type" and "_path".
+func makeTransformedPost(result interface{}) (*webhookPost, error) {
+	post := &webhookPost{}
+	if envelope, ok := result.(map[string]interface{}); ok {
+		if payload, found := envelope["_payload"]; found {
+			result = payload
+			if contentType, ok := envelope["_content_type"].(string); ok {
+				post.ContentType = contentType
 			}
-		}()
+			if path, ok := envelope["_path"].(string); ok {
+				post.Path = path
+			}
+		}
+	}
 
+	switch result := result.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		post.Payload = []byte(result)
+		if post.ContentType == "" {
+			post.ContentType = "text/plain; charset=utf-8"
+		}
+	default:
+		jsonOut, err := json.Marshal(result)
 		if err != nil {
-			base.Warn("Error attempting to post %s to url %s: %s -- %+v", event.String(), wh.SanitizedUrl(), err)
-			return
+			return nil, err
+		}
+		post.Payload = jsonOut
+		if post.ContentType == "" {
+			post.ContentType = "application/json"
 		}
+	}
+	return post, nil
+}
 
-		if base.LogEnabled("Events+") {
-			base.LogTo("Events+", "Webhook handler ran for event.  Payload %s posted to URL %s, got status %s",
-				payload, wh.SanitizedUrl(), resp.Status)
+// Retries a post whose first attempt failed with err, with exponential backoff, for as long as
+// it fails with an error that may be transient.  Returns the number of attempts made, including
+// the first, and the last error if none succeeded.
+func (wh *Webhook) retry(post *webhookPost, err error, logContext *base.LogContext) (attempts int, lastErr error) {
+	backoff := wh.initialBackoff
+	for attempts = 1; ; attempts++ {
+		if err == nil || attempts >= wh.maxAttempts || !isRetryableWebhookError(err) {
+			return attempts, err
+		}
+		// Wait between half and all of the backoff, so that retries from many events spread out
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		logContext.LogTo("Events+", "Webhook post to %s failed (%v); retrying in %v", wh.SanitizedUrl(), err, wait)
+		dbExpvars.Add("webhook_retries", 1)
+		time.Sleep(wait)
+		if backoff *= 2; backoff > wh.maxBackoff {
+			backoff = wh.maxBackoff
+		}
+		err = wh.post(post)
+	}
+}
+
+// Error returned by Webhook.post for a non-2xx response
+type webhookStatusError struct {
+	status     string
+	statusCode int
+}
+
+func (err *webhookStatusError) Error() string {
+	return fmt.Sprintf("response status %s", err.status)
+}
+
+// Transport errors, server errors, timeouts and throttling are worth retrying; other client
+// errors would just fail again.
+func isRetryableWebhookError(err error) bool {
+	if statusErr, ok := err.(*webhookStatusError); ok {
+		code := statusErr.statusCode
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Makes a single attempt to post a payload.  A non-2xx response is returned as an error.
+func (wh *Webhook) post(post *webhookPost) error {
+	var resp *http.Response
+	req, err := http.NewRequest("POST", wh.urlWithPath(post.Path), bytes.NewReader(post.Payload))
+	if err == nil {
+		for name, value := range wh.headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Content-Type", post.ContentType)
+		if post.RequestID != "" {
+			// Let the receiver correlate the post with the request that triggered it
+			req.Header.Set("X-Request-ID", post.RequestID)
+		}
+		if wh.secret != nil {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(WebhookTimestampHeader, timestamp)
+			req.Header.Set(WebhookSignatureHeader, "sha256="+wh.signature(timestamp, post.Payload))
+		}
+		resp, err = wh.client.Do(req)
+	}
+	defer func() {
+		// Ensure we're closing the response, so it can be reused
+		if resp != nil && resp.Body != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
 		}
 	}()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookStatusError{status: resp.Status, statusCode: resp.StatusCode}
+	}
+	return nil
+}
 
+// Returns the webhook's URL with a path appended to its path.
+func (wh *Webhook) urlWithPath(path string) string {
+	if path == "" {
+		return wh.url
+	}
+	u, err := url.Parse(wh.url)
+	if err != nil {
+		return wh.url // NewRequest will report the error
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	return u.String()
+}
+
+// Returns the hex HMAC-SHA256 of a post's timestamp and payload, keyed with the shared secret.
+func (wh *Webhook) signature(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, wh.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Name of an event type, as used in the config and saved in dead letters
+func eventTypeName(eventType EventType) string {
+	switch eventType {
+	case DocumentChange:
+		return "document_changed"
+	case DBStateChange:
+		return "db_state_changed"
+	case PrincipalChange:
+		return "principal_changed"
+	case DocumentRejected:
+		return "document_rejected"
+	case ReplicationFailed:
+		return "replication_failed"
+	default:
+		return fmt.Sprintf("%v", eventType)
+	}
+}
+
+// Returns the event type with the given config name, or false if there's no such type.
+func ParseEventType(name string) (EventType, bool) {
+	for _, eventType := range []EventType{DocumentChange, DBStateChange, PrincipalChange, DocumentRejected, ReplicationFailed} {
+		if eventTypeName(eventType) == name {
+			return eventType, true
+		}
+	}
+	return 0, false
 }
 
 func (wh *Webhook) String() string {
@@ -145,6 +527,10 @@ func (wh *Webhook) String() string {
 }
 
 func (wh *Webhook) SanitizedUrl() string {
+	return sanitizedWebhookUrl(wh.url)
+}
+
+func sanitizedWebhookUrl(url string) string {
 	// Basic auth credentials may have been included in the URL, in which case obscure them
-	return kBasicAuthUrlRegexp.ReplaceAllLiteralString(wh.url, "://****:****@")
+	return kBasicAuthUrlRegexp.ReplaceAllLiteralString(url, "://****:****@")
 }
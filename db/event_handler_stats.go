@@ -0,0 +1,109 @@
+package db
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State of an EventManager's queue and handlers, as reported by the _event_handlers admin API
+type EventQueueStats struct {
+	QueueDepth    int                 `json:"queue_depth"`    // Events waiting to be processed
+	QueueCapacity int                 `json:"queue_capacity"` // Events that can wait before new ones are dropped
+	Active        int                 `json:"active"`         // Events being processed
+	MaxActive     int                 `json:"max_active"`     // Events that can be processed concurrently
+	Dropped       int64               `json:"dropped"`        // Events discarded because the queue was full
+	Handlers      []EventHandlerStats `json:"handlers"`
+}
+
+// Stats of a single event handler
+type EventHandlerStats struct {
+	ID           string  `json:"id"`
+	EventType    string  `json:"event_type"`
+	Handler      string  `json:"handler"`
+	Durable      bool    `json:"durable,omitempty"`
+	Paused       bool    `json:"paused"`
+	InFlight     int64   `json:"in_flight"`      // Events being handled
+	Processed    int64   `json:"processed"`      // Events handled
+	Dropped      int64   `json:"dropped"`        // Events discarded because the queue was full
+	Buffered     int     `json:"buffered"`       // Events held while the handler is paused, to be handled when it's resumed
+	Skipped      int64   `json:"skipped"`        // Events discarded because the handler was paused and already held too many
+	Failures     int64   `json:"failures"`       // Events the handler couldn't deliver
+	AvgLatencyMs float64 `json:"avg_latency_ms"` // Average time taken to handle an event
+	Lag          *int64  `json:"lag,omitempty"`  // Sequences not yet handled by a durable handler
+}
+
+// Implemented by event handlers that count the events they fail to deliver
+type failureCounter interface {
+	Failures() int64
+}
+
+// Counters kept for each event handler; all accessed atomically
+type eventHandlerCounters struct {
+	paused    int32
+	inFlight  int64
+	processed int64
+	dropped   int64
+	skipped   int64
+	latencyNs int64 // Total time spent handling events
+}
+
+// Sends the event to the handler, counting it and timing it.
+func (c *eventHandlerCounters) handle(handler EventHandler, event Event) {
+	atomic.AddInt64(&c.inFlight, 1)
+	c.handleInFlight(handler, event)
+}
+
+// Like handle, for an event that's already been counted as in flight.
+func (c *eventHandlerCounters) handleInFlight(handler EventHandler, event Event) {
+	start := time.Now()
+	handler.HandleEvent(event)
+	atomic.AddInt64(&c.latencyNs, int64(time.Since(start)))
+	atomic.AddInt64(&c.processed, 1)
+	atomic.AddInt64(&c.inFlight, -1)
+}
+
+func (c *eventHandlerCounters) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) != 0
+}
+
+func (c *eventHandlerCounters) setPaused(paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	atomic.StoreInt32(&c.paused, value)
+}
+
+func (c *eventHandlerCounters) stats(id string, eventType EventType, handler EventHandler) EventHandlerStats {
+	stats := EventHandlerStats{
+		ID:        id,
+		EventType: eventTypeName(eventType),
+		Handler:   handler.String(),
+		Paused:    c.isPaused(),
+		InFlight:  atomic.LoadInt64(&c.inFlight),
+		Processed: atomic.LoadInt64(&c.processed),
+		Dropped:   atomic.LoadInt64(&c.dropped),
+		Skipped:   atomic.LoadInt64(&c.skipped),
+	}
+	if stats.Processed > 0 {
+		avg := time.Duration(atomic.LoadInt64(&c.latencyNs) / stats.Processed)
+		stats.AvgLatencyMs = avg.Seconds() * 1000
+	}
+	if counter, ok := handler.(failureCounter); ok {
+		stats.Failures = counter.Failures()
+	}
+	return stats
+}
+
+// Embedded in event handlers to count the events they fail to deliver
+type deliveryFailures struct {
+	count int64 // accessed atomically
+}
+
+func (f *deliveryFailures) addFailure() {
+	atomic.AddInt64(&f.count, 1)
+}
+
+func (f *deliveryFailures) Failures() int64 {
+	return atomic.LoadInt64(&f.count)
+}
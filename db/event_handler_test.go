@@ -1,8 +1,16 @@
 package db
 
 import (
-	"github.com/couchbaselabs/go.assert"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
 )
 
 func TestWebhookString(t *testing.T) {
@@ -32,3 +40,84 @@ func TestSanitizedUrl(t *testing.T) {
 	}
 	assert.Equals(t, wh.SanitizedUrl(), "https://example.com/does-not-count-as-url-embedded:basic-auth-credentials@qux")
 }
+
+func TestWebhookSignatureAndHeaders(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	wh, err := NewWebhookWithOptions(server.URL, "", WebhookOptions{
+		Secret:  "s3cret",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	assert.Equals(t, err, nil)
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+
+	assert.True(t, received != nil)
+	assert.Equals(t, received.Header.Get("Authorization"), "Bearer token")
+	assert.Equals(t, received.Header.Get("Content-Type"), "application/json")
+
+	// The receiver can verify the signature with the shared secret
+	timestamp := received.Header.Get(WebhookTimestampHeader)
+	assert.True(t, timestamp != "")
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	assert.Equals(t, received.Header.Get(WebhookSignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	// Without a secret, posts aren't signed
+	wh, _ = NewWebhook(server.URL, "", nil)
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	assert.Equals(t, received.Header.Get(WebhookSignatureHeader), "")
+}
+
+func TestWebhookTransformedPost(t *testing.T) {
+	// Objects and arrays are posted as JSON, strings as text
+	post, err := makeTransformedPost(map[string]interface{}{"text": "doc1 changed"})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(post.Payload), `{"text":"doc1 changed"}`)
+	assert.Equals(t, post.ContentType, "application/json")
+
+	post, _ = makeTransformedPost("doc1 changed")
+	assert.Equals(t, string(post.Payload), "doc1 changed")
+	assert.Equals(t, post.ContentType, "text/plain; charset=utf-8")
+
+	// An envelope sets the content type and path
+	post, _ = makeTransformedPost(map[string]interface{}{
+		"_payload":      "a,b\n",
+		"_content_type": "text/csv",
+		"_path":         "/ingest/docs",
+	})
+	assert.Equals(t, string(post.Payload), "a,b\n")
+	assert.Equals(t, post.ContentType, "text/csv")
+	wh := &Webhook{url: "http://example.com:9000/hooks/?token=x"}
+	assert.Equals(t, wh.urlWithPath(post.Path), "http://example.com:9000/hooks/ingest/docs?token=x")
+
+	// Null means the event isn't posted
+	post, _ = makeTransformedPost(nil)
+	assert.True(t, post == nil)
+}
+
+func TestWebhookTransform(t *testing.T) {
+	var body []byte
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	wh, err := NewWebhookWithOptions(server.URL, "", WebhookOptions{
+		Transform: `function(doc, oldDoc, channels) {
+			return {_payload: {text: doc._id + " in " + channels.join(",")}, _path: "/slack"};
+		}`,
+	})
+	assert.Equals(t, err, nil)
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}, Channels: base.SetOf("B", "A")})
+	assert.Equals(t, path, "/slack")
+	assert.Equals(t, string(body), `{"text":"doc1 in A,B"}`)
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Adds an event handler, either to the event manager or, if durable, as a durable event feed.
+// If id is empty, one is generated; durable handlers must have one, since it identifies their
+// checkpoint.  Returns the handler's ID.
+func (context *DatabaseContext) AddEventHandler(id string, handler EventHandler, eventType EventType, durable bool) (string, error) {
+	if durable {
+		if eventType != DocumentChange {
+			return "", base.HTTPErrorf(http.StatusBadRequest, "Only document_changed event handlers can be durable")
+		}
+		if id == "" {
+			return "", base.HTTPErrorf(http.StatusBadRequest, "Durable event handler for %s must have an id", handler)
+		}
+	}
+	if id != "" && context.durableFeedWithID(id) != nil {
+		return "", base.HTTPErrorf(http.StatusConflict, "There is already an event handler with id %q", id)
+	}
+	if durable {
+		context.EventMgr.handlersLock.RLock()
+		exists := context.EventMgr.handlerWithID(id) != nil
+		context.EventMgr.handlersLock.RUnlock()
+		if exists {
+			return "", base.HTTPErrorf(http.StatusConflict, "There is already an event handler with id %q", id)
+		}
+		if _, err := context.StartDurableEventHandler(id, handler); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+	return context.EventMgr.RegisterEventHandlerWithID(id, handler, eventType)
+}
+
+// Removes the event handler with the given ID, closing it.  A durable handler's checkpoint is kept,
+// so a handler added later with the same ID resumes from it.  Returns false if there's no such handler.
+func (context *DatabaseContext) RemoveEventHandler(id string) bool {
+	if context.EventMgr.RemoveEventHandler(id) {
+		return true
+	}
+	context.durableEventsLock.Lock()
+	var feed *DurableEventFeed
+	remaining := make([]*DurableEventFeed, 0, len(context.durableEvents))
+	for _, existing := range context.durableEvents {
+		if existing.id == id {
+			feed = existing
+		} else {
+			remaining = append(remaining, existing)
+		}
+	}
+	context.durableEvents = remaining
+	context.durableEventsLock.Unlock()
+	if feed == nil {
+		return false
+	}
+	feed.Stop()
+	if closer, ok := feed.handler.(io.Closer); ok {
+		closer.Close()
+	}
+	return true
+}
+
+// Pauses or resumes the event handler with the given ID.  Returns false if there's no such handler.
+func (context *DatabaseContext) PauseEventHandler(id string, paused bool) bool {
+	if context.EventMgr.PauseEventHandler(id, paused) {
+		return true
+	}
+	if feed := context.durableFeedWithID(id); feed != nil {
+		feed.setPaused(paused)
+		return true
+	}
+	return false
+}
+
+// Returns the state of the event queue, and the stats of every event handler, durable or not.
+func (context *DatabaseContext) EventHandlerStats() EventQueueStats {
+	stats := context.EventMgr.Stats()
+	context.durableEventsLock.Lock()
+	feeds := context.durableEvents
+	context.durableEventsLock.Unlock()
+	for _, feed := range feeds {
+		stats.Handlers = append(stats.Handlers, feed.Stats())
+	}
+	if stats.Handlers == nil {
+		stats.Handlers = []EventHandlerStats{}
+	}
+	return stats
+}
+
+func (context *DatabaseContext) durableFeedWithID(id string) *DurableEventFeed {
+	context.durableEventsLock.Lock()
+	defer context.durableEventsLock.Unlock()
+	for _, feed := range context.durableEvents {
+		if feed.id == id {
+			return feed
+		}
+	}
+	return nil
+}
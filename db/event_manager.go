@@ -2,8 +2,12 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"github.com/couchbase/sync_gateway/base"
+	"io"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,30 +16,60 @@ import (
 // The event queue worker goroutine works the event channel and sends events to the appropriate handlers
 type EventManager struct {
 	activeEventTypes   map[EventType]bool
-	eventHandlers      map[EventType][]EventHandler
+	eventHandlers      map[EventType][]*registeredHandler
+	handlersLock       sync.RWMutex // Protects activeEventTypes and eventHandlers, which can change at runtime
+	lastHandlerID      uint64       // Used to generate IDs of handlers registered without one
 	asyncEventChannel  chan Event
 	activeCountChannel chan bool
 	waitTime           int
+	started            bool
+	pendingEvents      int64 // Async events queued or being processed; accessed atomically
+	droppedEvents      int64 // Async events discarded because the queue was full; accessed atomically
+}
+
+// An event handler registered with the EventManager, with the stats reported for it
+type registeredHandler struct {
+	eventHandlerCounters
+	id           string
+	eventType    EventType
+	handler      EventHandler
+	pausedEvents []Event    // Events raised while paused, handled in order once resumed
+	resuming     bool       // True while pausedEvents are being handled after a resume
+	removed      bool       // Set once the handler is removed; it's sent no more events
+	lock         sync.Mutex // Protects pausedEvents, resuming, removed and pausing
 }
 
 const kMaxActiveEvents = 500 // number of events that are processed concurrently
 const kEventWaitTime = 5     // time (ms) to wait before dropping event, when at max events
 
+// Number of events held for a paused handler; events beyond this are discarded, and counted as skipped
+var MaxPausedHandlerEvents = 1000
+
+// How long removing a handler waits for the events it's handling before closing it
+var RemoveEventHandlerTimeout = 60 * time.Second
+
 // Creates a new event manager.  Sets up the event channel for async events, and the goroutine to
 // monitor and process that channel.
 func NewEventManager() *EventManager {
 
 	em := &EventManager{
-		eventHandlers: make(map[EventType][]EventHandler, 0),
+		eventHandlers: make(map[EventType][]*registeredHandler, 0),
 	}
 	// Create channel for queued asynchronous events.
 	em.activeEventTypes = make(map[EventType]bool)
 	return em
 }
 
-// Starts the listener queue for the event manager
+// Starts the listener queue for the event manager.  Does nothing if it's already been started.
 func (em *EventManager) Start(maxProcesses uint, waitTime int) {
 
+	em.handlersLock.Lock()
+	defer em.handlersLock.Unlock()
+	if em.started {
+		return
+	}
+	em.started = true
+
 	if maxProcesses == 0 {
 		maxProcesses = kMaxActiveEvents
 	}
@@ -59,7 +93,10 @@ func (em *EventManager) Start(maxProcesses uint, waitTime int) {
 	go func() {
 		for event := range em.asyncEventChannel {
 			em.activeCountChannel <- true
-			go em.ProcessEvent(event)
+			go func(event Event) {
+				em.ProcessEvent(event)
+				atomic.AddInt64(&em.pendingEvents, -1)
+			}(event)
 		}
 	}()
 
@@ -71,29 +108,213 @@ func (em *EventManager) ProcessEvent(event Event) {
 	// Send event to all registered handlers concurrently.  WaitGroup blocks
 	// until all are finished
 	var wg sync.WaitGroup
-	for _, handler := range em.eventHandlers[event.EventType()] {
-		base.LogTo("Events+", "Event queue worker sending event %s to: %s", event.String(), handler)
+	for _, reg := range em.handlersFor(event.EventType()) {
+		if !em.admitEvent(reg, event) {
+			continue
+		}
+		event.LogContext().LogTo("Events+", "Event queue worker sending event %s to: %s", event.String(), reg.handler)
 		wg.Add(1)
-		go func(event Event, handler EventHandler) {
+		go func(event Event, reg *registeredHandler) {
 			defer wg.Done()
-			//TODO: Currently we're not tracking success/fail from event handlers.  When this
-			// is needed, could pass a channel to HandleEvent for tracking results
-			handler.HandleEvent(event)
-		}(event, handler)
+			reg.handleInFlight(reg.handler, event)
+		}(event, reg)
 	}
 	wg.Wait()
 }
 
+// Decides whether an event is sent to a handler now.  If so, counts it as in flight, so that
+// removing the handler waits for it.  Events for a paused handler are held instead, as are events
+// arriving while a resumed handler is still being sent the ones held for it, to keep them in order.
+func (em *EventManager) admitEvent(reg *registeredHandler, event Event) bool {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.removed {
+		return false
+	}
+	if !reg.isPaused() && !reg.resuming {
+		atomic.AddInt64(&reg.inFlight, 1)
+		return true
+	}
+	if len(reg.pausedEvents) >= MaxPausedHandlerEvents {
+		event.LogContext().LogTo("Events+", "Event handler %s is paused and holding too many events - discarding event: %s", reg.handler, event.String())
+		atomic.AddInt64(&reg.skipped, 1)
+		return false
+	}
+	reg.pausedEvents = append(reg.pausedEvents, event)
+	if !reg.isPaused() {
+		atomic.AddInt64(&em.pendingEvents, 1)
+	}
+	return false
+}
+
+// Sends a resumed handler the events held while it was paused, until there are none left or it's
+// paused again.  Held events count as pending while the handler isn't paused, so
+// WaitForPendingEvents waits for them.
+func (em *EventManager) sendPausedEvents(reg *registeredHandler) {
+	for {
+		reg.lock.Lock()
+		if reg.isPaused() || reg.removed || len(reg.pausedEvents) == 0 {
+			reg.resuming = false
+			reg.lock.Unlock()
+			return
+		}
+		event := reg.pausedEvents[0]
+		reg.pausedEvents[0] = nil
+		reg.pausedEvents = reg.pausedEvents[1:]
+		atomic.AddInt64(&reg.inFlight, 1)
+		reg.lock.Unlock()
+
+		reg.handleInFlight(reg.handler, event)
+		atomic.AddInt64(&em.pendingEvents, -1)
+	}
+}
+
 // Register a new event handler to the EventManager.  The event manager will route events of
 // type eventType to the handler.
 func (em *EventManager) RegisterEventHandler(handler EventHandler, eventType EventType) {
-	em.eventHandlers[eventType] = append(em.eventHandlers[eventType], handler)
+	em.RegisterEventHandlerWithID("", handler, eventType)
+}
+
+// Registers a new event handler with the given ID, which is used to refer to it in the admin API.
+// If id is empty, one is generated.  Returns the ID, or an error if it's already in use.
+func (em *EventManager) RegisterEventHandlerWithID(id string, handler EventHandler, eventType EventType) (string, error) {
+	em.handlersLock.Lock()
+	defer em.handlersLock.Unlock()
+	if id == "" {
+		em.lastHandlerID++
+		id = fmt.Sprintf("%s-%d", eventTypeName(eventType), em.lastHandlerID)
+	} else if em.handlerWithID(id) != nil {
+		return "", base.HTTPErrorf(http.StatusConflict, "There is already an event handler with id %q", id)
+	}
+	reg := &registeredHandler{id: id, eventType: eventType, handler: handler}
+	em.eventHandlers[eventType] = append(em.eventHandlers[eventType], reg)
 	em.activeEventTypes[eventType] = true
 	base.LogTo("Events", "Registered event handler: %v, for event type %v", handler, eventType)
+	return id, nil
+}
+
+// Unregisters the handler with the given ID, and closes it if it holds open resources, once the
+// events already being sent to it have been handled.  Events held while it was paused are
+// discarded.  Returns false if there's no such handler.
+func (em *EventManager) RemoveEventHandler(id string) bool {
+	em.handlersLock.Lock()
+	reg := em.handlerWithID(id)
+	if reg != nil {
+		handlers := em.eventHandlers[reg.eventType]
+		remaining := make([]*registeredHandler, 0, len(handlers))
+		for _, other := range handlers {
+			if other != reg {
+				remaining = append(remaining, other)
+			}
+		}
+		em.eventHandlers[reg.eventType] = remaining
+		em.activeEventTypes[reg.eventType] = len(remaining) > 0
+	}
+	em.handlersLock.Unlock()
+
+	if reg == nil {
+		return false
+	}
+	reg.lock.Lock()
+	reg.removed = true
+	if !reg.isPaused() {
+		atomic.AddInt64(&em.pendingEvents, -int64(len(reg.pausedEvents)))
+	}
+	reg.pausedEvents = nil
+	reg.lock.Unlock()
+
+	base.LogTo("Events", "Removed event handler: %v, for event type %v", reg.handler, reg.eventType)
+	if !waitForZero(&reg.inFlight, RemoveEventHandlerTimeout) {
+		base.Warn("Removed event handler %v is still handling events after %v; closing it anyway", reg.handler, RemoveEventHandlerTimeout)
+	}
+	if closer, ok := reg.handler.(io.Closer); ok {
+		closer.Close()
+	}
+	return true
+}
+
+// Pauses or resumes the handler with the given ID.  While paused, events for the handler are held,
+// up to MaxPausedHandlerEvents, and handled in order once it's resumed; events beyond that are
+// discarded, and counted as skipped.  Returns false if there's no such handler.
+func (em *EventManager) PauseEventHandler(id string, paused bool) bool {
+	em.handlersLock.RLock()
+	reg := em.handlerWithID(id)
+	em.handlersLock.RUnlock()
+	if reg == nil {
+		return false
+	}
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if paused == reg.isPaused() || reg.removed {
+		return true
+	}
+	reg.setPaused(paused)
+	// Held events are pending only while they're due to be handled
+	if paused {
+		atomic.AddInt64(&em.pendingEvents, -int64(len(reg.pausedEvents)))
+	} else if len(reg.pausedEvents) > 0 {
+		atomic.AddInt64(&em.pendingEvents, int64(len(reg.pausedEvents)))
+		if !reg.resuming {
+			reg.resuming = true
+			go em.sendPausedEvents(reg)
+		}
+	}
+	return true
+}
+
+// Must be called with handlersLock held.
+func (em *EventManager) handlerWithID(id string) *registeredHandler {
+	for _, handlers := range em.eventHandlers {
+		for _, reg := range handlers {
+			if reg.id == id {
+				return reg
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the handlers registered for the event type.  The result mustn't be modified.
+func (em *EventManager) handlersFor(eventType EventType) []*registeredHandler {
+	em.handlersLock.RLock()
+	defer em.handlersLock.RUnlock()
+	return em.eventHandlers[eventType]
+}
+
+// Returns all registered handlers.
+func (em *EventManager) allHandlers() []*registeredHandler {
+	em.handlersLock.RLock()
+	defer em.handlersLock.RUnlock()
+	var result []*registeredHandler
+	for _, handlers := range em.eventHandlers {
+		result = append(result, handlers...)
+	}
+	return result
+}
+
+// Returns the registered webhook that posts to the given URL, or nil if there isn't one.
+func (em *EventManager) webhookForUrl(url string) *Webhook {
+	for _, reg := range em.allHandlers() {
+		if wh, ok := reg.handler.(*Webhook); ok && wh.url == url {
+			return wh
+		}
+	}
+	return nil
+}
+
+// Closes the registered handlers that hold open files, processes or connections.
+func (em *EventManager) CloseHandlers() {
+	for _, reg := range em.allHandlers() {
+		if closer, ok := reg.handler.(io.Closer); ok {
+			closer.Close()
+		}
+	}
 }
 
 // Checks whether a handler of the given type has been registered to the event manager.
 func (em *EventManager) HasHandlerForEvent(eventType EventType) bool {
+	em.handlersLock.RLock()
+	defer em.handlersLock.RUnlock()
 	return em.activeEventTypes[eventType]
 }
 
@@ -102,11 +323,18 @@ func (em *EventManager) raiseEvent(event Event) error {
 	if !event.Synchronous() {
 		// When asyncEventChannel is full, the raiseEvent method will block for (waitTime).
 		// Default value of (waitTime) is 5 ms.
+		atomic.AddInt64(&em.pendingEvents, 1)
 		select {
 		case em.asyncEventChannel <- event:
 		case <-time.After(time.Duration(em.waitTime) * time.Millisecond):
+			atomic.AddInt64(&em.pendingEvents, -1)
 			// Event queue channel is full - ignore event and log error
-			base.Warn("Event queue full - discarding event: %s", event.String())
+			event.LogContext().Warn("Event queue full - discarding event: %s", event.String())
+			atomic.AddInt64(&em.droppedEvents, 1)
+			dbExpvars.Add("events_dropped", 1)
+			for _, reg := range em.handlersFor(event.EventType()) {
+				atomic.AddInt64(&reg.dropped, 1)
+			}
 			return errors.New("Event queue full")
 		}
 	}
@@ -114,17 +342,59 @@ func (em *EventManager) raiseEvent(event Event) error {
 	return nil
 }
 
+// Waits until every queued async event has been processed by its handlers, or until the timeout
+// expires, then posts any events waiting in webhook batches or retries.  Returns false on timeout.
+func (em *EventManager) WaitForPendingEvents(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	if !waitForZero(&em.pendingEvents, timeout) {
+		return false
+	}
+	// Handled events may still be waiting in webhook batches, or to be retried
+	for _, reg := range em.allHandlers() {
+		if wh, ok := reg.handler.(*Webhook); ok {
+			wh.flushBatches()
+			if !waitForZero(&wh.pendingRetries, deadline.Sub(time.Now())) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the state of the event queue, and the stats of each registered handler.
+func (em *EventManager) Stats() EventQueueStats {
+	em.handlersLock.RLock()
+	stats := EventQueueStats{
+		QueueDepth:    len(em.asyncEventChannel),
+		QueueCapacity: cap(em.asyncEventChannel),
+		Active:        len(em.activeCountChannel),
+		MaxActive:     cap(em.activeCountChannel),
+		Dropped:       atomic.LoadInt64(&em.droppedEvents),
+	}
+	em.handlersLock.RUnlock()
+	for _, reg := range em.allHandlers() {
+		handlerStats := reg.stats(reg.id, reg.eventType, reg.handler)
+		reg.lock.Lock()
+		handlerStats.Buffered = len(reg.pausedEvents)
+		reg.lock.Unlock()
+		stats.Handlers = append(stats.Handlers, handlerStats)
+	}
+	return stats
+}
+
 // Raises a document change event based on the the document body and channel set.  If the
-// event manager doesn't have a listener for this event, ignores.
-func (em *EventManager) RaiseDocumentChangeEvent(body Body, oldBodyJSON string, channels base.Set) error {
+// event manager doesn't have a listener for this event, ignores.  logContext identifies the
+// request that made the change, and may be nil.
+func (em *EventManager) RaiseDocumentChangeEvent(body Body, oldBodyJSON string, channels base.Set, logContext *base.LogContext) error {
 
-	if !em.activeEventTypes[DocumentChange] {
+	if !em.HasHandlerForEvent(DocumentChange) {
 		return nil
 	}
 	event := &DocumentChangeEvent{
-		Doc:      body,
-		OldDoc:   oldBodyJSON,
-		Channels: channels,
+		AsyncEvent: AsyncEvent{logContext: logContext},
+		Doc:        body,
+		OldDoc:     oldBodyJSON,
+		Channels:   channels,
 	}
 
 	return em.raiseEvent(event)
@@ -135,7 +405,7 @@ func (em *EventManager) RaiseDocumentChangeEvent(body Body, oldBodyJSON string,
 // If the event manager doesn't have a listener for this event, ignores.
 func (em *EventManager) RaiseDBStateChangeEvent(dbName string, state string, reason string, adminInterface string) error {
 
-	if !em.activeEventTypes[DBStateChange] {
+	if !em.HasHandlerForEvent(DBStateChange) {
 		return nil
 	}
 
@@ -152,3 +422,79 @@ func (em *EventManager) RaiseDBStateChangeEvent(dbName string, state string, rea
 
 	return em.raiseEvent(event)
 }
+
+// Raises a principal change event for a user or role.  details holds properties specific to the
+// action, and may be nil.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaisePrincipalChangeEvent(name string, isUser bool, action string, details Body, logContext *base.LogContext) error {
+
+	if !em.HasHandlerForEvent(PrincipalChange) {
+		return nil
+	}
+
+	body := make(Body, len(details)+4)
+	for key, value := range details {
+		body[key] = value
+	}
+	body["name"] = name
+	body["type"] = "role"
+	if isUser {
+		body["type"] = "user"
+	}
+	body["action"] = action
+	body["localtime"] = time.Now().Format(base.ISO8601Format)
+
+	event := &PrincipalChangeEvent{
+		AsyncEvent: AsyncEvent{logContext: logContext},
+		Doc:        body,
+	}
+
+	return em.raiseEvent(event)
+}
+
+// Raises a document rejected event for an update that the sync function rejected with the given
+// error.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseDocumentRejectedEvent(docID string, revID string, userName string, body Body, rejection error, logContext *base.LogContext) error {
+
+	if !em.HasHandlerForEvent(DocumentRejected) {
+		return nil
+	}
+	status, message := base.ErrorAsHTTPStatus(rejection)
+	event := &DocumentRejectedEvent{
+		AsyncEvent: AsyncEvent{logContext: logContext},
+		DocID:      docID,
+		RevID:      revID,
+		User:       userName,
+		Status:     status,
+		Message:    message,
+		Doc:        body,
+		Time:       time.Now(),
+	}
+
+	return em.raiseEvent(event)
+}
+
+// Raises a replication failed event for a replication that stopped with the given error.  If the
+// event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseReplicationFailedEvent(task *base.ActiveTask, reason error) error {
+
+	if !em.HasHandlerForEvent(ReplicationFailed) {
+		return nil
+	}
+	body := Body{
+		"replication_id":       task.ReplicationID,
+		"source":               task.Source,
+		"target":               task.Target,
+		"continuous":           task.Continuous,
+		"error":                reason.Error(),
+		"consecutive_failures": task.ConsecutiveFailures,
+		"localtime":            time.Now().Format(base.ISO8601Format),
+	}
+	if task.CheckpointSeq != nil {
+		body["checkpoint_seq"] = task.CheckpointSeq
+	}
+	event := &ReplicationFailedEvent{
+		Doc: body,
+	}
+
+	return em.raiseEvent(event)
+}
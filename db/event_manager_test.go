@@ -2,14 +2,17 @@ package db
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbaselabs/go.assert"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -64,6 +67,18 @@ func (th *TestingHandler) HandleEvent(event Event) {
 
 		th.ResultChannel <- dsceEvent.Doc
 	}
+
+	if pceEvent, ok := event.(*PrincipalChangeEvent); ok {
+		th.ResultChannel <- pceEvent.Doc
+	}
+
+	if dreEvent, ok := event.(*DocumentRejectedEvent); ok {
+		th.ResultChannel <- dreEvent.Body(true)
+	}
+
+	if rfeEvent, ok := event.(*ReplicationFailedEvent); ok {
+		th.ResultChannel <- rfeEvent.Doc
+	}
 	return
 }
 
@@ -106,7 +121,7 @@ func TestDocumentChangeEvent(t *testing.T) {
 	//Raise events
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	// wait for Event Manager queue worker to process
 	time.Sleep(100 * time.Millisecond)
@@ -201,7 +216,7 @@ func TestSlowExecutionProcessing(t *testing.T) {
 
 	for i := 0; i < 20; i++ {
 		body, channels := eventForTest(i % 10)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	// wait for Event Manager queue worker to process
 	time.Sleep(2 * time.Second)
@@ -211,6 +226,160 @@ func TestSlowExecutionProcessing(t *testing.T) {
 
 }
 
+// Test that WaitForPendingEvents waits for queued events to be handled, as on shutdown
+func TestWaitForPendingEvents(t *testing.T) {
+
+	em := NewEventManager()
+	em.Start(2, -1)
+
+	resultChannel := make(chan Body, 10)
+	testHandler := &TestingHandler{HandledEvent: DocumentChange, handleDelay: 100}
+	testHandler.SetChannel(resultChannel)
+	em.RegisterEventHandler(testHandler, DocumentChange)
+
+	for i := 0; i < 6; i++ {
+		em.RaiseDocumentChangeEvent(Body{"_id": fmt.Sprintf("%d", i)}, "", base.SetOf("A"), nil)
+	}
+	assert.False(t, em.WaitForPendingEvents(10*time.Millisecond))
+	assert.True(t, em.WaitForPendingEvents(5*time.Second))
+	assert.Equals(t, len(resultChannel), 6)
+}
+
+func TestPrincipalChangeEvent(t *testing.T) {
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.EventMgr.Start(0, -1)
+
+	resultChannel := make(chan Body, 10)
+	testHandler := &TestingHandler{HandledEvent: PrincipalChange}
+	testHandler.SetChannel(resultChannel)
+	db.EventMgr.RegisterEventHandler(testHandler, PrincipalChange)
+
+	nextEvent := func() Body {
+		select {
+		case body := <-resultChannel:
+			return body
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for principal change event")
+			return nil
+		}
+	}
+
+	name, password := "naomi", "letmein"
+	_, err := db.UpdatePrincipal(PrincipalConfig{Name: &name, Password: &password, ExplicitChannels: base.SetOf("A")}, true, true)
+	assertNoError(t, err, "Couldn't create user")
+	event := nextEvent()
+	assert.Equals(t, event["name"], "naomi")
+	assert.Equals(t, event["type"], "user")
+	assert.Equals(t, event["action"], PrincipalCreated)
+	assert.DeepEquals(t, event["admin_channels"], []string{"A"})
+
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: &name, ExplicitChannels: base.SetOf("A", "B")}, true, true)
+	assertNoError(t, err, "Couldn't update user")
+	assert.Equals(t, nextEvent()["action"], PrincipalUpdated)
+
+	_, err = db.Authenticator().CreateSession(name, time.Hour)
+	assertNoError(t, err, "Couldn't create session")
+	assert.Equals(t, nextEvent()["action"], PrincipalSessionCreated)
+
+	// A grant by the sync function
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {access(doc.user, doc.channel);}`)
+	_, err = db.Put("grant", Body{"user": "naomi", "channel": "C"})
+	assertNoError(t, err, "Couldn't put doc")
+	event = nextEvent()
+	assert.Equals(t, event["action"], PrincipalAccessChanged)
+	assert.Equals(t, event["grants"], "channels")
+	assert.Equals(t, event["doc_id"], "grant")
+
+	user, _ := db.Authenticator().GetUser(name)
+	assertNoError(t, db.Authenticator().Delete(user), "Couldn't delete user")
+	assert.Equals(t, nextEvent()["action"], PrincipalDeleted)
+
+	// Nothing else, e.g. from invalidating the user's channels
+	assert.True(t, db.EventMgr.WaitForPendingEvents(5*time.Second))
+	assert.Equals(t, len(resultChannel), 0)
+}
+
+func TestDocumentRejectedEvent(t *testing.T) {
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.EventMgr.Start(0, -1)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		if (doc.secret) {
+			throw({forbidden: "no secrets"});
+		}
+		if (doc.broken) {
+			doc.missing.property = true;
+		}
+	}`)
+
+	resultChannel := make(chan Body, 10)
+	testHandler := &TestingHandler{HandledEvent: DocumentRejected}
+	testHandler.SetChannel(resultChannel)
+	db.EventMgr.RegisterEventHandler(testHandler, DocumentRejected)
+
+	rejectionsBefore, _ := strconv.Atoi(rejectedDocsExpvars.Get("db").String())
+
+	_, err := db.Put("allowed", Body{"public": true})
+	assertNoError(t, err, "Couldn't put doc")
+	_, err = db.Put("denied", Body{"secret": true})
+	assertHTTPError(t, err, 403)
+
+	// An exception in the sync function isn't a rejection
+	_, err = db.Put("broken", Body{"broken": true})
+	assertHTTPError(t, err, 500)
+
+	select {
+	case event := <-resultChannel:
+		assert.Equals(t, event["doc_id"], "denied")
+		assert.Equals(t, event["status"], 403)
+		assert.Equals(t, event["message"], "no secrets")
+		assert.Equals(t, event["doc"].(Body)["secret"], true)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for document rejected event")
+	}
+	assert.True(t, db.EventMgr.WaitForPendingEvents(5*time.Second))
+	assert.Equals(t, len(resultChannel), 0)
+
+	rejections, _ := strconv.Atoi(rejectedDocsExpvars.Get("db").String())
+	assert.Equals(t, rejections, rejectionsBefore+1)
+}
+
+func TestReplicationFailedEvent(t *testing.T) {
+
+	em := NewEventManager()
+	em.Start(0, -1)
+
+	// Without a handler, nothing is raised
+	task := &base.ActiveTask{ReplicationID: "rep1", Source: "http://localhost:4985/a", Target: "http://remote:4984/b", Continuous: true, ConsecutiveFailures: 3}
+	assertNoError(t, em.RaiseReplicationFailedEvent(task, errors.New("unreachable")), "Couldn't raise event")
+
+	resultChannel := make(chan Body, 10)
+	testHandler := &TestingHandler{HandledEvent: ReplicationFailed}
+	testHandler.SetChannel(resultChannel)
+	em.RegisterEventHandler(testHandler, ReplicationFailed)
+
+	assertNoError(t, em.RaiseReplicationFailedEvent(task, errors.New("unreachable")), "Couldn't raise event")
+	select {
+	case event := <-resultChannel:
+		assert.Equals(t, event["replication_id"], "rep1")
+		assert.Equals(t, event["target"], "http://remote:4984/b")
+		assert.Equals(t, event["continuous"], true)
+		assert.Equals(t, event["error"], "unreachable")
+		assert.Equals(t, event["consecutive_failures"], 3)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for replication failed event")
+	}
+	assert.True(t, em.WaitForPendingEvents(5*time.Second))
+	assert.Equals(t, len(resultChannel), 0)
+
+	eventType, ok := ParseEventType("replication_failed")
+	assert.True(t, ok)
+	assert.Equals(t, eventType, ReplicationFailed)
+}
+
 func TestCustomHandler(t *testing.T) {
 
 	em := NewEventManager()
@@ -243,7 +412,7 @@ func TestCustomHandler(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	// wait for Event Manager queue worker to process
 	time.Sleep(50 * time.Millisecond)
@@ -286,7 +455,7 @@ func TestUnhandledEvent(t *testing.T) {
 	// send DocumentChange events to handler
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	// Wait for Event Manager queue worker to process
 	time.Sleep(50 * time.Millisecond)
@@ -389,7 +558,7 @@ func TestWebhookBasic(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 10)
@@ -410,7 +579,7 @@ func TestWebhookBasic(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 4)
@@ -422,7 +591,7 @@ func TestWebhookBasic(t *testing.T) {
 	webhookHandler, _ = NewWebhook("http://localhost:8081/echo", "", nil)
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	body, channels := eventForTest(0)
-	em.RaiseDocumentChangeEvent(body, "", channels)
+	em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	time.Sleep(50 * time.Millisecond)
 	receivedPayload := string((*payloads)[0])
 	fmt.Println("payload:", receivedPayload)
@@ -438,7 +607,7 @@ func TestWebhookBasic(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 100; i++ {
 		body, channels := eventForTest(i % 10)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	time.Sleep(500 * time.Millisecond)
 	assert.Equals(t, *count, 100)
@@ -453,7 +622,7 @@ func TestWebhookBasic(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 100; i++ {
 		body, channels := eventForTest(i)
-		err := em.RaiseDocumentChangeEvent(body, "", channels)
+		err := em.RaiseDocumentChangeEvent(body, "", channels, nil)
 		time.Sleep(2 * time.Millisecond)
 		if err != nil {
 			errCount++
@@ -474,7 +643,7 @@ func TestWebhookBasic(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 100; i++ {
 		body, channels := eventForTest(i % 10)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	time.Sleep(5 * time.Second)
 	assert.Equals(t, *count, 100)
@@ -520,7 +689,7 @@ func TestWebhookOldDoc(t *testing.T) {
 		oldBody, _ := eventForTest(-i)
 		oldBodyBytes, _ := json.Marshal(oldBody)
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels)
+		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 10)
@@ -543,7 +712,7 @@ func TestWebhookOldDoc(t *testing.T) {
 		oldBody, _ := eventForTest(-i)
 		oldBodyBytes, _ := json.Marshal(oldBody)
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels)
+		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 4)
@@ -566,7 +735,7 @@ func TestWebhookOldDoc(t *testing.T) {
 		oldBody, _ := eventForTest(-i)
 		oldBodyBytes, _ := json.Marshal(oldBody)
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels)
+		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 4)
@@ -587,13 +756,13 @@ func TestWebhookOldDoc(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	for i := 10; i < 20; i++ {
 		body, channels := eventForTest(i)
 		oldBody, _ := eventForTest(-i)
 		oldBodyBytes, _ := json.Marshal(oldBody)
-		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels)
+		em.RaiseDocumentChangeEvent(body, string(oldBodyBytes), channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 10)
@@ -642,7 +811,7 @@ func TestWebhookTimeout(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 	time.Sleep(50 * time.Millisecond)
 	assert.Equals(t, *count, 10)
@@ -658,7 +827,7 @@ func TestWebhookTimeout(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		err := em.RaiseDocumentChangeEvent(body, "", channels)
+		err := em.RaiseDocumentChangeEvent(body, "", channels, nil)
 		time.Sleep(2 * time.Millisecond)
 		if err != nil {
 			errCount++
@@ -680,7 +849,7 @@ func TestWebhookTimeout(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		err := em.RaiseDocumentChangeEvent(body, "", channels)
+		err := em.RaiseDocumentChangeEvent(body, "", channels, nil)
 		time.Sleep(2 * time.Millisecond)
 		if err != nil {
 			errCount++
@@ -701,7 +870,7 @@ func TestWebhookTimeout(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		err := em.RaiseDocumentChangeEvent(body, "", channels)
+		err := em.RaiseDocumentChangeEvent(body, "", channels, nil)
 		time.Sleep(2 * time.Millisecond)
 		if err != nil {
 			errCount++
@@ -741,8 +910,98 @@ func TestUnavailableWebhook(t *testing.T) {
 	em.RegisterEventHandler(webhookHandler, DocumentChange)
 	for i := 0; i < 10; i++ {
 		body, channels := eventForTest(i)
-		em.RaiseDocumentChangeEvent(body, "", channels)
+		em.RaiseDocumentChangeEvent(body, "", channels, nil)
 	}
 
 	time.Sleep(50 * time.Millisecond)
 }
+
+func TestEventHandlerStats(t *testing.T) {
+	em := NewEventManager()
+	em.Start(0, -1)
+	handler := &TestingHandler{HandledEvent: DocumentChange, ResultChannel: make(chan Body, 10)}
+	id, err := em.RegisterEventHandlerWithID("changes", handler, DocumentChange)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, id, "changes")
+	_, err = em.RegisterEventHandlerWithID("changes", handler, DocumentChange)
+	assertHTTPError(t, err, 409)
+
+	em.RaiseDocumentChangeEvent(Body{"_id": "doc1"}, "", nil, nil)
+	em.RaiseDocumentChangeEvent(Body{"_id": "doc2"}, "", nil, nil)
+	assert.True(t, em.WaitForPendingEvents(5*time.Second))
+
+	// Events for a paused handler are held, up to a limit, and the rest are skipped
+	defer func(max int) { MaxPausedHandlerEvents = max }(MaxPausedHandlerEvents)
+	MaxPausedHandlerEvents = 2
+	assert.True(t, em.PauseEventHandler("changes", true))
+	em.RaiseDocumentChangeEvent(Body{"_id": "doc3"}, "", nil, nil)
+	em.RaiseDocumentChangeEvent(Body{"_id": "doc4"}, "", nil, nil)
+	em.RaiseDocumentChangeEvent(Body{"_id": "doc5"}, "", nil, nil)
+	assert.True(t, em.WaitForPendingEvents(5*time.Second))
+
+	stats := em.Stats()
+	assert.Equals(t, len(stats.Handlers), 1)
+	assert.Equals(t, stats.Handlers[0].ID, "changes")
+	assert.Equals(t, stats.Handlers[0].EventType, "document_changed")
+	assert.Equals(t, stats.Handlers[0].Processed, int64(2))
+	assert.Equals(t, stats.Handlers[0].Buffered, 2)
+	assert.Equals(t, stats.Handlers[0].Skipped, int64(1))
+	assert.True(t, stats.Handlers[0].Paused)
+	assert.Equals(t, len(handler.ResultChannel), 2)
+
+	// Resuming the handler sends it the held events
+	assert.True(t, em.PauseEventHandler("changes", false))
+	assert.True(t, em.WaitForPendingEvents(5*time.Second))
+	stats = em.Stats()
+	assert.Equals(t, stats.Handlers[0].Processed, int64(4))
+	assert.Equals(t, stats.Handlers[0].Buffered, 0)
+	assert.False(t, stats.Handlers[0].Paused)
+	assert.Equals(t, len(handler.ResultChannel), 4)
+
+	// Generated IDs are based on the event type
+	id, _ = em.RegisterEventHandlerWithID("", handler, DBStateChange)
+	assert.Equals(t, id, "db_state_changed-1")
+
+	assert.True(t, em.RemoveEventHandler("changes"))
+	assert.False(t, em.RemoveEventHandler("changes"))
+	assert.False(t, em.HasHandlerForEvent(DocumentChange))
+	assert.True(t, em.HasHandlerForEvent(DBStateChange))
+}
+
+// An event handler that counts the events it's sent after being closed
+type closingTestHandler struct {
+	TestingHandler
+	closed        int32
+	handledClosed int32
+}
+
+func (th *closingTestHandler) HandleEvent(event Event) {
+	th.TestingHandler.HandleEvent(event)
+	if atomic.LoadInt32(&th.closed) != 0 {
+		atomic.AddInt32(&th.handledClosed, 1)
+	}
+}
+
+func (th *closingTestHandler) Close() error {
+	atomic.StoreInt32(&th.closed, 1)
+	return nil
+}
+
+func TestRemoveEventHandlerWaitsForEvents(t *testing.T) {
+	em := NewEventManager()
+	em.Start(0, -1)
+	handler := &closingTestHandler{TestingHandler: TestingHandler{HandledEvent: DocumentChange, ResultChannel: make(chan Body, 10), handleDelay: 200}}
+	_, err := em.RegisterEventHandlerWithID("slow", handler, DocumentChange)
+	assert.Equals(t, err, nil)
+
+	em.RaiseDocumentChangeEvent(Body{"_id": "doc1"}, "", nil, nil)
+	for i := 0; i < 50 && em.Stats().Handlers[0].InFlight == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The handler isn't closed until it's finished handling the event
+	assert.True(t, em.RemoveEventHandler("slow"))
+	assert.Equals(t, len(handler.ResultChannel), 1)
+	assert.Equals(t, atomic.LoadInt32(&handler.closed), int32(1))
+	assert.Equals(t, atomic.LoadInt32(&handler.handledClosed), int32(0))
+}
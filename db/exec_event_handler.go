@@ -0,0 +1,184 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Minimum time between restarts of an exec handler's process, so a process that keeps exiting
+// isn't restarted for every event
+const kExecRestartInterval = 1 * time.Second
+
+// How long writing an event to an exec handler's process may block before the process is killed
+var ExecEventWriteTimeout = 10 * time.Second
+
+// How long a closed exec handler's process has to exit after its stdin is closed, before it's killed
+var ExecEventStopTimeout = 5 * time.Second
+
+// ExecEventHandler is an implementation of EventHandler that writes events as NDJSON to the stdin of
+// a long-running local process.  The process is started when the first event is handled, and
+// restarted if it exits.  A process that stops reading its stdin is killed, and restarted for a
+// later event.  Lines it writes to stderr are logged.
+type ExecEventHandler struct {
+	AsyncEventHandler
+	eventFunctions
+	deliveryFailures
+	command   []string
+	stdin     io.WriteCloser
+	process   *os.Process
+	exited    chan struct{} // Closed when the process has exited
+	startTime time.Time
+	closed    bool
+	lock      sync.Mutex // Serializes writes and restarts
+}
+
+// Creates a new exec event handler.  command is the path of the executable followed by its arguments.
+func NewExecEventHandler(command []string, filterFnString string, options EventSinkOptions) (*ExecEventHandler, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, errors.New("command parameter must be defined for exec events.")
+	}
+	return &ExecEventHandler{
+		eventFunctions: newEventFunctions(filterFnString, options.Transform, options.IncludeBody),
+		command:        command,
+	}, nil
+}
+
+// Writes the event's payload to the process, if it passes the filter function.
+func (eh *ExecEventHandler) HandleEvent(event Event) {
+	post := eh.filterAndMakePost(event, "exec")
+	if post == nil {
+		return
+	}
+	if err := eh.write(post.ndjsonLine()); err != nil {
+		event.LogContext().Warn("Error writing %s to %s: %v", event.String(), eh, err)
+		dbExpvars.Add("event_sink_failures", 1)
+		eh.addFailure()
+	}
+}
+
+func (eh *ExecEventHandler) write(line []byte) error {
+	eh.lock.Lock()
+	defer eh.lock.Unlock()
+
+	if eh.closed {
+		return errors.New("handler is closed")
+	}
+	if eh.stdin != nil {
+		err := eh._writeToProcess(line)
+		if err == nil {
+			return nil
+		} else if err == errExecWriteTimeout {
+			return err
+		}
+		base.Warn("%s: process has stopped (%v); restarting", eh, err)
+		eh.stop()
+	}
+	if time.Since(eh.startTime) < kExecRestartInterval {
+		return errors.New("process was restarted too recently")
+	}
+	if err := eh.start(); err != nil {
+		return err
+	}
+	return eh._writeToProcess(line)
+}
+
+var errExecWriteTimeout = errors.New("process isn't reading events; killed it")
+
+// Writes to the process's stdin, killing the process if the write blocks for longer than
+// ExecEventWriteTimeout.  Must be called with the lock held.
+func (eh *ExecEventHandler) _writeToProcess(line []byte) error {
+	stdin := eh.stdin
+	result := make(chan error, 1)
+	go func() {
+		_, err := stdin.Write(line)
+		result <- err
+	}()
+	timer := time.NewTimer(ExecEventWriteTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		// Killing the process fails the write, ending the goroutine
+		eh.process.Kill()
+		eh.stop()
+		return errExecWriteTimeout
+	}
+}
+
+func (eh *ExecEventHandler) start() error {
+	eh.startTime = time.Now()
+	cmd := exec.Command(eh.command[0], eh.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	base.LogTo("Events", "%s: started process %d", eh, cmd.Process.Pid)
+	eh.stdin = stdin
+	eh.process = cmd.Process
+	exited := make(chan struct{})
+	eh.exited = exited
+
+	go func() {
+		defer close(exited)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			base.LogTo("Events", "%s: %s", eh, scanner.Text())
+		}
+		if err := cmd.Wait(); err != nil {
+			base.Warn("%s: process %d exited: %v", eh, cmd.Process.Pid, err)
+		}
+	}()
+	return nil
+}
+
+// Closes the process's stdin, which should make it exit.  Must be called with the lock held.
+func (eh *ExecEventHandler) stop() {
+	if eh.stdin != nil {
+		eh.stdin.Close()
+		eh.stdin = nil
+	}
+}
+
+// Stops the process, killing it if it hasn't exited within ExecEventStopTimeout of its stdin
+// being closed.  Events handled afterwards aren't written.
+func (eh *ExecEventHandler) Close() error {
+	eh.lock.Lock()
+	eh.closed = true
+	eh.stop()
+	process, exited := eh.process, eh.exited
+	eh.lock.Unlock()
+
+	if process == nil {
+		return nil
+	}
+	timer := time.NewTimer(ExecEventStopTimeout)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		return nil
+	case <-timer.C:
+		base.Warn("%s: process %d didn't exit; killing it", eh, process.Pid)
+		return process.Kill()
+	}
+}
+
+func (eh *ExecEventHandler) String() string {
+	return fmt.Sprintf("Exec event handler [%s]", strings.Join(eh.command, " "))
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestExecEventHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+
+	eh, err := NewExecEventHandler([]string{"sh", "-c", "cat > " + path}, "", EventSinkOptions{})
+	assertNoError(t, err, "Couldn't create exec event handler")
+	eh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	eh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	eh.Close()
+
+	// Closing stdin makes the process exit once it's written everything
+	expected := "{\"_id\":\"doc1\"}\n{\"_id\":\"doc2\"}\n"
+	var contents []byte
+	for i := 0; i < 50 && string(contents) != expected; i++ {
+		time.Sleep(20 * time.Millisecond)
+		contents, _ = ioutil.ReadFile(path)
+	}
+	assert.Equals(t, string(contents), expected)
+
+	_, err = NewExecEventHandler(nil, "", EventSinkOptions{})
+	assert.True(t, err != nil)
+}
+
+func TestExecEventHandlerStuckProcess(t *testing.T) {
+	defer func(write, stop time.Duration) {
+		ExecEventWriteTimeout, ExecEventStopTimeout = write, stop
+	}(ExecEventWriteTimeout, ExecEventStopTimeout)
+	ExecEventWriteTimeout = 100 * time.Millisecond
+	ExecEventStopTimeout = 100 * time.Millisecond
+
+	// A process that never reads its stdin is killed once the pipe's buffer fills up
+	eh, err := NewExecEventHandler([]string{"sleep", "60"}, "", EventSinkOptions{})
+	assertNoError(t, err, "Couldn't create exec event handler")
+	filler := strings.Repeat("x", 200*1024)
+	eh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1", "filler": filler}})
+	assert.Equals(t, eh.Failures(), int64(1))
+
+	// A process that doesn't exit when its stdin is closed is killed by Close
+	time.Sleep(kExecRestartInterval)
+	eh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	assert.Equals(t, eh.Failures(), int64(1))
+	eh.lock.Lock()
+	exited := eh.exited
+	eh.lock.Unlock()
+	assertNoError(t, eh.Close(), "Couldn't close exec event handler")
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Process wasn't killed")
+	}
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Rotation of event files when none is configured: at 100MB, keeping 5 rotated files
+var defaultEventFileRotation = base.LogRotationConfig{MaxSize: 100, MaxBackups: 5}
+
+// FileEventHandler is an implementation of EventHandler that appends events to a file as NDJSON.
+// The file is rotated like a log file: once it reaches its max size or age it's renamed with a
+// timestamp inserted before its extension, and a new file is started.
+type FileEventHandler struct {
+	AsyncEventHandler
+	eventFunctions
+	deliveryFailures
+	path string
+	file *base.RotatingFile
+}
+
+// Creates a new file event handler.  A nil rotation uses the default.
+func NewFileEventHandler(path string, filterFnString string, rotation *base.LogRotationConfig, options EventSinkOptions) (*FileEventHandler, error) {
+	if path == "" {
+		return nil, errors.New("path parameter must be defined for file events.")
+	}
+	if rotation == nil {
+		rotation = &defaultEventFileRotation
+	}
+	file, err := base.NewRotatingFile(path, rotation)
+	if err != nil {
+		return nil, err
+	}
+	return &FileEventHandler{
+		eventFunctions: newEventFunctions(filterFnString, options.Transform, options.IncludeBody),
+		path:           path,
+		file:           file,
+	}, nil
+}
+
+// Appends the event's payload to the file, if it passes the filter function.
+func (fh *FileEventHandler) HandleEvent(event Event) {
+	post := fh.filterAndMakePost(event, "file")
+	if post == nil {
+		return
+	}
+	if _, err := fh.file.Write(post.ndjsonLine()); err != nil {
+		event.LogContext().Warn("Error writing %s to event file %s: %v", event.String(), fh.path, err)
+		dbExpvars.Add("event_sink_failures", 1)
+		fh.addFailure()
+	}
+}
+
+// Closes the file.  Events handled afterwards aren't written.
+func (fh *FileEventHandler) Close() error {
+	return fh.file.Close()
+}
+
+func (fh *FileEventHandler) String() string {
+	return fmt.Sprintf("File event handler [%s]", fh.path)
+}
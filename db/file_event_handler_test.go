@@ -0,0 +1,48 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestFileEventHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+
+	fh, err := NewFileEventHandler(path, "", &base.LogRotationConfig{MaxSize: 1, MaxBackups: 2}, EventSinkOptions{})
+	assertNoError(t, err, "Couldn't create file event handler")
+	fh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	fh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	contents, _ := ioutil.ReadFile(path)
+	assert.Equals(t, string(contents), "{\"_id\":\"doc1\"}\n{\"_id\":\"doc2\"}\n")
+
+	// Exceeding the max size rotates the file, keeping max_backups old ones.  Each of these
+	// events is 600KB, so every one of them starts a new file.
+	filler := strings.Repeat("x", 600*1024)
+	for i := 0; i < 4; i++ {
+		fh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "big", "filler": filler}})
+		// Rotated files are pruned asynchronously
+		time.Sleep(50 * time.Millisecond)
+	}
+	fh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc3"}})
+	assertNoError(t, fh.Close(), "Couldn't close file event handler")
+
+	contents, _ = ioutil.ReadFile(path)
+	assert.True(t, strings.HasSuffix(string(contents), "{\"_id\":\"doc3\"}\n"))
+	backups, _ := filepath.Glob(filepath.Join(dir, "events-*.log"))
+	assert.Equals(t, len(backups), 2)
+	assert.Equals(t, fh.Failures(), int64(0))
+
+	// Events handled after closing aren't written
+	fh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc4"}})
+	assert.Equals(t, fh.Failures(), int64(1))
+}
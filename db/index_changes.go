@@ -25,7 +25,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 		userVbNo = uint16(db.Bucket.VBHash(db.user.DocID()))
 	}
 
-	base.LogTo("Changes+", "Vector MultiChangesFeed(%s, %+v) ... %s", chans, options, to)
+	db.logContext.LogTo("Changes+", "Vector MultiChangesFeed(%s, %+v) ... %s", chans, options, to)
 	output := make(chan *ChangeEntry, 50)
 
 	go func() {
@@ -33,7 +33,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 		var lastHashedValue string
 		hashedEntryCount := 0
 		defer func() {
-			base.LogTo("Changes+", "MultiChangesFeed done %s", to)
+			db.logContext.LogTo("Changes+", "MultiChangesFeed done %s", to)
 			close(output)
 		}()
 
@@ -66,7 +66,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 			// Get the last polled stable sequence.  We don't return anything later than stable sequence in each iteration
 			stableClock, err := db.changeCache.GetStableClock(true)
 			if err != nil {
-				base.Warn("MultiChangesFeed got error reading stable sequence: %v", err)
+				db.logContext.Warn("MultiChangesFeed got error reading stable sequence: %v", err)
 				return
 			}
 
@@ -74,7 +74,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 			if changeWaiter != nil {
 				changeWaiter.UpdateChannels(channelsSince)
 			}
-			base.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince, to)
+			db.logContext.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince, to)
 
 			// Build the channel feeds.
 			feeds, err := db.initializeChannelFeeds(channelsSince, options, addedChannels, userVbNo)
@@ -142,7 +142,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 						cumulativeClock.SetMaxSequence(minEntry.Seq.TriggeredByVbNo, minEntry.Seq.TriggeredBy)
 						clockHash, err := db.SequenceHasher.GetHash(cumulativeClock)
 						if err != nil {
-							base.Warn("Error calculating hash for triggered by clock:%v", base.PrintClock(cumulativeClock))
+							db.logContext.Warn("Error calculating hash for triggered by clock:%v", base.PrintClock(cumulativeClock))
 						} else {
 							minEntry.Seq.TriggeredByClock.SetHashedValue(clockHash)
 						}
@@ -175,7 +175,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 
 			// If nothing found, and in wait mode: wait for the db to change, then run again.
 			// First notify the reader that we're waiting by sending a nil.
-			base.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
+			db.logContext.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
 			output <- nil
 
 		waitForChanges:
@@ -208,7 +208,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 			}
 			if err != nil {
 				change := makeErrorEntry("User not found during reload - terminating changes feed")
-				base.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
+				db.logContext.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
 				output <- &change
 				return
 			}
@@ -279,7 +279,7 @@ func (db *Database) calculateHashWhenNeeded(options ChangesOptions, entry *Chang
 	if *hashedEntryCount == 0 || forceHash {
 		clockHash, err := db.SequenceHasher.GetHash(cumulativeClock)
 		if err != nil {
-			base.Warn("Error calculating hash for clock:%v", base.PrintClock(cumulativeClock))
+			db.logContext.Warn("Error calculating hash for clock:%v", base.PrintClock(cumulativeClock))
 			return lastHashedValue
 		} else {
 			entry.Seq.Clock = base.NewSyncSequenceClock()
@@ -299,7 +299,7 @@ func (db *Database) initializeChannelFeeds(channelsSince channels.TimedSet, opti
 	// Populate the  array of feed channels:
 	feeds := make([]<-chan *ChangeEntry, 0, len(channelsSince))
 
-	base.LogTo("Changes+", "GotChannelSince... %v", channelsSince)
+	db.logContext.LogTo("Changes+", "GotChannelSince... %v", channelsSince)
 	for name, vbSeqAddedAt := range channelsSince {
 		seqAddedAt := vbSeqAddedAt.Sequence
 		// If there's no vbNo on the channelsSince, it indicates a user doc channel grant - use the userVbNo.
@@ -310,7 +310,7 @@ func (db *Database) initializeChannelFeeds(channelsSince channels.TimedSet, opti
 			vbAddedAt = *vbSeqAddedAt.VbNo
 		}
 
-		base.LogTo("Changes+", "Starting for channel... %s, %d", name, seqAddedAt)
+		db.logContext.LogTo("Changes+", "Starting for channel... %s, %d", name, seqAddedAt)
 		chanOpts := options
 
 		// Check whether requires backfill based on addedChannels in this _changes feed
@@ -337,7 +337,7 @@ func (db *Database) initializeChannelFeeds(channelsSince channels.TimedSet, opti
 
 		if isNewChannel || (backfillRequired && !backfillInProgress) {
 			// Case 2.  No backfill in progress, backfill required
-			base.LogTo("Changes+", "Starting backfill for channel... %s, %d", name, seqAddedAt)
+			db.logContext.LogTo("Changes+", "Starting backfill for channel... %s, %d", name, seqAddedAt)
 			chanOpts.Since = SequenceID{
 				Seq:              0,
 				vbNo:             0,
@@ -361,7 +361,7 @@ func (db *Database) initializeChannelFeeds(channelsSince channels.TimedSet, opti
 		}
 		feed, err := db.vectorChangesFeed(name, chanOpts)
 		if err != nil {
-			base.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
+			db.logContext.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
 			return feeds, err
 		}
 		feeds = append(feeds, feed)
@@ -379,7 +379,7 @@ func (db *Database) initializeChannelFeeds(channelsSince channels.TimedSet, opti
 func (db *Database) vectorChangesFeed(channel string, options ChangesOptions) (<-chan *ChangeEntry, error) {
 	dbExpvars.Add("channelChangesFeeds", 1)
 	log, err := db.changeCache.GetChanges(channel, options)
-	base.LogTo("Changes+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
+	db.logContext.LogTo("Changes+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
 	if err != nil {
 		return nil, err
 	}
@@ -417,7 +417,7 @@ func (db *Database) vectorChangesFeed(channel string, options ChangesOptions) (<
 					change := makeChangeEntry(logEntry, seqID, channel)
 					select {
 					case <-options.Terminator:
-						base.LogTo("Changes+", "Aborting changesFeed")
+						db.logContext.LogTo("Changes+", "Aborting changesFeed")
 						return
 					case feed <- &change:
 					}
@@ -441,7 +441,7 @@ func (db *Database) vectorChangesFeed(channel string, options ChangesOptions) (<
 				change := makeChangeEntry(logEntry, seqID, channel)
 				select {
 				case <-options.Terminator:
-					base.LogTo("Changes+", "Aborting changesFeed")
+					db.logContext.LogTo("Changes+", "Aborting changesFeed")
 					return
 				case feed <- &change:
 				}
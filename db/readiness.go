@@ -0,0 +1,167 @@
+package db
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	DefaultReadinessMaxCacheLag    = 1000 // Max sequences the change cache may trail the sequence allocator by
+	DefaultReadinessMaxSkippedSeqs = 1000 // Max sequences waiting in the skipped sequence queue
+)
+
+// Reasons reported when a readiness check fails
+const (
+	kReadinessReasonOffline           = "database is not online"
+	kReadinessReasonBucketUnavailable = "bucket is not reachable"
+	kReadinessReasonFeedStopped       = "mutation feed is not running"
+	kReadinessReasonCacheLag          = "change cache lag exceeds threshold"
+	kReadinessReasonSkippedSeqs       = "skipped sequence queue exceeds threshold"
+	kReadinessReasonCacheWarmup       = "channel cache warm-up in progress"
+)
+
+// Thresholds used when deciding whether a database is ready to receive traffic.  A nil threshold
+// uses the default; zero allows no lag or skipped sequences at all.
+type ReadinessOptions struct {
+	MaxCacheLag         *uint64 // Max difference between the allocated and cached sequence
+	MaxSkippedSequences *int    // Max length of the skipped sequence queue
+}
+
+// Result of a readiness check, returned as-is by the admin REST API.  The public API only
+// returns its Summary.
+type ReadinessStatus struct {
+	Ready   bool                   `json:"ready"`
+	State   string                 `json:"state"`
+	Bucket  *ReadinessBucketStatus `json:"bucket,omitempty"`
+	Feed    *ReadinessFeedStatus   `json:"feed,omitempty"`
+	Cache   *ReadinessCacheStatus  `json:"cache,omitempty"`
+	Reasons []string               `json:"reasons,omitempty"`
+}
+
+type ReadinessBucketStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadinessFeedStatus struct {
+	OK   bool   `json:"ok"`
+	Type string `json:"type,omitempty"`
+}
+
+type ReadinessCacheStatus struct {
+	OK               bool   `json:"ok"`
+	LastSequence     uint64 `json:"last_sequence"`
+	CachedSequence   uint64 `json:"cached_sequence"`
+	Lag              uint64 `json:"lag"`
+	MaxLag           uint64 `json:"max_lag"`
+	SkippedSequences int    `json:"skipped_sequences"`
+	MaxSkipped       int    `json:"max_skipped_sequences"`
+	WarmingUp        bool   `json:"warming_up,omitempty"`
+}
+
+// Returns the status without the details of the individual checks, which can include bucket
+// error messages and sequence numbers that unauthenticated clients shouldn't see.
+func (status ReadinessStatus) Summary() ReadinessStatus {
+	return ReadinessStatus{
+		Ready:   status.Ready,
+		State:   status.State,
+		Reasons: status.Reasons,
+	}
+}
+
+// Returns the effective readiness thresholds, filling in defaults for unset values.
+func (context *DatabaseContext) readinessThresholds() (maxCacheLag uint64, maxSkippedSequences int) {
+	maxCacheLag = DefaultReadinessMaxCacheLag
+	maxSkippedSequences = DefaultReadinessMaxSkippedSeqs
+	if options := context.Options.ReadinessOptions; options != nil {
+		if options.MaxCacheLag != nil {
+			maxCacheLag = *options.MaxCacheLag
+		}
+		if options.MaxSkippedSequences != nil {
+			maxSkippedSequences = *options.MaxSkippedSequences
+		}
+	}
+	return maxCacheLag, maxSkippedSequences
+}
+
+// Checks whether the database is able to service requests: it must be online, its bucket must
+// respond to a cheap counter read, its mutation feed must be running, and (for the in-memory
+// change cache) the cache must be reasonably close to the latest allocated sequence.
+func (context *DatabaseContext) CheckReadiness() ReadinessStatus {
+	maxCacheLag, maxSkippedSequences := context.readinessThresholds()
+	dbState := atomic.LoadUint32(&context.State)
+	status := ReadinessStatus{
+		Ready: true,
+		State: RunStateString[dbState],
+	}
+
+	if dbState != DBOnline {
+		status.Ready = false
+		status.Reasons = append(status.Reasons, kReadinessReasonOffline)
+	}
+
+	// Bucket connectivity: a zero-delta Incr on the sequence counter is the cheapest round trip
+	// that's guaranteed to touch the server.
+	var bucketErr error
+	context.BucketLock.RLock()
+	if context.Bucket != nil {
+		_, bucketErr = context.Bucket.Incr(SyncSeqKey, 0, 0, 0)
+	} else {
+		bucketErr = errors.New("Database closed")
+	}
+	context.BucketLock.RUnlock()
+	status.Bucket = &ReadinessBucketStatus{}
+	if bucketErr != nil {
+		status.Ready = false
+		status.Bucket.Error = bucketErr.Error()
+		status.Reasons = append(status.Reasons, kReadinessReasonBucketUnavailable)
+	} else {
+		status.Bucket.OK = true
+	}
+
+	status.Feed = &ReadinessFeedStatus{Type: context.BucketSpec.FeedType}
+	if context.tapListener.IsFeedActive() {
+		status.Feed.OK = true
+	} else {
+		status.Ready = false
+		status.Reasons = append(status.Reasons, kReadinessReasonFeedStopped)
+	}
+
+	// Cache lag is only meaningful for the in-memory change cache.  It's measured from the highest
+	// sequence assigned, not the _sync:seq counter, which counts batches reserved but not yet used.
+	if cache, ok := context.changeCache.(*changeCache); ok && bucketErr == nil {
+		lastSeq, _ := context.LastSequence()
+		cacheStatus := &ReadinessCacheStatus{
+			OK:               true,
+			LastSequence:     lastSeq,
+			CachedSequence:   cache.LastSequence(),
+			SkippedSequences: cache.getSkippedSequenceCount(),
+			MaxLag:           maxCacheLag,
+			MaxSkipped:       maxSkippedSequences,
+		}
+		if cacheStatus.LastSequence > cacheStatus.CachedSequence {
+			cacheStatus.Lag = cacheStatus.LastSequence - cacheStatus.CachedSequence
+		}
+		if cacheStatus.Lag > maxCacheLag {
+			cacheStatus.OK = false
+			status.Reasons = append(status.Reasons, kReadinessReasonCacheLag)
+		}
+		if cacheStatus.SkippedSequences > maxSkippedSequences {
+			cacheStatus.OK = false
+			status.Reasons = append(status.Reasons, kReadinessReasonSkippedSeqs)
+		}
+		if cache.isWarmingUp() {
+			cacheStatus.WarmingUp = true
+			if cache.options.WarmupWait {
+				cacheStatus.OK = false
+				status.Reasons = append(status.Reasons, kReadinessReasonCacheWarmup)
+			}
+		}
+		if !cacheStatus.OK {
+			status.Ready = false
+		}
+		status.Cache = cacheStatus
+	}
+
+	return status
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestReadinessBucketError(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	status := db.CheckReadiness()
+	assert.True(t, status.Ready)
+	assert.True(t, status.Bucket.OK)
+
+	// Without a bucket the check fails, and reports why
+	db.BucketLock.Lock()
+	bucket := db.Bucket
+	db.Bucket = nil
+	db.BucketLock.Unlock()
+	status = db.CheckReadiness()
+	db.BucketLock.Lock()
+	db.Bucket = bucket
+	db.BucketLock.Unlock()
+
+	assert.False(t, status.Ready)
+	assert.False(t, status.Bucket.OK)
+	assert.Equals(t, status.Bucket.Error, "Database closed")
+	assert.DeepEquals(t, status.Reasons, []string{kReadinessReasonBucketUnavailable})
+
+	// The summary leaves out the details
+	summary := status.Summary()
+	assert.False(t, summary.Ready)
+	assert.True(t, summary.Bucket == nil)
+	assert.DeepEquals(t, summary.Reasons, status.Reasons)
+}
+
+func TestReadinessCacheLag(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// A zero threshold allows no lag at all
+	maxLag := uint64(0)
+	db.Options.ReadinessOptions = &ReadinessOptions{MaxCacheLag: &maxLag}
+	status := db.CheckReadiness()
+	assert.True(t, status.Ready)
+	assert.Equals(t, status.Cache.MaxLag, uint64(0))
+
+	// Assigning a sequence that the cache hasn't received yet puts it behind
+	_, err := db.sequences.nextSequence()
+	assertNoError(t, err, "Couldn't assign sequence")
+	status = db.CheckReadiness()
+	assert.False(t, status.Ready)
+	assert.Equals(t, status.Cache.Lag, uint64(1))
+	assert.DeepEquals(t, status.Reasons, []string{kReadinessReasonCacheLag})
+
+	// The default threshold allows it
+	db.Options.ReadinessOptions = nil
+	status = db.CheckReadiness()
+	assert.True(t, status.Ready)
+	assert.Equals(t, status.Cache.MaxLag, uint64(DefaultReadinessMaxCacheLag))
+}
@@ -116,10 +116,11 @@ func (db *DatabaseContext) getOldRevisionJSON(docid string, revid string) ([]byt
 }
 
 func (db *Database) setOldRevisionJSON(docid string, revid string, body []byte) error {
-	base.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
+	db.logContext.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
 
 	// Set old revisions to expire after 5 minutes.  Future enhancement to make this a config
 	// setting might be appropriate.
+	defer db.timings.Track(base.PhaseBucketWrite, time.Now())
 	return db.Bucket.SetRaw(oldRevisionKey(docid, revid), 300, body)
 }
 
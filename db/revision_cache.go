@@ -2,7 +2,11 @@ package db
 
 import (
 	"container/list"
+	"encoding/json"
+	"expvar"
+	"hash/crc32"
 	"sync"
+	"sync/atomic"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -10,13 +14,47 @@ import (
 // Number of recently-accessed doc revisions to cache in RAM
 const KDefaultRevisionCacheCapacity = 5000
 
-// An LRU cache of document revision bodies, together with their channel access.
+// Number of independently-locked shards a database's revision cache is split into
+const KDefaultRevisionCacheShardCount = 16
+
+// Per-shard stats of each database's revision cache, keyed by database name
+var revisionCacheExpvars = expvar.NewMap("syncGateway_revisionCache")
+
+// Size and sharding of a RevisionCache.
+type RevisionCacheOptions struct {
+	Capacity   int   // Max number of revisions to cache (across all shards)
+	ShardCount int   // Number of shards; each has its own lock and LRU list
+	MaxBytes   int64 // Max estimated size of the cached bodies (across all shards); 0 for no limit
+}
+
+// An LRU cache of document revision bodies, together with their channel access.  The cache is
+// split into shards by doc ID, each with its own lock, so that concurrent requests for different
+// documents don't contend with each other.
 type RevisionCache struct {
-	cache      map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
-	lruList    *list.List                 // List ordered by most recent access (Front is newest)
-	capacity   int                        // Max number of revisions to cache
+	shards     []*revisionCacheShard
 	loaderFunc RevisionCacheLoaderFunc
-	lock       sync.Mutex // For thread-safety
+}
+
+// One shard of a RevisionCache: an LRU list bounded by entry count and, optionally, bytes.
+type revisionCacheShard struct {
+	cache     map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
+	lruList   *list.List                 // List ordered by most recent access (Front is newest)
+	capacity  int                        // Max number of revisions to cache
+	maxBytes  int64                      // Max total size of cached bodies; 0 for no limit
+	bytes     int64                      // Current total size of cached bodies
+	lock      sync.Mutex                 // For thread-safety
+	hits      uint64                     // Updated atomically
+	misses    uint64                     // Updated atomically
+	evictions uint64                     // Updated atomically
+}
+
+// Statistics of a single revision cache shard.
+type RevisionCacheShardStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
 }
 
 type RevisionCacheLoaderFunc func(id IDAndRev) (body Body, history Body, channels base.Set, err error)
@@ -28,22 +66,42 @@ type revCacheValue struct {
 	history  Body       // Rev history encoded like a "_revisions" property
 	channels base.Set   // Set of channels that have access
 	err      error      // Error from loaderFunc if it failed
+	size     int64      // Estimated size of body, once loaded; guarded by the shard's lock
 	lock     sync.Mutex // Synchronizes access to this struct
 }
 
-// Creates a revision cache with the given capacity and an optional loader function.
+// Creates a single-shard revision cache with the given capacity and an optional loader function.
 func NewRevisionCache(capacity int, loaderFunc RevisionCacheLoaderFunc) *RevisionCache {
+	return NewShardedRevisionCache(RevisionCacheOptions{Capacity: capacity, ShardCount: 1}, loaderFunc)
+}
 
-	if capacity == 0 {
-		capacity = KDefaultRevisionCacheCapacity
+// Creates a revision cache with the given options and an optional loader function.  The capacity
+// and byte limit are divided evenly between the shards.
+func NewShardedRevisionCache(options RevisionCacheOptions, loaderFunc RevisionCacheLoaderFunc) *RevisionCache {
+
+	if options.Capacity == 0 {
+		options.Capacity = KDefaultRevisionCacheCapacity
+	}
+	if options.ShardCount <= 0 {
+		options.ShardCount = KDefaultRevisionCacheShardCount
+	}
+	if options.ShardCount > options.Capacity {
+		options.ShardCount = options.Capacity
 	}
 
-	return &RevisionCache{
-		cache:      map[IDAndRev]*list.Element{},
-		lruList:    list.New(),
-		capacity:   capacity,
+	rc := &RevisionCache{
+		shards:     make([]*revisionCacheShard, options.ShardCount),
 		loaderFunc: loaderFunc,
 	}
+	for i := range rc.shards {
+		rc.shards[i] = &revisionCacheShard{
+			cache:    map[IDAndRev]*list.Element{},
+			lruList:  list.New(),
+			capacity: (options.Capacity + options.ShardCount - 1) / options.ShardCount,
+			maxBytes: options.MaxBytes / int64(options.ShardCount),
+		}
+	}
+	return rc
 }
 
 // Looks up a revision from the cache.
@@ -51,13 +109,16 @@ func NewRevisionCache(capacity int, loaderFunc RevisionCacheLoaderFunc) *Revisio
 // If the cache has a loaderFunction, it will be called if the revision isn't in the cache;
 // any error returned by the loaderFunction will be returned from Get.
 func (rc *RevisionCache) Get(docid, revid string) (Body, Body, base.Set, error) {
-	value := rc.getValue(docid, revid, rc.loaderFunc != nil)
+	shard := rc.shardFor(docid)
+	value := shard.getValue(docid, revid, rc.loaderFunc != nil)
 	if value == nil {
 		return nil, nil, nil, nil
 	}
-	body, history, channels, err := value.load(rc.loaderFunc)
+	body, history, channels, err, size := value.load(rc.loaderFunc, shard)
 	if err != nil {
-		rc.removeValue(value) // don't keep failed loads in the cache
+		shard.removeValue(value) // don't keep failed loads in the cache
+	} else if size > 0 {
+		shard.setValueSize(value, size)
 	}
 	return body, history, channels, err
 }
@@ -67,74 +128,175 @@ func (rc *RevisionCache) Put(body Body, history Body, channels base.Set) {
 	if history == nil {
 		panic("Missing history for RevisionCache.Put")
 	}
-	value := rc.getValue(body["_id"].(string), body["_rev"].(string), true)
-	value.store(body, history, channels)
+	docid := body["_id"].(string)
+	shard := rc.shardFor(docid)
+	value := shard.getValue(docid, body["_rev"].(string), true)
+	if size := value.store(body, history, channels); size > 0 {
+		shard.setValueSize(value, size)
+	}
 }
 
-func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revCacheValue) {
+// Returns the statistics of each shard.  These are published in the syncGateway_revisionCache
+// expvar under the database name.
+func (rc *RevisionCache) Stats() []RevisionCacheShardStats {
+	stats := make([]RevisionCacheShardStats, len(rc.shards))
+	for i, shard := range rc.shards {
+		shard.lock.Lock()
+		stats[i].Entries = len(shard.cache)
+		stats[i].Bytes = shard.bytes
+		shard.lock.Unlock()
+		stats[i].Hits = atomic.LoadUint64(&shard.hits)
+		stats[i].Misses = atomic.LoadUint64(&shard.misses)
+		stats[i].Evictions = atomic.LoadUint64(&shard.evictions)
+	}
+	return stats
+}
+
+// Implements expvar.Var, so the stats are only gathered when the expvars are read.
+func (rc *RevisionCache) String() string {
+	data, _ := json.Marshal(rc.Stats())
+	return string(data)
+}
+
+func (rc *RevisionCache) shardFor(docid string) *revisionCacheShard {
+	if len(rc.shards) == 1 {
+		return rc.shards[0]
+	}
+	return rc.shards[crc32.ChecksumIEEE([]byte(docid))%uint32(len(rc.shards))]
+}
+
+func (shard *revisionCacheShard) getValue(docid, revid string, create bool) (value *revCacheValue) {
 	if docid == "" || revid == "" {
 		panic("RevisionCache: invalid empty doc/rev id")
 	}
 	key := IDAndRev{DocID: docid, RevID: revid}
-	rc.lock.Lock()
-	defer rc.lock.Unlock()
-	if elem := rc.cache[key]; elem != nil {
-		rc.lruList.MoveToFront(elem)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if elem := shard.cache[key]; elem != nil {
+		shard.lruList.MoveToFront(elem)
 		value = elem.Value.(*revCacheValue)
 	} else if create {
 		value = &revCacheValue{key: key}
-		rc.cache[key] = rc.lruList.PushFront(value)
-		for len(rc.cache) > rc.capacity {
-			rc.purgeOldest_()
+		shard.cache[key] = shard.lruList.PushFront(value)
+		for len(shard.cache) > shard.capacity {
+			shard.purgeOldest_()
 		}
 	}
 	return
 }
 
-func (rc *RevisionCache) removeValue(value *revCacheValue) {
-	rc.lock.Lock()
-	if element := rc.cache[value.key]; element != nil && element.Value == value {
-		rc.lruList.Remove(element)
-		delete(rc.cache, value.key)
+func (shard *revisionCacheShard) removeValue(value *revCacheValue) {
+	shard.lock.Lock()
+	if element := shard.cache[value.key]; element != nil && element.Value == value {
+		shard.lruList.Remove(element)
+		delete(shard.cache, value.key)
+		shard.bytes -= value.size
+	}
+	shard.lock.Unlock()
+}
+
+// Records the size of a newly-loaded value, then evicts the oldest values if the shard is over
+// its byte limit.  The new value itself is kept even if it's larger than the limit on its own,
+// so that it's still cached for the requests that follow.
+func (shard *revisionCacheShard) setValueSize(value *revCacheValue, size int64) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if element := shard.cache[value.key]; element == nil || element.Value != value || value.size != 0 {
+		return // Already evicted, or already counted
+	}
+	value.size = size
+	shard.bytes += size
+	for shard.maxBytes > 0 && shard.bytes > shard.maxBytes && shard.lruList.Back().Value != value {
+		shard.purgeOldest_()
 	}
-	rc.lock.Unlock()
 }
 
-func (rc *RevisionCache) purgeOldest_() {
-	value := rc.lruList.Remove(rc.lruList.Back()).(*revCacheValue)
-	delete(rc.cache, value.key)
+func (shard *revisionCacheShard) purgeOldest_() {
+	value := shard.lruList.Remove(shard.lruList.Back()).(*revCacheValue)
+	delete(shard.cache, value.key)
+	shard.bytes -= value.size
+	atomic.AddUint64(&shard.evictions, 1)
+}
+
+func (shard *revisionCacheShard) recordLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&shard.hits, 1)
+		base.StatsExpvars.Add("revisionCache_hits", 1)
+	} else {
+		atomic.AddUint64(&shard.misses, 1)
+		base.StatsExpvars.Add("revisionCache_misses", 1)
+	}
 }
 
 // Gets the body etc. out of a revCacheValue. If they aren't present already, the loader func
 // will be called. This is synchronized so that the loader will only be called once even if
-// multiple goroutines try to load at the same time.
-func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc) (Body, Body, base.Set, error) {
+// multiple goroutines try to load at the same time.  Also returns the estimated size of the body
+// if this call loaded it, otherwise 0.
+func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc, shard *revisionCacheShard) (Body, Body, base.Set, error, int64) {
 	value.lock.Lock()
 	defer value.lock.Unlock()
+	var loadedSize int64
 	if value.body == nil && value.err == nil {
-		base.StatsExpvars.Add("revisionCache_misses", 1)
+		shard.recordLookup(false)
 		if loaderFunc != nil {
 			value.body, value.history, value.channels, value.err = loaderFunc(value.key)
+			if value.body != nil {
+				loadedSize = estimateBodySize(value.body)
+			}
 		}
 	} else {
-		base.StatsExpvars.Add("revisionCache_hits", 1)
+		shard.recordLookup(true)
 	}
 	body := value.body
 	if body != nil {
 		body = body.ShallowCopy() // Never let the caller mutate the stored body
 	}
-	return body, value.history, value.channels, value.err
+	return body, value.history, value.channels, value.err, loadedSize
 }
 
-// Stores a body etc. into a revCacheValue if there isn't one already.
-func (value *revCacheValue) store(body Body, history Body, channels base.Set) {
+// Stores a body etc. into a revCacheValue if there isn't one already.  Returns the estimated
+// size of the body if it was stored, otherwise 0.
+func (value *revCacheValue) store(body Body, history Body, channels base.Set) int64 {
 	value.lock.Lock()
+	defer value.lock.Unlock()
 	if value.body == nil {
 		value.body = body.ShallowCopy() // Don't store a body the caller might later mutate
 		value.history = history
 		value.channels = channels
 		value.err = nil
 		dbExpvars.Add("revisionCache_adds", 1)
+		return estimateBodySize(value.body)
+	}
+	return 0
+}
+
+// Roughly estimates the memory used by a document body, without the cost of marshaling it.
+func estimateBodySize(body Body) int64 {
+	return estimateValueSize(map[string]interface{}(body))
+}
+
+func estimateValueSize(value interface{}) int64 {
+	const overhead = 16 // interface header, or map/slice bookkeeping per item
+	switch value := value.(type) {
+	case string:
+		return overhead + int64(len(value))
+	case []byte:
+		return overhead + int64(len(value))
+	case map[string]interface{}:
+		size := int64(overhead)
+		for k, v := range value {
+			size += int64(len(k)) + estimateValueSize(v)
+		}
+		return size
+	case Body:
+		return estimateValueSize(map[string]interface{}(value))
+	case []interface{}:
+		size := int64(overhead)
+		for _, v := range value {
+			size += estimateValueSize(v)
+		}
+		return size
+	default:
+		return overhead // numbers, bools, nil
 	}
-	value.lock.Unlock()
 }
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
@@ -101,3 +102,67 @@ func TestLoaderFunction(t *testing.T) {
 	assert.DeepEquals(t, err, base.HTTPErrorf(404, "missing"))
 	assert.Equals(t, callsToLoader, 3)
 }
+
+func TestShardedRevisionCache(t *testing.T) {
+	cache := NewShardedRevisionCache(RevisionCacheOptions{Capacity: 100, ShardCount: 4}, nil)
+	assert.Equals(t, len(cache.shards), 4)
+	for i := 0; i < 100; i++ {
+		cache.Put(Body{"_id": fmt.Sprintf("doc%d", i), "_rev": "1-a"}, Body{"start": 1}, nil)
+	}
+	for i := 0; i < 100; i++ {
+		body, _, _, _ := cache.Get(fmt.Sprintf("doc%d", i), "1-a")
+		if body != nil {
+			assert.Equals(t, body["_id"], fmt.Sprintf("doc%d", i))
+		}
+	}
+
+	// Each shard is bounded by its share of the capacity, and counts its own hits and evictions
+	var entries int
+	var hits, evictions uint64
+	for _, stats := range cache.Stats() {
+		assert.True(t, stats.Entries <= 25)
+		assert.True(t, stats.Bytes > 0)
+		entries += stats.Entries
+		hits += stats.Hits
+		evictions += stats.Evictions
+	}
+	assert.Equals(t, uint64(entries), hits)
+	assert.Equals(t, uint64(entries)+evictions, uint64(100))
+}
+
+func TestRevisionCacheMaxBytes(t *testing.T) {
+	loader := func(id IDAndRev) (body Body, history Body, channels base.Set, err error) {
+		body = Body{"_id": id.DocID, "_rev": id.RevID, "data": string(make([]byte, 1000))}
+		return body, Body{"start": 1}, nil, nil
+	}
+	cache := NewShardedRevisionCache(RevisionCacheOptions{Capacity: 100, ShardCount: 1, MaxBytes: 5000}, loader)
+	for i := 0; i < 10; i++ {
+		cache.Get(fmt.Sprintf("doc%d", i), "1-a")
+	}
+
+	// Only the most recently loaded revisions fit in the byte limit
+	stats := cache.Stats()[0]
+	assert.True(t, stats.Bytes <= 5000)
+	assert.Equals(t, stats.Entries, 4)
+	assert.Equals(t, stats.Evictions, uint64(6))
+	assert.Equals(t, stats.Misses, uint64(10))
+
+	cache.Get("doc9", "1-a")
+	assert.Equals(t, cache.Stats()[0].Hits, uint64(1))
+	cache.Get("doc0", "1-a")
+	assert.Equals(t, cache.Stats()[0].Misses, uint64(11))
+
+	// A revision larger than the whole limit still stays cached, evicting everything else
+	cache.Put(Body{"_id": "big", "_rev": "1-a", "data": string(make([]byte, 6000))}, Body{"start": 1}, nil)
+	stats = cache.Stats()[0]
+	assert.Equals(t, stats.Entries, 1)
+	assert.True(t, stats.Bytes > 5000)
+	body, _, _, _ := cache.Get("big", "1-a")
+	assert.Equals(t, body["_id"], "big")
+	assert.Equals(t, cache.Stats()[0].Hits, uint64(2))
+
+	// The stats are published as JSON
+	var published []RevisionCacheShardStats
+	assertNoError(t, json.Unmarshal([]byte(cache.String()), &published), "Couldn't unmarshal stats")
+	assert.Equals(t, published[0].Entries, 1)
+}
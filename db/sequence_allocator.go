@@ -11,6 +11,8 @@ package db
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,21 +23,46 @@ const (
 	kMaxIncrRetries = 3
 )
 
+// Key of the counter that sequences are allocated from
+const SyncSeqKey = KSyncKeyPrefix + "seq"
+
+// Key prefix of docs announcing sequences that were reserved but never used.  The full key is
+// UnusedSequenceKeyPrefix + "<first>:<last>".  Every node's change cache sees these on the
+// mutation feed, so it doesn't wait for the sequences to show up.
+const UnusedSequenceKeyPrefix = KSyncKeyPrefix + "unusedSeqs:"
+
+// Expiry (in seconds) of unused sequence docs; they're only needed until every node has seen them
+const kUnusedSequenceDocExpiry = 60 * 60
+
+var (
+	// How long a partly used batch of sequences is kept before the rest are released
+	DefaultSequenceReleaseWait = 1500 * time.Millisecond
+
+	// A batch used up faster than this doubles the size of the next one; one that's released
+	// unused halves it.
+	kSequenceBatchGrowTime = 1 * time.Second
+)
+
 type sequenceAllocator struct {
-	bucket base.Bucket // Bucket whose counter to use
-	mutex  sync.Mutex  // Makes this object thread-safe
-	last   uint64      // Last sequence # assigned
-	max    uint64      // Max sequence # reserved
+	bucket       base.Bucket // Bucket whose counter to use
+	mutex        sync.Mutex  // Makes this object thread-safe
+	last         uint64      // Last sequence # assigned, or released unused
+	max          uint64      // Max sequence # reserved
+	assigned     uint64      // Highest sequence # this allocator has actually assigned
+	maxBatchSize uint64      // Upper limit of batchSize; 1 or less disables batching
+	batchSize    uint64      // Number of sequences to reserve the next time the batch runs out
+	lastReserved time.Time   // When the current batch was reserved
+	releaseTimer *time.Timer // Releases the rest of the batch once it's been idle for a while
 }
 
 func newSequenceAllocator(bucket base.Bucket) (*sequenceAllocator, error) {
-	s := &sequenceAllocator{bucket: bucket}
+	s := &sequenceAllocator{bucket: bucket, batchSize: 1}
 	return s, s.reserveSequences(0) // just reads latest sequence from bucket
 }
 
 func (s *sequenceAllocator) lastSequence() (uint64, error) {
 	dbExpvars.Add("sequence_gets", 1)
-	last, err := s.incrWithRetry("_sync:seq", 0)
+	last, err := s.incrWithRetry(SyncSeqKey, 0)
 	if err != nil {
 		base.Warn("Error from Incr in lastSequence(): %v", err)
 	}
@@ -46,21 +73,34 @@ func (s *sequenceAllocator) nextSequence() (uint64, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	if s.last >= s.max {
-		if err := s._reserveSequences(1); err != nil {
+		s._adjustBatchSize()
+		if err := s._reserveSequences(s.batchSize); err != nil {
 			return 0, err
 		}
+		s.lastReserved = time.Now()
 	}
 	s.last++
+	s.assigned = s.last
+	if s.last < s.max {
+		s._scheduleRelease()
+	}
 	return s.last, nil
 }
 
+// Returns the highest sequence this allocator has assigned, or 0 if none.
+func (s *sequenceAllocator) lastAssignedSequence() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.assigned
+}
+
 func (s *sequenceAllocator) _reserveSequences(numToReserve uint64) error {
 	if s.last < s.max {
 		return nil // Already have some sequences left; don't be greedy and waste them
 		//OPT: Could remember multiple discontiguous ranges of free sequences
 	}
 	dbExpvars.Add("sequence_reserves", 1)
-	max, err := s.incrWithRetry("_sync:seq", numToReserve)
+	max, err := s.incrWithRetry(SyncSeqKey, numToReserve)
 	if err != nil {
 		base.Warn("Error from Incr in _reserveSequences(%d): %v", numToReserve, err)
 		return err
@@ -76,6 +116,88 @@ func (s *sequenceAllocator) reserveSequences(numToReserve uint64) error {
 	return s._reserveSequences(numToReserve)
 }
 
+// Sets the upper limit on the number of sequences reserved at once.
+func (s *sequenceAllocator) setMaxBatchSize(maxBatchSize uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxBatchSize = maxBatchSize
+}
+
+// Grows the batch size if the last batch ran out quickly, so that busy nodes go to the shared
+// counter less often.
+func (s *sequenceAllocator) _adjustBatchSize() {
+	if s.maxBatchSize <= 1 {
+		s.batchSize = 1
+	} else if time.Since(s.lastReserved) < kSequenceBatchGrowTime && s.batchSize < s.maxBatchSize {
+		s.batchSize *= 2
+		if s.batchSize > s.maxBatchSize {
+			s.batchSize = s.maxBatchSize
+		}
+		base.LogTo("CRUD+", "Sequence batch size increased to %d", s.batchSize)
+	}
+}
+
+func (s *sequenceAllocator) _scheduleRelease() {
+	if s.releaseTimer == nil {
+		s.releaseTimer = time.AfterFunc(DefaultSequenceReleaseWait, s.releaseUnusedSequences)
+	} else {
+		s.releaseTimer.Reset(DefaultSequenceReleaseWait)
+	}
+}
+
+// Gives up the unassigned remainder of the current batch, announcing it so that change caches
+// don't wait for those sequences.  The next batch will be smaller.
+func (s *sequenceAllocator) releaseUnusedSequences() {
+	s.mutex.Lock()
+	if s.last >= s.max {
+		s.mutex.Unlock()
+		return
+	}
+	first, last := s.last+1, s.max
+	s.last = s.max
+	if s.batchSize > 1 {
+		s.batchSize /= 2
+	}
+	s.mutex.Unlock()
+
+	key := fmt.Sprintf("%s%d:%d", UnusedSequenceKeyPrefix, first, last)
+	if err := s.bucket.Set(key, kUnusedSequenceDocExpiry, Body{}); err != nil {
+		base.Warn("Unable to release unused sequences #%d-#%d: %v", first, last, err)
+		return
+	}
+	dbExpvars.Add("sequence_releases", 1)
+	dbExpvars.Add("sequences_released", int64(last-first+1))
+	base.LogTo("CRUD+", "Released unused sequences #%d-#%d", first, last)
+}
+
+// Stops the release timer and immediately releases any unused sequences.
+func (s *sequenceAllocator) stop() {
+	s.mutex.Lock()
+	if s.releaseTimer != nil {
+		s.releaseTimer.Stop()
+	}
+	s.mutex.Unlock()
+	s.releaseUnusedSequences()
+}
+
+// Parses the range of sequences released by an unused sequence doc.
+func parseUnusedSequenceKey(docID string) (first, last uint64, err error) {
+	parts := strings.Split(strings.TrimPrefix(docID, UnusedSequenceKeyPrefix), ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid unused sequence key %q", docID)
+	}
+	if first, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if last, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("Invalid unused sequence key %q", docID)
+	}
+	return first, last, nil
+}
+
 func (s *sequenceAllocator) incrWithRetry(key string, numToReserve uint64) (uint64, error) {
 
 	var err error
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Number of entries buffered for each subscriber of a shared feed.  A subscriber that falls
+// further behind than this is dropped, so it can't hold back the others.
+const kSharedFeedSubscriberBuffer = 500
+
+// How often a subscriber checks whether its user's channel access has changed
+var SharedFeedUserCheckInterval = 1 * time.Second
+
+// One upstream merge of a set of channels, whose entries are fanned out to every continuous or
+// longpoll feed with the same effective channels and options.
+type sharedChangesFeed struct {
+	key         string
+	terminator  chan bool
+	subscribers map[*sharedFeedSubscriber]struct{}
+	closed      bool
+	lock        sync.Mutex
+}
+
+type sharedFeedSubscriber struct {
+	feed    *sharedChangesFeed
+	entries chan *ChangeEntry // Closed when the shared feed ends or drops the subscriber
+}
+
+// The shared feeds of a database, by key.  The zero value is ready to use.
+type sharedFeedRegistry struct {
+	feeds map[string]*sharedChangesFeed
+	lock  sync.Mutex
+}
+
+// Identifies feeds whose entries are interchangeable: the same channels, and the same options
+// affecting which entries are sent and what they contain.
+func sharedFeedKey(channelNames []string, options ChangesOptions) string {
+	sort.Strings(channelNames)
+	return fmt.Sprintf("%s|docs=%t|conflicts=%t|active=%t", strings.Join(channelNames, ","),
+		options.IncludeDocs, options.Conflicts, options.ActiveOnly)
+}
+
+// Subscribes to the shared feed with the given key, starting it if there isn't one.
+func (registry *sharedFeedRegistry) subscribe(key string, start func(terminator chan bool) (<-chan *ChangeEntry, error)) (*sharedFeedSubscriber, error) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	feed := registry.feeds[key]
+	if feed == nil {
+		feed = &sharedChangesFeed{
+			key:         key,
+			terminator:  make(chan bool),
+			subscribers: map[*sharedFeedSubscriber]struct{}{},
+		}
+		upstream, err := start(feed.terminator)
+		if err != nil {
+			return nil, err
+		}
+		if registry.feeds == nil {
+			registry.feeds = map[string]*sharedChangesFeed{}
+		}
+		registry.feeds[key] = feed
+		dbExpvars.Add("sharedChangesFeeds", 1)
+		go registry.fanOut(feed, upstream)
+	}
+
+	sub := &sharedFeedSubscriber{feed: feed, entries: make(chan *ChangeEntry, kSharedFeedSubscriberBuffer)}
+	feed.lock.Lock()
+	feed.subscribers[sub] = struct{}{}
+	feed.lock.Unlock()
+	return sub, nil
+}
+
+// Removes a subscriber, stopping the shared feed if it was the last one.
+func (registry *sharedFeedRegistry) unsubscribe(sub *sharedFeedSubscriber) (stopped bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	feed := sub.feed
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	if _, found := feed.subscribers[sub]; found {
+		delete(feed.subscribers, sub)
+		close(sub.entries)
+	}
+	if len(feed.subscribers) == 0 && !feed.closed {
+		feed.closed = true
+		close(feed.terminator)
+		if registry.feeds[feed.key] == feed {
+			delete(registry.feeds, feed.key)
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the number of running shared feeds.
+func (registry *sharedFeedRegistry) count() int {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	return len(registry.feeds)
+}
+
+// Copies every entry of the upstream feed to each subscriber, until the upstream feed ends.
+func (registry *sharedFeedRegistry) fanOut(feed *sharedChangesFeed, upstream <-chan *ChangeEntry) {
+	for entry := range upstream {
+		feed.lock.Lock()
+		for sub := range feed.subscribers {
+			select {
+			case sub.entries <- entry:
+			default:
+				// Subscriber isn't keeping up; it'll resume from its own position with a new feed
+				delete(feed.subscribers, sub)
+				close(sub.entries)
+				dbExpvars.Add("sharedChangesFeedDrops", 1)
+			}
+		}
+		feed.lock.Unlock()
+	}
+
+	registry.lock.Lock()
+	if registry.feeds[feed.key] == feed {
+		delete(registry.feeds, feed.key)
+	}
+	registry.lock.Unlock()
+	feed.lock.Lock()
+	feed.closed = true
+	for sub := range feed.subscribers {
+		delete(feed.subscribers, sub)
+		close(sub.entries)
+	}
+	feed.lock.Unlock()
+}
+
+// Like SimpleMultiChangesFeed, but once the feed has caught up, the entries come from a feed
+// shared with every other continuous/longpoll feed that has the same effective channels.
+// The output is closed whenever the feed can no longer use the shared feed (the user's channel
+// access changed, or it fell too far behind); continuous callers restart from their last
+// sequence, as they do when any feed ends.
+func (db *Database) sharedMultiChangesFeed(chans base.Set, options ChangesOptions) (<-chan *ChangeEntry, error) {
+	var channelsSince channels.TimedSet
+	if db.user != nil {
+		channelsSince = db.user.FilterToAvailableChannels(chans)
+	} else {
+		channelsSince = channels.AtSequence(chans, 0)
+	}
+	if len(channelsSince) == 0 {
+		return db.SimpleMultiChangesFeed(chans, options)
+	}
+	upstreamChannels := channelsSince.AsSet()
+	key := sharedFeedKey(upstreamChannels.ToArray(), options)
+
+	// Subscribe before catching up, so that nothing is missed in between
+	sub, err := db.sharedFeeds.subscribe(key, func(terminator chan bool) (<-chan *ChangeEntry, error) {
+		db.logContext.LogTo("Changes", "Starting shared changes feed for %s", key)
+		upstreamDb := &Database{DatabaseContext: db.DatabaseContext}
+		return upstreamDb.SimpleMultiChangesFeed(upstreamChannels, ChangesOptions{
+			Since:       db.changeCache.GetStableSequence(""),
+			Conflicts:   options.Conflicts,
+			IncludeDocs: options.IncludeDocs,
+			ActiveOnly:  options.ActiveOnly,
+			Wait:        true,
+			Continuous:  true,
+			Terminator:  terminator,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	catchUpOptions := options
+	catchUpOptions.Wait = false
+	catchUpOptions.Continuous = false
+	catchUp, err := db.SimpleMultiChangesFeed(chans, catchUpOptions)
+	if err != nil {
+		db.unsubscribeSharedFeed(sub)
+		return nil, err
+	}
+
+	output := make(chan *ChangeEntry, 50)
+	go func() {
+		defer close(output)
+		defer db.unsubscribeSharedFeed(sub)
+
+		send := func(entry *ChangeEntry) bool {
+			select {
+			case <-options.Terminator:
+				return false
+			case output <- entry:
+				return true
+			}
+		}
+
+		// Catch up from the requested sequence with a feed of our own, remembering what was
+		// sent so it's not sent again when the shared feed delivers it.
+		sentSeqs := map[uint64]struct{}{}
+		var maxCatchUpSeq uint64
+		sinceSeq := options.Since.SafeSequence()
+		sentSomething := false
+		for entry := range catchUp {
+			if entry == nil {
+				continue
+			}
+			if !send(entry) {
+				return
+			}
+			sentSeqs[entry.Seq.Seq] = struct{}{}
+			if entry.Seq.Seq > maxCatchUpSeq {
+				maxCatchUpSeq = entry.Seq.Seq
+			}
+			sentSomething = true
+		}
+		if !options.Continuous && sentSomething {
+			return
+		}
+		if !send(nil) {
+			return
+		}
+
+		changeWaiter := db.startChangeWaiter(base.Set{})
+		userCounter := changeWaiter.CurrentUserCount()
+		ticker := time.NewTicker(SharedFeedUserCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-options.Terminator:
+				return
+			case <-ticker.C:
+				userChanged, newCounter, _, err := db.checkForUserUpdates(userCounter, changeWaiter)
+				if err != nil {
+					change := makeErrorEntry("User not found during reload - terminating changes feed")
+					send(&change)
+					return
+				}
+				userCounter = newCounter
+				if userChanged {
+					db.logContext.LogTo("Changes+", "User changed; leaving shared changes feed %s", key)
+					return
+				}
+			case entry, ok := <-sub.entries:
+				if !ok {
+					db.logContext.LogTo("Changes+", "Shared changes feed %s ended or dropped this feed", key)
+					return
+				}
+				if entry == nil {
+					if !options.Continuous && sentSomething {
+						return
+					}
+					if !send(nil) {
+						return
+					}
+					continue
+				}
+				seq := entry.Seq.Seq
+				if sentSeqs != nil {
+					if _, found := sentSeqs[seq]; found {
+						continue
+					}
+					// A skipped sequence sent while catching up can still arrive late on the shared
+					// feed, until the feed's low sequence has passed everything sent
+					if entry.Seq.SafeSequence() > maxCatchUpSeq {
+						sentSeqs = nil
+					}
+				}
+				// A client resuming from a compound since (LowSeq::Seq) hasn't seen the skipped
+				// sequences above LowSeq, so only what it's seen up to there is filtered; anything
+				// already sent while catching up was dropped above
+				if seq <= sinceSeq {
+					continue
+				}
+				change := *entry // The entry is shared with the other subscribers
+				if !send(&change) {
+					return
+				}
+				sentSomething = true
+			}
+		}
+	}()
+	return output, nil
+}
+
+func (db *Database) unsubscribeSharedFeed(sub *sharedFeedSubscriber) {
+	if db.sharedFeeds.unsubscribe(sub) {
+		// Wake the shared feed if it's waiting for changes, so it notices it's been terminated
+		db.tapListener.NotifyCheckForTermination(base.SetOf(sub.feed.key))
+	}
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// default timeout for connecting and writing to a unix socket
+const kDefaultSocketTimeout = 10 * time.Second
+
+// SocketEventHandler is an implementation of EventHandler that writes events as NDJSON to a Unix
+// domain socket.  It connects when the first event is handled, and reconnects if the connection fails.
+type SocketEventHandler struct {
+	AsyncEventHandler
+	eventFunctions
+	deliveryFailures
+	path    string
+	timeout time.Duration
+	conn    net.Conn
+	closed  bool
+	lock    sync.Mutex // Serializes writes and reconnects
+}
+
+// Creates a new unix socket event handler.  timeout limits connecting and each write; if nil, the
+// default of 10 seconds is used.
+func NewSocketEventHandler(path string, filterFnString string, timeout *uint64, options EventSinkOptions) (*SocketEventHandler, error) {
+	if path == "" {
+		return nil, errors.New("path parameter must be defined for unix_socket events.")
+	}
+	sh := &SocketEventHandler{
+		eventFunctions: newEventFunctions(filterFnString, options.Transform, options.IncludeBody),
+		path:           path,
+		timeout:        kDefaultSocketTimeout,
+	}
+	if timeout != nil {
+		sh.timeout = time.Duration(*timeout) * time.Second
+	}
+	return sh, nil
+}
+
+// Writes the event's payload to the socket, if it passes the filter function.
+func (sh *SocketEventHandler) HandleEvent(event Event) {
+	post := sh.filterAndMakePost(event, "unix_socket")
+	if post == nil {
+		return
+	}
+	if err := sh.write(post.ndjsonLine()); err != nil {
+		event.LogContext().Warn("Error writing %s to %s: %v", event.String(), sh, err)
+		dbExpvars.Add("event_sink_failures", 1)
+		sh.addFailure()
+	}
+}
+
+// Writes a line, reconnecting once if the existing connection fails.
+func (sh *SocketEventHandler) write(line []byte) error {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	if sh.closed {
+		return errors.New("handler is closed")
+	}
+	if sh.conn != nil {
+		err := sh.writeToConn(line)
+		if err == nil {
+			return nil
+		}
+		sh.conn.Close()
+		sh.conn = nil
+	}
+	conn, err := net.DialTimeout("unix", sh.path, sh.timeout)
+	if err != nil {
+		return err
+	}
+	sh.conn = conn
+	return sh.writeToConn(line)
+}
+
+func (sh *SocketEventHandler) writeToConn(line []byte) error {
+	sh.conn.SetWriteDeadline(time.Now().Add(sh.timeout))
+	_, err := sh.conn.Write(line)
+	return err
+}
+
+// Closes the connection.  Events handled afterwards aren't written.
+func (sh *SocketEventHandler) Close() error {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	sh.closed = true
+	if sh.conn == nil {
+		return nil
+	}
+	err := sh.conn.Close()
+	sh.conn = nil
+	return err
+}
+
+func (sh *SocketEventHandler) String() string {
+	return fmt.Sprintf("Unix socket event handler [%s]", sh.path)
+}
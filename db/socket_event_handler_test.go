@@ -0,0 +1,45 @@
+package db
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSocketEventHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+
+	listener, err := net.Listen("unix", path)
+	assertNoError(t, err, "Couldn't listen on unix socket")
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			conn.Close()
+		}
+	}()
+
+	sh, err := NewSocketEventHandler(path, "", nil, EventSinkOptions{})
+	assertNoError(t, err, "Couldn't create unix socket event handler")
+	defer sh.Close()
+	sh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	sh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	assert.Equals(t, <-lines, `{"_id":"doc1"}`)
+	assert.Equals(t, <-lines, `{"_id":"doc2"}`)
+}
@@ -189,3 +189,37 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	}
 	return
 }
+
+//////// PRINCIPAL EVENTS (auth.PrincipalObserver):
+
+func (dbc *DatabaseContext) PrincipalEventsEnabled() bool {
+	return dbc.EventMgr.HasHandlerForEvent(PrincipalChange)
+}
+
+// Raises a PrincipalChangeEvent when a user or role is saved through the Authenticator.
+func (dbc *DatabaseContext) PrincipalSaved(princ auth.Principal, created bool) {
+	action := PrincipalUpdated
+	if created {
+		action = PrincipalCreated
+	}
+	details := Body{"admin_channels": princ.ExplicitChannels().AllChannels()}
+	user, isUser := princ.(auth.User)
+	if isUser {
+		details["admin_roles"] = user.ExplicitRoles().AllChannels()
+		details["email"] = user.Email()
+		details["disabled"] = user.Disabled()
+	}
+	dbc.EventMgr.RaisePrincipalChangeEvent(princ.Name(), isUser, action, details, nil)
+}
+
+// Raises a PrincipalChangeEvent when a user or role is deleted through the Authenticator.
+func (dbc *DatabaseContext) PrincipalDeleted(princ auth.Principal) {
+	_, isUser := princ.(auth.User)
+	dbc.EventMgr.RaisePrincipalChangeEvent(princ.Name(), isUser, PrincipalDeleted, nil, nil)
+}
+
+// Raises a PrincipalChangeEvent when a session is created for a user.
+func (dbc *DatabaseContext) SessionCreated(session *auth.LoginSession) {
+	details := Body{"expiration": session.Expiration.Format(base.ISO8601Format)}
+	dbc.EventMgr.RaisePrincipalChangeEvent(session.Username, true, PrincipalSessionCreated, details, nil)
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Posts with the same path waiting to be sent together by a batching webhook
+type webhookBatch struct {
+	posts []*webhookPost
+	timer *time.Timer // Posts the batch when the linger time expires
+}
+
+// Adds a post to the batch for its path.  The batch is posted once it's full, or once the linger
+// time has passed since its first post was added, whichever is sooner.
+func (wh *Webhook) addToBatch(post *webhookPost) {
+	wh.batchLock.Lock()
+	defer wh.batchLock.Unlock()
+
+	if wh.batches == nil {
+		wh.batches = make(map[string]*webhookBatch)
+	}
+	path := post.Path
+	batch := wh.batches[path]
+	if batch == nil {
+		batch = &webhookBatch{}
+		wh.batches[path] = batch
+		wh.batchPosts.Add(1)
+		batch.timer = time.AfterFunc(wh.batchLinger, func() {
+			defer wh.batchPosts.Done()
+			wh.batchLock.Lock()
+			if wh.batches[path] != batch {
+				wh.batchLock.Unlock()
+				return // Already posted, because it filled up or was flushed
+			}
+			delete(wh.batches, path)
+			wh.batchLock.Unlock()
+			wh.postBatch(path, batch.posts)
+		})
+	}
+	batch.posts = append(batch.posts, post)
+
+	if len(batch.posts) >= wh.batchSize {
+		delete(wh.batches, path)
+		if !batch.timer.Stop() {
+			wh.batchPosts.Add(1) // The timer has fired, and will find the batch already taken
+		}
+		go func() {
+			defer wh.batchPosts.Done()
+			wh.postBatch(path, batch.posts)
+		}()
+	}
+}
+
+// Posts every waiting batch now, and waits until all batch posts and retries have finished.  Used
+// before durable checkpoints are saved, so the checkpoint never gets ahead of delivery.
+func (wh *Webhook) Flush() {
+	wh.flushBatches()
+	wh.retries.Wait()
+}
+
+// Posts every waiting batch now, and waits until all batch posts have been attempted once.
+func (wh *Webhook) flushBatches() {
+	wh.batchLock.Lock()
+	batches := wh.batches
+	wh.batches = nil
+	wh.batchLock.Unlock()
+
+	for path, batch := range batches {
+		stopped := batch.timer.Stop() // If not, the timer has fired, and will find the batch already taken
+		wh.postBatch(path, batch.posts)
+		if stopped {
+			wh.batchPosts.Done()
+		}
+	}
+	wh.batchPosts.Wait()
+}
+
+// Posts a batch of payloads as a JSON array.  JSON payloads become the array's elements, and any
+// others are included as JSON strings.
+func (wh *Webhook) postBatch(path string, posts []*webhookPost) {
+	var payload bytes.Buffer
+	payload.WriteByte('[')
+	for i, post := range posts {
+		if i > 0 {
+			payload.WriteByte(',')
+		}
+		payload.Write(post.jsonValue())
+	}
+	payload.WriteByte(']')
+
+	dbExpvars.Add("webhook_batches", 1)
+	batchPost := &webhookPost{Payload: payload.Bytes(), ContentType: "application/json", Path: path}
+	wh.deliver(batchPost, "batch", fmt.Sprintf("batch of %d events", len(posts)), nil)
+}
+
+// Returns the payload as a JSON value: JSON payloads as they are, and any others as JSON strings.
+func (post *webhookPost) jsonValue() []byte {
+	if strings.HasPrefix(post.ContentType, "application/json") {
+		return post.Payload
+	}
+	value, _ := json.Marshal(string(post.Payload))
+	return value
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestWebhookBatching(t *testing.T) {
+	var lock sync.Mutex
+	var posts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		posts = append(posts, string(body))
+		lock.Unlock()
+	}))
+	defer server.Close()
+	postCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(posts)
+	}
+
+	wh, err := NewWebhookWithOptions(server.URL, "", WebhookOptions{
+		BatchSize:   3,
+		BatchLinger: 100 * time.Millisecond,
+	})
+	assert.Equals(t, err, nil)
+
+	// A full batch is posted right away
+	for _, docID := range []string{"a", "b", "c", "d"} {
+		wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": docID}})
+	}
+	for i := 0; i < 50 && postCount() < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, postCount(), 1)
+	assert.Equals(t, posts[0], `[{"_id":"a"},{"_id":"b"},{"_id":"c"}]`)
+
+	// The rest are posted once the linger time passes
+	for i := 0; i < 50 && postCount() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, postCount(), 2)
+	assert.Equals(t, posts[1], `[{"_id":"d"}]`)
+
+	// Flushing posts a partial batch immediately
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "e"}})
+	wh.Flush()
+	assert.Equals(t, postCount(), 3)
+	assert.Equals(t, posts[2], `[{"_id":"e"}]`)
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Key prefix of the docs holding webhook events that couldn't be delivered, numbered in order
+const DeadLetterKeyPrefix = KSyncKeyPrefix + "deadLetter:"
+
+// Key of the counter that numbers the dead letters.  Each letter is saved in a doc of its own,
+// with no index to update, so saving one never contends with saving another.
+const kDeadLetterCounterKey = KSyncKeyPrefix + "deadLetterSeq"
+
+// Max number of dead letters kept.  Only the most recent kMaxDeadLetters numbers are listed, and
+// saving a letter deletes the one this many before it.
+const kMaxDeadLetters = 10000
+
+// Number of dead letters read from the bucket at once when listing them
+const kDeadLetterListBatchSize = 500
+
+// A webhook event that couldn't be delivered, saved so it can be replayed later.
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	Url         string    `json:"url"`
+	Path        string    `json:"path,omitempty"`
+	EventType   string    `json:"event_type"`
+	ContentType string    `json:"content_type"`
+	Payload     string    `json:"payload"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+// Result of replaying a dead letter that failed again
+type DeadLetterReplayFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// Stores undeliverable webhook events in the database's bucket.
+type DeadLetterStore struct {
+	context *DatabaseContext
+}
+
+func (letter *DeadLetter) SanitizedUrl() string {
+	return sanitizedWebhookUrl(letter.Url)
+}
+
+// Saves a dead letter, assigning it the next number as its ID.
+func (store *DeadLetterStore) Add(letter *DeadLetter) error {
+	number, err := store.context.Bucket.Incr(kDeadLetterCounterKey, 1, 1, 0)
+	if err != nil {
+		return err
+	}
+	letter.ID = strconv.FormatUint(number, 10)
+	if err := store.context.Bucket.Set(DeadLetterKeyPrefix+letter.ID, 0, letter); err != nil {
+		return err // The number is left unused, and skipped when listing
+	}
+	if number > kMaxDeadLetters {
+		if err := store.deleteDoc(strconv.FormatUint(number-kMaxDeadLetters, 10)); err != nil {
+			base.Warn("Unable to delete dead letter %d, which is beyond the limit of %d: %v", number-kMaxDeadLetters, kMaxDeadLetters, err)
+		}
+	}
+	dbExpvars.Add("webhook_dead_letters", 1)
+	return nil
+}
+
+// Returns all dead letters, oldest first.
+func (store *DeadLetterStore) List() ([]*DeadLetter, error) {
+	last, err := store.context.Bucket.Incr(kDeadLetterCounterKey, 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	first := uint64(1)
+	if last > kMaxDeadLetters {
+		first = last - kMaxDeadLetters + 1
+	}
+
+	letters := []*DeadLetter{}
+	for start := first; start <= last; start += kDeadLetterListBatchSize {
+		keys := make([]string, 0, kDeadLetterListBatchSize)
+		for number := start; number <= last && number < start+kDeadLetterListBatchSize; number++ {
+			keys = append(keys, DeadLetterKeyPrefix+strconv.FormatUint(number, 10))
+		}
+		docs, err := store.context.Bucket.GetBulkRaw(keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			data := docs[key]
+			if len(data) == 0 {
+				continue // Deleted, or never saved
+			}
+			var letter DeadLetter
+			if err := json.Unmarshal(data, &letter); err != nil {
+				return nil, err
+			}
+			letters = append(letters, &letter)
+		}
+	}
+	return letters, nil
+}
+
+// Returns the dead letter with the given ID.
+func (store *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	var letter DeadLetter
+	if _, err := store.context.Bucket.Get(DeadLetterKeyPrefix+id, &letter); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// Deletes the dead letter with the given ID.  Returns false if there's no such dead letter.
+func (store *DeadLetterStore) Delete(id string) (bool, error) {
+	err := store.context.Bucket.Delete(DeadLetterKeyPrefix + id)
+	if base.IsDocNotFoundError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Deletes every dead letter.  Returns the number deleted.
+func (store *DeadLetterStore) Purge() (int, error) {
+	letters, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, letter := range letters {
+		found, err := store.Delete(letter.ID)
+		if err != nil {
+			return count, err
+		}
+		if found {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Posts the given dead letters (or all of them, if ids is empty) again, using the configured
+// webhook with the same URL.  Those delivered are deleted; those that fail again are kept.
+func (store *DeadLetterStore) Replay(ids []string) (replayed int, failures []DeadLetterReplayFailure, err error) {
+	var letters []*DeadLetter
+	if len(ids) == 0 {
+		if letters, err = store.List(); err != nil {
+			return 0, nil, err
+		}
+	} else {
+		for _, id := range ids {
+			letter, err := store.Get(id)
+			if err != nil {
+				if base.IsDocNotFoundError(err) {
+					return 0, nil, base.HTTPErrorf(http.StatusNotFound, "No dead letter %q", id)
+				}
+				return 0, nil, err
+			}
+			letters = append(letters, letter)
+		}
+	}
+
+	failures = []DeadLetterReplayFailure{}
+	for _, letter := range letters {
+		wh := store.context.webhookForUrl(letter.Url)
+		if wh == nil {
+			failures = append(failures, DeadLetterReplayFailure{letter.ID, "No webhook is configured for this URL"})
+			continue
+		}
+		post := &webhookPost{
+			Payload:     []byte(letter.Payload),
+			ContentType: letter.ContentType,
+			Path:        letter.Path,
+			RequestID:   letter.RequestID,
+		}
+		if postErr := wh.post(post); postErr != nil {
+			letter.Attempts++
+			letter.Error = postErr.Error()
+			store.context.Bucket.Set(DeadLetterKeyPrefix+letter.ID, 0, letter)
+			failures = append(failures, DeadLetterReplayFailure{letter.ID, letter.Error})
+			continue
+		}
+		if _, err := store.Delete(letter.ID); err != nil {
+			base.Warn("Unable to delete replayed dead letter %s: %v", letter.ID, err)
+		}
+		replayed++
+	}
+	return replayed, failures, nil
+}
+
+func (store *DeadLetterStore) deleteDoc(id string) error {
+	err := store.context.Bucket.Delete(DeadLetterKeyPrefix + id)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestWebhookRetry(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&posts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	wh, err := NewWebhookWithOptions(server.URL, "", WebhookOptions{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		DeadLetters:    db.DeadLetters,
+	})
+	assertNoError(t, err, "Couldn't create webhook")
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	wh.Flush()
+	assert.Equals(t, atomic.LoadInt32(&posts), int32(3))
+
+	letters, err := db.DeadLetters.List()
+	assertNoError(t, err, "Couldn't list dead letters")
+	assert.Equals(t, len(letters), 0)
+}
+
+func TestWebhookRetriesOffQueue(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	defer func(limit int64) { maxWebhookPendingRetries = limit }(maxWebhookPendingRetries)
+	maxWebhookPendingRetries = 1
+	wh, err := NewWebhookWithOptions(server.URL, "", WebhookOptions{
+		MaxAttempts:    3,
+		InitialBackoff: 200 * time.Millisecond,
+		DeadLetters:    db.DeadLetters,
+	})
+	assertNoError(t, err, "Couldn't create webhook")
+
+	// Handling returns after the first attempt, without waiting to retry
+	start := time.Now()
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.Equals(t, atomic.LoadInt32(&posts), int32(1))
+
+	// With the limit of waiting retries reached, a failed post is saved as a dead letter at once
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	letters, err := db.DeadLetters.List()
+	assertNoError(t, err, "Couldn't list dead letters")
+	assert.Equals(t, len(letters), 1)
+	assert.Equals(t, letters[0].Payload, `{"_id":"doc2"}`)
+	assert.Equals(t, letters[0].Attempts, 1)
+
+	wh.Flush()
+	assert.Equals(t, atomic.LoadInt32(&posts), int32(4))
+	letters, _ = db.DeadLetters.List()
+	assert.Equals(t, len(letters), 2)
+	assert.Equals(t, letters[1].Payload, `{"_id":"doc1"}`)
+	assert.Equals(t, letters[1].Attempts, 3)
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	wh, err := NewWebhookWithOptions(server.URL, "", WebhookOptions{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+		DeadLetters:    db.DeadLetters,
+	})
+	assertNoError(t, err, "Couldn't create webhook")
+	db.EventMgr.RegisterEventHandler(wh, DocumentChange)
+
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc1"}})
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc2"}})
+	wh.Flush()
+	assert.Equals(t, atomic.LoadInt32(&posts), int32(4))
+
+	letters, err := db.DeadLetters.List()
+	assertNoError(t, err, "Couldn't list dead letters")
+	assert.Equals(t, len(letters), 2)
+	assert.Equals(t, letters[0].Payload, `{"_id":"doc1"}`)
+	assert.Equals(t, letters[0].Attempts, 2)
+	assert.Equals(t, letters[0].EventType, "document_changed")
+
+	// Client errors other than throttling aren't retried
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	wh.HandleEvent(&DocumentChangeEvent{Doc: Body{"_id": "doc3"}})
+	assert.Equals(t, atomic.LoadInt32(&posts), int32(5))
+
+	// Replaying one that fails again keeps it
+	replayed, failures, err := db.DeadLetters.Replay([]string{letters[0].ID})
+	assertNoError(t, err, "Couldn't replay dead letter")
+	assert.Equals(t, replayed, 0)
+	assert.Equals(t, len(failures), 1)
+
+	// Once the receiver is back, replaying delivers and removes them
+	atomic.StoreInt32(&status, http.StatusOK)
+	replayed, failures, err = db.DeadLetters.Replay([]string{letters[0].ID})
+	assertNoError(t, err, "Couldn't replay dead letter")
+	assert.Equals(t, replayed, 1)
+	assert.Equals(t, len(failures), 0)
+	letters, _ = db.DeadLetters.List()
+	assert.Equals(t, len(letters), 2)
+
+	found, err := db.DeadLetters.Delete(letters[0].ID)
+	assert.True(t, found)
+	purged, err := db.DeadLetters.Purge()
+	assertNoError(t, err, "Couldn't purge dead letters")
+	assert.Equals(t, purged, 1)
+	letters, _ = db.DeadLetters.List()
+	assert.Equals(t, len(letters), 0)
+}
@@ -31,5 +31,19 @@ func main() {
 		}
 	}()
 
+	// On SIGTERM or SIGINT, shut down gracefully; RunServer returns when it's done.  A second
+	// signal exits immediately.
+	shutdownchannel := make(chan os.Signal, 1)
+	signal.Notify(shutdownchannel, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-shutdownchannel
+		base.Logf("%v: Shutting down....\n", sig)
+		go rest.Shutdown()
+		sig = <-shutdownchannel
+		base.Logf("%v: Exiting without waiting for shutdown to complete\n", sig)
+		os.Exit(1)
+	}()
+
 	rest.ServerMain(rest.SyncGatewayRunModeNormal)
 }
@@ -12,8 +12,10 @@ package rest
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -73,7 +75,7 @@ func (h *handler) handleDbOnline() error {
 
 	json.Unmarshal(body, &input)
 
-	base.LogTo("CRUD", "Taking Database : %v, online in %v seconds", h.db.Name, input.Delay)
+	h.logContext.LogTo("CRUD", "Taking Database : %v, online in %v seconds", h.db.Name, input.Delay)
 
 	timer := time.NewTimer(time.Duration(input.Delay) * time.Second)
 	go func() {
@@ -90,7 +92,7 @@ func (h *handler) handleDbOffline() error {
 	h.assertAdminOnly()
 	var err error
 	if err = h.db.TakeDbOffline("ADMIN Request"); err != nil {
-		base.LogTo("CRUD", "Unable to take Database : %v, offline", h.db.Name)
+		h.logContext.LogTo("CRUD", "Unable to take Database : %v, offline", h.db.Name)
 	}
 
 	return err
@@ -146,16 +148,27 @@ func (h *handler) handleReplicate() error {
 		return err
 	}
 
-	params, cancel, _, err := h.readReplicationParametersFromJSON(body)
+	var in ReplicationConfig
+	if err := json.Unmarshal(body, &in); err != nil {
+		return err
+	}
+
+	params, cancel, _, err := h.server.replicationParameters(in, false)
 
 	if err != nil {
 		return err
 	}
 
-	replication, err := h.server.replicator.Replicate(params, cancel)
+	replication, err := h.server.replicator.ReplicateWithRetryPolicy(params, cancel, in.retryPolicy())
 
 	if err == nil {
+		if cancel {
+			h.server.removeReplicationFilter(replication.ReplicationID)
+		}
 		h.writeJSON(replication)
+	} else if !cancel && strings.HasPrefix(params.Target.Path, kReplicationFilterPathPrefix) {
+		// Drop the filter this request set up for the replication that didn't start
+		h.server.removeReplicationFilter(params.ReplicationId)
 	}
 
 	return err
@@ -163,28 +176,44 @@ func (h *handler) handleReplicate() error {
 }
 
 type ReplicationConfig struct {
-	Source           string      `json:"source"`
-	Target           string      `json:"target"`
-	Continuous       bool        `json:"continuous"`
-	CreateTarget     bool        `json:"create_target"`
-	DocIds           []string    `json:"doc_ids"`
-	Filter           string      `json:"filter"`
-	Proxy            string      `json:"proxy"`
-	QueryParams      interface{} `json:"query_params"`
-	Cancel           bool        `json:"cancel"`
-	Async            bool        `json:"async"`
-	ChangesFeedLimit int         `json:"changes_feed_limit"`
-	ReplicationId    string      `json:"replication_id"`
-}
-
-func (h *handler) readReplicationParametersFromJSON(jsonData []byte) (params sgreplicate.ReplicationParameters, cancel bool, localdb bool, err error) {
+	Source           string                  `json:"source"`
+	Target           string                  `json:"target"`
+	Continuous       bool                    `json:"continuous"`
+	CreateTarget     bool                    `json:"create_target"`
+	DocIds           []string                `json:"doc_ids"`
+	Filter           string                  `json:"filter"`
+	Proxy            string                  `json:"proxy"`
+	QueryParams      interface{}             `json:"query_params"`
+	Cancel           bool                    `json:"cancel"`
+	Async            bool                    `json:"async"`
+	ChangesFeedLimit int                     `json:"changes_feed_limit"`
+	ReplicationId    string                  `json:"replication_id"`
+	Retry            *ReplicationRetryConfig `json:"retry,omitempty"`
+	Channels         []string                `json:"channels,omitempty"`         // Only replicate docs in these channels
+	PurgeOnRemoval   bool                    `json:"purge_on_removal,omitempty"` // Purge docs from the target when they leave the replicated channels
+}
 
-	var in ReplicationConfig
-	if err = json.Unmarshal(jsonData, &in); err != nil {
-		return params, false, localdb, err
-	}
+type ReplicationRetryConfig struct {
+	MaxAttempts  *int `json:"max_attempts,omitempty"`   // Consecutive failed attempts before the replication stops with an error (default: continuous retries forever, one-shot tries once)
+	BackoffMs    *int `json:"backoff_ms,omitempty"`     // Wait before the first retry, doubling on each consecutive failure (default 500)
+	MaxBackoffMs *int `json:"max_backoff_ms,omitempty"` // Upper limit of the wait between retries (default 300000)
+}
 
-	return validateReplicationParameters(in, false, *h.server.config.AdminInterface)
+// Returns the policy for retrying the replication's failed attempts.
+func (config ReplicationConfig) retryPolicy() base.ReplicationRetryPolicy {
+	policy := base.DefaultReplicationRetryPolicy()
+	if config.Retry != nil {
+		if config.Retry.MaxAttempts != nil {
+			policy.MaxAttempts = *config.Retry.MaxAttempts
+		}
+		if config.Retry.BackoffMs != nil {
+			policy.InitialBackoff = time.Duration(*config.Retry.BackoffMs) * time.Millisecond
+		}
+		if config.Retry.MaxBackoffMs != nil {
+			policy.MaxBackoff = time.Duration(*config.Retry.MaxBackoffMs) * time.Millisecond
+		}
+	}
+	return policy
 }
 
 func validateReplicationParameters(requestParams ReplicationConfig, paramsFromConfig bool, adminInterface string) (params sgreplicate.ReplicationParameters, cancel bool, localdb bool, err error) {
@@ -193,16 +222,20 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 		return
 	}
 
-	if len(requestParams.DocIds) > 0 {
-		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate doc_ids option is not currently supported.")
-		return
-	}
-
 	if requestParams.Proxy != "" {
 		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate proxy option is not currently supported.")
 		return
 	}
 
+	if retry := requestParams.Retry; retry != nil {
+		for _, value := range []*int{retry.MaxAttempts, retry.BackoffMs, retry.MaxBackoffMs} {
+			if value != nil && *value < 0 {
+				err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate retry values must not be negative.")
+				return
+			}
+		}
+	}
+
 	params.ReplicationId = requestParams.ReplicationId
 
 	//cancel parameter is only supported via the REST API
@@ -283,10 +316,17 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 				}
 				params.Channels = channels
 			}
-		} else {
-			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate Unknown filter; try sync_gateway/bychannel")
+		}
+		// Any other filter names one of the target database's replication_filters, which is
+		// applied by the replication filter endpoints (see replication_filter.go)
+	}
+
+	if len(requestParams.Channels) > 0 {
+		if requestParams.Filter == "sync_gateway/bychannel" {
+			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate channels can't be combined with the sync_gateway/bychannel filter; use query_params")
 			return
 		}
+		params.Channels = requestParams.Channels
 	}
 
 
@@ -310,6 +350,242 @@ func (h *handler) handleActiveTasks() error {
 	return nil
 }
 
+// Lists the replications stored through the /_replication API, with their state
+func (h *handler) handleGetReplications() error {
+	store, err := h.server.replicationStore()
+	if err != nil {
+		return err
+	}
+	docs, err := store.List()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		doc.Task = h.server.replicator.ActiveTask(doc.ReplicationId)
+	}
+	h.writeJSON(docs)
+	return nil
+}
+
+func (h *handler) handleGetReplication() error {
+	store, err := h.server.replicationStore()
+	if err != nil {
+		return err
+	}
+	doc, err := store.Get(h.PathVar("id"))
+	if err != nil {
+		return err
+	}
+	doc.Task = h.server.replicator.ActiveTask(doc.ReplicationId)
+	h.writeJSON(doc)
+	return nil
+}
+
+// Creates or replaces a stored replication, and (re)starts it
+func (h *handler) handlePutReplication() error {
+	store, err := h.server.replicationStore()
+	if err != nil {
+		return err
+	}
+	var doc ReplicationDoc
+	if err := h.readJSONInto(&doc.ReplicationConfig); err != nil {
+		return err
+	}
+	if doc.Cancel {
+		return base.HTTPErrorf(http.StatusBadRequest, "To cancel a stored replication, DELETE it")
+	}
+	doc.ReplicationId = h.PathVar("id")
+	if err := h.server.startStoredReplication(store, &doc, false); err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusCreated, doc)
+	return nil
+}
+
+// Cancels a stored replication and deletes it
+func (h *handler) handleDeleteReplication() error {
+	store, err := h.server.replicationStore()
+	if err != nil {
+		return err
+	}
+	id := h.PathVar("id")
+	found, err := store.Delete(id)
+	if err != nil {
+		return err
+	} else if !found {
+		return base.HTTPErrorf(http.StatusNotFound, "No replication %q", id)
+	}
+	return h.server.stopLocalReplication(id)
+}
+
+// Lists the database's active longpoll, continuous and websocket changes feeds
+func (h *handler) handleGetChangesFeeds() error {
+	h.writeJSON(h.db.ChangesFeeds.List())
+	return nil
+}
+
+// Terminates an active changes feed
+func (h *handler) handleDeleteChangesFeed() error {
+	feedID := h.PathVar("feedid")
+	if !h.db.ChangesFeeds.Terminate(feedID) {
+		return kNotFoundError
+	}
+	h.logContext.LogTo("Changes", "Changes feed %s terminated by admin request", feedID)
+	return nil
+}
+
+// Reports the state of the change cache: sequence bookkeeping, skipped sequences and channel caches.
+// Only the largest channels and oldest skipped sequences are listed, up to ?limit (0 for all), unless
+// specific channels are asked for with ?channel=...
+func (h *handler) handleGetCache() error {
+	options := db.ChangeCacheStatusOptions{
+		Channels: h.getQueryValues("channel"),
+		Limit:    int(h.getIntQuery("limit", db.DefaultChangeCacheStatusLimit)),
+	}
+	status, err := h.db.GetChangeCacheStatus(options)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// Evicts a channel's cached changes
+func (h *handler) handleEvictChannelCache() error {
+	return h.db.EvictChannelCache(h.PathVar("channel"))
+}
+
+// Drops a sequence from the skipped sequence queue, so it no longer holds back the cache
+func (h *handler) handleDropSkippedSequence() error {
+	seq, err := strconv.ParseUint(h.PathVar("seq"), 10, 64)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid sequence")
+	}
+	return h.db.DropSkippedSequence(seq)
+}
+
+// Lists the webhook events that couldn't be delivered
+func (h *handler) handleGetDeadLetters() error {
+	letters, err := h.db.DeadLetters.List()
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		letter.Url = letter.SanitizedUrl()
+	}
+	h.writeJSON(letters)
+	return nil
+}
+
+// Posts dead letters to their webhooks again: the ones whose IDs are given in the optional
+// request body, or else all of them
+func (h *handler) handleReplayDeadLetters() error {
+	var params struct {
+		IDs []string `json:"ids"`
+	}
+	if body, err := h.readBody(); err != nil {
+		return err
+	} else if len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON: %v", err)
+		}
+	}
+	replayed, failures, err := h.db.DeadLetters.Replay(params.IDs)
+	if err != nil {
+		return err
+	}
+	h.logContext.LogTo("Events", "Replayed %d dead letters by admin request; %d failed again", replayed, len(failures))
+	h.writeJSON(db.Body{"replayed": replayed, "failed": failures})
+	return nil
+}
+
+// Deletes all dead letters
+func (h *handler) handlePurgeDeadLetters() error {
+	count, err := h.db.DeadLetters.Purge()
+	if err != nil {
+		return err
+	}
+	h.logContext.LogTo("Events", "Purged %d dead letters by admin request", count)
+	h.writeJSON(db.Body{"purged": count})
+	return nil
+}
+
+// Deletes a dead letter
+func (h *handler) handleDeleteDeadLetter() error {
+	found, err := h.db.DeadLetters.Delete(h.PathVar("id"))
+	if err != nil {
+		return err
+	} else if !found {
+		return kNotFoundError
+	}
+	return nil
+}
+
+// Lists the event handlers, with the state of the event queue and each handler's stats
+func (h *handler) handleGetEventHandlers() error {
+	h.writeJSON(h.db.EventHandlerStats())
+	return nil
+}
+
+// Adds an event handler.  The body is an event handler config, plus the type of event it handles.
+// Handlers added this way aren't saved in the database config, so are gone after a restart.
+func (h *handler) handleAddEventHandler() error {
+	var params struct {
+		Event string `json:"event"`
+		EventConfig
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	eventType, ok := db.ParseEventType(params.Event)
+	if !ok {
+		return base.HTTPErrorf(http.StatusBadRequest, "Unsupported event type %q", params.Event)
+	}
+	eventHandler, err := newEventHandler(&params.EventConfig, h.db.DatabaseContext)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid event handler: %v", err)
+	}
+	// The event manager is only started at load time if the config has event handlers
+	h.db.EventMgr.Start(0, -1)
+	id, err := h.db.AddEventHandler(params.ID, eventHandler, eventType, params.Durable)
+	if err != nil {
+		if closer, ok := eventHandler.(io.Closer); ok {
+			closer.Close()
+		}
+		return err
+	}
+	h.logContext.LogTo("Events", "Added event handler %q by admin request: %s", id, eventHandler)
+	h.writeJSONStatus(http.StatusCreated, db.Body{"id": id})
+	return nil
+}
+
+// Removes an event handler
+func (h *handler) handleDeleteEventHandler() error {
+	id := h.PathVar("id")
+	if !h.db.RemoveEventHandler(id) {
+		return kNotFoundError
+	}
+	h.logContext.LogTo("Events", "Removed event handler %q by admin request", id)
+	return nil
+}
+
+func (h *handler) handlePauseEventHandler() error {
+	return h.setEventHandlerPaused(true)
+}
+
+func (h *handler) handleResumeEventHandler() error {
+	return h.setEventHandlerPaused(false)
+}
+
+func (h *handler) setEventHandlerPaused(paused bool) error {
+	id := h.PathVar("id")
+	if !h.db.PauseEventHandler(id, paused) {
+		return kNotFoundError
+	}
+	h.logContext.LogTo("Events", "Set event handler %q paused=%v by admin request", id, paused)
+	return nil
+}
+
 // raw document access for admin api
 
 func (h *handler) handleGetRawDoc() error {
@@ -338,6 +614,14 @@ func (h *handler) handleSetLogging() error {
 			return nil // empty body is OK if request is just setting the log level
 		}
 	}
+	if format := h.getQuery("format"); format != "" {
+		if err := base.SetLogFormat(format); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+		}
+		if len(body) == 0 {
+			return nil // empty body is OK if request is just setting the log format
+		}
+	}
 	var keys map[string]bool
 	if err := json.Unmarshal(body, &keys); err != nil {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON or non-boolean values")
@@ -346,6 +630,28 @@ func (h *handler) handleSetLogging() error {
 	return nil
 }
 
+func (h *handler) handleGetLoggingConfig() error {
+	h.writeJSON(base.GetLoggingConfig())
+	return nil
+}
+
+// Replaces the log format, rotation settings and sinks.  The main log file path can't be changed.
+func (h *handler) handleSetLoggingConfig() error {
+	var loggingConfig base.LoggingConfig
+	if err := h.readJSONInto(&loggingConfig); err != nil {
+		return err
+	}
+	logFilePath := ""
+	if h.server.config.LogFilePath != nil {
+		logFilePath = *h.server.config.LogFilePath
+	}
+	if err := base.ConfigureLogging(loggingConfig, logFilePath); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+	}
+	h.server.config.Logging = &loggingConfig
+	return nil
+}
+
 //////// USERS & ROLES:
 
 func internalUserName(name string) string {
@@ -512,7 +818,7 @@ func (h *handler) getRoles() error {
 
 // HTTP handler for /index
 func (h *handler) handleIndex() error {
-	base.LogTo("HTTP", "Index")
+	h.logContext.LogTo("HTTP", "Index")
 
 	indexStats, err := h.db.IndexStats()
 
@@ -527,7 +833,7 @@ func (h *handler) handleIndex() error {
 // HTTP handler for /index/channel
 func (h *handler) handleIndexChannel() error {
 	channelName := h.PathVar("channel")
-	base.LogTo("HTTP", "Index channel %q", channelName)
+	h.logContext.LogTo("HTTP", "Index channel %q", channelName)
 
 	channelStats, err := h.db.IndexChannelStats(channelName)
 
@@ -541,7 +847,7 @@ func (h *handler) handleIndexChannel() error {
 
 // HTTP handler for /index/channels
 func (h *handler) handleIndexAllChannels() error {
-	base.LogTo("HTTP", "Index channels")
+	h.logContext.LogTo("HTTP", "Index channels")
 
 	channelStats, err := h.db.IndexAllChannelStats()
 
@@ -572,18 +878,18 @@ func (h *handler) handlePurge() error {
 
 	for key, value := range input {
 		//For each one validate that the revision list is set to ["*"], otherwise skip doc and log warning
-		base.LogTo("CRUD", "purging document = %v", key)
+		h.logContext.LogTo("CRUD", "purging document = %v", key)
 
 		if revisionList, ok := value.([]interface{}); ok {
 
 			//There should only be a single revision entry of "*"
 			if len(revisionList) != 1 {
-				base.LogTo("CRUD", "Revision list for doc ID %v, should contain exactly one entry", key)
+				h.logContext.LogTo("CRUD", "Revision list for doc ID %v, should contain exactly one entry", key)
 				continue //skip this entry its not valid
 			}
 
 			if revisionList[0] != "*" {
-				base.LogTo("CRUD", "Revision entry for doc ID %v, should be the '*' revison", key)
+				h.logContext.LogTo("CRUD", "Revision entry for doc ID %v, should be the '*' revison", key)
 				continue //skip this entry its not valid
 			}
 
@@ -601,12 +907,12 @@ func (h *handler) handlePurge() error {
 				h.response.Write([]byte(s))
 
 			} else {
-				base.LogTo("CRUD", "Failed to purge document %v, err = %v", key, err)
+				h.logContext.LogTo("CRUD", "Failed to purge document %v, err = %v", key, err)
 				continue //skip this entry its not valid
 			}
 
 		} else {
-			base.LogTo("CRUD", "Revision list for doc ID %v, is not an array, ", key)
+			h.logContext.LogTo("CRUD", "Revision list for doc ID %v, is not an array, ", key)
 			continue //skip this entry its not valid
 		}
 	}
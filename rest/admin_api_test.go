@@ -15,7 +15,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -1160,6 +1163,81 @@ func TestReplicateErrorConditions(t *testing.T) {
 	//Send JSON Object containing no source and target as local DB
 	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"target":"mylocaltargetdb"}`), 400)
 
+	//Send JSON Object containing a negative retry value
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"http://myhost:4985/a", "target":"http://myhost:4985/b", "retry":{"max_attempts":-1}}`), 400)
+
+	//Send JSON Object containing doc_ids, a named filter or purge_on_removal with a remote target
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db", "target":"http://myhost:4985/b", "doc_ids":["foo"]}`), 400)
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db", "target":"http://myhost:4985/b", "filter":"somefilter"}`), 400)
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db", "target":"http://myhost:4985/b", "channels":["A"], "purge_on_removal":true}`), 400)
+
+	//Send JSON Object containing a filter the local target database doesn't define
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"http://myhost:4985/a", "target":"db", "filter":"somefilter"}`), 400)
+
+	//Send JSON Object containing purge_on_removal without channels
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"http://myhost:4985/a", "target":"db", "purge_on_removal":true}`), 400)
+
+	//Send JSON Object containing both channels and the 'sync_gateway/bychannel' filter
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"http://myhost:4985/a", "target":"db", "channels":["A"], "filter":"sync_gateway/bychannel", "query_params":["A"]}`), 400)
+
+}
+
+func TestReplicationRetryPolicy(t *testing.T) {
+	var config ReplicationConfig
+	assert.DeepEquals(t, config.retryPolicy(), base.DefaultReplicationRetryPolicy())
+
+	assertNoError(t, json.Unmarshal([]byte(`{"retry":{"max_attempts":5, "backoff_ms":250, "max_backoff_ms":10000}}`), &config), "Couldn't parse config")
+	policy := config.retryPolicy()
+	assert.Equals(t, policy.MaxAttempts, 5)
+	assert.Equals(t, policy.InitialBackoff, 250*time.Millisecond)
+	assert.Equals(t, policy.MaxBackoff, 10*time.Second)
+}
+
+func TestReplicationFilter(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channels)}`}
+	sc := rt.ServerContext()
+	sc.GetDatabaseConfig("db").ReplicationFilters = map[string]string{
+		"wanted": `function(doc) {return doc.type == "wanted"}`,
+	}
+
+	// Doc IDs and a named filter function
+	config := ReplicationConfig{DocIds: []string{"doc1", "doc2"}, Filter: "wanted"}
+	params, _, _, err := validateReplicationParameters(ReplicationConfig{Source: "http://localhost:1/a", Target: "db"}, false, *sc.config.AdminInterface)
+	assertNoError(t, err, "Couldn't validate replication")
+	filter, err := sc.newReplicationFilter(config, params)
+	assertNoError(t, err, "Couldn't create replication filter")
+	params.ReplicationId = "rf1"
+	sc.addReplicationFilter(&params, filter)
+	assert.Equals(t, params.Target.Path, "/_replication_filter/rf1")
+
+	response := rt.sendAdminRequest("POST", "/_replication_filter/rf1/db/_revs_diff", `{"doc1":["1-a"], "doc3":["1-c"]}`)
+	assertStatus(t, response, 200)
+	var diff map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &diff)
+	assert.Equals(t, len(diff), 1)
+	assert.True(t, diff["doc1"] != nil)
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replication_filter/rf1/db/_bulk_docs",
+		`{"docs":[{"_id":"doc1", "type":"wanted"}, {"_id":"doc2", "type":"other"}, {"_id":"doc3", "type":"wanted"}]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/doc1", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/doc2", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/doc3", ""), 404)
+
+	// Purging docs that leave the replicated channels
+	params, _, _, err = validateReplicationParameters(ReplicationConfig{Source: "http://localhost:1/a", Target: "db", Channels: []string{"A"}}, false, *sc.config.AdminInterface)
+	assertNoError(t, err, "Couldn't validate replication")
+	filter, err = sc.newReplicationFilter(ReplicationConfig{PurgeOnRemoval: true}, params)
+	assertNoError(t, err, "Couldn't create replication filter")
+	params.ReplicationId = "rf2"
+	sc.addReplicationFilter(&params, filter)
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replication_filter/rf2/db/_bulk_docs",
+		`{"docs":[{"_id":"doc4", "channels":["A"]}, {"_id":"doc5", "channels":["B"]}]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/doc4", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/doc5", ""), 404)
+
+	sc.removeReplicationFilter("rf1")
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replication_filter/rf1/db/_bulk_docs", `{"docs":[]}`), 404)
 }
 
 //These tests validate request parameters not actual replication
@@ -1202,3 +1280,170 @@ func TestDocumentChangeReplicate(t *testing.T) {
 	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"replication_id":"ABC", "cancel":true}`), 404)
 
 }
+
+func TestEventHandlersAdmin(t *testing.T) {
+	var rt restTester
+	dir, err := ioutil.TempDir("", "events")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+
+	// Handlers can be added at runtime, even if the config has none
+	response := rt.sendAdminRequest("POST", "/db/_event_handlers",
+		fmt.Sprintf(`{"event":"document_changed", "handler":"file", "path":%q, "id":"log"}`, path))
+	assertStatus(t, response, 201)
+	response = rt.sendAdminRequest("POST", "/db/_event_handlers",
+		fmt.Sprintf(`{"event":"document_changed", "handler":"file", "path":%q, "id":"log"}`, path))
+	assertStatus(t, response, 409)
+	response = rt.sendAdminRequest("POST", "/db/_event_handlers", `{"event":"bogus", "handler":"file", "path":"x"}`)
+	assertStatus(t, response, 400)
+
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"prop":true}`), 201)
+	var stats db.EventQueueStats
+	for i := 0; i < 100; i++ {
+		response = rt.sendAdminRequest("GET", "/db/_event_handlers", "")
+		assertStatus(t, response, 200)
+		json.Unmarshal(response.Body.Bytes(), &stats)
+		if len(stats.Handlers) == 1 && stats.Handlers[0].Processed == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, len(stats.Handlers), 1)
+	assert.Equals(t, stats.Handlers[0].ID, "log")
+	assert.Equals(t, stats.Handlers[0].Processed, int64(1))
+	assert.Equals(t, stats.Handlers[0].Failures, int64(0))
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_event_handlers/log/_pause", ""), 200)
+	response = rt.sendAdminRequest("GET", "/db/_event_handlers", "")
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.True(t, stats.Handlers[0].Paused)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_event_handlers/log/_resume", ""), 200)
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_event_handlers/log", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_event_handlers/log", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_event_handlers/log/_pause", ""), 404)
+}
+
+func TestStoredReplications(t *testing.T) {
+	var rt restTester
+
+	// Stored replications are disabled unless the config names a database to keep them in
+	assertStatus(t, rt.sendAdminRequest("GET", "/_replication", ""), 404)
+	dbName := "db"
+	rt.ServerContext().config.ReplicationsDatabase = &dbName
+
+	response := rt.sendAdminRequest("GET", "/_replication", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "[]")
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_replication/rep1",
+		`{"source":"http://localhost:1/a", "target":"http://localhost:1/b", "cancel":true}`), 400)
+	response = rt.sendAdminRequest("PUT", "/_replication/rep1",
+		`{"source":"http://localhost:1/a", "target":"http://localhost:1/b"}`)
+	assertStatus(t, response, 201)
+	var doc ReplicationDoc
+	json.Unmarshal(response.Body.Bytes(), &doc)
+	assert.Equals(t, doc.ReplicationId, "rep1")
+	assert.Equals(t, doc.State, base.ReplicationStateRunning)
+
+	response = rt.sendAdminRequest("GET", "/_replication/rep1", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &doc)
+	assert.Equals(t, doc.Source, "http://localhost:1/a")
+	assert.Equals(t, doc.Target, "http://localhost:1/b")
+
+	var docs []ReplicationDoc
+	response = rt.sendAdminRequest("GET", "/_replication", "")
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 1)
+	assert.Equals(t, docs[0].ReplicationId, "rep1")
+
+	// The definition is kept in the bucket
+	store, err := rt.ServerContext().replicationStore()
+	assertNoError(t, err, "Couldn't get replication store")
+	stored, err := store.Get("rep1")
+	assertNoError(t, err, "Couldn't get stored replication")
+	assert.Equals(t, stored.Target, "http://localhost:1/b")
+	assert.True(t, stored.Task == nil)
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/_replication/rep1", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/_replication/rep1", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/_replication/rep1", ""), 404)
+	response = rt.sendAdminRequest("GET", "/_replication", "")
+	assert.Equals(t, string(response.Body.Bytes()), "[]")
+}
+
+func TestStoredReplicationClaims(t *testing.T) {
+	var rt restTester
+	dbName := "db"
+	sc := rt.ServerContext()
+	sc.config.ReplicationsDatabase = &dbName
+	store, err := sc.replicationStore()
+	assertNoError(t, err, "Couldn't get replication store")
+
+	// A replication another node is running can't be claimed until that node's claim expires
+	doc := &ReplicationDoc{State: base.ReplicationStateRunning, Owner: "other-node", LeaseEnd: time.Now().Add(time.Minute)}
+	doc.ReplicationId = "rep1"
+	assertNoError(t, store.Put(doc), "Couldn't store replication")
+	claimed, err := sc.claimStoredReplication(store, "rep1")
+	assertNoError(t, err, "Couldn't claim replication")
+	assert.True(t, claimed == nil)
+
+	doc.LeaseEnd = time.Now().Add(-time.Second)
+	assertNoError(t, store.Put(doc), "Couldn't store replication")
+	claimed, err = sc.claimStoredReplication(store, "rep1")
+	assertNoError(t, err, "Couldn't claim replication")
+	assert.Equals(t, claimed.Owner, sc.config.nodeID())
+	stored, _ := store.Get("rep1")
+	assert.Equals(t, stored.Owner, sc.config.nodeID())
+	assert.True(t, stored.LeaseEnd.After(time.Now()))
+
+	// Once shutdown has stopped the stored replications, they're not resumed
+	sc.stopReplicationCheckpoints()
+	sc.resumeStoredReplications()
+	assert.True(t, sc.replicationTicker == nil)
+}
+
+func TestDeletedStoredReplicationIsStopped(t *testing.T) {
+	var rt restTester
+	dbName := "db"
+	sc := rt.ServerContext()
+	sc.config.ReplicationsDatabase = &dbName
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_replication/rep1",
+		`{"source":"http://localhost:1/a", "target":"http://localhost:1/b", "continuous":true}`), 201)
+	for i := 0; i < 100 && sc.replicator.ActiveTask("rep1") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, sc.replicator.ActiveTask("rep1") != nil)
+
+	// Deleting the definition directly in the bucket, as another node would, stops the replication
+	// the next time this node records its checkpoints
+	store, err := sc.replicationStore()
+	assertNoError(t, err, "Couldn't get replication store")
+	_, err = store.Delete("rep1")
+	assertNoError(t, err, "Couldn't delete stored replication")
+	sc.recordReplicationCheckpoints()
+	assert.True(t, sc.replicator.ActiveTask("rep1") == nil)
+	assert.False(t, sc.isStoredReplicationStarted("rep1"))
+}
+
+func TestReplicationEventDatabase(t *testing.T) {
+	var rt restTester
+	sc := rt.ServerContext()
+	local := "http://" + *sc.config.AdminInterface
+
+	// Events are raised on the local source, or else the local target
+	task := &base.ActiveTask{Source: local + "/db", Target: "http://localhost:1/b"}
+	assert.Equals(t, sc.replicationEventDatabase(task), rt.getDatabase())
+	task = &base.ActiveTask{Source: "http://localhost:1/a", Target: local + "/_replication_filter/rf1/db"}
+	assert.Equals(t, sc.replicationEventDatabase(task), rt.getDatabase())
+
+	// A replication between remote databases raises them on the database storing replications
+	task = &base.ActiveTask{Source: "http://localhost:1/a", Target: "http://localhost:1/b"}
+	assert.True(t, sc.replicationEventDatabase(task) == nil)
+	dbName := "db"
+	sc.config.ReplicationsDatabase = &dbName
+	assert.Equals(t, sc.replicationEventDatabase(task), rt.getDatabase())
+}
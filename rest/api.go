@@ -80,6 +80,28 @@ func (h *handler) handleRoot() error {
 	return nil
 }
 
+// HTTP handler for the liveness check ("/_health").  Only reports that the process is able to
+// serve requests; database-level checks are done by handleReady.
+func (h *handler) handleHealth() error {
+	h.writeJSON(db.Body{"status": "ok"})
+	return nil
+}
+
+// HTTP handler for a database's readiness check ("/db/_ready").  Responds with 503 if the
+// database shouldn't be sent traffic.  The details of each check are only shown on the admin port.
+func (h *handler) handleReady() error {
+	status := h.db.CheckReadiness()
+	if h.privs != adminPrivs {
+		status = status.Summary()
+	}
+	if status.Ready {
+		h.writeJSON(status)
+	} else {
+		h.writeJSONStatus(http.StatusServiceUnavailable, status)
+	}
+	return nil
+}
+
 func (h *handler) handleAllDbs() error {
 	h.writeJSON(h.server.AllDatabaseNames())
 	return nil
@@ -215,12 +237,12 @@ func (h *handler) handleProfiling() error {
 			defer f.Close()
 			if profile := pprof.Lookup(profileName); profile != nil {
 				profile.WriteTo(f, 0)
-				base.Logf("Wrote %s profile to %s", profileName, params.File)
+				h.logContext.Logf("Wrote %s profile to %s", profileName, params.File)
 			} else {
 				return base.HTTPErrorf(http.StatusNotFound, "No such profile %q", profileName)
 			}
 		} else {
-			base.Logf("Starting CPU profile to %s ...", params.File)
+			h.logContext.Logf("Starting CPU profile to %s ...", params.File)
 			pprof.StartCPUProfile(f)
 		}
 	} else {
@@ -247,7 +269,7 @@ func (h *handler) handleHeapProfiling() error {
 		return err
 	}
 
-	base.Logf("Dumping heap profile to %s ...", params.File)
+	h.logContext.Logf("Dumping heap profile to %s ...", params.File)
 	f, err := os.Create(params.File)
 	if err != nil {
 		return err
@@ -271,6 +271,115 @@ func TestRoot(t *testing.T) {
 	assert.Equals(t, response.Header().Get("Allow"), "GET, HEAD")
 }
 
+func TestHealthAndReadiness(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("GET", "/_health", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["status"], "ok")
+
+	response = rt.sendRequest("GET", "/db/_ready", "")
+	assertStatus(t, response, 200)
+	var status db.ReadinessStatus
+	json.Unmarshal(response.Body.Bytes(), &status)
+	assert.True(t, status.Ready)
+	assert.Equals(t, status.State, "Online")
+
+	// The details of the checks are only reported on the admin port
+	assert.True(t, status.Bucket == nil)
+	assert.True(t, status.Cache == nil)
+	response = rt.sendAdminRequest("GET", "/db/_ready", "")
+	assertStatus(t, response, 200)
+	status = db.ReadinessStatus{}
+	json.Unmarshal(response.Body.Bytes(), &status)
+	assert.True(t, status.Ready)
+	assert.True(t, status.Bucket.OK)
+	assert.True(t, status.Feed.OK)
+	assert.True(t, status.Cache != nil)
+
+	// An offline database isn't ready
+	response = rt.sendAdminRequest("POST", "/db/_offline", "")
+	assertStatus(t, response, 200)
+	response = rt.sendRequest("GET", "/db/_ready", "")
+	assertStatus(t, response, 503)
+	status = db.ReadinessStatus{}
+	json.Unmarshal(response.Body.Bytes(), &status)
+	assert.False(t, status.Ready)
+	assert.Equals(t, status.State, "Offline")
+}
+
+func TestRequestID(t *testing.T) {
+	var rt restTester
+	// A valid client-supplied ID is echoed back
+	response := rt.sendRequestWithHeaders("PUT", "/db/doc", `{"prop":true}`, map[string]string{"X-Request-ID": "abc-123"})
+	assertStatus(t, response, 201)
+	assert.Equals(t, response.Header().Get("X-Request-ID"), "abc-123")
+
+	// Otherwise one is generated
+	response = rt.sendRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 200)
+	generated := response.Header().Get("X-Request-ID")
+	assert.Equals(t, len(generated), 32)
+
+	response = rt.sendRequestWithHeaders("GET", "/db/doc", "", map[string]string{"X-Request-ID": "bad id\twith spaces"})
+	assertStatus(t, response, 200)
+	assert.True(t, response.Header().Get("X-Request-ID") != "bad id\twith spaces")
+	assert.True(t, response.Header().Get("X-Request-ID") != generated)
+}
+
+func TestChangesFeedsAdmin(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channel);}`}
+	a := rt.ServerContext().Database("db").Authenticator()
+	bernard, err := a.NewUser("bernard", "letmein", channels.SetOf("PBS"))
+	assert.True(t, err == nil)
+	a.Save(bernard)
+
+	response := rt.send(request("PUT", "/db/doc1", `{"channel":["PBS"]}`))
+	assertStatus(t, response, 201)
+	var dbInfo struct {
+		UpdateSeq uint64 `json:"update_seq"`
+	}
+	json.Unmarshal(rt.sendAdminRequest("GET", "/db/", "").Body.Bytes(), &dbInfo)
+
+	// Start a longpoll feed that has nothing to return yet
+	done := make(chan *testResponse)
+	go func() {
+		changesJSON := fmt.Sprintf(`{"feed":"longpoll", "since":"%d", "heartbeat":300000}`, dbInfo.UpdateSeq)
+		done <- rt.send(requestByUser("POST", "/db/_changes", changesJSON, "bernard"))
+	}()
+
+	var feeds []db.ChangesFeedInfo
+	for i := 0; i < 100 && len(feeds) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		response = rt.sendAdminRequest("GET", "/db/_changes_feeds", "")
+		assertStatus(t, response, 200)
+		json.Unmarshal(response.Body.Bytes(), &feeds)
+	}
+	assert.Equals(t, len(feeds), 1)
+	assert.Equals(t, feeds[0].User, "bernard")
+	assert.Equals(t, feeds[0].FeedType, "longpoll")
+	assert.Equals(t, feeds[0].Since, fmt.Sprintf("%d", dbInfo.UpdateSeq))
+	assert.Equals(t, feeds[0].EntriesSent, uint64(0))
+
+	// Terminating the feed ends the longpoll request
+	feedID := feeds[0].ID
+	response = rt.sendAdminRequest("DELETE", "/db/_changes_feeds/"+feedID, "")
+	assertStatus(t, response, 200)
+	select {
+	case changesResponse := <-done:
+		assertStatus(t, changesResponse, 200)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Changes feed wasn't terminated")
+	}
+
+	response = rt.sendAdminRequest("GET", "/db/_changes_feeds", "")
+	json.Unmarshal(response.Body.Bytes(), &feeds)
+	assert.Equals(t, len(feeds), 0)
+	response = rt.sendAdminRequest("DELETE", "/db/_changes_feeds/"+feedID, "")
+	assertStatus(t, response, 404)
+}
+
 func (rt *restTester) createDoc(t *testing.T, docid string) string {
 	response := rt.sendRequest("PUT", "/db/"+docid, `{"prop":true}`)
 	assertStatus(t, response, 201)
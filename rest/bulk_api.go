@@ -218,7 +218,7 @@ func (h *handler) handleAllDocs() error {
 // HTTP handler for _dump
 func (h *handler) handleDump() error {
 	viewName := h.PathVar("view")
-	base.LogTo("HTTP", "Dump view %q", viewName)
+	h.logContext.LogTo("HTTP", "Dump view %q", viewName)
 	opts := db.Body{"stale": false, "reduce": false}
 	result, err := h.db.Bucket.View(db.DesignDocSyncGateway, viewName, opts)
 	if err != nil {
@@ -248,7 +248,7 @@ func (h *handler) handleDump() error {
 func (h *handler) handleDumpChannel() error {
 	channelName := h.PathVar("channel")
 	since := h.getIntQuery("since", 0)
-	base.LogTo("HTTP", "Dump channel %q", channelName)
+	h.logContext.LogTo("HTTP", "Dump channel %q", channelName)
 
 	chanLog := h.db.GetChangeLog(channelName, since)
 	if chanLog == nil {
@@ -432,7 +432,7 @@ func (h *handler) handleBulkDocs() error {
 			status["status"] = code
 			status["error"] = base.CouchHTTPErrorName(code)
 			status["reason"] = msg
-			base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
+			h.logContext.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
 			err = nil // wrote it to output already; not going to return it
 		} else {
 			status["rev"] = revid
@@ -458,7 +458,7 @@ func (h *handler) handleBulkDocs() error {
 			status["status"] = code
 			status["error"] = base.CouchHTTPErrorName(code)
 			status["reason"] = msg
-			base.Logf("\tBulkDocs: Local Doc %q --> %d %s (%v)", docid, code, msg, err)
+			h.logContext.Logf("\tBulkDocs: Local Doc %q --> %d %s (%v)", docid, code, msg, err)
 			err = nil
 		} else {
 			status["rev"] = revid
@@ -271,6 +271,20 @@ func (h *handler) handleChanges() error {
 
 	options.Terminator = make(chan bool)
 
+	// Register long-lived feeds so administrators can list and terminate them:
+	if feed == "longpoll" || feed == "continuous" || feed == "websocket" {
+		h.changesFeed = h.db.ChangesFeeds.Register(db.ChangesFeedInfo{
+			User:       h.currentEffectiveUserName(),
+			Channels:   userChannels.ToArray(),
+			Since:      options.Since.String(),
+			FeedType:   feed,
+			StartTime:  time.Now(),
+			RemoteAddr: h.rq.RemoteAddr,
+			RequestID:  h.requestID,
+		}, options.Terminator)
+		defer h.db.ChangesFeeds.Unregister(h.changesFeed)
+	}
+
 	var err error
 	forceClose := false
 
@@ -293,7 +307,11 @@ func (h *handler) handleChanges() error {
 		forceClose = false
 	}
 
-	close(options.Terminator)
+	if h.changesFeed != nil {
+		h.changesFeed.Terminate()
+	} else {
+		close(options.Terminator)
+	}
 
 	if forceClose && h.user != nil {
 		h.db.DatabaseContext.NotifyUser(h.user.Name())
@@ -338,7 +356,7 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 		if ok {
 			closeNotify = cn.CloseNotify()
 		} else {
-			base.LogTo("Changes", "simple changes cannot get Close Notifier from ResponseWriter")
+			h.logContext.LogTo("Changes", "simple changes cannot get Close Notifier from ResponseWriter")
 		}
 
 		encoder := json.NewEncoder(h.response)
@@ -359,19 +377,20 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 						h.response.Write([]byte(","))
 					}
 					encoder.Encode(entry)
+					h.changesFeed.AddEntriesSent(1)
 					lastSeq = entry.Seq
 				}
 
 			case <-heartbeat:
 				_, err = h.response.Write([]byte("\n"))
 				h.flush()
-				base.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
+				h.logContext.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
 			case <-timeout:
 				message = "OK (timeout)"
 				forceClose = true
 				break loop
 			case <-closeNotify:
-				base.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
+				h.logContext.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
 				forceClose = true
 				break loop
 			case <-h.db.ExitChanges:
@@ -410,7 +429,7 @@ func (h *handler) sendChangesForDocIds(userChannels base.Set, explicitDocIds []s
 		// Fetch the document body and other metadata that lives with it:
 		populatedDoc, body, err := h.db.GetDocAndActiveRev(doc.DocID)
 		if err != nil {
-			base.LogTo("Changes", "Unable to get changes for docID %v, caused by %v", doc.DocID, err)
+			h.logContext.LogTo("Changes", "Unable to get changes for docID %v, caused by %v", doc.DocID, err)
 			return nil
 		}
 
@@ -513,8 +532,11 @@ func (h *handler) sendChangesForDocIds(userChannels base.Set, explicitDocIds []s
 // This is the core functionality of both the HTTP and WebSocket-based continuous change feed.
 // It defers to a callback function 'send()' to actually send the changes to the client.
 // It will call send(nil) to notify that it's caught up and waiting for new changes, or as
-// a periodic heartbeat while waiting.
-func (h *handler) generateContinuousChanges(inChannels base.Set, options db.ChangesOptions, send func([]*db.ChangeEntry) error) (error, bool) {
+// a periodic heartbeat while waiting.  The optional 'sendLastSeq()' callback is used to tell the
+// client where to resume when the server ends the feed: when it's terminated or the database goes
+// offline.  'closeConnection()' is used to disconnect a client that falls too far behind under the
+// database's slow consumer policy, without waiting for it to read what's queued.
+func (h *handler) generateContinuousChanges(inChannels base.Set, options db.ChangesOptions, send func([]*db.ChangeEntry) error, sendLastSeq func(db.SequenceID) error, closeConnection func()) (error, bool) {
 	// Set up heartbeat/timeout
 	var timeoutInterval time.Duration
 	var timer *time.Timer
@@ -532,26 +554,58 @@ func (h *handler) generateContinuousChanges(inChannels base.Set, options db.Chan
 		}()
 	}
 
+	// With a slow consumer policy, changes are written from a separate goroutine, with a limit on
+	// how many may be waiting to be written.
+	write := send
+	maxBatch := 20
+	var writer *changesFeedWriter
+	var writerIdle <-chan struct{}
+	slowConsumerOptions := h.db.Options.SlowConsumerOptions
+	if slowConsumerOptions != nil && slowConsumerOptions.BufferSize > 0 {
+		writer = newChangesFeedWriter(slowConsumerOptions.BufferSize, send, closeConnection)
+		write = writer.enqueue
+		if slowConsumerOptions.BufferSize < maxBatch {
+			maxBatch = slowConsumerOptions.BufferSize // A bigger batch could never be queued
+		}
+		defer func() {
+			if writer != nil {
+				writer.close()
+			}
+		}()
+	}
+
 	options.Wait = true       // we want the feed channel to wait for changes
 	options.Continuous = true // and to keep sending changes indefinitely
 	var lastSeq db.SequenceID
 	var feed <-chan *db.ChangeEntry
+	var feedTerminator chan bool // Stops the current feed without ending the request
 	var timeout <-chan time.Time
 	var err error
 
+	stopFeed := func() {
+		if feedTerminator != nil {
+			close(feedTerminator)
+			feedTerminator = nil
+			h.db.DatabaseContext.NotifyUser(h.currentEffectiveUserName()) // wakes the feed if it's waiting
+		}
+		feed = nil
+	}
+	defer stopFeed()
+
 	var closeNotify <-chan bool
 	cn, ok := h.response.(http.CloseNotifier)
 	if ok {
 		closeNotify = cn.CloseNotify()
 	} else {
-		base.LogTo("Changes", "continuous changes cannot get Close Notifier from ResponseWriter")
+		h.logContext.LogTo("Changes", "continuous changes cannot get Close Notifier from ResponseWriter")
 	}
 
 	forceClose := false
+	sendFinalSeq := false // Whether to tell the client where to resume, when the server ends the feed
 
 loop:
 	for {
-		if feed == nil {
+		if feed == nil && writerIdle == nil {
 			// Refresh the feed of all current changes:
 			if lastSeq.IsNonZero() { // start after end of last feed
 				options.Since = lastSeq
@@ -560,7 +614,18 @@ loop:
 				forceClose = true
 				break loop
 			}
-			feed, err = h.db.MultiChangesFeed(inChannels, options)
+			select {
+			case <-options.Terminator:
+				// Terminated (e.g. by an administrator); don't start a new feed
+				forceClose = true
+				sendFinalSeq = true
+				break loop
+			default:
+			}
+			feedOptions := options
+			feedTerminator = make(chan bool)
+			feedOptions.Terminator = feedTerminator
+			feed, err = h.db.MultiChangesFeed(inChannels, feedOptions)
 			if err != nil || feed == nil {
 				return err, forceClose
 			}
@@ -576,9 +641,9 @@ loop:
 		select {
 		case entry, ok := <-feed:
 			if !ok {
-				feed = nil
+				stopFeed()
 			} else if entry == nil {
-				err = send(nil)
+				err = write(nil)
 			} else if entry.Err != nil {
 				break loop // error returned by feed - end changes
 			} else {
@@ -586,11 +651,11 @@ loop:
 				waiting := false
 				// Batch up as many entries as we can without waiting:
 			collect:
-				for len(entries) < 20 {
+				for len(entries) < maxBatch {
 					select {
 					case entry, ok = <-feed:
 						if !ok {
-							feed = nil
+							stopFeed()
 							break collect
 						} else if entry == nil {
 							waiting = true
@@ -603,11 +668,33 @@ loop:
 						break collect
 					}
 				}
-				base.LogTo("Changes", "sending %d change(s)", len(entries))
-				err = send(entries)
+				h.logContext.LogTo("Changes", "sending %d change(s)", len(entries))
+				err = write(entries)
+				if err == errSlowConsumer {
+					err = nil
+					restExpvars.Add("slow_consumers", 1)
+					if slowConsumerOptions.Policy == db.SlowConsumerCatchUp {
+						// Stop reading the feed until the client has caught up, then start a new
+						// one from the last sequence queued, which coalesces the changes missed.
+						h.logContext.LogTo("Changes", "Slow consumer %s: pausing feed at %s until caught up",
+							h.currentEffectiveUserName(), lastSeq)
+						restExpvars.Add("slow_consumer_catchups", 1)
+						stopFeed()
+						writerIdle = writer.whenIdle()
+						continue loop
+					}
+					h.logContext.LogTo("Changes", "Slow consumer %s: disconnecting at %s",
+						h.currentEffectiveUserName(), lastSeq)
+					restExpvars.Add("slow_consumer_disconnects", 1)
+					writer.abandon()
+					writer = nil
+					forceClose = true
+					break loop
+				}
+				h.changesFeed.AddEntriesSent(len(entries))
 
 				if err == nil && waiting {
-					err = send(nil)
+					err = write(nil)
 				}
 
 				lastSeq = entries[len(entries)-1].Seq
@@ -624,18 +711,26 @@ loop:
 				timer.Stop()
 				timer = nil
 			}
+		case <-writerIdle:
+			// The slow consumer has caught up; resume with a new feed
+			writerIdle = nil
 		case <-heartbeat:
-			err = send(nil)
-			base.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
+			err = write(nil)
+			h.logContext.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
 		case <-timeout:
 			forceClose = true
 			break loop
 		case <-closeNotify:
-			base.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
+			h.logContext.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
 			forceClose = true
 			break loop
 		case <-h.db.ExitChanges:
 			forceClose = true
+			sendFinalSeq = true
+			break loop
+		case <-options.Terminator:
+			forceClose = true
+			sendFinalSeq = true
 			break loop
 		}
 
@@ -645,6 +740,20 @@ loop:
 		}
 	}
 
+	if sendFinalSeq && sendLastSeq != nil {
+		// Let everything queued reach the client first
+		if writer != nil {
+			err = writer.close()
+			writer = nil
+		}
+		if err == nil {
+			if !lastSeq.IsNonZero() {
+				lastSeq = options.Since
+			}
+			sendLastSeq(lastSeq)
+		}
+	}
+
 	h.logStatus(http.StatusOK, "OK (continuous feed closed)")
 	return nil, forceClose
 }
@@ -673,6 +782,13 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 		}
 		h.flush()
 		return err
+	}, func(lastSeq db.SequenceID) error {
+		data, _ := json.Marshal(db.Body{"last_seq": lastSeq})
+		_, err := h.response.Write(append(data, '\n'))
+		h.flush()
+		return err
+	}, func() {
+		base.CloseHTTPConnection(h.rq.RemoteAddr)
 	})
 }
 
@@ -683,7 +799,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 		h.logStatus(101, "Upgraded to WebSocket protocol")
 		defer func() {
 			conn.Close()
-			base.LogTo("HTTP+", "#%03d:     --> WebSocket closed", h.serialNumber)
+			h.logContext.LogTo("HTTP+", "#%03d:     --> WebSocket closed", h.serialNumber)
 		}()
 
 		// Read changes-feed options from an initial incoming WebSocket message in JSON format:
@@ -738,6 +854,13 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 			}
 			_, err := conn.Write(data)
 			return err
+		}, func(lastSeq db.SequenceID) error {
+			data, _ := json.Marshal(db.Body{"last_seq": lastSeq})
+			conn.PayloadType = websocket.TextFrame
+			_, err := conn.Write(data)
+			return err
+		}, func() {
+			conn.Close()
 		})
 
 		if zipWriter != nil {
@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Returned by changesFeedWriter.enqueue when the client has too many entries waiting to be written
+var errSlowConsumer = errors.New("changes feed client is reading too slowly")
+
+// Writes a continuous changes feed to its client from a separate goroutine, so that a client
+// that reads slowly doesn't hold up the feed.  At most `limit` entries may be waiting to be
+// written; beyond that the client is treated as a slow consumer.
+type changesFeedWriter struct {
+	send      func([]*db.ChangeEntry) error
+	interrupt func() // Closes the client connection, making a write in progress fail
+	queue     chan []*db.ChangeEntry
+	limit     int64
+	queued    int64         // Entries enqueued but not yet written; accessed atomically
+	idle      chan struct{} // Signaled whenever the queue becomes empty
+	done      chan struct{} // Closed when the writer goroutine exits
+	err       error         // First error returned by send, or errSlowConsumer once abandoned
+	lock      sync.Mutex    // Protects err
+}
+
+func newChangesFeedWriter(limit int, send func([]*db.ChangeEntry) error, interrupt func()) *changesFeedWriter {
+	w := &changesFeedWriter{
+		send:      send,
+		interrupt: interrupt,
+		queue:     make(chan []*db.ChangeEntry, limit+1), // Every batch holds at least one entry, plus a heartbeat
+		limit:     int64(limit),
+		idle:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *changesFeedWriter) run() {
+	defer close(w.done)
+	for batch := range w.queue {
+		if w.error() == nil {
+			if err := w.send(batch); err != nil {
+				w.setError(err)
+			}
+		}
+		if atomic.AddInt64(&w.queued, -int64(len(batch))) == 0 {
+			select {
+			case w.idle <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Queues a batch of entries to be written, or a heartbeat/caught-up notification if changes is
+// nil.  Returns errSlowConsumer, without queueing the batch, if it would exceed the limit.
+// Returns the write error if an earlier write failed.
+func (w *changesFeedWriter) enqueue(changes []*db.ChangeEntry) error {
+	if err := w.error(); err != nil {
+		return err
+	}
+	if changes == nil {
+		// A heartbeat is pointless if there are already writes queued up
+		select {
+		case w.queue <- nil:
+		default:
+		}
+		return nil
+	}
+	if atomic.LoadInt64(&w.queued)+int64(len(changes)) > w.limit {
+		return errSlowConsumer
+	}
+	atomic.AddInt64(&w.queued, int64(len(changes)))
+	w.queue <- changes
+	return nil
+}
+
+func (w *changesFeedWriter) error() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+func (w *changesFeedWriter) setError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Returns a channel that receives once the queue is empty, right away if it's empty already.
+func (w *changesFeedWriter) whenIdle() <-chan struct{} {
+	// Discard the signal left from an earlier time the queue emptied
+	select {
+	case <-w.idle:
+	default:
+	}
+	if atomic.LoadInt64(&w.queued) == 0 {
+		select {
+		case w.idle <- struct{}{}:
+		default:
+		}
+	}
+	return w.idle
+}
+
+// Waits for all queued entries to be written, then stops the writer goroutine.
+func (w *changesFeedWriter) close() error {
+	close(w.queue)
+	<-w.done
+	return w.error()
+}
+
+// Stops the writer goroutine without writing what's still queued.  The client connection is
+// closed first, since a client that isn't reading would otherwise block the write in progress.
+func (w *changesFeedWriter) abandon() {
+	w.setError(errSlowConsumer)
+	close(w.queue)
+	if w.interrupt != nil {
+		w.interrupt()
+	}
+	<-w.done
+}
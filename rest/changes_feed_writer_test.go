@@ -0,0 +1,146 @@
+package rest
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestChangesFeedWriterLimit(t *testing.T) {
+	release := make(chan struct{})
+	var written []*db.ChangeEntry
+	writer := newChangesFeedWriter(3, func(changes []*db.ChangeEntry) error {
+		<-release // Simulates a client that isn't reading
+		written = append(written, changes...)
+		return nil
+	}, nil)
+
+	entry := func(seq uint64) *db.ChangeEntry {
+		return &db.ChangeEntry{Seq: db.SequenceID{Seq: seq}}
+	}
+	assert.Equals(t, writer.enqueue([]*db.ChangeEntry{entry(1), entry(2)}), nil)
+	assert.Equals(t, writer.enqueue([]*db.ChangeEntry{entry(3)}), nil)
+	assert.Equals(t, writer.enqueue(nil), nil)
+	assert.Equals(t, writer.enqueue([]*db.ChangeEntry{entry(4)}), errSlowConsumer)
+
+	// Once the client reads, everything queued (but nothing rejected) is written
+	close(release)
+	<-writer.whenIdle()
+	assert.Equals(t, writer.enqueue([]*db.ChangeEntry{entry(5)}), nil)
+	assert.Equals(t, writer.close(), nil)
+	assert.Equals(t, len(written), 4)
+	assert.Equals(t, written[3].Seq.Seq, uint64(5))
+}
+
+// Returns the current value of one of the REST API's int expvars.
+func restExpvarValue(name string) int64 {
+	if value, ok := restExpvars.Get(name).(*expvar.Int); ok {
+		return value.Value()
+	}
+	return 0
+}
+
+// Sets up a database with four docs and the given slow consumer policy, and a handler that can
+// run a continuous feed of its changes.
+func setupSlowConsumerTest(t *testing.T, rt *restTester, policy string) *handler {
+	for i := 1; i <= 4; i++ {
+		rt.createDoc(t, fmt.Sprintf("doc%d", i))
+	}
+	assertNoError(t, rt.waitForSequence(4), "Docs not cached")
+
+	dbContext := rt.getDatabase()
+	dbContext.Options.SlowConsumerOptions = &db.SlowConsumerOptions{BufferSize: 2, Policy: policy}
+	rq, err := http.NewRequest("GET", "/db/_changes?feed=continuous", nil)
+	assertNoError(t, err, "Couldn't create request")
+	h := newHandler(rt.ServerContext(), adminPrivs, httptest.NewRecorder(), rq, false)
+	h.db, err = db.GetDatabase(dbContext, nil)
+	assertNoError(t, err, "Couldn't get database")
+	return h
+}
+
+func TestSlowConsumerCatchUp(t *testing.T) {
+	var rt restTester
+	h := setupSlowConsumerTest(t, &rt, db.SlowConsumerCatchUp)
+	catchUps := restExpvarValue("slow_consumer_catchups")
+
+	// The client doesn't read until the feed has fallen behind
+	sent := make(chan []*db.ChangeEntry)
+	terminator := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.generateContinuousChanges(base.SetOf("*"), db.ChangesOptions{Terminator: terminator},
+			func(changes []*db.ChangeEntry) error {
+				sent <- changes
+				return nil
+			}, nil, nil)
+	}()
+	for i := 0; i < 50 && restExpvarValue("slow_consumer_catchups") == catchUps; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equals(t, restExpvarValue("slow_consumer_catchups"), catchUps+1)
+
+	// Once it reads what was queued, the feed resumes from there, without gaps or repeats
+	var seqs []uint64
+	for len(seqs) < 4 {
+		select {
+		case changes := <-sent:
+			for _, change := range changes {
+				seqs = append(seqs, change.Seq.Seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Feed didn't resume; received %v", seqs)
+		}
+	}
+	assert.DeepEquals(t, seqs, []uint64{1, 2, 3, 4})
+
+	close(terminator)
+	for ended := false; !ended; {
+		select {
+		case <-sent:
+		case <-done:
+			ended = true
+		}
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	var rt restTester
+	h := setupSlowConsumerTest(t, &rt, db.SlowConsumerDisconnect)
+	disconnects := restExpvarValue("slow_consumer_disconnects")
+
+	// The client never reads, so writes only end when the connection is closed
+	closed := make(chan struct{})
+	sentLastSeq := false
+	done := make(chan bool)
+	go func() {
+		_, forceClose := h.generateContinuousChanges(base.SetOf("*"), db.ChangesOptions{Terminator: make(chan bool)},
+			func(changes []*db.ChangeEntry) error {
+				<-closed
+				return errors.New("connection closed")
+			}, func(db.SequenceID) error {
+				sentLastSeq = true
+				return nil
+			}, func() {
+				close(closed)
+			})
+		done <- forceClose
+	}()
+
+	select {
+	case forceClose := <-done:
+		assert.True(t, forceClose)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Slow consumer wasn't disconnected")
+	}
+	assert.Equals(t, restExpvarValue("slow_consumer_disconnects"), disconnects+1)
+	assert.False(t, sentLastSeq)
+}
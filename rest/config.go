@@ -14,6 +14,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -69,6 +70,7 @@ type ServerConfig struct {
 	CORS                           *CORSConfig              `json:",omitempty"` // Configuration for allowing CORS
 	Log                            []string                 `json:",omitempty"` // Log keywords to enable
 	LogFilePath                    *string                  `json:",omitempty"` // Path to log file, if missing write to stderr
+	Logging                        *base.LoggingConfig      `json:",omitempty"` // Log format, rotation and per-level sinks
 	Pretty                         bool                     `json:",omitempty"` // Pretty-print JSON responses?
 	DeploymentID                   *string                  `json:",omitempty"` // Optional customer/deployment ID for stats reporting
 	StatsReportInterval            *float64                 `json:",omitempty"` // Optional stats report interval (0 to disable)
@@ -76,11 +78,15 @@ type ServerConfig struct {
 	MaxCouchbaseOverflow           *int                     `json:",omitempty"` // Max # of overflow sockets to open
 	CouchbaseKeepaliveInterval     *int                     `json:",omitempty"` // TCP keep-alive interval between SG and Couchbase server
 	SlowServerCallWarningThreshold *int                     `json:",omitempty"` // Log warnings if database calls take this many ms
+	SlowRequestThreshold           *int                     `json:",omitempty"` // Log a per-phase timing breakdown of requests taking this many ms
 	MaxIncomingConnections         *int                     `json:",omitempty"` // Max # of incoming HTTP connections to accept
 	MaxFileDescriptors             *uint64                  `json:",omitempty"` // Max # of open file descriptors (RLIMIT_NOFILE)
+	ShutdownTimeout                *int                     `json:",omitempty"` // Seconds to wait for requests, writes and events to finish on shutdown (default 30)
+	NodeID                         *string                  `json:",omitempty"` // Identifies this node's own state in shared buckets; default is host name and admin port
 	CompressResponses              *bool                    `json:",omitempty"` // If false, disables compression of HTTP responses
 	Databases                      DbConfigMap              `json:",omitempty"` // Pre-configured databases, mapped by name
 	Replications                   []*ReplicationConfig     `json:",omitempty"`
+	ReplicationsDatabase           *string                  `json:",omitempty"`                        // Database whose bucket stores the replications defined through /_replication; each runs on one of the nodes sharing it
 	MaxHeartbeat                   uint64                   `json:",omitempty"`                        // Max heartbeat value for _changes request (seconds)
 	ClusterConfig                  *ClusterConfig           `json:"cluster_config,omitempty"`          // Bucket and other config related to CBGT
 	SkipRunmodeValidation          bool                     `json:"skip_runmode_validation,omitempty"` // If this is true, skips any config validation regarding accel vs normal mode
@@ -123,9 +129,16 @@ type DbConfig struct {
 	CacheConfig        *CacheConfig                   `json:"cache,omitempty"`                // Cache settings
 	ChannelIndex       *ChannelIndexConfig            `json:"channel_index,omitempty"`        // Channel index settings
 	RevCacheSize       *uint32                        `json:"rev_cache_size,omitempty"`       // Maximum number of revisions to store in the revision cache
+	RevCacheShards     *uint16                        `json:"rev_cache_shards,omitempty"`     // Number of independently-locked shards in the revision cache
+	RevCacheMaxBytes   *int64                         `json:"rev_cache_max_bytes,omitempty"`  // Maximum estimated size of the bodies in the revision cache; unlimited by default
+	SequenceBatchMax   *uint64                        `json:"sequence_batch_max,omitempty"`   // Maximum number of sequences each node reserves at once; batching is disabled by default
+	ShareChangesFeeds  *bool                          `json:"share_changes_feeds,omitempty"`  // Share one upstream feed between continuous/longpoll feeds with the same channels
+	SlowConsumer       *SlowConsumerConfig            `json:"slow_consumer,omitempty"`        // Handling of continuous feed clients that read too slowly
 	StartOffline       bool                           `json:"offline,omitempty"`              // start the DB in the offline state, defaults to false
 	Unsupported        *UnsupportedConfig             `json:"unsupported,omitempty"`          // Config for unsupported features
 	OIDCConfig         *auth.OIDCOptions              `json:"oidc,omitempty"`                 // Config properties for OpenID Connect authentication
+	Readiness          *ReadinessConfig               `json:"readiness,omitempty"`            // Thresholds for the _ready endpoint
+	ReplicationFilters map[string]string              `json:"replication_filters,omitempty"`  // Named JS filter functions for replications into this database
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -155,27 +168,67 @@ type ShadowConfig struct {
 }
 
 type EventHandlerConfig struct {
-	MaxEventProc    uint           `json:"max_processes,omitempty"`    // Max concurrent event handling goroutines
-	WaitForProcess  string         `json:"wait_for_process,omitempty"` // Max wait time when event queue is full (ms)
-	DocumentChanged []*EventConfig `json:"document_changed,omitempty"` // Document Commit
-	DBStateChanged  []*EventConfig `json:"db_state_changed,omitempty"` // DB state change
+	MaxEventProc      uint           `json:"max_processes,omitempty"`      // Max concurrent event handling goroutines
+	WaitForProcess    string         `json:"wait_for_process,omitempty"`   // Max wait time when event queue is full (ms)
+	DocumentChanged   []*EventConfig `json:"document_changed,omitempty"`   // Document Commit
+	DBStateChanged    []*EventConfig `json:"db_state_changed,omitempty"`   // DB state change
+	PrincipalChanged  []*EventConfig `json:"principal_changed,omitempty"`  // User/role change, access grant or session creation
+	DocumentRejected  []*EventConfig `json:"document_rejected,omitempty"`  // Document update rejected by the sync function
+	ReplicationFailed []*EventConfig `json:"replication_failed,omitempty"` // Replication stopped after failing
 }
 
 type EventConfig struct {
-	HandlerType string  `json:"handler"`           // Handler type
-	Url         string  `json:"url,omitempty"`     // Url (webhook)
-	Filter      string  `json:"filter,omitempty"`  // Filter function (webhook)
-	Timeout     *uint64 `json:"timeout,omitempty"` // Timeout (webhook)
+	HandlerType string                  `json:"handler"`                // Handler type
+	Url         string                  `json:"url,omitempty"`          // Url (webhook)
+	Path        string                  `json:"path,omitempty"`         // Path of the file (file) or socket (unix_socket)
+	Command     []string                `json:"command,omitempty"`      // Executable and arguments of the process (exec)
+	Rotation    *base.LogRotationConfig `json:"rotation,omitempty"`     // Rotation of the file, as for log files (file)
+	Filter      string                  `json:"filter,omitempty"`       // Filter function
+	Transform   string                  `json:"transform,omitempty"`    // Function building the payload
+	Timeout     *uint64                 `json:"timeout,omitempty"`      // Timeout (webhook, unix_socket)
+	Retry       *WebhookRetryConfig     `json:"retry,omitempty"`        // Retries of failed posts (webhook)
+	Secret      string                  `json:"secret,omitempty"`       // Shared secret for signing posts with HMAC-SHA256 (webhook)
+	Headers     map[string]string       `json:"headers,omitempty"`      // Static headers added to posts (webhook)
+	Batch       *WebhookBatchConfig     `json:"batch,omitempty"`        // Posting events together in batches (webhook)
+	IncludeBody bool                    `json:"include_body,omitempty"` // Include the rejected body in document_rejected payloads
+	Durable     bool                    `json:"durable,omitempty"`      // Deliver document_changed events from the changes feed, resuming from this node's checkpoint
+	ID          string                  `json:"id,omitempty"`           // Identifies the handler in the admin API, and the checkpoint of a durable handler
+}
+
+type WebhookBatchConfig struct {
+	MaxSize     *int `json:"max_size,omitempty"`      // Max number of events posted in one JSON array
+	MaxLingerMs *int `json:"max_linger_ms,omitempty"` // Max time an event waits for its batch to fill (default 1000)
+}
+
+type WebhookRetryConfig struct {
+	MaxAttempts  *int `json:"max_attempts,omitempty"`   // Number of times to try posting each event (default 1)
+	BackoffMs    *int `json:"backoff_ms,omitempty"`     // Wait before the first retry, doubling on each retry (default 1000)
+	MaxBackoffMs *int `json:"max_backoff_ms,omitempty"` // Upper limit of the wait between retries (default 60000)
 }
 
 type CacheConfig struct {
-	CachePendingSeqMaxWait *uint32 `json:"max_wait_pending,omitempty"` // Max wait for pending sequence before skipping
-	CachePendingSeqMaxNum  *int    `json:"max_num_pending,omitempty"`  // Max number of pending sequences before skipping
-	CacheSkippedSeqMaxWait *uint32 `json:"max_wait_skipped,omitempty"` // Max wait for skipped sequence before abandoning
-	EnableStarChannel      *bool   `json:"enable_star_channel"`        // Enable star channel
-	ChannelCacheMaxLength  *int    `json:"channel_cache_max_length"`   // Maximum number of entries maintained in cache per channel
-	ChannelCacheMinLength  *int    `json:"channel_cache_min_length"`   // Minimum number of entries maintained in cache per channel
-	ChannelCacheAge        *int    `json:"channel_cache_expiry"`       // Time (seconds) to keep entries in cache beyond the minimum retained
+	CachePendingSeqMaxWait      *uint32  `json:"max_wait_pending,omitempty"`                // Max wait for pending sequence before skipping
+	CachePendingSeqMaxNum       *int     `json:"max_num_pending,omitempty"`                 // Max number of pending sequences before skipping
+	CacheSkippedSeqMaxWait      *uint32  `json:"max_wait_skipped,omitempty"`                // Max wait for skipped sequence before abandoning
+	EnableStarChannel           *bool    `json:"enable_star_channel"`                       // Enable star channel
+	ChannelCacheMaxLength       *int     `json:"channel_cache_max_length"`                  // Maximum number of entries maintained in cache per channel
+	ChannelCacheMinLength       *int     `json:"channel_cache_min_length"`                  // Minimum number of entries maintained in cache per channel
+	ChannelCacheAge             *int     `json:"channel_cache_expiry"`                      // Time (seconds) to keep entries in cache beyond the minimum retained
+	ChannelCacheMaxTotalEntries *int     `json:"channel_cache_max_total_entries,omitempty"` // Maximum number of entries maintained across all channel caches
+	ChannelCacheMaxTotalBytes   *int64   `json:"channel_cache_max_total_bytes,omitempty"`   // Maximum estimated memory used by all channel caches
+	WarmupChannels              []string `json:"warmup_channels,omitempty"`                 // Channels to preload into the cache on startup
+	WarmupTopChannels           *int     `json:"warmup_top_channels,omitempty"`             // Number of most recently queried channels to preload on startup
+	WarmupWait                  *bool    `json:"warmup_wait,omitempty"`                     // Report the database as not ready until warm-up completes
+}
+
+type SlowConsumerConfig struct {
+	BufferSize *int   `json:"buffer_size,omitempty"` // Max change entries waiting to be written to a continuous/websocket client
+	Policy     string `json:"policy,omitempty"`      // "disconnect" (default) or "catchup"
+}
+
+type ReadinessConfig struct {
+	MaxCacheLag         *uint64 `json:"max_cache_lag,omitempty"`         // Max sequences the change cache may trail _sync:seq by
+	MaxSkippedSequences *int    `json:"max_skipped_sequences,omitempty"` // Max length of the skipped sequence queue
 }
 
 type ChannelIndexConfig struct {
@@ -432,6 +485,9 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 	if self.CORS == nil {
 		self.CORS = other.CORS
 	}
+	if self.Logging == nil {
+		self.Logging = other.Logging
+	}
 	for _, flag := range other.Log {
 		self.Log = append(self.Log, flag)
 	}
@@ -583,6 +639,27 @@ func SetMaxFileDescriptors(maxP *uint64) {
 	}
 }
 
+// Returns the ID of this node, which keys the state it keeps of its own in shared buckets.  It
+// must be unique among the nodes sharing a bucket, and stay the same across restarts: the NodeID
+// setting if there is one, or else the host name and admin interface port.
+func (config *ServerConfig) nodeID() string {
+	if config.NodeID != nil && *config.NodeID != "" {
+		return *config.NodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		base.Warn("Unable to get host name for the node ID; set NodeID in the config: %v", err)
+		hostname = "localhost"
+	}
+	port := ""
+	if config.AdminInterface != nil {
+		if _, adminPort, err := net.SplitHostPort(*config.AdminInterface); err == nil {
+			port = adminPort
+		}
+	}
+	return hostname + ":" + port
+}
+
 func (config *ServerConfig) Serve(addr string, handler http.Handler) {
 	maxConns := DefaultMaxIncomingConnections
 	if config.MaxIncomingConnections != nil {
@@ -654,9 +731,14 @@ func RunServer(config *ServerConfig) {
 
 	SetMaxFileDescriptors(config.MaxFileDescriptors)
 
+	// Registered before the databases are loaded, so that a shutdown while they load stops startup
 	sc := NewServerContext(config)
+	setRunningServer(sc)
 	for _, dbConfig := range config.Databases {
 		if _, err := sc.AddDatabaseFromConfig(dbConfig); err != nil {
+			if isShuttingDown() {
+				break
+			}
 			base.LogFatal("Error opening database: %v", err)
 		}
 	}
@@ -669,19 +751,40 @@ func RunServer(config *ServerConfig) {
 		}()
 	}
 
+	if !isShuttingDown() {
+		sc.resumeStoredReplications()
+	}
+
 	base.Logf("Starting admin server on %s", *config.AdminInterface)
 	go config.Serve(*config.AdminInterface, CreateAdminHandler(sc))
 	base.Logf("Starting server on %s ...", *config.Interface)
 	config.Serve(*config.Interface, CreatePublicHandler(sc))
+
+	// Serve only returns once Shutdown has stopped the listeners; wait for it to finish
+	<-runningServer.shutdownDone
 }
 
-// for now  just cycle the logger to allow for log file rotation
+// for now  just cycle the logger to allow for log file rotation.  Called on SIGHUP, e.g. by
+// logrotate; if the log files can't be reopened, the current ones are kept.
 func ReloadConf() {
-	if config.LogFilePath != nil {
-		base.UpdateLogger(*config.LogFilePath)
+	if err := reopenLogFiles(); err != nil {
+		base.Warn("Error reopening log files; still logging to the previous files: %v", err)
 	}
 }
 
+func reopenLogFiles() error {
+	if config.Logging != nil {
+		logFilePath := ""
+		if config.LogFilePath != nil {
+			logFilePath = *config.LogFilePath
+		}
+		return base.ConfigureLogging(*config.Logging, logFilePath)
+	} else if config.LogFilePath != nil {
+		return base.OpenLogFile(*config.LogFilePath)
+	}
+	return nil
+}
+
 func GetConfig() *ServerConfig {
 	return config
 }
@@ -713,7 +816,9 @@ func ValidateConfigOrPanic(runMode SyncGatewayRunMode) {
 // It parses command-line flags, reads the optional configuration file, then starts the server.
 func ServerMain(runMode SyncGatewayRunMode) {
 	ParseCommandLine()
-	ReloadConf()
+	if err := reopenLogFiles(); err != nil {
+		base.LogFatal("Error configuring logging: %v", err)
+	}
 	ValidateConfigOrPanic(runMode)
 	RunServer(config)
 }
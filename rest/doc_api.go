@@ -115,7 +115,7 @@ func (h *handler) handleGetDoc() error {
 			})
 			return err
 		} else {
-			base.LogTo("HTTP+", "Fallback to non-multipart for open_revs")
+			h.logContext.LogTo("HTTP+", "Fallback to non-multipart for open_revs")
 			h.setHeader("Content-Type", "application/json")
 			h.response.Write([]byte(`[` + "\n"))
 			separator := []byte(``)
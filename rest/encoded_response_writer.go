@@ -21,10 +21,7 @@ type EncodedResponseWriter struct {
 
 // Creates a new EncodedResponseWriter, or returns nil if the request doesn't allow encoded responses.
 func NewEncodedResponseWriter(response http.ResponseWriter, rq *http.Request) *EncodedResponseWriter {
-	isWebSocketRequest := strings.ToLower(rq.Header.Get("Upgrade")) == "websocket" &&
-		strings.Contains(strings.ToLower(rq.Header.Get("Connection")), "upgrade")
-
-	if isWebSocketRequest || !strings.Contains(rq.Header.Get("Accept-Encoding"), "gzip") ||
+	if isWebSocketRequest(rq) || !strings.Contains(rq.Header.Get("Accept-Encoding"), "gzip") ||
 		rq.Method == "HEAD" || rq.Method == "PUT" || rq.Method == "DELETE" {
 		return nil
 	}
@@ -43,6 +40,12 @@ func NewEncodedResponseWriter(response http.ResponseWriter, rq *http.Request) *E
 	return &EncodedResponseWriter{ResponseWriter: response}
 }
 
+// Returns true if the request is asking to upgrade to a WebSocket, whose connection will be hijacked.
+func isWebSocketRequest(rq *http.Request) bool {
+	return strings.ToLower(rq.Header.Get("Upgrade")) == "websocket" &&
+		strings.Contains(strings.ToLower(rq.Header.Get("Connection")), "upgrade")
+}
+
 func (w *EncodedResponseWriter) WriteHeader(status int) {
 	w.status = status
 	w.sniff(nil) // Must do it now because headers can't be changed after WriteHeader call
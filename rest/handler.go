@@ -55,6 +55,12 @@ var kNotFoundError = base.HTTPErrorf(http.StatusNotFound, "missing")
 var kBadMethodError = base.HTTPErrorf(http.StatusMethodNotAllowed, "Method Not Allowed")
 var kBadRequestError = base.HTTPErrorf(http.StatusMethodNotAllowed, "Bad Request")
 
+// Header used to pass a request correlation ID in and out of the gateway.
+const kRequestIDHeader = "X-Request-ID"
+
+// Client-supplied request IDs must match this to be used; otherwise a new ID is generated.
+var kValidRequestIDRegexp = regexp.MustCompile(`^[-A-Za-z0-9_.:@/+=]{1,128}$`)
+
 // Encapsulates the state of handling an HTTP request.
 type handler struct {
 	server         *ServerContext
@@ -70,6 +76,10 @@ type handler struct {
 	serialNumber   uint64
 	loggedDuration bool
 	runOffline     bool
+	requestID      string                      // Correlation ID, from the X-Request-ID header or generated
+	logContext     *base.LogContext            // Tags log lines emitted on behalf of this request
+	timings        *base.RequestTimings        // Per-phase timing, if slow request logging is enabled
+	changesFeed    *db.ChangesFeedRegistration // Registration of the changes feed being served, if any
 }
 
 type handlerPrivs int
@@ -85,6 +95,8 @@ type handlerMethod func(*handler) error
 // Creates an http.Handler that will run a handler with the given method
 func makeHandler(server *ServerContext, privs handlerPrivs, method handlerMethod) http.Handler {
 	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
 		runOffline := false
 		h := newHandler(server, privs, r, rq, runOffline)
 		err := h.invoke(method)
@@ -96,6 +108,8 @@ func makeHandler(server *ServerContext, privs handlerPrivs, method handlerMethod
 // Creates an http.Handler that will run a handler with the given method even if the target DB is offline
 func makeOfflineHandler(server *ServerContext, privs handlerPrivs, method handlerMethod) http.Handler {
 	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
 		runOffline := true
 		h := newHandler(server, privs, r, rq, runOffline)
 		err := h.invoke(method)
@@ -105,6 +119,15 @@ func makeOfflineHandler(server *ServerContext, privs handlerPrivs, method handle
 }
 
 func newHandler(server *ServerContext, privs handlerPrivs, r http.ResponseWriter, rq *http.Request, runOffline bool) *handler {
+	requestID := rq.Header.Get(kRequestIDHeader)
+	if !kValidRequestIDRegexp.MatchString(requestID) {
+		requestID = base.CreateUUID()
+	}
+	r.Header().Set(kRequestIDHeader, requestID)
+	var timings *base.RequestTimings
+	if threshold := server.config.SlowRequestThreshold; threshold != nil && *threshold > 0 {
+		timings = base.NewRequestTimings()
+	}
 	return &handler{
 		server:       server,
 		privs:        privs,
@@ -114,6 +137,9 @@ func newHandler(server *ServerContext, privs handlerPrivs, r http.ResponseWriter
 		serialNumber: atomic.AddUint64(&lastSerialNum, 1),
 		startTime:    time.Now(),
 		runOffline:   runOffline,
+		requestID:    requestID,
+		logContext:   &base.LogContext{RequestID: requestID},
+		timings:      timings,
 	}
 }
 
@@ -130,6 +156,9 @@ func (h *handler) invoke(method handlerMethod) error {
 			defer encoded.Close()
 		}
 	}
+	if h.timings != nil && !isWebSocketRequest(h.rq) {
+		h.response = newTimingResponseWriter(h.response, h.timings)
+	}
 
 	switch h.rq.Header.Get("Content-Encoding") {
 	case "":
@@ -148,6 +177,7 @@ func (h *handler) invoke(method handlerMethod) error {
 	// If there is a "db" path variable, look up the database context:
 	var dbContext *db.DatabaseContext
 	if dbname := h.PathVar("db"); dbname != "" {
+		h.logContext.Database = dbname
 		if dbContext, err = h.server.GetDatabase(dbname); err != nil {
 			h.logRequestLine()
 			return err
@@ -181,12 +211,18 @@ func (h *handler) invoke(method handlerMethod) error {
 
 	// Authenticate, if not on admin port:
 	if h.privs != adminPrivs {
-		if err = h.checkAuth(dbContext); err != nil {
+		authStart := time.Now()
+		err = h.checkAuth(dbContext)
+		h.timings.Track(base.PhaseAuth, authStart)
+		if err != nil {
 			h.logRequestLine()
 			return err
 		}
 	}
 
+	if h.user != nil {
+		h.logContext.User = h.user.Name()
+	}
 	h.logRequestLine()
 
 	// Now set the request's Database (i.e. context + user)
@@ -195,6 +231,8 @@ func (h *handler) invoke(method handlerMethod) error {
 		if err != nil {
 			return err
 		}
+		h.db.SetLogContext(h.logContext)
+		h.db.SetRequestTimings(h.timings)
 	}
 
 	return method(h) // Call the actual handler code
@@ -215,7 +253,7 @@ func (h *handler) logRequestLine() {
 		proto = " HTTP/2"
 	}
 
-	base.LogTo("HTTP", " #%03d: %s %s%s%s", h.serialNumber, h.rq.Method, sanitizeRequestURL(h.rq.URL), proto, as)
+	h.logContext.LogTo("HTTP", " #%03d: %s %s%s%s", h.serialNumber, h.rq.Method, sanitizeRequestURL(h.rq.URL), proto, as)
 }
 
 // Replaces sensitive data from the URL query string with ******.
@@ -258,9 +296,19 @@ func (h *handler) logDuration(realTime bool) {
 	if h.status >= 300 {
 		logKey = "HTTP"
 	}
-	base.LogTo(logKey, "#%03d:     --> %d %s  (%.1f ms)",
+	h.logContext.LogTo(logKey, "#%03d:     --> %d %s  (%.1f ms)",
 		h.serialNumber, h.status, h.statusMessage,
 		float64(duration)/float64(time.Millisecond))
+
+	if realTime && h.timings != nil {
+		threshold := time.Duration(*h.server.config.SlowRequestThreshold) * time.Millisecond
+		if duration >= threshold {
+			restExpvars.Add("slow_requests", 1)
+			h.logContext.Logf("SLOW REQUEST #%03d: %s %s --> %d  total=%.1fms %s",
+				h.serialNumber, h.rq.Method, sanitizeRequestURL(h.rq.URL), h.status,
+				float64(duration)/float64(time.Millisecond), h.timings)
+		}
+	}
 }
 
 // Used for indefinitely-long handlers like _changes that we don't want to track duration of
@@ -310,7 +358,7 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	if userName, password := h.getBasicAuth(); userName != "" {
 		h.user = context.Authenticator().AuthenticateUser(userName, password)
 		if h.user == nil {
-			base.Logf("HTTP auth failed for username=%q", userName)
+			h.logContext.Logf("HTTP auth failed for username=%q", userName)
 			h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
 			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 		}
@@ -363,6 +411,11 @@ func (h *handler) getQuery(query string) string {
 	return h.rq.URL.Query().Get(query)
 }
 
+// Returns all the values of a query parameter that may be repeated
+func (h *handler) getQueryValues(query string) []string {
+	return h.rq.URL.Query()[query]
+}
+
 func (h *handler) getJSONStringQuery(query string) string {
 	var jsonString string
 	rawString := h.getQuery(query)
@@ -447,7 +500,7 @@ func (h *handler) readDocument() (db.Body, error) {
 			body, err := db.ReadMultipartDocument(reader)
 			if err != nil {
 				ioutil.WriteFile("GatewayPUT.mime", raw, 0600)
-				base.Warn("Error reading MIME data: copied to file GatewayPUT.mime")
+				h.logContext.Warn("Error reading MIME data: copied to file GatewayPUT.mime")
 			}
 			return body, err
 		} else {
@@ -515,7 +568,11 @@ func (h *handler) setStatus(status int, message string) {
 }
 
 func (h *handler) disableResponseCompression() {
-	switch r := h.response.(type) {
+	response := h.response
+	if timing, ok := response.(*timingResponseWriter); ok {
+		response = timing.ResponseWriter
+	}
+	switch r := response.(type) {
 	case *EncodedResponseWriter:
 		r.disableCompression()
 	}
@@ -525,14 +582,14 @@ func (h *handler) disableResponseCompression() {
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
 	if !h.requestAccepts("application/json") {
-		base.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
+		h.logContext.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
 		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
 		return
 	}
 
 	jsonOut, err := json.Marshal(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v : %s", value, err)
+		h.logContext.Warn("Couldn't serialize JSON for %v : %s", value, err)
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
@@ -566,7 +623,7 @@ func (h *handler) addJSON(value interface{}) {
 	encoder := json.NewEncoder(h.response)
 	err := encoder.Encode(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v : %s", value, err)
+		h.logContext.Warn("Couldn't serialize JSON for %v : %s", value, err)
 		panic("JSON serialization failed")
 	}
 }
@@ -68,7 +68,7 @@ func (h *handler) handleOIDCCommon() (redirectURLString string, err error) {
 	redirectURLString = ""
 
 	providerName := h.getQuery("provider")
-	base.LogTo("OIDC", "Getting provider for name %v", providerName)
+	h.logContext.LogTo("OIDC", "Getting provider for name %v", providerName)
 	provider, err := h.getOIDCProvider(providerName)
 	if err != nil || provider == nil {
 		return redirectURLString, err
@@ -173,7 +173,7 @@ func (h *handler) handleOIDCRefresh() error {
 
 	tokenResponse, err := oac.RequestToken(oauth2.GrantTypeRefreshToken, refreshToken)
 	if err != nil {
-		base.LogTo("OIDC", "Unsuccessful token refresh: %v", err)
+		h.logContext.LogTo("OIDC", "Unsuccessful token refresh: %v", err)
 		return base.HTTPErrorf(http.StatusUnauthorized, "Unable to refresh token.")
 		return err
 	}
@@ -235,7 +235,7 @@ func (h *handler) getOIDCCallbackURL() string {
 		scheme = "https"
 	}
 	if dbName := h.PathVar("db"); dbName == "" {
-		base.Warn("Can't calculate OIDC callback URL without DB in path.")
+		h.logContext.Warn("Can't calculate OIDC callback URL without DB in path.")
 		return ""
 	} else {
 		return fmt.Sprintf("%s://%s/%s/%s", scheme, h.rq.Host, dbName, "_oidc_callback")
@@ -105,7 +105,7 @@ func (h *handler) handleOidcProviderConfiguration() error {
 	}
 
 	issuerUrl := issuerUrl(h)
-	base.LogTo("OIDC+", "handleOidcProviderConfiguration issuerURL = %s", issuerUrl)
+	h.logContext.LogTo("OIDC+", "handleOidcProviderConfiguration issuerURL = %s", issuerUrl)
 
 	config := &auth.OidcProviderConfiguration{
 		Issuer:                            issuerUrl,
@@ -147,7 +147,7 @@ func (h *handler) handleOidcTestProviderAuthorize() error {
 
 	requestParams := h.rq.URL.RawQuery
 
-	base.LogTo("OIDC", "handleOidcTestProviderAuthorize() raw authorize request raw query params = %v", requestParams)
+	h.logContext.LogTo("OIDC", "handleOidcTestProviderAuthorize() raw authorize request raw query params = %v", requestParams)
 
 	scope := h.rq.URL.Query().Get("scope")
 	if scope == "" {
@@ -204,7 +204,7 @@ func (h *handler) handleOidcTestProviderToken() error {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
-	base.LogTo("OIDC", "handleOidcTestProviderToken() called")
+	h.logContext.LogTo("OIDC", "handleOidcTestProviderToken() called")
 
 	//determine the grant_type being requested
 	grantType := h.rq.FormValue("grant_type")
@@ -226,7 +226,7 @@ func (h *handler) handleOidcTestProviderCerts() error {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
-	base.LogTo("OIDC", "handleOidcTestProviderCerts() called")
+	h.logContext.LogTo("OIDC", "handleOidcTestProviderCerts() called")
 
 	privateKey, err := privateKey()
 	if err != nil {
@@ -276,10 +276,10 @@ func (h *handler) handleOidcTestProviderAuthenticate() error {
 
 	redirect_uri := requestParams.Get("redirect_uri")
 
-	base.LogTo("OIDC+", "handleOidcTestProviderAuthenticate() called.  username: %s authenticated: %s", username, authenticated)
+	h.logContext.LogTo("OIDC+", "handleOidcTestProviderAuthenticate() called.  username: %s authenticated: %s", username, authenticated)
 
 	if username == "" || authenticated == "" {
-		base.LogTo("OIDC+", "user did not enter valid credentials -- username or authenticated is empty")
+		h.logContext.LogTo("OIDC+", "user did not enter valid credentials -- username or authenticated is empty")
 		error := "?error=invalid_request&error_description=User failed authentication"
 		h.setHeader("Location", requestParams.Get("redirect_uri")+error)
 		h.response.WriteHeader(http.StatusFound)
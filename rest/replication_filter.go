@@ -0,0 +1,273 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+)
+
+// Path prefix of the admin API endpoints that filtered replications write to the target through
+const kReplicationFilterPathPrefix = "/_replication_filter/"
+
+// Filtering of a replication into a local database that sg-replicate can't do itself, since it
+// only filters the source's changes feed by channel.  The replication's target URL points at the
+// replication filter endpoints, which leave out the docs that don't pass before writing the rest.
+type replicationFilter struct {
+	docIDs         base.Set            // If non-nil, only these docs are replicated
+	filterFn       *db.JSEventFunction // If non-nil, only docs it returns true for are replicated
+	channels       base.Set            // Channels being replicated
+	purgeOnRemoval bool                // Purge docs that are no longer in any of the channels
+}
+
+// Returns whether a doc being written by the replication passes the filter.
+func (filter *replicationFilter) allows(doc db.Body) bool {
+	docid, _ := doc["_id"].(string)
+	if filter.docIDs != nil && !filter.docIDs.Contains(docid) {
+		return false
+	}
+	if filter.filterFn != nil {
+		pass, err := filter.filterFn.CallValidateFunction(&db.DocumentChangeEvent{Doc: doc})
+		if err != nil {
+			base.Warn("Error calling replication filter function for doc %q: %v", docid, err)
+			return false
+		}
+		return pass
+	}
+	return true
+}
+
+// Validates a replication's config and returns its sg-replicate parameters, setting up filtering
+// by doc IDs or a named filter function, and purging on removal, if the config asks for them.
+func (sc *ServerContext) replicationParameters(config ReplicationConfig, paramsFromConfig bool) (params sgreplicate.ReplicationParameters, cancel bool, localdb bool, err error) {
+	params, cancel, localdb, err = validateReplicationParameters(config, paramsFromConfig, *sc.config.AdminInterface)
+	if err != nil || cancel {
+		return
+	}
+	filter, err := sc.newReplicationFilter(config, params)
+	if err != nil || filter == nil {
+		return
+	}
+	if params.ReplicationId != "" {
+		if task := sc.replicator.ActiveTask(params.ReplicationId); task != nil && task.State != base.ReplicationStateError {
+			err = base.HTTPErrorf(http.StatusConflict, "Replication already active for specified parameters")
+			return
+		}
+	}
+	sc.addReplicationFilter(&params, filter)
+	return
+}
+
+// Returns the filter a replication needs, or nil if sg-replicate can do all its filtering.  Doc
+// IDs, named filter functions and purge_on_removal are only supported when the target is a local
+// database, whose replication_filters config defines the named filter functions.
+func (sc *ServerContext) newReplicationFilter(config ReplicationConfig, params sgreplicate.ReplicationParameters) (*replicationFilter, error) {
+	namedFilter := config.Filter != "" && config.Filter != "sync_gateway/bychannel"
+	if len(config.DocIds) == 0 && !namedFilter && !config.PurgeOnRemoval {
+		return nil, nil
+	}
+	if !isAdminInterfaceURL(params.Target, *sc.config.AdminInterface) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate doc_ids, named filters and purge_on_removal require a local target database.")
+	}
+	if strings.Contains(params.ReplicationId, "/") {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate replication_id of a filtered replication can't contain '/'.")
+	}
+
+	filter := &replicationFilter{purgeOnRemoval: config.PurgeOnRemoval}
+	if len(config.DocIds) > 0 {
+		filter.docIDs = base.SetFromArray(config.DocIds)
+	}
+	if namedFilter {
+		var fnSource string
+		if dbConfig := sc.GetDatabaseConfig(params.TargetDb); dbConfig != nil {
+			fnSource = dbConfig.ReplicationFilters[config.Filter]
+		}
+		if fnSource == "" {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate Unknown filter %q; try sync_gateway/bychannel or one of the target database's replication_filters", config.Filter)
+		}
+		filter.filterFn = db.NewJSEventFunction(fnSource)
+	}
+	if config.PurgeOnRemoval {
+		if len(params.Channels) == 0 {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate purge_on_removal requires channels to replicate.")
+		}
+		filter.channels = base.SetFromArray(params.Channels)
+	}
+	return filter, nil
+}
+
+// Returns whether a replication source or target URL refers to this server's admin interface.
+func isAdminInterfaceURL(target *url.URL, adminInterface string) bool {
+	if target.Host == adminInterface {
+		return true
+	}
+	host, port, err := net.SplitHostPort(target.Host)
+	if err != nil {
+		return false
+	}
+	adminHost, adminPort, err := net.SplitHostPort(adminInterface)
+	if err != nil || port != adminPort {
+		return false
+	}
+	if host == adminHost {
+		return true
+	}
+	// A loopback host reaches the admin interface if it listens on loopback or on all interfaces
+	isLoopback := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	adminIP := net.ParseIP(adminHost)
+	return isLoopback(host) && (adminHost == "" || isLoopback(adminHost) || (adminIP != nil && adminIP.IsUnspecified()))
+}
+
+// Registers a replication's filter, and points the replication's target at the replication filter
+// endpoints.  Generates the replication ID if there isn't one, since the endpoints use it.
+func (sc *ServerContext) addReplicationFilter(params *sgreplicate.ReplicationParameters, filter *replicationFilter) {
+	if params.ReplicationId == "" {
+		params.ReplicationId = base.CreateUUID()
+	}
+	filterUrl := &url.URL{Path: kReplicationFilterPathPrefix + params.ReplicationId}
+	params.Target, _ = url.Parse("http://" + *sc.config.AdminInterface + filterUrl.EscapedPath())
+
+	sc.replicationFiltersLock.Lock()
+	defer sc.replicationFiltersLock.Unlock()
+	sc.replicationFilters[params.ReplicationId] = filter
+}
+
+func (sc *ServerContext) getReplicationFilter(replicationId string) *replicationFilter {
+	sc.replicationFiltersLock.RLock()
+	defer sc.replicationFiltersLock.RUnlock()
+	return sc.replicationFilters[replicationId]
+}
+
+func (sc *ServerContext) removeReplicationFilter(replicationId string) {
+	sc.replicationFiltersLock.Lock()
+	defer sc.replicationFiltersLock.Unlock()
+	delete(sc.replicationFilters, replicationId)
+}
+
+// Returns the filter of the replication named in the request path.
+func (h *handler) replicationFilter() (*replicationFilter, error) {
+	replicationId := h.PathVar("replication")
+	filter := h.server.getReplicationFilter(replicationId)
+	if filter == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "No filtered replication %q", replicationId)
+	}
+	return filter, nil
+}
+
+// Replaces the request body with the JSON encoding of a value, so another handler method can read it.
+func (h *handler) replaceRequestBody(value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	h.requestBody = ioutil.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// Handles a filtered replication's _revs_diff request, leaving out the docs not in its doc IDs so
+// they're never fetched from the source.
+func (h *handler) handleFilteredRevsDiff() error {
+	filter, err := h.replicationFilter()
+	if err != nil {
+		return err
+	}
+	if filter.docIDs == nil {
+		return h.handleRevsDiff()
+	}
+	var input map[string][]string
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	for docid := range input {
+		if !filter.docIDs.Contains(docid) {
+			delete(input, docid)
+		}
+	}
+	if err := h.replaceRequestBody(input); err != nil {
+		return err
+	}
+	return h.handleRevsDiff()
+}
+
+// Handles a filtered replication's _bulk_docs request, writing only the docs that pass its filter,
+// then purging the written docs that are no longer in any of its channels if purge_on_removal is set.
+func (h *handler) handleFilteredBulkDocs() error {
+	filter, err := h.replicationFilter()
+	if err != nil {
+		return err
+	}
+	body, err := h.readJSON()
+	if err != nil {
+		return err
+	}
+	docs, ok := body["docs"].([]interface{})
+	if !ok {
+		return base.HTTPErrorf(http.StatusBadRequest, "missing 'docs' property")
+	}
+
+	allowed := make([]interface{}, 0, len(docs))
+	written := make([]string, 0, len(docs))
+	for _, item := range docs {
+		doc, ok := item.(map[string]interface{})
+		if !ok {
+			return base.HTTPErrorf(http.StatusBadRequest, "Bad doc in 'docs' property")
+		}
+		docid, _ := doc["_id"].(string)
+		if strings.HasPrefix(docid, "_local/") {
+			allowed = append(allowed, doc)
+		} else if filter.allows(db.Body(doc)) {
+			allowed = append(allowed, doc)
+			written = append(written, docid)
+		} else {
+			h.logContext.LogTo("Replicate+", "Replication %s filtered out doc %q", h.PathVar("replication"), docid)
+		}
+	}
+	body["docs"] = allowed
+	if err := h.replaceRequestBody(body); err != nil {
+		return err
+	}
+	if err := h.handleBulkDocs(); err != nil {
+		return err
+	}
+
+	if filter.purgeOnRemoval {
+		h.purgeRemovedDocs(filter, written)
+	}
+	return nil
+}
+
+// Purges the docs that the sync function no longer assigns to any of a replication's channels, so
+// a doc that leaves the replicated channels doesn't stay behind in the target.
+func (h *handler) purgeRemovedDocs(filter *replicationFilter, docids []string) {
+	for _, docid := range docids {
+		doc, err := h.db.GetDoc(docid)
+		if err != nil {
+			continue
+		}
+		inChannel := false
+		for channel, removal := range doc.Channels {
+			if removal == nil && filter.channels.Contains(channel) {
+				inChannel = true
+				break
+			}
+		}
+		if inChannel {
+			continue
+		}
+		if err := h.db.Bucket.Delete(docid); err != nil {
+			h.logContext.Warn("Replication %s couldn't purge doc %q: %v", h.PathVar("replication"), docid, err)
+		} else {
+			h.logContext.LogTo("Replicate", "Replication %s purged doc %q, which is no longer in a replicated channel", h.PathVar("replication"), docid)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+)
+
+// Key prefix of the docs defining replications created through the /_replication API
+const ReplicationDocKeyPrefix = db.KSyncKeyPrefix + "replication:"
+
+// Key of the doc listing the IDs of the stored replications
+const kReplicationIndexKey = db.KSyncKeyPrefix + "replications"
+
+// How often the checkpoints of running stored replications are recorded
+const kReplicationCheckpointInterval = 30 * time.Second
+
+// How long a node's claim on a stored replication lasts.  A node renews the claims on the
+// replications it's running whenever it records their checkpoints; once a claim has expired,
+// another node sharing the replications database takes the replication over.
+const kReplicationLeaseDuration = 3 * kReplicationCheckpointInterval
+
+// A replication definition stored in the bucket, with the state it was last known to be in
+type ReplicationDoc struct {
+	ReplicationConfig
+	State      string           `json:"state"`
+	LastError  string           `json:"last_error,omitempty"`
+	Checkpoint interface{}      `json:"checkpoint,omitempty"` // Last sequence replicated, as of UpdatedAt
+	Owner      string           `json:"owner,omitempty"`      // ID of the node running the replication
+	LeaseEnd   time.Time        `json:"lease_end"`            // When another node may take the replication over
+	UpdatedAt  time.Time        `json:"updated_at"`
+	Task       *base.ActiveTask `json:"task,omitempty"` // Live state of a running replication; not stored
+}
+
+type replicationIndex struct {
+	IDs []string `json:"ids"`
+}
+
+// Stores replication definitions in a database's bucket, so they survive restarts.
+type ReplicationStore struct {
+	bucket base.Bucket
+}
+
+// Stops recording the checkpoints of stored replications, after recording them one last time.
+// Stored replications aren't resumed or taken over afterwards.
+func (sc *ServerContext) stopReplicationCheckpoints() {
+	sc.replicationLock.Lock()
+	sc.replicationsStopped = true
+	ticker := sc.replicationTicker
+	if ticker != nil {
+		ticker.Stop()
+		close(sc.replicationTickerDone)
+		sc.replicationTicker = nil
+	}
+	sc.replicationLock.Unlock()
+	if ticker != nil {
+		sc.recordReplicationCheckpoints()
+	}
+}
+
+// Returns the store of replications, in the bucket of the database named by ReplicationsDatabase.
+func (sc *ServerContext) replicationStore() (*ReplicationStore, error) {
+	if sc.config.ReplicationsDatabase == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Stored replications aren't enabled; set ReplicationsDatabase in the config")
+	}
+	dbc, err := sc.GetDatabase(*sc.config.ReplicationsDatabase)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplicationStore{bucket: dbc.Bucket}, nil
+}
+
+// Returns the stored replication with the given ID.
+func (store *ReplicationStore) Get(id string) (*ReplicationDoc, error) {
+	var doc ReplicationDoc
+	if _, err := store.bucket.Get(ReplicationDocKeyPrefix+id, &doc); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "No replication %q", id)
+		}
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Returns all stored replications, in the order they were created.
+func (store *ReplicationStore) List() ([]*ReplicationDoc, error) {
+	var index replicationIndex
+	if _, err := store.bucket.Get(kReplicationIndexKey, &index); err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	docs := make([]*ReplicationDoc, 0, len(index.IDs))
+	for _, id := range index.IDs {
+		doc, err := store.Get(id)
+		if err != nil {
+			if isNotFound(err) {
+				continue // Deleted since the index was read
+			}
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// Saves a replication, adding it to the index if it's new.
+func (store *ReplicationStore) Put(doc *ReplicationDoc) error {
+	id := doc.ReplicationId
+	doc.UpdatedAt = time.Now()
+	if err := store.bucket.Set(ReplicationDocKeyPrefix+id, 0, doc); err != nil {
+		return err
+	}
+	return store.updateIndex(func(index *replicationIndex) bool {
+		for _, existing := range index.IDs {
+			if existing == id {
+				return false
+			}
+		}
+		index.IDs = append(index.IDs, id)
+		return true
+	})
+}
+
+// Updates the state of a stored replication via a callback, which returns false if it made no
+// changes.  Does nothing if there's no such replication.
+func (store *ReplicationStore) Update(id string, callback func(*ReplicationDoc) bool) error {
+	err := store.bucket.Update(ReplicationDocKeyPrefix+id, 0, func(currentValue []byte) ([]byte, error) {
+		if currentValue == nil {
+			return nil, couchbase.UpdateCancel
+		}
+		var doc ReplicationDoc
+		if err := json.Unmarshal(currentValue, &doc); err != nil {
+			return nil, err
+		}
+		if !callback(&doc) {
+			return nil, couchbase.UpdateCancel
+		}
+		doc.UpdatedAt = time.Now()
+		return json.Marshal(doc)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Deletes a stored replication.  Returns false if there's no such replication.
+func (store *ReplicationStore) Delete(id string) (bool, error) {
+	found := false
+	err := store.updateIndex(func(index *replicationIndex) bool {
+		for i, existing := range index.IDs {
+			if existing == id {
+				index.IDs = append(index.IDs[:i], index.IDs[i+1:]...)
+				found = true
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil || !found {
+		return false, err
+	}
+	err = store.bucket.Delete(ReplicationDocKeyPrefix + id)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+func (store *ReplicationStore) updateIndex(callback func(*replicationIndex) bool) error {
+	err := store.bucket.Update(kReplicationIndexKey, 0, func(currentValue []byte) ([]byte, error) {
+		var index replicationIndex
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &index); err != nil {
+				return nil, err
+			}
+		}
+		if !callback(&index) {
+			return nil, couchbase.UpdateCancel
+		}
+		return json.Marshal(index)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	httpErr, ok := err.(*base.HTTPError)
+	return ok && httpErr.Status == http.StatusNotFound
+}
+
+// Starts (or restarts) the replication defined by a stored doc, claims it for this node, and saves
+// its new state.  If atStartup is true, a one-shot replication using a local database is delayed to
+// let the REST API come up first.
+func (sc *ServerContext) startStoredReplication(store *ReplicationStore, doc *ReplicationDoc, atStartup bool) error {
+	params, _, localdb, err := validateReplicationParameters(doc.ReplicationConfig, true, *sc.config.AdminInterface)
+	if err != nil {
+		return err
+	}
+	filter, err := sc.newReplicationFilter(doc.ReplicationConfig, params)
+	if err != nil {
+		return err
+	}
+	// Stored replications always run in the background
+	params.Async = true
+
+	// Stop the replication if it's already running, e.g. with a previous definition
+	if _, err := sc.replicator.Replicate(sgreplicate.ReplicationParameters{ReplicationId: doc.ReplicationId}, true); err != nil && !isNotFound(err) {
+		return err
+	}
+	sc.removeReplicationFilter(doc.ReplicationId)
+	if filter != nil {
+		sc.addReplicationFilter(&params, filter)
+	}
+
+	doc.State = base.ReplicationStateRunning
+	doc.LastError = ""
+	doc.Owner = sc.config.nodeID()
+	doc.LeaseEnd = time.Now().Add(kReplicationLeaseDuration)
+	if err := store.Put(doc); err != nil {
+		return err
+	}
+	sc.setStoredReplicationStarted(doc.ReplicationId, true)
+
+	go func() {
+		if atStartup && params.Lifecycle == sgreplicate.ONE_SHOT && localdb {
+			time.Sleep(kOneShotLocalDbReplicateWait)
+		}
+		if _, err := sc.replicator.ReplicateWithRetryPolicy(params, false, doc.retryPolicy()); err != nil {
+			base.Warn("Unable to start replication %q: %v", doc.ReplicationId, err)
+			sc.replicationFinished(&base.ActiveTask{
+				ReplicationID: doc.ReplicationId,
+				Source:        params.GetSourceDbUrl(),
+				Target:        params.GetTargetDbUrl(),
+				Continuous:    params.Lifecycle == sgreplicate.CONTINUOUS,
+			}, err)
+		}
+	}()
+	return nil
+}
+
+// Called by the replicator when a replication finishes or fails.  Raises a replication failed event
+// if it failed, and records the state of a stored replication.
+func (sc *ServerContext) replicationFinished(task *base.ActiveTask, err error) {
+	sc.removeReplicationFilter(task.ReplicationID)
+	sc.setStoredReplicationStarted(task.ReplicationID, false)
+	if err != nil {
+		if dbc := sc.replicationEventDatabase(task); dbc != nil {
+			dbc.EventMgr.RaiseReplicationFailedEvent(task, err)
+		} else {
+			base.LogTo("Replicate", "Replication %q failed, but has no local database to raise an event on", task.ReplicationID)
+		}
+	}
+
+	store, storeErr := sc.replicationStore()
+	if storeErr != nil {
+		return
+	}
+	nodeID := sc.config.nodeID()
+	updateErr := store.Update(task.ReplicationID, func(doc *ReplicationDoc) bool {
+		if doc.Owner != "" && doc.Owner != nodeID {
+			return false // Another node has taken the replication over
+		}
+		if err != nil {
+			doc.State = base.ReplicationStateError
+			doc.LastError = err.Error()
+		} else {
+			doc.State = base.ReplicationStateCompleted
+			doc.LastError = ""
+		}
+		if task.EndLastSeq != nil {
+			doc.Checkpoint = task.EndLastSeq
+		}
+		return true
+	})
+	if updateErr != nil {
+		base.Warn("Unable to record state of replication %q: %v", task.ReplicationID, updateErr)
+	}
+}
+
+// Returns the database a replication's events are raised on: its source if that's a local
+// database, or else its target if that is, or else the database storing the replications.
+func (sc *ServerContext) replicationEventDatabase(task *base.ActiveTask) *db.DatabaseContext {
+	databases := sc.AllDatabases()
+	localPrefix := "http://" + *sc.config.AdminInterface + "/"
+	for _, dbURL := range []string{task.Source, task.Target} {
+		if strings.HasPrefix(dbURL, localPrefix) {
+			// The database is the last path component, even when the URL goes through a replication filter
+			dbPath := strings.Trim(dbURL[len(localPrefix):], "/")
+			if dbc := databases[dbPath[strings.LastIndex(dbPath, "/")+1:]]; dbc != nil {
+				return dbc
+			}
+		}
+	}
+	if sc.config.ReplicationsDatabase != nil {
+		return databases[*sc.config.ReplicationsDatabase]
+	}
+	return nil
+}
+
+// Records the checkpoints of the running stored replications, and renews this node's claims on
+// them.  A replication that's been taken over or deleted by another node is stopped here.
+func (sc *ServerContext) recordReplicationCheckpoints() {
+	store, err := sc.replicationStore()
+	if err != nil {
+		return
+	}
+	nodeID := sc.config.nodeID()
+	for _, task := range sc.replicator.ActiveTasks() {
+		checkpoint := task.EndLastSeq
+		found, owned := false, false
+		err := store.Update(task.ReplicationID, func(doc *ReplicationDoc) bool {
+			found = true
+			owned = doc.Owner == "" || doc.Owner == nodeID
+			if doc.State != base.ReplicationStateRunning || !owned {
+				return false
+			}
+			doc.Owner = nodeID
+			doc.LeaseEnd = time.Now().Add(kReplicationLeaseDuration)
+			if checkpoint != nil {
+				doc.Checkpoint = checkpoint
+			}
+			return true
+		})
+		if err != nil {
+			base.Warn("Unable to record checkpoint of replication %q: %v", task.ReplicationID, err)
+		} else if found && !owned {
+			base.LogTo("Replicate", "Stored replication %q was taken over by another node; stopping it", task.ReplicationID)
+			sc.stopLocalReplication(task.ReplicationID)
+		} else if !found && sc.isStoredReplicationStarted(task.ReplicationID) {
+			base.LogTo("Replicate", "Stored replication %q was deleted; stopping it", task.ReplicationID)
+			sc.stopLocalReplication(task.ReplicationID)
+		}
+	}
+}
+
+// Stops a replication running on this node, without changing its stored state.
+func (sc *ServerContext) stopLocalReplication(id string) error {
+	sc.setStoredReplicationStarted(id, false)
+	_, err := sc.replicator.Replicate(sgreplicate.ReplicationParameters{ReplicationId: id}, true)
+	sc.removeReplicationFilter(id)
+	if err != nil && !isNotFound(err) {
+		base.Warn("Unable to stop replication %q: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// Records whether this node has started the stored replication with the given ID, so that it's
+// stopped if its definition is deleted through another node.
+func (sc *ServerContext) setStoredReplicationStarted(id string, started bool) {
+	sc.storedReplicationsLock.Lock()
+	defer sc.storedReplicationsLock.Unlock()
+	if started {
+		if sc.storedReplications == nil {
+			sc.storedReplications = map[string]struct{}{}
+		}
+		sc.storedReplications[id] = struct{}{}
+	} else {
+		delete(sc.storedReplications, id)
+	}
+}
+
+func (sc *ServerContext) isStoredReplicationStarted(id string) bool {
+	sc.storedReplicationsLock.Lock()
+	defer sc.storedReplicationsLock.Unlock()
+	_, found := sc.storedReplications[id]
+	return found
+}
+
+// Claims a stored replication for this node, unless another node's claim on it hasn't expired.
+// Returns the claimed replication, or nil if another node holds it.
+func (sc *ServerContext) claimStoredReplication(store *ReplicationStore, id string) (*ReplicationDoc, error) {
+	nodeID := sc.config.nodeID()
+	var claimed *ReplicationDoc
+	err := store.Update(id, func(doc *ReplicationDoc) bool {
+		claimed = nil
+		if doc.Owner != "" && doc.Owner != nodeID && time.Now().Before(doc.LeaseEnd) {
+			return false
+		}
+		doc.Owner = nodeID
+		doc.LeaseEnd = time.Now().Add(kReplicationLeaseDuration)
+		claimed = doc
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// Restarts the stored replications that hadn't completed, other than those another node is
+// running, and starts recording their checkpoints.  Called once the databases have been loaded.
+// Does nothing if the server has started shutting down.
+func (sc *ServerContext) resumeStoredReplications() {
+	sc.replicationLock.Lock()
+	defer sc.replicationLock.Unlock()
+	if sc.replicationsStopped {
+		return
+	}
+	store, err := sc.replicationStore()
+	if err != nil {
+		if sc.config.ReplicationsDatabase != nil {
+			base.Warn("Unable to resume stored replications: %v", err)
+		}
+		return
+	}
+	docs, err := store.List()
+	if err != nil {
+		base.Warn("Unable to list stored replications: %v", err)
+		return
+	}
+	for _, doc := range docs {
+		if doc.State == base.ReplicationStateCompleted {
+			continue
+		}
+		sc.resumeStoredReplication(store, doc.ReplicationId, true)
+	}
+
+	ticker := time.NewTicker(kReplicationCheckpointInterval)
+	done := make(chan struct{})
+	sc.replicationTicker = ticker
+	sc.replicationTickerDone = done
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				sc.recordReplicationCheckpoints()
+				sc.takeOverStoredReplications()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Claims a stored replication and restarts it, unless another node is running it.
+func (sc *ServerContext) resumeStoredReplication(store *ReplicationStore, id string, atStartup bool) {
+	doc, err := sc.claimStoredReplication(store, id)
+	if err != nil {
+		base.Warn("Unable to claim stored replication %q: %v", id, err)
+		return
+	} else if doc == nil {
+		base.LogTo("Replicate", "Stored replication %q is running on another node", id)
+		return
+	}
+	base.LogTo("Replicate", "Resuming stored replication %q", id)
+	if err := sc.startStoredReplication(store, doc, atStartup); err != nil {
+		base.Warn("Unable to resume stored replication %q: %v", id, err)
+	}
+}
+
+// Restarts the running stored replications whose nodes' claims on them have expired, e.g.
+// because those nodes went down.
+func (sc *ServerContext) takeOverStoredReplications() {
+	sc.replicationLock.Lock()
+	defer sc.replicationLock.Unlock()
+	if sc.replicationsStopped {
+		return
+	}
+	store, err := sc.replicationStore()
+	if err != nil {
+		return
+	}
+	docs, err := store.List()
+	if err != nil {
+		base.Warn("Unable to list stored replications: %v", err)
+		return
+	}
+	nodeID := sc.config.nodeID()
+	for _, doc := range docs {
+		if doc.State == base.ReplicationStateRunning && doc.Owner != nodeID && time.Now().After(doc.LeaseEnd) {
+			base.LogTo("Replicate", "Claim of node %q on stored replication %q has expired; taking it over", doc.Owner, doc.ReplicationId)
+			sc.resumeStoredReplication(store, doc.ReplicationId, false)
+		}
+	}
+}
@@ -42,11 +42,18 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	r.StrictSlash(true)
 	// Global operations:
 	r.Handle("/", makeHandler(sc, privs, (*handler).handleRoot)).Methods("GET", "HEAD")
+	r.Handle("/_health", makeHandler(sc, publicPrivs, (*handler).handleHealth)).Methods("GET", "HEAD")
 
 	// Operations on databases:
 	r.Handle("/{db:"+dbRegex+"}/", makeOfflineHandler(sc, privs, (*handler).handleGetDB)).Methods("GET", "HEAD")
 	r.Handle("/{db:"+dbRegex+"}/", makeHandler(sc, privs, (*handler).handlePostDoc)).Methods("POST")
 
+	// The readiness check doesn't need auth, but only reports its details on the admin port
+	readyPrivs := publicPrivs
+	if privs == adminPrivs {
+		readyPrivs = adminPrivs
+	}
+
 	// Special database URLs:
 	dbr := r.PathPrefix("/{db:" + dbRegex + "}/").Subrouter()
 	dbr.StrictSlash(true)
@@ -60,6 +67,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.Handle("/_design/{ddoc}/_view/{view}", makeHandler(sc, privs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_ensure_full_commit", makeHandler(sc, privs, (*handler).handleEFC)).Methods("POST")
 	dbr.Handle("/_revs_diff", makeHandler(sc, privs, (*handler).handleRevsDiff)).Methods("POST")
+	dbr.Handle("/_ready", makeOfflineHandler(sc, readyPrivs, (*handler).handleReady)).Methods("GET", "HEAD")
 
 	// Document URLs:
 	dbr.Handle("/_local/{docid}", makeHandler(sc, privs, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
@@ -194,6 +202,10 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
 	r.Handle("/_logging",
 		makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT", "POST")
+	r.Handle("/_logging/config",
+		makeHandler(sc, adminPrivs, (*handler).handleGetLoggingConfig)).Methods("GET")
+	r.Handle("/_logging/config",
+		makeHandler(sc, adminPrivs, (*handler).handleSetLoggingConfig)).Methods("PUT")
 	r.Handle("/_profile/{name}",
 		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
 	r.Handle("/_profile",
@@ -210,6 +222,24 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
 	r.Handle("/_active_tasks",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET")
+	r.Handle("/_replication",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleGetReplications)).Methods("GET")
+	r.Handle("/_replication/{id}",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleGetReplication)).Methods("GET")
+	r.Handle("/_replication/{id}",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handlePutReplication)).Methods("PUT")
+	r.Handle("/_replication/{id}",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleDeleteReplication)).Methods("DELETE")
+
+	// Targets of replications that are filtered by doc ID or a named filter function
+	r.Handle(kReplicationFilterPathPrefix+"{replication}/{db:"+dbRegex+"}/",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleGetDB)).Methods("GET", "HEAD")
+	rfr := r.PathPrefix(kReplicationFilterPathPrefix + "{replication}/{db:" + dbRegex + "}/").Subrouter()
+	rfr.Handle("/_local/{docid}", makeHandler(sc, adminPrivs, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
+	rfr.Handle("/_local/{docid}", makeHandler(sc, adminPrivs, (*handler).handlePutLocalDoc)).Methods("PUT")
+	rfr.Handle("/_revs_diff", makeHandler(sc, adminPrivs, (*handler).handleFilteredRevsDiff)).Methods("POST")
+	rfr.Handle("/_bulk_docs", makeHandler(sc, adminPrivs, (*handler).handleFilteredBulkDocs)).Methods("POST")
+	rfr.Handle("/_ensure_full_commit", makeHandler(sc, adminPrivs, (*handler).handleEFC)).Methods("POST")
 
 	// Debugging handlers
 	r.Handle("/_debug/pprof/goroutine",
@@ -246,6 +276,34 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOnline)).Methods("POST")
 	dbr.Handle("/_offline",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOffline)).Methods("POST")
+	dbr.Handle("/_changes_feeds",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChangesFeeds)).Methods("GET")
+	dbr.Handle("/_changes_feeds/{feedid}",
+		makeHandler(sc, adminPrivs, (*handler).handleDeleteChangesFeed)).Methods("DELETE")
+	dbr.Handle("/_dead_letters",
+		makeHandler(sc, adminPrivs, (*handler).handleGetDeadLetters)).Methods("GET")
+	dbr.Handle("/_dead_letters",
+		makeHandler(sc, adminPrivs, (*handler).handlePurgeDeadLetters)).Methods("DELETE")
+	dbr.Handle("/_dead_letters/_replay",
+		makeHandler(sc, adminPrivs, (*handler).handleReplayDeadLetters)).Methods("POST")
+	dbr.Handle("/_dead_letters/{id}",
+		makeHandler(sc, adminPrivs, (*handler).handleDeleteDeadLetter)).Methods("DELETE")
+	dbr.Handle("/_event_handlers",
+		makeHandler(sc, adminPrivs, (*handler).handleGetEventHandlers)).Methods("GET")
+	dbr.Handle("/_event_handlers",
+		makeHandler(sc, adminPrivs, (*handler).handleAddEventHandler)).Methods("POST")
+	dbr.Handle("/_event_handlers/{id}",
+		makeHandler(sc, adminPrivs, (*handler).handleDeleteEventHandler)).Methods("DELETE")
+	dbr.Handle("/_event_handlers/{id}/_pause",
+		makeHandler(sc, adminPrivs, (*handler).handlePauseEventHandler)).Methods("POST")
+	dbr.Handle("/_event_handlers/{id}/_resume",
+		makeHandler(sc, adminPrivs, (*handler).handleResumeEventHandler)).Methods("POST")
+	dbr.Handle("/_cache",
+		makeHandler(sc, adminPrivs, (*handler).handleGetCache)).Methods("GET")
+	dbr.Handle("/_cache/channels/{channel}",
+		makeHandler(sc, adminPrivs, (*handler).handleEvictChannelCache)).Methods("DELETE")
+	dbr.Handle("/_cache/skipped/{seq}",
+		makeHandler(sc, adminPrivs, (*handler).handleDropSkippedSequence)).Methods("DELETE")
 	dbr.Handle("/_dump/{view}",
 		makeHandler(sc, adminPrivs, (*handler).handleDump)).Methods("GET")
 	dbr.Handle("/_view/{view}", // redundant; just for backward compatibility with 1.0
@@ -41,21 +41,31 @@ const kOneShotLocalDbReplicateWait = 10 * time.Second
 // This struct is accessed from HTTP handlers running on multiple goroutines, so it needs to
 // be thread-safe.
 type ServerContext struct {
-	config      *ServerConfig
-	databases_  map[string]*db.DatabaseContext
-	lock        sync.RWMutex
-	statsTicker *time.Ticker
-	HTTPClient  *http.Client
-	replicator  *base.Replicator
+	config                 *ServerConfig
+	databases_             map[string]*db.DatabaseContext
+	lock                   sync.RWMutex
+	statsTicker            *time.Ticker
+	HTTPClient             *http.Client
+	replicator             *base.Replicator
+	replicationTicker      *time.Ticker                  // Records the checkpoints of stored replications
+	replicationTickerDone  chan struct{}                 // Closed to stop the goroutine working replicationTicker
+	replicationsStopped    bool                          // Set at shutdown; stored replications aren't resumed afterwards
+	replicationLock        sync.Mutex                    // Protects the above three, and serializes resuming stored replications
+	replicationFilters     map[string]*replicationFilter // Filters of running replications, by replication ID
+	replicationFiltersLock sync.RWMutex
+	storedReplications     map[string]struct{} // IDs of the stored replications this node has started
+	storedReplicationsLock sync.Mutex
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
 	sc := &ServerContext{
-		config:     config,
-		databases_: map[string]*db.DatabaseContext{},
-		HTTPClient: http.DefaultClient,
-		replicator: base.NewReplicator(),
+		config:             config,
+		databases_:         map[string]*db.DatabaseContext{},
+		HTTPClient:         http.DefaultClient,
+		replicator:         base.NewReplicator(),
+		replicationFilters: make(map[string]*replicationFilter),
 	}
+	sc.replicator.SetFinishedCallback(sc.replicationFinished)
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
 	}
@@ -88,13 +98,15 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 
 		for _, replicationConfig := range config.Replications {
 
-			params, _, localdb, err := validateReplicationParameters(*replicationConfig, true, *config.AdminInterface)
+			params, _, localdb, err := sc.replicationParameters(*replicationConfig, true)
 
 			if err != nil {
 				base.LogError(err)
 				continue
 			}
 
+			retryPolicy := replicationConfig.retryPolicy()
+
 			//Force one-shot replications to run Async
 			//to avoid blocking server startup
 			params.Async = true
@@ -107,7 +119,7 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 					base.Warn("Delaying start of local database one-shot replication, source %v, target %v for %v seconds", params.SourceDb, params.TargetDb, kOneShotLocalDbReplicateWait)
 					time.Sleep(kOneShotLocalDbReplicateWait)
 				}
-				sc.replicator.Replicate(params, false)
+				sc.replicator.ReplicateWithRetryPolicy(params, false, retryPolicy)
 			}()
 		}
 
@@ -130,6 +142,9 @@ func (sc *ServerContext) FindDbByBucketName(bucketName string) string {
 }
 
 func (sc *ServerContext) Close() {
+	// Recording the checkpoints looks up the replications database, so must be done before locking
+	sc.stopReplicationCheckpoints()
+
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
 
@@ -258,6 +273,10 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 // lock to see if it's already been added by another process. If so, returns either the
 // existing DatabaseContext or an error based on the useExisting flag.
 func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisting bool) (*db.DatabaseContext, error) {
+	if sc.databases_ == nil {
+		// Closed, e.g. by a shutdown while the server was starting up
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Server is shutting down")
+	}
 
 	server := "http://localhost:8091"
 	pool := "default"
@@ -342,6 +361,19 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		if config.CacheConfig.ChannelCacheAge != nil && *config.CacheConfig.ChannelCacheAge > 0 {
 			cacheOptions.ChannelCacheAge = time.Duration(*config.CacheConfig.ChannelCacheAge) * time.Second
 		}
+		if config.CacheConfig.ChannelCacheMaxTotalEntries != nil && *config.CacheConfig.ChannelCacheMaxTotalEntries > 0 {
+			cacheOptions.ChannelCacheMaxTotalEntries = *config.CacheConfig.ChannelCacheMaxTotalEntries
+		}
+		if config.CacheConfig.ChannelCacheMaxTotalBytes != nil && *config.CacheConfig.ChannelCacheMaxTotalBytes > 0 {
+			cacheOptions.ChannelCacheMaxTotalBytes = *config.CacheConfig.ChannelCacheMaxTotalBytes
+		}
+		cacheOptions.WarmupChannels = config.CacheConfig.WarmupChannels
+		if config.CacheConfig.WarmupTopChannels != nil && *config.CacheConfig.WarmupTopChannels > 0 {
+			cacheOptions.WarmupTopChannels = *config.CacheConfig.WarmupTopChannels
+		}
+		if config.CacheConfig.WarmupWait != nil {
+			cacheOptions.WarmupWait = *config.CacheConfig.WarmupWait
+		}
 
 	}
 
@@ -459,6 +491,35 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	} else {
 		revCacheSize = db.KDefaultRevisionCacheCapacity
 	}
+	var revCacheShards uint16
+	if config.RevCacheShards != nil {
+		revCacheShards = *config.RevCacheShards
+	}
+	var revCacheMaxBytes int64
+	if config.RevCacheMaxBytes != nil {
+		revCacheMaxBytes = *config.RevCacheMaxBytes
+	}
+	var sequenceBatchMax uint64
+	if config.SequenceBatchMax != nil {
+		sequenceBatchMax = *config.SequenceBatchMax
+	}
+	shareChangesFeeds := config.ShareChangesFeeds != nil && *config.ShareChangesFeeds
+
+	var slowConsumerOptions *db.SlowConsumerOptions
+	if config.SlowConsumer != nil && config.SlowConsumer.BufferSize != nil && *config.SlowConsumer.BufferSize > 0 {
+		slowConsumerOptions = &db.SlowConsumerOptions{
+			BufferSize: *config.SlowConsumer.BufferSize,
+			Policy:     db.SlowConsumerDisconnect,
+		}
+		switch config.SlowConsumer.Policy {
+		case "", db.SlowConsumerDisconnect:
+		case db.SlowConsumerCatchUp:
+			slowConsumerOptions.Policy = db.SlowConsumerCatchUp
+		default:
+			return nil, fmt.Errorf("Unknown slow_consumer policy %q; must be %q or %q",
+				config.SlowConsumer.Policy, db.SlowConsumerDisconnect, db.SlowConsumerCatchUp)
+		}
+	}
 
 	unsupportedOptions := &db.UnsupportedOptions{}
 	if config.Unsupported != nil {
@@ -472,6 +533,14 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		}
 	}
 
+	var readinessOptions *db.ReadinessOptions
+	if config.Readiness != nil {
+		readinessOptions = &db.ReadinessOptions{
+			MaxCacheLag:         config.Readiness.MaxCacheLag,
+			MaxSkippedSequences: config.Readiness.MaxSkippedSequences,
+		}
+	}
+
 	// Enable doc tracking if needed for autoImport or shadowing
 	trackDocs := autoImport || config.Shadow != nil
 
@@ -480,10 +549,17 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		IndexOptions:          channelIndexOptions,
 		SequenceHashOptions:   sequenceHashOptions,
 		RevisionCacheCapacity: revCacheSize,
+		RevisionCacheShards:   revCacheShards,
+		RevisionCacheMaxBytes: revCacheMaxBytes,
+		MaxSequenceBatchSize:  sequenceBatchMax,
+		ShareChangesFeeds:     shareChangesFeeds,
+		SlowConsumerOptions:   slowConsumerOptions,
 		AdminInterface:        sc.config.AdminInterface,
+		NodeID:                sc.config.nodeID(),
 		UnsupportedOptions:    unsupportedOptions,
 		TrackDocs:             trackDocs,
 		OIDCOptions:           config.OIDCConfig,
+		ReadinessOptions:      readinessOptions,
 	}
 
 	dbcontext, err := db.NewDatabaseContext(dbName, bucket, autoImport, contextOptions)
@@ -606,7 +682,7 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 
 		// validate event-related keys
 		for k := range eventHandlersMap {
-			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" {
+			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" && k != "principal_changed" && k != "document_rejected" && k != "replication_failed" {
 				return errors.New(fmt.Sprintf("Unsupported event property '%s' defined for db %s", k, dbcontext.Name))
 			}
 		}
@@ -628,6 +704,21 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 		if err = sc.processEventHandlersForEvent(eventHandlers.DBStateChanged, db.DBStateChange, dbcontext); err != nil {
 			return err
 		}
+
+		// Process principal change event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.PrincipalChanged, db.PrincipalChange, dbcontext); err != nil {
+			return err
+		}
+
+		// Process document rejected event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.DocumentRejected, db.DocumentRejected, dbcontext); err != nil {
+			return err
+		}
+
+		// Process replication failed event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.ReplicationFailed, db.ReplicationFailed, dbcontext); err != nil {
+			return err
+		}
 		// WaitForProcess uses string, to support both omitempty and zero values
 		customWaitTime := int64(-1)
 		if eventHandlers.WaitForProcess != "" {
@@ -652,22 +743,84 @@ func (sc *ServerContext) AddDatabaseFromConfig(config *DbConfig) (*db.DatabaseCo
 func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eventType db.EventType, dbcontext *db.DatabaseContext) error {
 
 	for _, event := range events {
-		switch event.HandlerType {
-		case "webhook":
-			wh, err := db.NewWebhook(event.Url, event.Filter, event.Timeout)
-			if err != nil {
-				base.Warn("Error creating webhook %v", err)
-				return err
-			}
-			dbcontext.EventMgr.RegisterEventHandler(wh, eventType)
-		default:
-			return errors.New(fmt.Sprintf("Unknown event handler type %s", event.HandlerType))
+		handler, err := newEventHandler(event, dbcontext)
+		if err != nil {
+			return err
+		}
+		if _, err := dbcontext.AddEventHandler(event.ID, handler, eventType, event.Durable); err != nil {
+			return err
 		}
-
 	}
 	return nil
 }
 
+// Creates the event handler described by an event handler config.
+func newEventHandler(event *EventConfig, dbcontext *db.DatabaseContext) (db.EventHandler, error) {
+	sinkOptions := db.EventSinkOptions{
+		Transform:   event.Transform,
+		IncludeBody: event.IncludeBody,
+	}
+	switch event.HandlerType {
+	case "webhook":
+		options := db.WebhookOptions{
+			Timeout:     event.Timeout,
+			DeadLetters: dbcontext.DeadLetters,
+			Secret:      event.Secret,
+			Headers:     event.Headers,
+			Transform:   event.Transform,
+			IncludeBody: event.IncludeBody,
+		}
+		if event.Batch != nil {
+			if event.Batch.MaxSize != nil {
+				options.BatchSize = *event.Batch.MaxSize
+			}
+			if event.Batch.MaxLingerMs != nil {
+				options.BatchLinger = time.Duration(*event.Batch.MaxLingerMs) * time.Millisecond
+			}
+		}
+		if event.Retry != nil {
+			if event.Retry.MaxAttempts != nil {
+				options.MaxAttempts = *event.Retry.MaxAttempts
+			}
+			if event.Retry.BackoffMs != nil {
+				options.InitialBackoff = time.Duration(*event.Retry.BackoffMs) * time.Millisecond
+			}
+			if event.Retry.MaxBackoffMs != nil {
+				options.MaxBackoff = time.Duration(*event.Retry.MaxBackoffMs) * time.Millisecond
+			}
+		}
+		wh, err := db.NewWebhookWithOptions(event.Url, event.Filter, options)
+		if err != nil {
+			base.Warn("Error creating webhook %v", err)
+			return nil, err
+		}
+		return wh, nil
+	case "file":
+		fh, err := db.NewFileEventHandler(event.Path, event.Filter, event.Rotation, sinkOptions)
+		if err != nil {
+			base.Warn("Error creating file event handler %v", err)
+			return nil, err
+		}
+		return fh, nil
+	case "exec":
+		eh, err := db.NewExecEventHandler(event.Command, event.Filter, sinkOptions)
+		if err != nil {
+			base.Warn("Error creating exec event handler %v", err)
+			return nil, err
+		}
+		return eh, nil
+	case "unix_socket":
+		sh, err := db.NewSocketEventHandler(event.Path, event.Filter, event.Timeout, sinkOptions)
+		if err != nil {
+			base.Warn("Error creating unix socket event handler %v", err)
+			return nil, err
+		}
+		return sh, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown event handler type %s", event.HandlerType))
+	}
+}
+
 func (sc *ServerContext) applySyncFunction(dbcontext *db.DatabaseContext, syncFn string) error {
 	changed, err := dbcontext.UpdateSyncFun(syncFn)
 	if err != nil || !changed {
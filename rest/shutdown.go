@@ -0,0 +1,102 @@
+package rest
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Default number of seconds a graceful shutdown waits for requests, writes and events to finish
+const DefaultShutdownTimeout = 30
+
+var activeRequests int64 // Number of HTTP requests being handled; accessed atomically
+
+// The ServerContext started by RunServer, and the state of its shutdown
+var runningServer struct {
+	sc           *ServerContext
+	shuttingDown bool
+	shutdownOnce sync.Once
+	shutdownDone chan struct{}
+	lock         sync.Mutex
+}
+
+func init() {
+	runningServer.shutdownDone = make(chan struct{})
+}
+
+func setRunningServer(sc *ServerContext) {
+	runningServer.lock.Lock()
+	defer runningServer.lock.Unlock()
+	runningServer.sc = sc
+}
+
+// Returns true once Shutdown has been called.
+func isShuttingDown() bool {
+	runningServer.lock.Lock()
+	defer runningServer.lock.Unlock()
+	return runningServer.shuttingDown
+}
+
+// Gracefully shuts down the server started by RunServer, after which RunServer returns.  Safe to
+// call more than once, or concurrently; every call returns once shutdown is complete.  If the
+// server is still starting up, the databases loaded so far are closed and the rest aren't loaded.
+func Shutdown() {
+	runningServer.shutdownOnce.Do(func() {
+		runningServer.lock.Lock()
+		sc := runningServer.sc
+		runningServer.shuttingDown = true
+		runningServer.lock.Unlock()
+		if sc != nil {
+			sc.Shutdown()
+		} else {
+			base.StopAcceptingHTTP()
+		}
+		close(runningServer.shutdownDone)
+	})
+	<-runningServer.shutdownDone
+}
+
+// Shuts down gracefully: stops accepting connections, ends every longpoll, continuous and
+// websocket changes feed (continuous feeds get a final last_seq to resume from), waits for
+// in-flight requests, document writes and queued events to finish, and closes the databases.
+// Anything still running when the ShutdownTimeout expires is abandoned.
+func (sc *ServerContext) Shutdown() {
+	timeout := time.Duration(DefaultShutdownTimeout) * time.Second
+	if sc.config.ShutdownTimeout != nil {
+		timeout = time.Duration(*sc.config.ShutdownTimeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	base.Logf("Shutting down; waiting up to %v for requests to finish...", timeout)
+
+	base.StopAcceptingHTTP()
+
+	databases := sc.AllDatabases()
+	for name, dbc := range databases {
+		if count := dbc.ChangesFeeds.TerminateAll(); count > 0 {
+			base.Logf("Shutdown: ended %d changes feeds of db %q", count, name)
+		}
+	}
+
+	for atomic.LoadInt64(&activeRequests) > 0 {
+		if time.Now().After(deadline) {
+			base.Warn("Shutdown: %d requests still in progress after %v; abandoning them",
+				atomic.LoadInt64(&activeRequests), timeout)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for name, dbc := range databases {
+		if !dbc.WaitForPendingWrites(deadline.Sub(time.Now())) {
+			base.Warn("Shutdown: document writes to db %q still in progress after %v", name, timeout)
+		}
+		if !dbc.EventMgr.WaitForPendingEvents(deadline.Sub(time.Now())) {
+			base.Warn("Shutdown: event handlers of db %q still running after %v; discarding queued events", name, timeout)
+		}
+	}
+
+	sc.Close()
+	base.Logf("Shutdown complete")
+}
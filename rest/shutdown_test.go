@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestServerContextShutdown(t *testing.T) {
+	var rt restTester
+	rt.createDoc(t, "doc1")
+	assertNoError(t, rt.waitForSequence(1), "Doc not cached")
+	dbc := rt.getDatabase()
+	sc := rt.ServerContext()
+
+	// A longpoll feed waiting for changes is ended by the shutdown
+	responses := make(chan *testResponse, 1)
+	go func() {
+		responses <- rt.sendAdminRequest("GET", "/db/_changes?feed=longpoll&since=1", "")
+	}()
+	for i := 0; i < 50 && dbc.ChangesFeeds.Count() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equals(t, dbc.ChangesFeeds.Count(), 1)
+
+	done := make(chan struct{})
+	go func() {
+		sc.Shutdown()
+		close(done)
+	}()
+	select {
+	case response := <-responses:
+		assertStatus(t, response, 200)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Changes feed wasn't ended by the shutdown")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown didn't finish")
+	}
+
+	// The databases are closed, and no more can be added
+	assert.Equals(t, len(sc.AllDatabases()), 0)
+	assert.True(t, dbc.IsClosed())
+	_, err := sc.AddDatabaseFromConfig(&DbConfig{Name: "db2"})
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 503)
+}
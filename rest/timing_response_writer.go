@@ -0,0 +1,41 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// An implementation of http.ResponseWriter that wraps another instance and records the time
+// spent writing the response body into a RequestTimings.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timings *base.RequestTimings
+}
+
+func newTimingResponseWriter(response http.ResponseWriter, timings *base.RequestTimings) *timingResponseWriter {
+	return &timingResponseWriter{ResponseWriter: response, timings: timings}
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	defer w.timings.Track(base.PhaseResponse, time.Now())
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingResponseWriter) Flush() {
+	defer w.timings.Track(base.PhaseResponse, time.Now())
+	switch r := w.ResponseWriter.(type) {
+	case http.Flusher:
+		r.Flush()
+	}
+}
+
+func (w *timingResponseWriter) CloseNotify() <-chan bool {
+	var closeNotify <-chan bool
+	cn, ok := w.ResponseWriter.(http.CloseNotifier)
+	if ok {
+		closeNotify = cn.CloseNotify()
+	}
+	return closeNotify
+}
@@ -99,7 +99,7 @@ func (h *handler) handleView() error {
 		}
 	}
 
-	base.LogTo("HTTP", "JSON view %q/%q - opts %v", ddocName, viewName, opts)
+	h.logContext.LogTo("HTTP", "JSON view %q/%q - opts %v", ddocName, viewName, opts)
 
 	result, err := h.db.QueryDesignDoc(ddocName, viewName, opts)
 	if err != nil {